@@ -0,0 +1,100 @@
+package MyRPC
+
+import (
+	"MyRPC/logger"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// 接受连接
+// 建立连接很频繁的服务，单个协程循环 Accept 可能来不及从内核的队列中取出连接，表现为建立连接的延迟抖动。
+// SetAcceptWorkers 让每个监听器由多个协程同时 Accept；配合 SO_REUSEPORT 时，
+// 可以为同一个端口创建多个监听器分别调用 Accept，由内核在监听器之间分配连接。
+// 接受的连接数、Accept 的错误数和还没有完成协议协商的连接数会导出到指标中
+//
+
+// Accept 遇到临时错误（比如文件描述符耗尽）时的退避时间
+const (
+	acceptMinBackoff = 5 * time.Millisecond
+	acceptMaxBackoff = time.Second
+)
+
+// acceptStats 接受连接的统计
+type acceptStats struct {
+	accepted    uint64 // 接受的连接数
+	errors      uint64 // Accept 返回的错误数，不包括监听器关闭
+	handshaking int64  // 已经接受但还没有完成协议协商的连接数
+}
+
+// SetAcceptWorkers 设置每个监听器同时 Accept 的协程数，小于1时使用1，需要在 Accept 之前调用
+func (server *Server) SetAcceptWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	server.acceptWorkers = n
+}
+
+// acceptLoop 使用 acceptWorkers 个协程接受连接，监听器关闭后返回
+func (server *Server) acceptLoop(lis net.Listener) {
+	workers := server.acceptWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			err := server.acceptConns(lis)
+			once.Do(func() { logger.Errorf("rpc server: accept error: %v", err) })
+		}()
+	}
+	wg.Wait()
+}
+
+// acceptConns 循环等待socket连接建立 并开启子线程处理，临时错误退避后重试，其他错误返回
+func (server *Server) acceptConns(lis net.Listener) error {
+	stats := &server.metrics.accept
+	var backoff time.Duration
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			atomic.AddUint64(&stats.errors, 1)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if backoff == 0 {
+					backoff = acceptMinBackoff
+				} else if backoff *= 2; backoff > acceptMaxBackoff {
+					backoff = acceptMaxBackoff
+				}
+				logger.Warnf("rpc server: accept error: %v; retrying in %v", err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+		atomic.AddUint64(&stats.accepted, 1)
+		go server.ServerConn(conn)
+	}
+}
+
+// handshaking 记录一个正在协议协商的连接，返回的函数在协商结束时调用，多次调用只生效一次
+func (server *Server) handshaking() func() {
+	stats := &server.metrics.accept
+	atomic.AddInt64(&stats.handshaking, 1)
+	done := false
+	return func() {
+		if !done {
+			done = true
+			atomic.AddInt64(&stats.handshaking, -1)
+		}
+	}
+}
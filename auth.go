@@ -0,0 +1,119 @@
+package MyRPC
+
+import (
+	"MyRPC/client"
+	"MyRPC/logger"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+)
+
+//
+// 连接鉴权
+// 客户端在 Option.Token 中携带令牌，服务端设置 Authenticator 后在握手阶段校验，校验失败的连接在处理任何请求之前关闭；
+// 客户端设置 HandshakeAck 时可以立即拿到拒绝的原因。CallHandler 从请求头 Authorization: Bearer <token> 中读取令牌。
+// Option 在 StartTLS 升级之前以明文发送，所以 StartTLS 时令牌不放在 Option 中，而是在 TLS 握手之后单独发送再校验，见 tls.go
+//
+
+// Authenticator 校验客户端的令牌，remoteAddr 是连接对端的地址，可能为空。返回错误时拒绝连接
+type Authenticator func(token string, remoteAddr string) error
+
+// ErrInvalidToken TokenAuthenticator 拒绝连接时返回的错误
+var ErrInvalidToken = errors.New("invalid token")
+
+// TokenAuthenticator 返回只接受 tokens 中令牌的 Authenticator，比较时间与令牌内容无关
+func TokenAuthenticator(tokens ...string) Authenticator {
+	return func(token string, remoteAddr string) error {
+		ok := 0
+		for _, t := range tokens {
+			ok |= subtle.ConstantTimeCompare([]byte(token), []byte(t))
+		}
+		if ok != 1 {
+			return ErrInvalidToken
+		}
+		return nil
+	}
+}
+
+// SetAuthenticator 设置连接的鉴权，为 nil 时不鉴权，需要在 Accept 之前调用
+func (server *Server) SetAuthenticator(auth Authenticator) {
+	server.authenticator = auth
+}
+
+// authenticateTLS 读取 TLS 握手之后发送的令牌并校验，客户端设置 HandshakeAck 时回复校验的结果
+func (server *Server) authenticateTLS(conn io.ReadWriteCloser, opt *Option) bool {
+	token, err := readTLSToken(conn)
+	if err == nil {
+		opt.Token = token
+		err = server.authenticate(token, client.RemoteAddr(conn))
+	}
+	if opt.HandshakeAck {
+		if werr := writeHandshakeAck(conn, err, nil); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	if err != nil {
+		logger.Warnf("rpc server: options error: %v", err)
+		return false
+	}
+	return true
+}
+
+// authenticate 校验令牌，没有设置 Authenticator 时接受所有连接
+func (server *Server) authenticate(token, remoteAddr string) error {
+	if server.authenticator == nil {
+		return nil
+	}
+	if err := server.authenticator(token, remoteAddr); err != nil {
+		return Errorf(CodeUnauthenticated, "rpc server: authentication failed: %v", err)
+	}
+	return nil
+}
+
+//
+// 方法级的访问控制
+// 连接通过鉴权之后，Authorizer 在每个请求调用服务方法之前执行，按令牌、对端地址和元数据决定能否调用 serviceMethod，
+// 敏感的方法可以只开放给部分调用方。ctx 与服务方法收到的 ctx 相同，通过 PeerFromContext 获取连接的信息。
+// 内置的 _meta 服务同样经过检查，心跳不经过检查
+//
+
+// Authorizer 检查请求能否调用 serviceMethod，返回错误时拒绝请求，错误信息返回给客户端
+type Authorizer func(ctx context.Context, serviceMethod string) error
+
+// SetAuthorizer 设置方法级的访问控制，为 nil 时不检查，需要在 Accept 之前调用
+func (server *Server) SetAuthorizer(auth Authorizer) {
+	server.authorizer = auth
+}
+
+// authorize 检查请求的权限
+func (server *Server) authorize(ctx context.Context, serviceMethod string) error {
+	if server.authorizer == nil {
+		return nil
+	}
+	if err := server.authorizer(ctx, serviceMethod); err != nil {
+		return Errorf(CodePermissionDenied, "rpc server: permission denied for %s: %v", serviceMethod, err)
+	}
+	return nil
+}
+
+// Peer 请求所在连接的信息
+type Peer struct {
+	RemoteAddr string // 对端地址，可能为空
+	Token      string // 握手时携带的鉴权令牌，CallHandler 的请求为 Authorization 中的令牌
+}
+
+type peerKey struct{}
+
+func withPeer(ctx context.Context, ci *connInfo) context.Context {
+	if ci == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerKey{}, Peer{RemoteAddr: ci.remoteAddr, Token: ci.token})
+}
+
+// PeerFromContext 返回服务端处理请求的 ctx 中的连接信息
+func PeerFromContext(ctx context.Context) (Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(Peer)
+	return p, ok
+}
@@ -0,0 +1,112 @@
+// Package callopt 单次调用的可选配置，Client.Call、Client.Go 和 XClient.Call 都接受 CallOption，
+// 也可以用 NewContext 放在 ctx 中，沿调用链传递：
+//
+//	err := xc.Call(ctx, "Foo.Sum", args, &reply, callopt.WithTimeout(time.Second), callopt.WithRetry(3))
+//
+// 同一个配置同时出现在 ctx 和参数中时，参数中的优先
+package callopt
+
+import (
+	"MyRPC/codec"
+	"context"
+	"time"
+)
+
+// Options 单次调用的配置，零值表示使用客户端的默认配置
+type Options struct {
+	Timeout  time.Duration     // 调用的超时时间
+	Codec    codec.Type        // 编码方式，Client 只能使用连接协商的编码方式，XClient 会为它单独建立连接
+	Target   string            // XClient 跳过负载均衡，直接调用这个实例，形如 tcp@127.0.0.1:9999
+	Retry    int               // XClient 最多尝试的次数，大于0时使用 Failover
+	Metadata map[string]string // 随请求传递的元数据，与 ctx 中已有的元数据合并
+	Cache    time.Duration     // XClient 缓存响应的时间，小于0时不使用缓存，需要 XClient 开启响应缓存
+	Key      string            // XClient 用它在哈希环上选择实例，相同 key 的调用落到同一个实例上
+}
+
+// CallOption 修改单次调用的配置
+type CallOption func(*Options)
+
+// WithTimeout 设置调用的超时时间
+func WithTimeout(d time.Duration) CallOption {
+	return func(o *Options) {
+		o.Timeout = d
+	}
+}
+
+// WithCodec 设置调用的编码方式
+func WithCodec(t codec.Type) CallOption {
+	return func(o *Options) {
+		o.Codec = t
+	}
+}
+
+// WithTarget 直接调用 rpcAddr，不经过负载均衡
+func WithTarget(rpcAddr string) CallOption {
+	return func(o *Options) {
+		o.Target = rpcAddr
+	}
+}
+
+// WithRetry 失败时换一个实例重试，最多调用 maxAttempts 次
+func WithRetry(maxAttempts int) CallOption {
+	return func(o *Options) {
+		o.Retry = maxAttempts
+	}
+}
+
+// WithMetadata 添加随请求传递的元数据，多次调用会合并
+func WithMetadata(md map[string]string) CallOption {
+	return func(o *Options) {
+		merged := make(map[string]string, len(o.Metadata)+len(md))
+		for k, v := range o.Metadata {
+			merged[k] = v
+		}
+		for k, v := range md {
+			merged[k] = v
+		}
+		o.Metadata = merged
+	}
+}
+
+// WithCache 在 XClient 的响应缓存中保存本次调用的结果 ttl 时间，ttl 小于0时不读也不写缓存。
+// 只应该用于幂等的读操作
+func WithCache(ttl time.Duration) CallOption {
+	return func(o *Options) {
+		o.Cache = ttl
+	}
+}
+
+// WithKey XClient 按 key 做一致性哈希选择实例，不论 SelectMode 是什么，相同 key 的调用都落到同一个实例上
+func WithKey(key string) CallOption {
+	return func(o *Options) {
+		o.Key = key
+	}
+}
+
+type optionsKey struct{}
+
+// NewContext 返回带有调用配置的 ctx，ctx 中已有的配置会被保留，opts 优先
+func NewContext(ctx context.Context, opts ...CallOption) context.Context {
+	o := FromContext(ctx, opts...)
+	return context.WithValue(ctx, optionsKey{}, &o)
+}
+
+// FromContext 取出 ctx 中的调用配置，再依次应用 opts
+func FromContext(ctx context.Context, opts ...CallOption) Options {
+	var o Options
+	if p, ok := ctx.Value(optionsKey{}).(*Options); ok {
+		o = *p
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Context 按照配置派生调用使用的 ctx，设置超时时间；返回的 cancel 需要在调用结束后调用
+func (o *Options) Context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.Timeout > 0 {
+		return context.WithTimeout(ctx, o.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,51 @@
+package MyRPC
+
+import (
+	"MyRPC/wire"
+	"context"
+)
+
+//
+// 取消请求
+// Client.Call 的 ctx 结束时调用方不再等待，但服务端仍然会把方法执行完，浪费资源。
+// 客户端此时发送一个控制消息，Seq 是要取消的请求，服务端收到后取消处理这个请求的 ctx，
+// 还在排队的请求直接返回 errRequestCanceled。控制消息本身没有响应，被取消的请求仍然会有一个响应，客户端丢弃它。
+// 客户端的一侧见 client/cancel.go。
+// 服务端在能力协商中声明 CancelRequests，只有协商过并且服务端支持时客户端才发送，
+// 否则老的服务端会把控制消息当作未知服务，用被取消请求的 Seq 再回一个响应
+//
+
+// 控制消息使用的 ServiceMethod，不会和用户的服务冲突
+const (
+	pingMethod   = wire.PingMethod
+	cancelMethod = wire.CancelMethod
+)
+
+// errRequestCanceled 请求在开始处理之前被客户端取消
+var errRequestCanceled error = Errorf(CodeCanceled, "rpc server: request canceled by client")
+
+// bind 记录取消处理 seq 的 ctx 的函数，请求已经被客户端取消时返回 false
+func (s *seqSet) bind(seq uint64, cancel context.CancelFunc) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.seqs[seq]
+	if !ok {
+		return true
+	}
+	r.cancel = cancel
+	return !r.canceled
+}
+
+// cancel 取消正在处理的 seq，还没开始处理时记录下来，开始处理时 bind 返回 false
+func (s *seqSet) cancel(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.seqs[seq]
+	if !ok {
+		return
+	}
+	r.canceled = true
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
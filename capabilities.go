@@ -0,0 +1,43 @@
+package MyRPC
+
+import (
+	"MyRPC/codec"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// 能力协商见 client/capabilities.go，这里是服务端回复自己能力的一侧
+
+// capabilities 当前服务端的能力
+func (server *Server) capabilities() Capabilities {
+	caps := Capabilities{
+		ProtocolVersion: handshakeVersion,
+		Compressors:     codec.Compressors(),
+		Dictionaries:    codec.Dictionaries(),
+		Cancellation:    true,
+		CancelRequests:  true,
+		Encryption:      server.encryption != nil,
+		MaxFrameSize:    codec.MaxFrameSize,
+		MaxOptionLength: maxOptionLen,
+		InstanceID:      server.instanceID,
+	}
+	for t := range codec.NewCodecFuncMap {
+		caps.Codecs = append(caps.Codecs, string(t))
+	}
+	sort.Strings(caps.Codecs)
+	return caps
+}
+
+// writeCapabilities 服务端回复能力
+func writeCapabilities(w io.Writer, caps Capabilities) error {
+	body, err := json.Marshal(caps)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	_, err = w.Write(append(buf, body...))
+	return err
+}
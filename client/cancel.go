@@ -0,0 +1,24 @@
+package client
+
+import (
+	"MyRPC/codec"
+	"MyRPC/wire"
+)
+
+// 取消请求的格式见 MyRPC 的 cancel.go
+
+// cancelMethod 取消请求的控制消息使用的 ServiceMethod
+const cancelMethod = wire.CancelMethod
+
+// sendCancel 通知服务端取消 seq 对应的请求，连接出错时忽略
+func (client *Client) sendCancel(seq uint64) {
+	if !client.IsAvailable() || client.caps == nil || !client.caps.CancelRequests {
+		return
+	}
+	if !client.concurrent {
+		client.sending.Lock()
+		defer client.sending.Unlock()
+	}
+	h := &codec.Header{ServiceMethod: cancelMethod, Seq: seq}
+	_ = client.cc.Write(h, true)
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+//
+// 能力协商
+// 客户端在握手头部设置 flagCapabilities 后，服务端在握手（以及可能的TLS升级）之后回复自己支持的能力，
+// 客户端据此调整行为，不需要靠部署时约定。老的服务端不认识这个标志位，所以默认不开启：
+//
+//	| Length(uint32) | Capabilities(Json) |
+//
+
+// Capabilities 服务端支持的能力
+type Capabilities struct {
+	ProtocolVersion int      // 握手协议的版本
+	Codecs          []string // 支持的编码方式
+	Compressors     []string // 支持的压缩算法
+	Dictionaries    []uint32 // 已注册的预置压缩字典编号
+	Cancellation    bool     // 是否支持请求头中的截止时间，到期后取消服务方法的 ctx
+	CancelRequests  bool     // 是否支持客户端发送的取消请求的控制消息，见 cancel.go
+	Streaming       bool     // 是否支持流式调用
+	Encryption      bool     // 是否配置了消息体加密
+	MaxFrameSize    int      // 单帧的最大长度
+	MaxOptionLength int      // 握手中 Option 的最大长度
+	InstanceID      string   // 服务端的实例ID，见 Server.InstanceID
+}
+
+// readCapabilities 客户端读取服务端的能力
+func readCapabilities(r io.Reader) (*Capabilities, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(head[:])
+	if n > maxOptionLen {
+		return nil, errors.New("rpc client: capabilities too large")
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	var caps Capabilities
+	if err := json.Unmarshal(body, &caps); err != nil {
+		return nil, err
+	}
+	return &caps, nil
+}
+
+// InstanceID 返回服务端在握手时声明的实例ID，没有开启 Option.NegotiateCapabilities 或者服务端不支持时返回空字符串
+func (client *Client) InstanceID() string {
+	if client.caps == nil {
+		return ""
+	}
+	return client.caps.InstanceID
+}
+
+// Capabilities 返回服务端在握手时声明的能力，没有开启 Option.NegotiateCapabilities 时返回 false
+func (client *Client) Capabilities() (Capabilities, bool) {
+	if client.caps == nil {
+		return Capabilities{}, false
+	}
+	return *client.caps, true
+}
@@ -0,0 +1,741 @@
+// Package client MyRPC 的客户端和传输：Client、连接方式（tcp、unix、HTTP CONNECT、进程内的 local）、自动重连、
+// 每个调用一个 HTTP 请求的 HTTPCaller，以及客户端和服务端共用的协商信息、元数据和错误码。
+// 它不依赖服务端、注册中心和调试页面的代码，只需要调用服务的程序引入这个包即可；
+// 服务端在 MyRPC 包中，MyRPC 用类型别名重新导出了这里的类型和函数，老的代码不需要修改
+package client
+
+import (
+	"MyRPC/callopt"
+	"MyRPC/codec"
+	"MyRPC/logger"
+	"MyRPC/wire"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// go rpc中的对于服务端提供的方法的相关约束
+// 1. 方法的类型必须是外部可见的
+// 2. 方法必须是外部可见的
+// 3. 方法参数只能有两个，而且必须是外部可见的类型或者是基本类型。
+// 4. 方法的第二个参数类型必须是指针
+// 5. 方法的返回值必须是error类型
+// func (t *T) MethodName(argType T1, replyType *T2) error
+
+// 导出，一个标志符被导出后就可以在其他包中使用，但是必须满足下面两个条件：
+// 1.标识符的首字母是 Unicode 大写字母 (Unicode "Lu" 类); 而且
+// 2.标识符要在包块中进行了声明，或是它是个字段名 /方法名。
+// 而其他所有的标识符都不是导出的。
+
+// DefaultOption 默认采用Gob编码方式
+var DefaultOption = &Option{
+	MagicNumber:    MagicNumber,
+	CodecType:      codec.GobType,
+	ConnectTimeout: time.Second * 10,
+}
+
+// Call 一次RPC调用需要的信息
+type Call struct {
+	Seq           uint64
+	ServiceMethod string      // 需要调用的函数，格式是service.method
+	Args          interface{} // 形参
+	Reply         interface{} // 响应
+	Error         error       // 错误信息
+	Done          chan *Call  // 同步接口使用，结束标志
+
+	Timeline *Timeline // 调用的时间线，ctx 由 WithTimeline 派生时记录
+
+	deadline time.Time // 调用的截止时间，来自 Call 的 ctx
+	metadata Metadata  // 随请求发送的元数据，来自 Call 的 ctx
+	trailer  Metadata  // 接收响应 Trailer 的 Metadata，ctx 由 WithTrailer 派生时不为 nil
+	started  time.Time // 发起调用的时间，记录时间线时使用
+}
+
+// done 为了支持同步调用，Call结构体中添加了一个字段Done，当调用结束时，会调用call.done()通知调用方。
+// 和 net/rpc 一样，Done 没有空位时丢弃结果并记录日志，不会阻塞接收响应的循环
+func (call *Call) done() {
+	select {
+	case call.Done <- call:
+	default:
+		logger.Warnf("rpc client: discarding Call reply due to insufficient Done chan capacity")
+	}
+}
+
+type Client struct {
+	cc       codec.Codec      // 编码解码器，用来序列化将要发送出去的请求，以及反序列化接收到的响应
+	opt      *Option          // 与服务端的协商信息
+	pending  map[uint64]*Call // 存储未处理完的请求，键是编号，值是Call实例
+	sending  sync.Mutex       // 保证请求的有序发送，防止出现多个请求报文混淆，编解码器支持并发写时不使用
+	mu       sync.Mutex       // 客户端的互斥锁
+	seq      uint64           // 给发送的请求编号，每个请求拥有唯一编号
+	closing  bool             // 用户主动关闭
+	shutdown bool             // 一般是有错误发送
+	stats    *codec.Stats     // 连接上的编解码统计
+	addr     string           // 服务端地址，用于日志
+	canceled map[uint64]bool  // 严格模式下被调用方取消的请求，服务端之后仍可能返回响应，不属于协议异常
+	caps     *Capabilities    // 服务端在握手时声明的能力
+
+	concurrent bool // 编解码器可以被同时写，见 codec.ConcurrentWriter
+}
+
+// 判断Client是否实现了io.Closer接口
+var _ io.Closer = (*Client)(nil)
+var _ Caller = (*Client)(nil)
+
+// ErrShutdown errors.New 返回error类型的值 表示一个错误
+var ErrShutdown = errors.New("connection is shut down")
+
+// Close 关闭连接
+func (client *Client) Close() error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closing {
+		return ErrShutdown
+	}
+	client.closing = true
+	return client.cc.Close()
+}
+
+// IsAvailable 看客户端是否还在工作
+func (client *Client) IsAvailable() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return !client.shutdown && !client.closing
+}
+
+// Pending 返回已经发出、还没有收到响应的请求数
+func (client *Client) Pending() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return len(client.pending)
+}
+
+// registerCall 注册请求，将参数Call添加到client.pending中，并更新client.seq
+func (client *Client) registerCall(call *Call) (uint64, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closing || client.shutdown {
+		return 0, ErrShutdown
+	}
+	call.Seq = client.seq
+	// 注册请求，按照编号来
+	client.pending[call.Seq] = call
+	client.seq++
+	return call.Seq, nil
+}
+
+// removeCall 根据seq从client.pending中移除对应的Call并返回
+func (client *Client) removeCall(seq uint64) *Call {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	call := client.pending[seq]
+	delete(client.pending, seq)
+	return call
+}
+
+// maxCanceledSeqs 记录的已取消请求的最大数量，服务方法一直不返回时这些记录不会被响应清除，
+// 超过时丢弃最早的，之后才收到的响应会被当成未知的seq
+const maxCanceledSeqs = 1024
+
+// cancelCall 调用方放弃等待时移除Call。严格模式下记录下来，之后收到它的响应不算协议异常，
+// 其他模式本来就不检查未知的seq，不需要记录。返回请求是否还在等待响应
+func (client *Client) cancelCall(seq uint64) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if _, ok := client.pending[seq]; !ok {
+		return false
+	}
+	delete(client.pending, seq)
+	if client.opt.Strict == StrictOff {
+		return true
+	}
+	client.canceled[seq] = true
+	if len(client.canceled) > maxCanceledSeqs {
+		// seq 递增，只保留最近 maxCanceledSeqs 个编号中的记录
+		for s := range client.canceled {
+			if s+maxCanceledSeqs <= client.seq {
+				delete(client.canceled, s)
+			}
+		}
+	}
+	return true
+}
+
+// expectedSeq 判断一个不在pending中的响应是否属于已经取消的请求
+func (client *Client) expectedSeq(seq uint64) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.canceled[seq] {
+		delete(client.canceled, seq)
+		return true
+	}
+	return false
+}
+
+// terminateCalls 服务端或客户端发生错误时调用，将shutdown设置为true，且将错误信息通知所有pending状态的Call
+func (client *Client) terminateCalls(err error) {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.shutdown = true
+	for _, call := range client.pending {
+		call.Error = err
+		call.done()
+	}
+}
+
+// NewClient 创建Client实例，首先需要完成协议交换，然后再创建子线程调用receive()接收响应
+func NewClient(conn net.Conn, opt *Option) (*Client, error) {
+	return NewClientContext(context.Background(), conn, opt)
+}
+
+// NewClientContext 和 NewClient 相同，握手期间 ctx 结束时放弃握手并关闭 conn，
+// ctx 的截止时间只作用于握手，创建出的客户端不受影响
+func NewClientContext(ctx context.Context, conn net.Conn, opt *Option) (*Client, error) {
+	stop := watchConn(ctx, conn)
+	client, err := newClient(conn, opt)
+	stop()
+	if err != nil && deadlineReached(ctx) || ctx.Err() != nil {
+		// 握手刚好在 ctx 结束时完成，连接上的读可能已经因为过期的 deadline 失败
+		if client != nil {
+			_ = client.Close()
+		} else {
+			_ = conn.Close()
+		}
+		return nil, errors.New("rpc client: handshake failed: " + ctx.Err().Error())
+	}
+	return client, err
+}
+
+// watchConn 把 ctx 的截止时间设置到 conn 上，ctx 结束时让 conn 上阻塞的读写立即返回。
+// 返回的 stop 结束监听并清除 deadline，ctx 永远不会结束时不修改 conn
+func watchConn(ctx context.Context, conn net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	quit, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(aLongTimeAgo)
+		case <-quit:
+		}
+	}()
+	return func() {
+		close(quit)
+		<-exited
+		_ = conn.SetDeadline(time.Time{})
+	}
+}
+
+// deadlineReached 判断 ctx 是否已经结束。连接的 deadline 和 ctx 的定时器是各自触发的，
+// 读写因 deadline 超时返回时 ctx 可能还差一点才结束，这时等它结束
+func deadlineReached(ctx context.Context) bool {
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		<-ctx.Done()
+	}
+	return ctx.Err() != nil
+}
+
+// aLongTimeAgo 设置为 deadline 时阻塞的读写立即超时
+var aLongTimeAgo = time.Unix(1, 0)
+
+func newClient(conn net.Conn, opt *Option) (*Client, error) {
+	f := opt.NewCodecFunc()
+	if f == nil {
+		err := fmt.Errorf("invalid codec type %s", opt.CodecType)
+		logger.Errorf("rpc client: codec error: %v", err)
+		return nil, err
+	}
+	// 发送协议给服务端
+	if err := writeHandshake(conn, opt); err != nil {
+		logger.Errorf("rpc client: options error: %v", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	if opt.HandshakeAck && !opt.LegacyHandshake {
+		if err := readHandshakeAck(conn); err != nil {
+			logger.Errorf("rpc client: handshake error: %v", err)
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if opt.StartTLS {
+		tc, err := clientStartTLS(conn, opt)
+		if err != nil {
+			logger.Errorf("rpc client: start tls error: %v", err)
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tc
+		if opt.Token != "" {
+			if err := sendTLSToken(conn, opt); err != nil {
+				logger.Errorf("rpc client: handshake error: %v", err)
+				_ = conn.Close()
+				return nil, err
+			}
+		}
+	}
+	var caps *Capabilities
+	if opt.NegotiateCapabilities && !opt.LegacyHandshake {
+		var err error
+		if caps, err = readCapabilities(conn); err != nil {
+			logger.Errorf("rpc client: read capabilities error: %v", err)
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	wrapped, err := opt.WrapConn(conn, !opt.LegacyHandshake)
+	if err != nil {
+		logger.Errorf("rpc client: options error: %v", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	stats := new(codec.Stats)
+	f = codec.NewStatsCodec(f, stats)
+	if opt.Capture != nil {
+		f = codec.NewCaptureCodec(f, opt.Capture, RemoteAddr(conn))
+	}
+	if opt.Encryption != nil {
+		f = codec.NewEncryptCodec(f, opt.CodecType, opt.Encryption)
+	}
+	client := newClientCodec(f(wrapped), opt, stats, RemoteAddr(conn))
+	client.caps = caps
+	return client, nil
+}
+
+// newClientCodec 创建客户端，开始处理
+func newClientCodec(cc codec.Codec, opt *Option, stats *codec.Stats, addr string) *Client {
+	client := &Client{
+		cc:       cc,
+		opt:      opt,
+		pending:  make(map[uint64]*Call),
+		canceled: make(map[uint64]bool),
+		seq:      1, // 从1开始，0表示无效
+		stats:    stats,
+		addr:     addr,
+
+		concurrent: codec.ConcurrentWrites(cc),
+	}
+	go client.receive()
+	if opt.PingInterval > 0 {
+		go client.keepalive(opt.PingInterval, opt.PingTimeout)
+	}
+	return client
+}
+
+// ParseOptions 用户确定协商信息，这里实现为可选参数，以便用户不设置可以默认
+func ParseOptions(opts ...*Option) (*Option, error) {
+	if len(opts) == 0 || opts[0] == nil {
+		return DefaultOption, nil
+	}
+	if len(opts) != 1 {
+		return nil, errors.New("number of options is more than 1")
+	}
+	opt := opts[0]
+	opt.MagicNumber = DefaultOption.MagicNumber
+	if opt.CodecType == "" {
+		opt.CodecType = DefaultOption.CodecType
+	}
+	return opt, nil
+}
+
+/*
+	接收可能出现的情况：
+	1. Call不存在，可能是请求没有发送完整，或者因为其他原因取消了，但是服务端仍旧处理了（客户端出问题）
+	2. Call存在，服务端处理出错（服务端出问题）
+	3. 正常
+*/
+
+// receive 接收响应
+func (client *Client) receive() {
+	var err error
+	for err == nil {
+		var h codec.Header
+		if err = client.cc.ReadHeader(&h); err != nil {
+			break
+		}
+		call := client.removeCall(h.Seq)
+		switch {
+		case call == nil: // 客户端的Call列表中没有这个请求。可能是请求没有发送完整，或者因为其他原因被取消，但是服务端仍旧处理了
+			err = client.cc.ReadBody(nil)
+			// 严格模式下，未知的seq或者重复的响应视为协议异常
+			if client.expectedSeq(h.Seq) {
+				break
+			}
+			if client.protocolViolation("unknown seq %d", h.Seq) && err == nil {
+				err = fmt.Errorf("%w: unknown seq %d", errProtocol, h.Seq)
+			}
+		case h.Error != "": // call存在，但服务端处理出错
+			e := headerError(&h)
+			err = readErrorBody(client.cc, e)
+			call.Error = e
+			if call.trailer != nil {
+				call.setTrailer(h.Trailer)
+			}
+			if tl := call.Timeline; tl != nil {
+				tl.setTrailer(h.Trailer)
+				tl.Total = time.Since(call.started)
+			}
+			call.done()
+		default: // 正常情况
+			start := time.Now()
+			err = client.cc.ReadBody(call.Reply)
+			if err != nil {
+				call.Error = errors.New("reading body" + err.Error())
+			}
+			if call.trailer != nil {
+				call.setTrailer(h.Trailer)
+			}
+			if tl := call.Timeline; tl != nil {
+				tl.Read = time.Since(start)
+				tl.setTrailer(h.Trailer)
+				tl.Total = time.Since(call.started)
+			}
+			call.done()
+		}
+	}
+	client.terminateCalls(err)
+}
+
+// send 发送请求。每个请求使用自己的请求头，编解码器支持并发写时多个请求可以同时写出
+func (client *Client) send(call *Call) {
+	if !client.concurrent {
+		client.sending.Lock()
+		defer client.sending.Unlock()
+	}
+	if call.Timeline != nil {
+		call.Timeline.QueueWait = time.Since(call.started)
+	}
+
+	// 注册请求
+	seq, err := client.registerCall(call)
+	if err != nil {
+		call.Error = err
+		call.done()
+		return
+	}
+
+	h := &codec.Header{ServiceMethod: call.ServiceMethod, Seq: seq, Metadata: call.metadata}
+	if !call.deadline.IsZero() {
+		h.Deadline = call.deadline.UnixNano()
+	}
+
+	// 编码和发送请求--请求头和请求体
+	// 不是发送请求体吗？为什么只发送了参数		响应类型服务端自己能解析出来
+	start := time.Now()
+	if err := client.cc.Write(h, call.Args); err != nil {
+		call := client.removeCall(seq)
+		if call != nil {
+			call.Error = err
+			call.done()
+		}
+		return
+	}
+	if call.Timeline != nil {
+		// 响应可能在 Write 返回之前就被处理完了，此时调用方已经在读时间线，不能再写
+		client.mu.Lock()
+		if client.pending[seq] == call {
+			call.Timeline.Write = time.Since(start)
+		}
+		client.mu.Unlock()
+	}
+}
+
+// Go 返回调用的Call结构，没有阻塞，使其能够异步调用，结果从返回的 Call.Done 读取。
+// done 为 nil 时创建一个容量为10的通道，无缓冲时换成客户端创建的容量为1的通道，结果不会丢失，
+// 此时 Call.Done 不是传入的 done。多个调用共用一个有缓冲的 done 时，容量至少为同时进行的调用数，
+// 否则来不及取走的结果会被丢弃并记录日志
+func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call, opts ...callopt.CallOption) *Call {
+	ctx := context.Background()
+	if len(opts) > 0 {
+		ctx = callopt.NewContext(ctx, opts...)
+	}
+	return client.start(ctx, serviceMethod, args, reply, done)
+}
+
+// start 发送请求，ctx 中的截止时间和元数据会随请求头一起发送
+func (client *Client) start(ctx context.Context, serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 10)
+	} else if cap(done) == 0 {
+		// 接收响应的循环不能等待调用方，无缓冲的通道放不下结果
+		done = make(chan *Call, 1)
+	}
+	o := callopt.FromContext(ctx)
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          done,
+		metadata:      callMetadata(ctx, o),
+		Timeline:      TimelineFromContext(ctx),
+		trailer:       trailerFromContext(ctx),
+		started:       time.Now(),
+	}
+	call.deadline = callDeadline(ctx, o, call.started)
+	if o.Codec != "" && o.Codec != client.opt.CodecType {
+		call.Error = fmt.Errorf("rpc client: codec %s differs from the connection codec %s", o.Codec, client.opt.CodecType)
+		call.done()
+		return call
+	}
+	client.send(call)
+	return call
+}
+
+// callMetadata 一次调用随请求头发送的元数据：ctx 中的元数据加上调用选项中的元数据
+func callMetadata(ctx context.Context, o callopt.Options) Metadata {
+	if len(o.Metadata) > 0 {
+		ctx = WithMetadata(ctx, o.Metadata)
+	}
+	md := MetadataFromContext(ctx)
+	// 在服务方法中调用下游服务时带上当前请求的ID
+	if f, ok := LogFieldsFromContext(ctx); ok && md[MetadataRequestID] == "" {
+		md = MetadataFromContext(WithMetadata(ctx, Metadata{MetadataRequestID: f.RequestID}))
+	}
+	return md
+}
+
+// callDeadline 一次调用的截止时间：ctx 的截止时间和调用选项中的超时取较早的一个
+func callDeadline(ctx context.Context, o callopt.Options, started time.Time) time.Time {
+	deadline, ok := ctx.Deadline()
+	// Go 没有 ctx，超时时间只随请求头发给服务端
+	if d := started.Add(o.Timeout); o.Timeout > 0 && (!ok || d.Before(deadline)) {
+		deadline = d
+	}
+	return deadline
+}
+
+//
+// 超时处理
+//
+
+// 纵观整个远程调用的过程，需要客户端处理超时的地方有:
+// 1. 与服务端建立连接，导致的超时
+// 2. 发送请求到服务端，写报文导致的超时
+// 3. 等待服务端处理时，等待处理导致的超时（比如服务端已挂死，迟迟不响应）
+// 4. 从服务端接收响应时，读报文导致的超时
+
+// 服务端处理超时的地方有：
+// 1. 读取客户端请求报文时，读报文导致的超时
+// 2. 发送响应报文时，写报文导致的超时
+// 3. 调用映射服务的方法时，处理报文导致的超时
+
+type clientResult struct {
+	client *Client
+	err    error
+}
+
+type newClientFunc func(con net.Conn, opt *Option) (client *Client, err error)
+
+// dialTimeout 能处理超时的连接请求：这里处理了两个超时问题，第一个是连接的时候超时，第二个是协议交换时候的超时
+func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (client *Client, err error) {
+	return dialContext(context.Background(), f, network, address, opts...)
+}
+
+// dialContext 在 dialTimeout 的基础上，ctx 结束时同样放弃连接和协议交换。
+// 开启 RenegotiateCodec 时，服务端不支持 CodecType 的话换一种编码方式重新连接一次
+func dialContext(ctx context.Context, f newClientFunc, network, address string, opts ...*Option) (*Client, error) {
+	// 生成协商信息
+	opt, err := ParseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dialOption(ctx, f, network, address, opt)
+	if t, ok := renegotiateCodec(opt, err); ok {
+		logger.Warnf("rpc client: %s doesn't support codec %s, retry with %s", address, opt.CodecType, t)
+		o := *opt
+		o.CodecType = t
+		return dialOption(ctx, f, network, address, &o)
+	}
+	return client, err
+}
+
+// dialOption 用解析好的协商信息连接
+func dialOption(ctx context.Context, f newClientFunc, network, address string, opt *Option) (client *Client, err error) {
+	parent := ctx
+	if opt.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opt.ConnectTimeout)
+		defer cancel()
+	}
+	// 连接超时处理
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	// 出错，最后记得关闭连接
+	defer func() {
+		if err != nil {
+			_ = conn.Close()
+		}
+	}()
+	ch := make(chan clientResult, 1)
+	stop := watchConn(ctx, conn)
+	go func() {
+		client, err := f(conn, opt)
+		ch <- clientResult{client: client, err: err}
+	}()
+	// select是对信道的操作，匹配的case随机选择一个执行，不匹配会阻塞，所以要注意select的超时处理
+	// 协议交换超时处理
+	select {
+	case result := <-ch:
+		stop()
+		if result.err != nil && deadlineReached(ctx) {
+			return nil, dialError(parent, opt)
+		}
+		return result.client, result.err
+	case <-ctx.Done():
+		stop()
+		// 协议交换最终成功的话关闭创建出的客户端
+		go func() {
+			if result := <-ch; result.client != nil {
+				_ = result.client.Close()
+			}
+		}()
+		return nil, dialError(parent, opt)
+	}
+}
+
+// dialError 连接过程中 ctx 结束时的错误，区分 ConnectTimeout 超时和调用方的 ctx 结束
+func dialError(parent context.Context, opt *Option) error {
+	if err := parent.Err(); err != nil {
+		return errors.New("rpc client: connect failed: " + err.Error())
+	}
+	return fmt.Errorf("rpc client: connect timeout: expect within %s", opt.ConnectTimeout)
+}
+
+// Dial 带有超时处理的连接请求 封装，向上屏蔽具体的连接过程
+func Dial(network, address string, opts ...*Option) (*Client, error) {
+	return DialContext(context.Background(), network, address, opts...)
+}
+
+// DialContext 和 Dial 相同，连接和协议交换都在 ctx 结束时放弃
+func DialContext(ctx context.Context, network, address string, opts ...*Option) (*Client, error) {
+	return dialContext(ctx, NewClient, network, address, opts...)
+}
+
+// Call 同步调用对应的函数，阻塞等待响应返回，返回错误信息。
+// 超时处理使用context包实现，控制权交给用户，控制更为灵活，
+// opts 可以覆盖单次调用的超时时间和元数据，见 callopt。
+// context主要就是用来在多个goroutine中设置截至日期，同步信号，传递请求相关值
+// 他和WaitGroup的作用类似，但是更强大 https://www.cnblogs.com/failymao/p/15565326.html
+func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}, opts ...callopt.CallOption) error {
+	if len(opts) > 0 {
+		ctx = callopt.NewContext(ctx, opts...)
+	}
+	o := callopt.FromContext(ctx)
+	ctx, cancel := o.Context(ctx)
+	defer cancel()
+	call := client.start(ctx, serviceMethod, args, reply, make(chan *Call, 1))
+	select {
+	// 返回一个 channel，用于判断 context 是否结束，多次调用同一个 context done 方法会返回相同的 channel
+	case <-ctx.Done():
+		if client.cancelCall(call.Seq) {
+			go client.sendCancel(call.Seq)
+		}
+		return fmt.Errorf("rpc client: call failed: %w", ctx.Err())
+	case call := <-call.Done:
+		return call.Error
+	}
+}
+
+//
+// 客户端支持HTTP协议
+//
+// 支持 HTTP 协议的好处在于，RPC 服务仅仅使用了监听端口的 /_geerpc 路径，在其他路径上我们可以提供诸如日志、统计等更为丰富的功能。
+//
+
+// NewHTTPClient 创建通过HTTP连接的客户端
+func NewHTTPClient(conn net.Conn, opt *Option) (*Client, error) {
+	_, _ = io.WriteString(conn, fmt.Sprintf("CONNECT %s HTTP/1.0\n\n", wire.RPCPath))
+
+	// 需要获得HTTP正确的响应
+	// ReadResponse 发送Request 从 bufio.NewReader(conn) 读取并返回一个 HTTP 响应
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{
+		Method: "CONNECT",
+	})
+	if err == nil && resp.Status == wire.Connected {
+		return NewClient(conn, opt)
+	}
+	if err == nil {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	return nil, err
+}
+
+// DialHTTP 创建HTTP连接
+func DialHTTP(network, address string, opts ...*Option) (*Client, error) {
+	return DialHTTPContext(context.Background(), network, address, opts...)
+}
+
+// DialHTTPContext 和 DialHTTP 相同，连接、CONNECT 和协议交换都在 ctx 结束时放弃
+func DialHTTPContext(ctx context.Context, network, address string, opts ...*Option) (*Client, error) {
+	return dialContext(ctx, NewHTTPClient, network, address, opts...)
+}
+
+// DialFunc 根据地址创建客户端，第三方传输协议通过 RegisterScheme 接入 XDial
+type DialFunc func(addr string, opts ...*Option) (*Client, error)
+
+// DialContextFunc 支持 ctx 的 DialFunc，通过 RegisterSchemeContext 接入 XDialContext
+type DialContextFunc func(ctx context.Context, addr string, opts ...*Option) (*Client, error)
+
+var (
+	schemeMu sync.RWMutex
+	schemes  = map[string]DialContextFunc{
+		"http": func(ctx context.Context, addr string, opts ...*Option) (*Client, error) {
+			return DialHTTPContext(ctx, "tcp", addr, opts...)
+		},
+	}
+)
+
+// RegisterScheme 注册 protocol@addr 中 protocol 对应的连接方式，已存在时覆盖。
+// 没有注册的 protocol 当作 net.Dial 的 network 处理，例如 tcp、unix。
+// dial 不接收 ctx，XDialContext 的 ctx 只在调用 dial 之前检查一次，需要取消连接时使用 RegisterSchemeContext
+func RegisterScheme(scheme string, dial DialFunc) {
+	RegisterSchemeContext(scheme, func(ctx context.Context, addr string, opts ...*Option) (*Client, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.New("rpc client: connect failed: " + err.Error())
+		}
+		return dial(addr, opts...)
+	})
+}
+
+// RegisterSchemeContext 和 RegisterScheme 相同，dial 在 ctx 结束时应当放弃连接
+func RegisterSchemeContext(scheme string, dial DialContextFunc) {
+	schemeMu.Lock()
+	defer schemeMu.Unlock()
+	schemes[scheme] = dial
+}
+
+// XDial 简化调用 提供一个统一入口XDial。rpcAddr是一个通用格式（protocol@addr）
+func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
+	return XDialContext(context.Background(), rpcAddr, opts...)
+}
+
+// XDialContext 和 XDial 相同，连接和协议交换都在 ctx 结束时放弃
+func XDialContext(ctx context.Context, rpcAddr string, opts ...*Option) (*Client, error) {
+	protocol, addr, err := SplitAddr(rpcAddr)
+	if err != nil {
+		return nil, err
+	}
+	schemeMu.RLock()
+	dial := schemes[protocol]
+	schemeMu.RUnlock()
+	if dial != nil {
+		return dial(ctx, addr, opts...)
+	}
+	return DialContext(ctx, protocol, addr, opts...)
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"MyRPC/codec"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// 第一个测试用例，用于测试连接超时。NewClient 函数耗时 2s，ConnectionTimeout 分别设置为 1s 和 0
+func TestClient_dialTimeout(t *testing.T) {
+	t.Parallel()
+	l, _ := net.Listen("tcp", ":0")
+
+	f := func(conn net.Conn, opt *Option) (client *Client, err error) {
+		_ = conn.Close()
+		time.Sleep(time.Second * 2)
+		return nil, nil
+	}
+	t.Run("timeout", func(t *testing.T) {
+		_, err := dialTimeout(f, "tcp", l.Addr().String(), &Option{ConnectTimeout: time.Second})
+		_assert(err != nil && strings.Contains(err.Error(), "connect timeout"), "expect a timeout error")
+	})
+	t.Run("0", func(t *testing.T) {
+		_, err := dialTimeout(f, "tcp", l.Addr().String(), &Option{ConnectTimeout: 0})
+		_assert(err == nil, "0 means no limit")
+	})
+}
+
+// muxCodec 模拟多路复用的传输：Write 可以被同时调用，n 个请求都进入 Write 之后才一起返回，
+// 响应按请求头原样回写，reply 是请求的参数
+type muxCodec struct {
+	n       int
+	mu      sync.Mutex
+	writing int
+	ready   chan struct{}
+	headers []*codec.Header
+	resp    chan codec.Header
+	body    chan int
+}
+
+func (c *muxCodec) ConcurrentWrites() bool { return true }
+
+func (c *muxCodec) Write(h *codec.Header, body interface{}) error {
+	c.mu.Lock()
+	c.writing++
+	c.headers = append(c.headers, h)
+	if c.writing == c.n {
+		close(c.ready)
+	}
+	c.mu.Unlock()
+	select {
+	case <-c.ready:
+	case <-time.After(2 * time.Second):
+		return errors.New("writes are serialized")
+	}
+	c.resp <- *h
+	c.body <- body.(int)
+	return nil
+}
+
+func (c *muxCodec) ReadHeader(h *codec.Header) error {
+	r, ok := <-c.resp
+	if !ok {
+		return io.EOF
+	}
+	*h = codec.Header{ServiceMethod: r.ServiceMethod, Seq: r.Seq}
+	return nil
+}
+
+func (c *muxCodec) ReadBody(body interface{}) error {
+	v := <-c.body
+	if p, ok := body.(*int); ok {
+		*p = v
+	}
+	return nil
+}
+
+func (c *muxCodec) Close() error { return nil }
+
+func TestClient_ConcurrentWrites(t *testing.T) {
+	t.Parallel()
+	const n = 4
+	cc := &muxCodec{n: n, ready: make(chan struct{}), resp: make(chan codec.Header, n), body: make(chan int, n)}
+	stats := new(codec.Stats)
+	client := newClientCodec(codec.NewStatsCodec(func(io.ReadWriteCloser) codec.Codec { return cc }, stats)(nil), DefaultOption, stats, "mux")
+	_assert(client.concurrent, "expect the stats codec to forward ConcurrentWrites")
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply int
+			err := client.Call(context.Background(), fmt.Sprintf("Foo.M%d", i), i, &reply)
+			_assert(err == nil && reply == i, "expect reply %d, got %d, %v", i, reply, err)
+		}(i)
+	}
+	wg.Wait()
+	// 每个请求有自己的请求头，同时写出的请求不会互相覆盖
+	seen := make(map[uint64]string)
+	for _, h := range cc.headers {
+		_, dup := seen[h.Seq]
+		_assert(!dup, "expect a distinct seq per request, got %d twice", h.Seq)
+		seen[h.Seq] = h.ServiceMethod
+	}
+	_assert(len(seen) == n, "expect %d requests, got %d", n, len(seen))
+}
+
+func TestClient_CanceledSeqs(t *testing.T) {
+	t.Parallel()
+	// 只有严格模式才记录取消的请求
+	for mode, want := range map[StrictMode]int{StrictOff: 0, StrictLog: 1} {
+		client := &Client{opt: &Option{Strict: mode}, pending: make(map[uint64]*Call), canceled: make(map[uint64]bool), seq: 1}
+		seq, _ := client.registerCall(new(Call))
+		_assert(client.cancelCall(seq), "expect seq %d pending", seq)
+		_assert(len(client.canceled) == want, "mode %d: unexpected %d canceled seqs recorded", mode, len(client.canceled))
+		// 取消的请求之后才返回的响应不算协议异常，记录随之清除
+		_assert(client.expectedSeq(seq) == (want == 1) && len(client.canceled) == 0, "mode %d: expect the late response expected", mode)
+	}
+
+	// 服务方法一直不返回时，记录的数量有上限
+	client := &Client{opt: &Option{Strict: StrictLog}, pending: make(map[uint64]*Call), canceled: make(map[uint64]bool), seq: 1}
+	for i := 0; i < 3*maxCanceledSeqs; i++ {
+		seq, _ := client.registerCall(new(Call))
+		_assert(client.cancelCall(seq), "expect seq %d pending", seq)
+	}
+	_assert(len(client.canceled) <= maxCanceledSeqs, "expect at most %d canceled seqs, got %d", maxCanceledSeqs, len(client.canceled))
+	_assert(client.canceled[client.seq-1], "expect the latest canceled seq kept")
+}
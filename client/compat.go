@@ -0,0 +1,29 @@
+package client
+
+import (
+	"MyRPC/callopt"
+	"context"
+)
+
+//
+// 老的调用方式
+// Client.Call 原来的签名是 Call(ctx, serviceMethod, args, reply, buffSize)，现在去掉了 buffSize，增加了 CallOption。
+// 大的代码库可以分批迁移：先把老的调用改名为 CallLegacy，签名不变，编译通过后再用 cmd/callfix 改写成新的 Call：
+//
+//	go run MyRPC/cmd/callfix -w ./...
+//
+// 类型别名让调用方不用为了 CallOption 额外导入 callopt 包
+//
+
+// CallOption 见 callopt.CallOption
+type CallOption = callopt.CallOption
+
+// CallOptions 见 callopt.Options
+type CallOptions = callopt.Options
+
+// CallLegacy 老的 Call 签名，buffSize 不再起作用
+//
+// Deprecated: 使用 Call，cmd/callfix 可以自动改写
+func (client *Client) CallLegacy(ctx context.Context, serviceMethod string, args, reply interface{}, buffSize int) error {
+	return client.Call(ctx, serviceMethod, args, reply)
+}
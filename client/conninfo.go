@@ -0,0 +1,28 @@
+package client
+
+import (
+	"MyRPC/codec"
+	"io"
+	"net"
+)
+
+// RemoteAddr 获取连接对端的地址，MyRPC 的服务端也用它记录连接
+func RemoteAddr(conn io.ReadWriteCloser) string {
+	c, ok := conn.(net.Conn)
+	if !ok || c.RemoteAddr() == nil {
+		return ""
+	}
+	// unix socket 的客户端通常没有地址，用监听的 socket 文件标识
+	if addr := c.RemoteAddr().String(); addr != "" && addr != "@" {
+		return addr
+	}
+	if c.LocalAddr() != nil {
+		return c.LocalAddr().Network() + "@" + c.LocalAddr().String()
+	}
+	return ""
+}
+
+// Stats 返回客户端连接的编解码统计
+func (client *Client) Stats() codec.Stats {
+	return client.stats.Snapshot()
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"MyRPC/codec"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+//
+// 错误码
+// 服务端的错误原来只有一个字符串，调用方只能按错误信息的文本判断错误的种类。
+// 现在响应头中同时带有错误码和附加信息：服务方法用 Errorf 返回带错误码的错误，客户端用 Code 取出错误码：
+//
+//	return MyRPC.Errorf(MyRPC.CodeNotFound, "user %d not found", id)
+//
+//	if MyRPC.Code(err) == MyRPC.CodeNotFound { ... }
+//
+// 服务方法返回的普通错误是 CodeUnknown，框架本身的错误（服务不存在、超时、限流等）有各自的错误码。
+// 错误信息仍然放在 Header.Error 中，老版本的客户端不受影响：Gob 和 Json 会忽略不认识的字段，
+// CompactType 只在客户端握手时设置了 flagErrorCodes 才发送错误码；老版本服务端的错误在新客户端上是 CodeUnknown。
+// 错误码的取值与 gRPC 相同
+//
+
+// ErrorCode 错误码
+type ErrorCode uint32
+
+const (
+	CodeOK                 ErrorCode = iota // 没有错误
+	CodeCanceled                            // 调用被取消
+	CodeUnknown                             // 未知错误，服务方法返回的普通错误
+	CodeInvalidArgument                     // 参数不合法
+	CodeDeadlineExceeded                    // 超时
+	CodeNotFound                            // 服务、方法或者请求的资源不存在
+	CodeAlreadyExists                       // 要创建的资源已经存在
+	CodePermissionDenied                    // 没有权限
+	CodeResourceExhausted                   // 资源耗尽，比如限流
+	CodeFailedPrecondition                  // 系统状态不满足操作的条件
+	CodeAborted                             // 操作被中止，比如并发冲突
+	CodeOutOfRange                          // 超出有效范围
+	CodeUnimplemented                       // 没有实现
+	CodeInternal                            // 内部错误，比如服务方法 panic
+	CodeUnavailable                         // 服务暂时不可用，可以重试
+	CodeDataLoss                            // 数据丢失或损坏
+	CodeUnauthenticated                     // 没有通过鉴权
+)
+
+var codeNames = [...]string{
+	"OK", "Canceled", "Unknown", "InvalidArgument", "DeadlineExceeded", "NotFound", "AlreadyExists",
+	"PermissionDenied", "ResourceExhausted", "FailedPrecondition", "Aborted", "OutOfRange",
+	"Unimplemented", "Internal", "Unavailable", "DataLoss", "Unauthenticated",
+}
+
+func (c ErrorCode) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return "Code(" + strconv.Itoa(int(c)) + ")"
+}
+
+// Error 带错误码的错误，服务方法返回它时错误码和附加信息随响应发给客户端
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Details map[string]string // 附加信息，比如出错的字段、重试的等待时间
+
+	cause error // 客户端还原出的业务错误，见 typederror.go
+}
+
+// Errorf 创建错误码为 code 的错误
+func Errorf(code ErrorCode, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Error 只返回错误信息，与没有错误码时的错误文本相同
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is 错误码和错误信息都相同时认为是同一个错误，客户端收到的错误可以和 ErrServerBusy 这类错误比较
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code && t.Message == e.Message
+}
+
+// Unwrap 返回客户端还原出的业务错误，errors.As 可以取出它
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// WithDetails 添加附加信息，返回 e 本身
+func (e *Error) WithDetails(details map[string]string) *Error {
+	if e.Details == nil {
+		e.Details = make(map[string]string, len(details))
+	}
+	for k, v := range details {
+		e.Details[k] = v
+	}
+	return e
+}
+
+// Code 返回错误的错误码，err 为 nil 时是 CodeOK。客户端本地的错误也有对应的错误码：
+// ctx 超时是 CodeDeadlineExceeded，ctx 取消是 CodeCanceled，连接断开是 CodeUnavailable
+func Code(err error) ErrorCode {
+	if err == nil {
+		return CodeOK
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	case errors.Is(err, ErrShutdown):
+		return CodeUnavailable
+	case errors.Is(err, codec.ErrMetadataTooLarge):
+		return CodeInvalidArgument
+	}
+	return CodeUnknown
+}
+
+// headerError 客户端根据响应头还原错误，老版本的服务端没有错误码，是 CodeUnknown
+func headerError(h *codec.Header) *Error {
+	code := ErrorCode(h.Code)
+	if code == CodeOK {
+		code = CodeUnknown
+	}
+	return &Error{Code: code, Message: h.Error, Details: h.Details}
+}
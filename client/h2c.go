@@ -0,0 +1,19 @@
+//go:build go1.24
+
+package client
+
+import "net/http"
+
+//
+// 明文 HTTP/2（h2c）
+// NewH2CCaller 直接以 HTTP/2 发起连接（prior knowledge），所有调用都是同一个连接上的流，服务端使用 ServeH2C。
+// 需要 Go 1.24 的 http.Protocols，更早的版本返回错误，见 h2c_legacy.go
+//
+
+// NewH2CCaller 创建以明文 HTTP/2 发送调用的 HTTPCaller，url 形如 http://host/_myrpc_/call，opt 同 NewHTTPCaller
+func NewH2CCaller(url string, opts ...*Option) (*HTTPCaller, error) {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{Protocols: &protocols}
+	return NewHTTPCaller(url, &http.Client{Transport: transport}, opts...)
+}
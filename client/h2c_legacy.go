@@ -0,0 +1,13 @@
+//go:build !go1.24
+
+package client
+
+import "errors"
+
+// errH2CUnsupported 明文 HTTP/2 需要 Go 1.24 的 http.Protocols
+var errH2CUnsupported = errors.New("rpc: h2c requires Go 1.24 or later")
+
+// NewH2CCaller 见 h2c.go，这个版本的 Go 不支持
+func NewH2CCaller(url string, opts ...*Option) (*HTTPCaller, error) {
+	return nil, errH2CUnsupported
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"MyRPC/codec"
+	"MyRPC/wire"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 客户端的二进制握手，格式见 MyRPC 的 handshake.go，常量定义在 wire 包中
+const (
+	handshakeVersion = wire.Version
+	handshakeLen     = wire.HeaderLen
+	maxOptionLen     = wire.MaxOptionLen
+)
+
+// 握手头部的标志位
+const (
+	flagStartTLS     = wire.FlagStartTLS     // 握手之后升级TLS
+	flagCapabilities = wire.FlagCapabilities // 服务端回复自己支持的能力
+	flagAck          = wire.FlagAck          // 服务端回复握手确认
+	flagAckDetail    = wire.FlagAckDetail    // 拒绝握手时用 Json 回复原因和服务端支持的编码方式
+	flagErrorCodes   = wire.FlagErrorCodes   // 客户端能读取 CompactType 头部中的错误码和附加信息
+	flagTLSToken     = wire.FlagTLSToken     // 令牌在 TLS 握手之后发送，见 tls.go
+)
+
+// writeHandshake 客户端发送握手信息
+func writeHandshake(w io.Writer, opt *Option) error {
+	if opt.LegacyHandshake {
+		if opt.StartTLS && opt.Token != "" {
+			return errors.New("rpc client: can't send a token with StartTLS over the legacy handshake")
+		}
+		return json.NewEncoder(w).Encode(opt)
+	}
+	var flags uint16
+	sent := opt
+	if opt.StartTLS && opt.Token != "" {
+		// 令牌在 TLS 握手之后发送，不随明文的 Option 发送
+		o := *opt
+		o.Token = ""
+		sent = &o
+		flags |= flagTLSToken
+	}
+	body, err := json.Marshal(sent)
+	if err != nil {
+		return err
+	}
+	if opt.StartTLS {
+		flags |= flagStartTLS
+	}
+	if opt.NegotiateCapabilities {
+		flags |= flagCapabilities
+	}
+	if opt.HandshakeAck {
+		flags |= flagAck | flagAckDetail
+	}
+	flags |= flagErrorCodes
+	buf := make([]byte, handshakeLen, handshakeLen+len(body))
+	binary.BigEndian.PutUint32(buf[0:], uint32(opt.MagicNumber))
+	buf[4] = handshakeVersion
+	buf[5] = wire.CodecIDs[opt.CodecType]
+	binary.BigEndian.PutUint16(buf[6:], flags)
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(body)))
+	_, err = w.Write(append(buf, body...))
+	return err
+}
+
+// readHandshakeAck 客户端读取握手确认，服务端拒绝时返回 *HandshakeError
+func readHandshakeAck(r io.Reader) error {
+	var head [5]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(head[1:])
+	if n > maxOptionLen {
+		return errors.New("rpc client: handshake ack too large")
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return err
+	}
+	switch head[0] {
+	case wire.AckOK:
+		return nil
+	case wire.AckReject:
+		var detail wire.AckDetail
+		if len(msg) > 0 && msg[0] == '{' && json.Unmarshal(msg, &detail) == nil {
+			e := &HandshakeError{Reason: detail.Reason}
+			for _, c := range detail.Codecs {
+				e.Codecs = append(e.Codecs, codec.Type(c))
+			}
+			return e
+		}
+		return &HandshakeError{Reason: string(msg)}
+	default:
+		return fmt.Errorf("rpc client: unknown handshake ack status %d", head[0])
+	}
+}
+
+// ErrHandshakeRejected 服务端拒绝了握手，错误信息中带有服务端给出的原因
+var ErrHandshakeRejected = errors.New("rpc client: handshake rejected")
+
+// HandshakeError 服务端拒绝握手的原因，errors.Is(err, ErrHandshakeRejected) 为 true
+type HandshakeError struct {
+	Reason string
+	Codecs []codec.Type // 服务端支持的编码方式，老版本的服务端不提供
+}
+
+func (e *HandshakeError) Error() string {
+	return ErrHandshakeRejected.Error() + ": " + e.Reason
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return ErrHandshakeRejected
+}
+
+// supports 服务端是否支持编码方式 t，不知道时返回 true
+func (e *HandshakeError) supports(t codec.Type) bool {
+	if len(e.Codecs) == 0 {
+		return true
+	}
+	for _, c := range e.Codecs {
+		if c == t {
+			return true
+		}
+	}
+	return false
+}
+
+// renegotiateCodec 握手因为服务端不支持 opt.CodecType 被拒绝时，返回双方都支持的编码方式
+func renegotiateCodec(opt *Option, err error) (codec.Type, bool) {
+	var e *HandshakeError
+	if !opt.RenegotiateCodec || !errors.As(err, &e) || e.supports(opt.CodecType) {
+		return "", false
+	}
+	for _, c := range e.Codecs {
+		if codec.NewCodecFuncMap[c] != nil {
+			return c, true
+		}
+	}
+	return "", false
+}
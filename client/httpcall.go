@@ -0,0 +1,131 @@
+package client
+
+import (
+	"MyRPC/callopt"
+	"MyRPC/codec"
+	"MyRPC/wire"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//
+// 每个调用一个 HTTP 请求
+// HTTPCaller 把每次调用放在一个 POST 请求里，发给服务端的 CallHandler，请求和响应的格式见 MyRPC 的 httpcall.go。
+// HTTPCaller 使用调用方提供的 http.Client，明文的 HTTP/2（h2c）用 NewH2CCaller，见 h2c.go。
+// 每次调用是独立的请求，不支持握手中协商的压缩、批量写和流式调用
+//
+
+// HTTPCaller 每个调用发送一个 HTTP 请求的客户端，实现了 Caller
+type HTTPCaller struct {
+	url    string
+	client *http.Client
+	codec  codec.Type
+	token  string
+	seq    uint64
+}
+
+var _ Caller = (*HTTPCaller)(nil)
+
+// NewHTTPCaller 创建向 url 发送调用的客户端，url 是服务端 CallHandler 的完整地址，比如 https://host/_myrpc_/call。
+// client 为 nil 时使用 http.DefaultClient，opt 中只有 CodecType 和 Token 生效
+func NewHTTPCaller(url string, client *http.Client, opts ...*Option) (*HTTPCaller, error) {
+	opt, err := ParseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if opt.NewCodecFunc() == nil {
+		return nil, fmt.Errorf("rpc client: invalid codec type %s", opt.CodecType)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPCaller{url: strings.TrimSuffix(url, "/"), client: client, codec: opt.CodecType, token: opt.Token}, nil
+}
+
+// Call 发送一个 HTTP 请求并等待响应，ctx 结束时取消请求
+func (c *HTTPCaller) Call(ctx context.Context, serviceMethod string, args, reply interface{}, opts ...callopt.CallOption) error {
+	if len(opts) > 0 {
+		ctx = callopt.NewContext(ctx, opts...)
+	}
+	o := callopt.FromContext(ctx)
+	ctx, cancel := o.Context(ctx)
+	defer cancel()
+	if o.Codec != "" && o.Codec != c.codec {
+		return fmt.Errorf("rpc client: codec %s differs from the caller codec %s", o.Codec, c.codec)
+	}
+
+	h := &codec.Header{
+		ServiceMethod: serviceMethod,
+		Seq:           atomic.AddUint64(&c.seq, 1),
+		Metadata:      callMetadata(ctx, o),
+	}
+	if deadline := callDeadline(ctx, o, time.Now()); !deadline.IsZero() {
+		h.Deadline = deadline.UnixNano()
+	}
+	conn := new(httpCallConn)
+	cc := codec.NewCodecFuncMap[c.codec](conn)
+	if err := cc.Write(h, args); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(conn.req.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", wire.CallContentType)
+	req.Header.Set(wire.CodecHeader, string(c.codec))
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.New("rpc client: call failed: " + err.Error())
+	}
+	conn.resp = resp.Body
+	defer func() { _ = cc.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("rpc client: call failed: " + resp.Status)
+	}
+
+	var rh codec.Header
+	if err := cc.ReadHeader(&rh); err != nil {
+		return err
+	}
+	if rh.Error != "" {
+		e := headerError(&rh)
+		_ = readErrorBody(cc, e)
+		return e
+	}
+	if err := cc.ReadBody(reply); err != nil {
+		return errors.New("rpc client: reading body " + err.Error())
+	}
+	return nil
+}
+
+// httpCallConn 编码器写入请求体缓冲，解码器从响应体读
+type httpCallConn struct {
+	req  bytes.Buffer
+	resp io.ReadCloser
+}
+
+func (c *httpCallConn) Read(p []byte) (int, error) {
+	if c.resp == nil {
+		return 0, io.EOF
+	}
+	return c.resp.Read(p)
+}
+
+func (c *httpCallConn) Write(p []byte) (int, error) { return c.req.Write(p) }
+
+func (c *httpCallConn) Close() error {
+	if c.resp == nil {
+		return nil
+	}
+	return c.resp.Close()
+}
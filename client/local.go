@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+//
+// 进程内传输
+// local@name 地址：ListenLocal 返回一个内存中的监听器，XDial("local@name") 连接它，
+// 这样 XClient、服务发现等按地址工作的代码也能在测试中使用。local 地址只在同一个进程内可达
+//
+
+// localAddr local@name 地址
+type localAddr string
+
+func (a localAddr) Network() string { return "local" }
+func (a localAddr) String() string  { return string(a) }
+
+// localConn 管道的一端，地址是监听器的名字
+type localConn struct {
+	net.Conn
+	addr localAddr
+}
+
+func (c *localConn) LocalAddr() net.Addr  { return c.addr }
+func (c *localConn) RemoteAddr() net.Addr { return c.addr }
+
+// localListener 内存中的监听器，Dial 创建的管道通过 conns 交给 Accept
+type localListener struct {
+	addr  localAddr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+var (
+	localMu        sync.Mutex
+	localListeners = make(map[string]*localListener)
+)
+
+// ListenLocal 监听 local@name，同名的监听器已经存在时返回错误，MyRPC.Listen("local@name") 使用它
+func ListenLocal(name string) (net.Listener, error) {
+	localMu.Lock()
+	defer localMu.Unlock()
+	if _, ok := localListeners[name]; ok {
+		return nil, fmt.Errorf("rpc: local address %s already in use", name)
+	}
+	l := &localListener{addr: localAddr(name), conns: make(chan net.Conn), done: make(chan struct{})}
+	localListeners[name] = l
+	return l, nil
+}
+
+func (l *localListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *localListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		localMu.Lock()
+		if localListeners[string(l.addr)] == l {
+			delete(localListeners, string(l.addr))
+		}
+		localMu.Unlock()
+	})
+	return nil
+}
+
+func (l *localListener) Addr() net.Addr {
+	return l.addr
+}
+
+// errLocalRefused 没有监听这个名字，或者等待 Accept 超时
+var errLocalRefused = errors.New("rpc client: local connection refused")
+
+// dialLocal 连接 local@name，等待服务端 Accept 直到 ctx 结束
+func dialLocal(ctx context.Context, name string) (net.Conn, error) {
+	localMu.Lock()
+	l := localListeners[name]
+	localMu.Unlock()
+	if l == nil {
+		return nil, errLocalRefused
+	}
+	c1, c2 := net.Pipe()
+	select {
+	case l.conns <- &localConn{Conn: c2, addr: l.addr}:
+		return &localConn{Conn: c1, addr: l.addr}, nil
+	case <-l.done:
+	case <-ctx.Done():
+	}
+	_ = c1.Close()
+	_ = c2.Close()
+	return nil, errLocalRefused
+}
+
+func init() {
+	RegisterSchemeContext("local", func(ctx context.Context, addr string, opts ...*Option) (*Client, error) {
+		opt, err := ParseOptions(opts...)
+		if err != nil {
+			return nil, err
+		}
+		if opt.ConnectTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, opt.ConnectTimeout)
+			defer cancel()
+		}
+		conn, err := dialLocal(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return NewClientContext(ctx, conn, opt)
+	})
+}
@@ -0,0 +1,30 @@
+package client
+
+import "context"
+
+// 日志字段使用的元数据键
+const (
+	MetadataRequestID = "request-id" // 请求ID，客户端没有传时由服务端生成，用服务方法的 ctx 调用下游服务时继续传递
+	MetadataTenant    = "tenant"     // 租户
+)
+
+// LogFields 服务端处理一个请求时的日志字段，服务方法的 ctx 中带有它，用这个 ctx 调用下游服务时继续传递请求ID
+type LogFields struct {
+	RequestID     string
+	ServiceMethod string
+	RemoteAddr    string
+	Tenant        string
+}
+
+type logFieldsKey struct{}
+
+// LogFieldsFromContext 取出服务端放在 ctx 中的日志字段
+func LogFieldsFromContext(ctx context.Context) (LogFields, bool) {
+	f, ok := ctx.Value(logFieldsKey{}).(LogFields)
+	return f, ok
+}
+
+// WithLogFields 把日志字段放到 ctx 中，服务端处理请求前调用
+func WithLogFields(ctx context.Context, f LogFields) context.Context {
+	return context.WithValue(ctx, logFieldsKey{}, f)
+}
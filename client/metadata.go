@@ -0,0 +1,53 @@
+package client
+
+import (
+	"MyRPC/callopt"
+	"context"
+	"time"
+)
+
+//
+// 元数据与截止时间的传递
+// 客户端把 ctx 中的截止时间和元数据放到请求头中发给服务端，服务端据此构造处理请求的 ctx，
+// 接受 ctx 的服务方法（func (t *T) Method(ctx context.Context, args T1, reply *T2) error）就能拿到它们。
+// 在服务方法中继续调用下游服务时，用 Downstream 派生出的 ctx 可以保证下游调用不会比原始请求活得更久。
+//
+
+// Metadata 随请求传递的键值对
+type Metadata map[string]string
+
+type metadataKey struct{}
+
+// WithMetadata 返回带有元数据的 ctx，已有的元数据会被合并，md 中的键优先
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	merged := make(Metadata)
+	for k, v := range MetadataFromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, metadataKey{}, merged)
+}
+
+// MetadataFromContext 取出 ctx 中的元数据，没有时返回 nil
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
+}
+
+// Downstream 在服务方法中调用下游服务时使用，派生一个截止时间比 ctx 提前 margin 的子 ctx，
+// 给本服务留出处理下游结果和回复的时间。元数据保存在 ctx 中，会随下游调用一起转发。
+// ctx 没有截止时间时只派生一个可取消的子 ctx
+func Downstream(ctx context.Context, margin time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline.Add(-margin))
+}
+
+// Caller 调用下游服务的客户端，*Client 和 *xclient.XClient 都实现了该接口
+type Caller interface {
+	Call(ctx context.Context, serviceMethod string, args, reply interface{}, opts ...callopt.CallOption) error
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"MyRPC/codec"
+	"MyRPC/wire"
+	"crypto/tls"
+	"io"
+	"time"
+)
+
+// 客户端和服务端通信需要协商一些内容，服务端通过解析header就能够知道如何从body中读取需要的信息
+// 对于本项目来说，最主要需要协商的就是消息的编解码方式
+// 一般来说，涉及协议协商的这部分信息，需要固定的字节来传输。本项目使用固定长度的二进制头部加上长度明确的Json编码的Option，
+// 后续的header和body的编码方式由Option中的CodeType指定，并且都放在长度前缀的帧中。详见 MyRPC 的 handshake.go
+
+/*
+	| Handshake | Option(Json) | Frame(Header(Codec) Body(Codec)) | Frame | ...
+*/
+
+const MagicNumber = wire.MagicNumber
+
+// Option 协商信息
+type Option struct {
+	MagicNumber     int                // 标记这是MyRPC的请求
+	CodecType       codec.Type         // 客户端选择什么方式进行编码
+	ConnectTimeout  time.Duration      // 连接超时 默认10s
+	HandleTimeout   time.Duration      // 处理超时 默认不设限 0s
+	JsonOption      *codec.JsonOption  // CodecType为Json时的编解码行为，随Option一起发给服务端，双方保持一致
+	Strict          StrictMode         // 客户端处理协议异常的方式，只在客户端生效
+	BatchWindow     time.Duration      // 大于0时开启批量写，双方把这段时间内的消息合并成一次写出
+	BatchSize       int                // 批量写时攒够多少条消息立即写出，默认32
+	StartTLS        bool               // 发送完Option后把连接升级为TLS
+	TLSConfig       *tls.Config        `json:"-"` // 客户端升级TLS使用的配置，只在客户端生效
+	CompressType    codec.CompressType // 压缩方式，默认不压缩
+	CompressDict    uint32             `json:",omitempty"` // 压缩使用的预置字典编号，0表示不使用，见 codec.RegisterDictionary
+	Token           string             `json:",omitempty"` // 鉴权令牌，服务端设置 Authenticator 时在握手中校验，见 MyRPC 的 auth.go
+	PingInterval    time.Duration      `json:"-"`          // 大于0时客户端定期发送心跳，检测空闲时已经断开的连接
+	PingTimeout     time.Duration      `json:"-"`          // 心跳的超时时间，默认等于PingInterval
+	LegacyHandshake bool               `json:"-"`          // 使用老的Json握手，连接还没有升级的服务端时使用
+	Encryption      *codec.Encryption  `json:"-"`          // 需要加密消息体的方法，只在客户端生效，服务端使用 SetEncryption
+	Capture         *codec.Capture     `json:"-"`          // 把解码后的消息写入抓包文件，只在客户端生效，服务端使用 SetCapture
+
+	NegotiateCapabilities bool `json:"-"` // 握手后读取服务端声明的能力，服务端需要支持
+	HandshakeAck          bool `json:"-"` // 等待服务端确认握手，服务端拒绝时立即返回原因而不是等到超时，服务端需要支持
+	RenegotiateCodec      bool `json:"-"` // 服务端因为不支持 CodecType 拒绝握手时，换用服务端支持的编码方式重新连接一次，需要 HandshakeAck
+}
+
+// WrapConn 根据协商信息包装握手之后的连接，framed 为 false 时是老的 Json 握手，消息不使用帧。客户端和服务端共用
+func (opt *Option) WrapConn(conn io.ReadWriteCloser, framed bool) (io.ReadWriteCloser, error) {
+	if framed {
+		conn = codec.NewFrameConn(conn)
+	}
+	if opt.BatchWindow > 0 {
+		conn = codec.NewBatchConn(conn, opt.BatchWindow, opt.BatchSize)
+	}
+	return codec.NewCompressConnDict(conn, opt.CompressType, opt.CompressDict)
+}
+
+// NewCodecFunc 根据协商信息获取编解码器的构造函数，不支持 CodecType 时返回 nil。客户端和服务端共用
+func (opt *Option) NewCodecFunc() codec.NewCodecFunc {
+	if opt.CodecType == codec.JsonType && opt.JsonOption != nil {
+		return codec.NewJsonCodecWithOption(*opt.JsonOption)
+	}
+	return codec.NewCodecFuncMap[opt.CodecType]
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"MyRPC/logger"
+	"MyRPC/wire"
+	"context"
+	"time"
+)
+
+//
+// 心跳
+// TCP 连接被中间设备悄悄丢弃时，只有等到某次调用卡住才能发现。
+// 开启 PingInterval 后，客户端定期发送一个特殊的请求，服务端不经过服务查找直接回复；
+// 超时没有回复就认为连接已经断开，把客户端标记为不可用，XClient 会重新建立连接
+//
+
+// pingMethod 心跳使用的 ServiceMethod，不会和用户的服务冲突
+const pingMethod = wire.PingMethod
+
+// keepalive 定期发送心跳，客户端关闭后退出
+func (client *Client) keepalive(interval, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = interval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		if !client.IsAvailable() {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := client.Ping(ctx)
+		cancel()
+		// 只有超时才认为连接断开，连接本身出错时 receive 已经把客户端标记为不可用
+		if err != nil && ctx.Err() != nil {
+			logger.Warnf("rpc client: ping %s timeout, mark client unavailable", client.addr)
+			client.markDead()
+			return
+		}
+	}
+}
+
+// Ping 发送一次心跳，检查连接是否还通。服务端返回错误（比如老版本不认识心跳）也说明连接是通的，返回 nil
+func (client *Client) Ping(ctx context.Context) error {
+	var pong bool
+	err := client.Call(ctx, pingMethod, true, &pong)
+	if err != nil && ctx.Err() == nil && client.IsAvailable() {
+		return nil
+	}
+	return err
+}
+
+// markDead 把客户端标记为不可用并关闭连接，等待中的调用会收到连接关闭的错误
+func (client *Client) markDead() {
+	client.mu.Lock()
+	client.shutdown = true
+	client.mu.Unlock()
+	_ = client.cc.Close()
+}
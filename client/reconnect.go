@@ -0,0 +1,226 @@
+package client
+
+import (
+	"MyRPC/callopt"
+	"MyRPC/logger"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// 自动重连
+// Client 的连接断开后就不能再用了，长期持有客户端的调用方需要自己发现并重新创建。
+// ReconnectClient 包装 Client：发现连接断开后在后台按指数退避重新连接，期间的调用等待重连完成或者 ctx 结束，
+// 服务端重启对调用方是透明的。
+// 连接断开时已经发出、还没有收到响应的调用默认返回错误，因为服务端可能已经执行过；
+// ReconnectPolicy.Resend 为 true 时在新连接上重发一次，只适合幂等的方法。
+// 还没有发出的调用（连接已经断开时才发起的）总是在新连接上发送
+//
+
+// ReconnectPolicy 重连的策略
+type ReconnectPolicy struct {
+	MinBackoff  time.Duration // 第一次重试前的等待时间，之后每次翻倍，默认100ms
+	MaxBackoff  time.Duration // 等待时间的上限，默认10s
+	MaxAttempts int           // 一轮重连最多尝试的次数，0表示直到成功或者 Close
+	Resend      bool          // 连接断开时已经发出的调用是否在新连接上重发
+}
+
+// 默认值
+const (
+	defaultReconnectMinBackoff = 100 * time.Millisecond
+	defaultReconnectMaxBackoff = 10 * time.Second
+)
+
+// ReconnectClient 断开后自动重连的客户端，实现了 Caller，可以被多个协程同时使用
+type ReconnectClient struct {
+	rpcAddr string
+	opt     *Option
+	policy  ReconnectPolicy
+
+	mu         sync.Mutex
+	client     *Client
+	round      *dialRound // 正在进行或者最近失败的一轮重连
+	closed     bool
+	stop       chan struct{} // Close 时关闭，停止重连
+	reconnects uint64        // 连接断开后重连成功的次数
+}
+
+var _ Caller = (*ReconnectClient)(nil)
+
+// dialRound 一轮重连，结束时关闭 done，失败时 err 不为 nil
+type dialRound struct {
+	done chan struct{}
+	err  error
+}
+
+// NewReconnectClient 创建连接 rpcAddr（protocol@addr，见 XDial）的客户端，第一次调用时才建立连接。
+// policy 为 nil 时使用默认策略
+func NewReconnectClient(rpcAddr string, policy *ReconnectPolicy, opts ...*Option) (*ReconnectClient, error) {
+	opt, err := ParseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := SplitAddr(rpcAddr); err != nil {
+		return nil, err
+	}
+	c := &ReconnectClient{rpcAddr: rpcAddr, opt: opt, stop: make(chan struct{})}
+	if policy != nil {
+		c.policy = *policy
+	}
+	if c.policy.MinBackoff <= 0 {
+		c.policy.MinBackoff = defaultReconnectMinBackoff
+	}
+	if c.policy.MaxBackoff <= 0 {
+		c.policy.MaxBackoff = defaultReconnectMaxBackoff
+	}
+	if c.policy.MaxBackoff < c.policy.MinBackoff {
+		c.policy.MaxBackoff = c.policy.MinBackoff
+	}
+	return c, nil
+}
+
+// Call 调用 serviceMethod，连接断开时等待重连，见 ReconnectPolicy
+func (c *ReconnectClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}, opts ...callopt.CallOption) error {
+	resent := false
+	for {
+		client, err := c.get(ctx)
+		if err != nil {
+			return err
+		}
+		err = client.Call(ctx, serviceMethod, args, reply, opts...)
+		if err == nil || ctx.Err() != nil || client.IsAvailable() {
+			return err
+		}
+		// 连接已经断开时才注册的调用没有发出去，可以放心重发
+		if !errors.Is(err, ErrShutdown) {
+			if !c.policy.Resend || resent {
+				return err
+			}
+			resent = true
+		}
+	}
+}
+
+// get 返回可用的客户端，连接断开时发起重连并等待。一轮重连失败后，等待它的调用返回它的错误，
+// 之后的调用发起新的一轮
+func (c *ReconnectClient) get(ctx context.Context) (*Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.closed {
+			return nil, ErrShutdown
+		}
+		if c.client != nil && c.client.IsAvailable() {
+			return c.client, nil
+		}
+		if c.round == nil || c.round.err != nil {
+			c.round = &dialRound{done: make(chan struct{})}
+			go c.reconnect(c.round, c.client != nil)
+		}
+		round := c.round
+		c.mu.Unlock()
+		select {
+		case <-round.done:
+		case <-ctx.Done():
+			c.mu.Lock()
+			return nil, errors.New("rpc client: reconnect failed: " + ctx.Err().Error())
+		}
+		c.mu.Lock()
+		if round.err != nil {
+			return nil, round.err
+		}
+	}
+}
+
+// reconnect 按退避间隔连接直到成功、Close 或者达到 MaxAttempts，lost 表示之前的连接断开了
+func (c *ReconnectClient) reconnect(round *dialRound, lost bool) {
+	backoff := c.policy.MinBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-c.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		var client *Client
+		client, err = XDialContext(ctx, c.rpcAddr, c.opt)
+		cancel()
+		if err == nil {
+			c.mu.Lock()
+			if c.closed {
+				c.mu.Unlock()
+				_ = client.Close()
+				err = ErrShutdown
+				break
+			}
+			old := c.client
+			c.client, c.round = client, nil
+			if lost {
+				atomic.AddUint64(&c.reconnects, 1)
+			}
+			close(round.done)
+			c.mu.Unlock()
+			if old != nil {
+				_ = old.Close()
+			}
+			if lost {
+				logger.Infof("rpc client: reconnected to %s after %d attempts", c.rpcAddr, attempt)
+			}
+			return
+		}
+		if c.policy.MaxAttempts > 0 && attempt >= c.policy.MaxAttempts {
+			err = fmt.Errorf("rpc client: reconnect to %s failed after %d attempts: %v", c.rpcAddr, attempt, err)
+			break
+		}
+		logger.Warnf("rpc client: connect to %s failed, retry in %v: %v", c.rpcAddr, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-c.stop:
+			err = ErrShutdown
+		}
+		if errors.Is(err, ErrShutdown) {
+			break
+		}
+		if backoff *= 2; backoff > c.policy.MaxBackoff {
+			backoff = c.policy.MaxBackoff
+		}
+	}
+	c.mu.Lock()
+	round.err = err
+	close(round.done)
+	c.mu.Unlock()
+}
+
+// Reconnects 返回连接断开后重连成功的次数
+func (c *ReconnectClient) Reconnects() uint64 {
+	return atomic.LoadUint64(&c.reconnects)
+}
+
+// IsAvailable 当前的连接是否可用，断开后重连完成之前返回 false
+func (c *ReconnectClient) IsAvailable() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.closed && c.client != nil && c.client.IsAvailable()
+}
+
+// Close 关闭连接并停止重连，等待重连的调用返回 ErrShutdown
+func (c *ReconnectClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrShutdown
+	}
+	c.closed = true
+	close(c.stop)
+	if c.client != nil {
+		return c.client.Close()
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"MyRPC/logger"
+	"sync/atomic"
+)
+
+//
+// 严格模式
+// 默认情况下，遇到协议异常（比如收到未知seq的响应）时只是丢弃对应的body继续处理，问题会被悄悄掩盖。
+// 开启严格模式后，每次异常都会计入连接的ProtocolErrors，打印带对端地址的日志，并且可以选择直接断开连接。
+//
+
+// StrictMode 协议异常的处理方式
+type StrictMode int
+
+const (
+	StrictOff   StrictMode = iota // 默认，忽略异常继续处理
+	StrictLog                     // 计数并打印日志，继续处理
+	StrictClose                   // 计数并打印日志，然后断开连接
+)
+
+// errProtocol 协议异常，和服务端返回的协议异常错误码、错误信息相同
+var errProtocol error = Errorf(CodeInvalidArgument, "rpc: protocol violation")
+
+// protocolViolation 根据 Option.Strict 处理一次协议异常，返回true表示需要断开连接
+func (client *Client) protocolViolation(format string, v ...interface{}) bool {
+	mode := client.opt.Strict
+	if mode == StrictOff {
+		return false
+	}
+	atomic.AddUint64(&client.stats.ProtocolErrors, 1)
+	logger.Warnf("rpc client: protocol violation from %s: "+format, append([]interface{}{client.addr}, v...)...)
+	return mode == StrictClose
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"MyRPC/wire"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+//
+// 调用时间线
+// 排查延迟时需要知道时间花在了哪里：客户端排队、建立连接、写请求、服务端排队、服务方法、读响应。
+// 用 WithTimeline 派生的 ctx 发起调用时，客户端记录本地各阶段的耗时，并通过元数据请求服务端
+// 在响应头的 Trailer 中带回服务端的耗时，不需要抓包：
+//
+//	ctx, tl := client.WithTimeline(ctx)
+//	err := xc.Call(ctx, "Foo.Sum", args, &reply)
+//	log.Println(tl)
+//
+
+// Timeline 一次调用各阶段的耗时
+type Timeline struct {
+	QueueWait   time.Duration // 等待发送锁，同一个连接上并发调用很多时变长
+	Dial        time.Duration // XClient 建立连接，复用缓存连接时为0
+	Write       time.Duration // 编码并写出请求
+	ServerQueue time.Duration // 服务端读完请求到开始执行服务方法，包括准入和工作池排队
+	Handler     time.Duration // 服务方法的执行时间
+	Read        time.Duration // 读取并解码响应体
+	Total       time.Duration // 从发起调用到收到响应，剩下的时间基本花在网络上
+}
+
+// TimelineMetadataKey 请求服务端返回耗时的元数据
+const TimelineMetadataKey = "myrpc-timeline"
+
+// 响应头 Trailer 中服务端的耗时，单位纳秒
+const (
+	trailerServerQueue = wire.TrailerServerQueue
+	trailerHandler     = wire.TrailerHandler
+)
+
+type timelineKey struct{}
+
+// WithTimeline 返回记录调用时间线的 ctx，调用结束后可以从返回的 Timeline 中读取各阶段的耗时，
+// 同一个 Timeline 只应该用于一次调用
+func WithTimeline(ctx context.Context) (context.Context, *Timeline) {
+	tl := new(Timeline)
+	ctx = context.WithValue(ctx, timelineKey{}, tl)
+	return WithMetadata(ctx, Metadata{TimelineMetadataKey: "1"}), tl
+}
+
+// TimelineFromContext 取出 ctx 中的时间线，没有时返回 nil
+func TimelineFromContext(ctx context.Context) *Timeline {
+	tl, _ := ctx.Value(timelineKey{}).(*Timeline)
+	return tl
+}
+
+func (tl *Timeline) String() string {
+	return fmt.Sprintf("queue=%s dial=%s write=%s server_queue=%s handler=%s read=%s total=%s",
+		tl.QueueWait, tl.Dial, tl.Write, tl.ServerQueue, tl.Handler, tl.Read, tl.Total)
+}
+
+// setTrailer 客户端从响应的 Trailer 中读取服务端的耗时
+func (tl *Timeline) setTrailer(trailer map[string]string) {
+	if ns, err := strconv.ParseInt(trailer[trailerServerQueue], 10, 64); err == nil {
+		tl.ServerQueue = time.Duration(ns)
+	}
+	if ns, err := strconv.ParseInt(trailer[trailerHandler], 10, 64); err == nil {
+		tl.Handler = time.Duration(ns)
+	}
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// 连接升级（STARTTLS）的格式见 MyRPC 的 tls.go
+
+// writeTLSToken 客户端在 TLS 握手之后发送令牌
+func writeTLSToken(w io.Writer, token string) error {
+	buf := make([]byte, 4, 4+len(token))
+	binary.BigEndian.PutUint32(buf, uint32(len(token)))
+	_, err := w.Write(append(buf, token...))
+	return err
+}
+
+// sendTLSToken 客户端发送令牌，设置 HandshakeAck 时等待服务端校验的结果
+func sendTLSToken(conn io.ReadWriter, opt *Option) error {
+	if err := writeTLSToken(conn, opt.Token); err != nil {
+		return err
+	}
+	if opt.HandshakeAck {
+		return readHandshakeAck(conn)
+	}
+	return nil
+}
+
+// clientStartTLS 客户端把连接升级为 TLS
+func clientStartTLS(conn net.Conn, opt *Option) (net.Conn, error) {
+	config := opt.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+)
+
+//
+// 响应 Trailer
+// 服务端在响应头的 Trailer 中带回和结果无关的额外信息，比如时间线中服务端的耗时、处理请求的实例ID。
+// 用 WithTrailer 派生的 ctx 发起调用时，客户端把收到的 Trailer 复制到返回的 Metadata 中。
+//
+// 读己之写
+// 实例之间异步复制数据的服务，写请求之后马上读，可能读到还没有复制过来的旧数据。
+// 请求的元数据带有 ReadYourWritesMetadataKey 时，服务端在 Trailer 中返回自己的实例ID；
+// 之后的读请求把这个实例ID作为 ReadYourWritesMetadataKey 的值，XClient 会把它路由到同一个实例，见 xclient.Session
+//
+
+const (
+	ReadYourWritesMetadataKey = "myrpc-ryw"      // 写请求的值为 ReadYourWritesWrite，读请求的值为希望路由到的实例ID
+	ReadYourWritesWrite       = "write"          // 写请求，只要求服务端返回实例ID
+	TrailerInstance           = "myrpc-instance" // Trailer 中处理请求的实例ID
+)
+
+type trailerKey struct{}
+
+// WithTrailer 返回记录响应 Trailer 的 ctx，调用结束后可以从返回的 Metadata 中读取，
+// 同一个 Metadata 只应该用于一次调用
+func WithTrailer(ctx context.Context) (context.Context, Metadata) {
+	trailer := make(Metadata)
+	return context.WithValue(ctx, trailerKey{}, trailer), trailer
+}
+
+// trailerFromContext 取出 ctx 中记录 Trailer 的 Metadata，没有时返回 nil
+func trailerFromContext(ctx context.Context) Metadata {
+	trailer, _ := ctx.Value(trailerKey{}).(Metadata)
+	return trailer
+}
+
+// setTrailer 客户端把响应的 Trailer 复制给调用方
+func (call *Call) setTrailer(trailer map[string]string) {
+	for k, v := range trailer {
+		call.trailer[k] = v
+	}
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+//
+// 传输方式
+// rpcAddr 的格式是 protocol@addr，比如 tcp@127.0.0.1:9999、unix@/var/run/myrpc.sock。
+// 同一台机器上的服务之间使用 Unix domain socket 可以省掉 TCP 协议栈的开销。Listen 和 XDial 使用同样的格式，
+// Addr 把监听器的地址转换回 rpcAddr，用于向注册中心注册。
+// unix 地址只在本机可达，心跳会同时上报主机名，其他主机上的 MyRegistryDiscovery 忽略这些实例。
+// 标准库不支持 Windows 的命名管道，需要时可以通过 RegisterScheme 和自定义的 net.Listener 接入。
+// local@name 是进程内的内存连接，见 local.go
+//
+
+// SplitAddr 把 protocol@addr 拆成两部分
+func SplitAddr(rpcAddr string) (protocol, addr string, err error) {
+	parts := strings.SplitN(rpcAddr, "@", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("rpc: wrong format '%s', expect protocol@addr", rpcAddr)
+	}
+	return parts[0], parts[1], nil
+}
+
+// Addr 返回监听器的 rpcAddr，比如 tcp@127.0.0.1:9999、unix@/var/run/myrpc.sock
+func Addr(l net.Listener) string {
+	return l.Addr().Network() + "@" + l.Addr().String()
+}
+
+// LocalOnly 判断 rpcAddr 是否只在本机可达
+func LocalOnly(rpcAddr string) bool {
+	return strings.HasPrefix(rpcAddr, "unix@") || strings.HasPrefix(rpcAddr, "unixpacket@") || strings.HasPrefix(rpcAddr, "local@")
+}
+
+var (
+	hostOnce sync.Once
+	hostname string
+)
+
+// Hostname 本机的主机名，注册 unix 地址时上报，获取失败时返回空字符串
+func Hostname() string {
+	hostOnce.Do(func() {
+		hostname, _ = os.Hostname()
+	})
+	return hostname
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"MyRPC/codec"
+	"MyRPC/wire"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sync"
+)
+
+//
+// 业务错误
+// 错误码只能区分错误的种类，业务错误常常还带有结构化的信息，比如余额不足时的当前余额。
+// 服务方法返回实现了 TypedError 的错误时，错误值本身作为响应的消息体发给客户端，客户端还原出同样类型的值：
+//
+//	type BalanceError struct{ Balance int }
+//	func (e *BalanceError) Error() string     { return fmt.Sprintf("insufficient balance %d", e.Balance) }
+//	func (e *BalanceError) ErrorType() string { return "bank.BalanceError" }
+//	func init() { MyRPC.RegisterErrorType(&BalanceError{}) }
+//
+//	var be *BalanceError
+//	if errors.As(err, &be) { ... }
+//
+// 错误类型的名字放在响应头 Details 的 errorTypeKey 中。服务端和客户端都需要注册：服务端只发送注册过的类型，
+// 客户端不认识的类型丢弃消息体，只返回 *Error。老版本的客户端在出错时本来就丢弃消息体，不受影响
+//
+
+// TypedError 可以随响应发给客户端的业务错误，需要用 RegisterErrorType 注册
+type TypedError interface {
+	error
+	ErrorType() string // 错误类型的名字，在服务端和客户端之间唯一确定这个类型
+}
+
+// errorTypeKey 响应头 Details 中错误类型的名字
+const errorTypeKey = wire.ErrorTypeKey
+
+var errorTypes sync.Map // 错误类型的名字 -> reflect.Type
+
+// RegisterErrorType 注册业务错误的类型，通常在定义错误类型的包的 init 中调用。
+// 类型需要能被 Gob 和 Json 编码，比如至少有一个导出字段的结构体；同一个名字注册了不同的类型时 panic
+func RegisterErrorType(prototype TypedError) {
+	t := reflect.TypeOf(prototype)
+	name := prototype.ErrorType()
+	if old, dup := errorTypes.LoadOrStore(name, t); dup && old != t {
+		panic("rpc: error type " + name + " registered as both " + old.(reflect.Type).String() + " and " + t.String())
+	}
+	v := newErrorValue(t)
+	if err := gob.NewEncoder(io.Discard).Encode(v.Interface()); err != nil {
+		errorTypes.Delete(name)
+		panic("rpc: error type " + name + " can't be encoded by gob: " + err.Error())
+	}
+	if _, err := json.Marshal(v.Interface()); err != nil {
+		errorTypes.Delete(name)
+		panic("rpc: error type " + name + " can't be encoded by json: " + err.Error())
+	}
+}
+
+// ErrorTypeRegistered 判断 err 的类型是否用 RegisterErrorType 注册过，服务端只把注册过的业务错误作为消息体发送
+func ErrorTypeRegistered(err TypedError) bool {
+	t, ok := errorTypes.Load(err.ErrorType())
+	return ok && t == reflect.TypeOf(err)
+}
+
+// newErrorValue 创建 t 的零值，返回指向它的指针
+func newErrorValue(t reflect.Type) reflect.Value {
+	if t.Kind() == reflect.Ptr {
+		return reflect.New(t.Elem())
+	}
+	return reflect.New(t)
+}
+
+// readErrorBody 客户端读取出错的响应的消息体，是注册过的业务错误时还原出来作为 e 包装的错误
+func readErrorBody(cc codec.Codec, e *Error) error {
+	name, ok := e.Details[errorTypeKey]
+	if !ok {
+		return cc.ReadBody(nil)
+	}
+	delete(e.Details, errorTypeKey)
+	if len(e.Details) == 0 {
+		e.Details = nil
+	}
+	ti, ok := errorTypes.Load(name)
+	if !ok {
+		return cc.ReadBody(nil)
+	}
+	t := ti.(reflect.Type)
+	v := newErrorValue(t)
+	if err := cc.ReadBody(v.Interface()); err != nil {
+		return err
+	}
+	if t.Kind() != reflect.Ptr {
+		v = v.Elem()
+	}
+	e.cause = v.Interface().(error)
+	return nil
+}
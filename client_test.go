@@ -1,35 +1,25 @@
 package MyRPC
 
 import (
+	"MyRPC/callopt"
+	"MyRPC/codec"
+	"MyRPC/lite"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-// 第一个测试用例，用于测试连接超时。NewClient 函数耗时 2s，ConnectionTimeout 分别设置为 1s 和 0
-func TestClient_dialTimeout(t *testing.T) {
-	t.Parallel()
-	l, _ := net.Listen("tcp", ":0")
-
-	f := func(conn net.Conn, opt *Option) (client *Client, err error) {
-		_ = conn.Close()
-		time.Sleep(time.Second * 2)
-		return nil, nil
-	}
-	t.Run("timeout", func(t *testing.T) {
-		_, err := dialTimeout(f, "tcp", l.Addr().String(), &Option{ConnectTimeout: time.Second})
-		_assert(err != nil && strings.Contains(err.Error(), "connect timeout"), "expect a timeout error")
-	})
-	t.Run("0", func(t *testing.T) {
-		_, err := dialTimeout(f, "tcp", l.Addr().String(), &Option{ConnectTimeout: 0})
-		_assert(err == nil, "0 means no limit")
-	})
-}
-
 //
 //第二个测试用例，用于测试处理超时。Bar.Timeout 耗时 2s，
 //场景一：客户端设置超时时间为 1s，服务端无限制；
@@ -62,7 +52,7 @@ func TestClient_Call(t *testing.T) {
 		client, _ := Dial("tcp", addr)
 		ctx, _ := context.WithTimeout(context.Background(), time.Second)
 		var reply int
-		err := client.Call(ctx, "Bar.Timeout", 1, &reply, 1)
+		err := client.Call(ctx, "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
 	})
 
@@ -71,7 +61,7 @@ func TestClient_Call(t *testing.T) {
 			HandleTimeout: time.Second,
 		})
 		var reply int
-		err := client.Call(context.Background(), "Bar.Timeout", 1, &reply, 1)
+		err := client.Call(context.Background(), "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
 	})
 }
@@ -94,3 +84,917 @@ func TestXDial(t *testing.T) {
 		_assert(err == nil, "failed to connect unix socket")
 	}
 }
+
+func TestClient_Compress(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	for _, opt := range []*Option{
+		{CompressType: codec.CompressGzip},
+		{CompressType: codec.CompressGzip, CodecType: codec.JsonType, BatchWindow: time.Millisecond},
+		{CodecType: codec.CompactType, BatchWindow: time.Millisecond},
+	} {
+		client, err := Dial("tcp", l.Addr().String(), opt)
+		_assert(err == nil, "failed to dial: %v", err)
+		for i := 0; i < 3; i++ {
+			var reply int
+			err = client.Call(context.Background(), "Foo.Sum", Args{Num1: i, Num2: 1}, &reply)
+			_assert(err == nil && reply == i+1, "failed to call Foo.Sum with %+v: %v", opt, err)
+		}
+		_ = client.Close()
+	}
+}
+
+// 还有请求在写的时候关闭压缩连接，用 -race 运行时检查压缩器没有被同时写
+func TestClient_CompressCloseInFlight(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	for _, ct := range []codec.CompressType{codec.CompressGzip, codec.CompressDeflate} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{CompressType: ct})
+		_assert(err == nil, "failed to dial: %v", err)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					var reply int
+					if err := client.Call(context.Background(), "Foo.Sum", Args{Num1: i, Num2: j}, &reply); err != nil {
+						return
+					}
+				}
+			}(i)
+		}
+		time.Sleep(5 * time.Millisecond)
+		_ = client.Close()
+		wg.Wait()
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", Args{}, &reply)
+		_assert(err != nil, "expect calls to fail after Close with %s", ct)
+	}
+}
+
+func TestClient_Encryption(t *testing.T) {
+	t.Parallel()
+	enc := &codec.Encryption{Methods: []string{"Foo.Sum"}, KMS: codec.NewStaticKeyManager("k1", make([]byte, 32))}
+	server := NewServer()
+	server.SetEncryption(enc)
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	for _, ct := range []codec.Type{codec.GobType, codec.JsonType, codec.CompactType} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: ct, Encryption: enc})
+		_assert(err == nil, "failed to dial: %v", err)
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "failed to call encrypted Foo.Sum with %s: %v", ct, err)
+		_ = client.Close()
+	}
+
+	// 没有加密的请求会被拒绝
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err != nil, "expect plaintext body of encrypted method to be rejected")
+}
+
+// 老的Json握手和新的二进制握手可以连接同一个服务端
+func TestClient_Handshake(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	for _, legacy := range []bool{true, false} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{LegacyHandshake: legacy})
+		_assert(err == nil, "failed to dial: %v", err)
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "failed to call Foo.Sum with legacy=%v: %v", legacy, err)
+		_ = client.Close()
+	}
+}
+
+type Slow int
+
+func (s Slow) Wait(d time.Duration, reply *int) error {
+	time.Sleep(d)
+	return nil
+}
+
+func TestClient_Timeline(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var s Slow
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	ctx, tl := WithTimeline(context.Background())
+	err = client.Call(ctx, "Slow.Wait", 50*time.Millisecond, &reply)
+	_assert(err == nil, "failed to call Slow.Wait: %v", err)
+	_assert(tl.Handler >= 50*time.Millisecond && tl.Handler < time.Second, "expect handler time from server, got %s", tl)
+	_assert(tl.Write > 0 && tl.Total >= tl.Handler+tl.ServerQueue, "wrong client side timeline: %s", tl)
+
+	call := client.Go("Slow.Wait", time.Duration(0), &reply, nil)
+	_assert((<-call.Done).Timeline == nil, "expect no timeline without WithTimeline")
+}
+
+func TestClient_Capabilities(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{NegotiateCapabilities: true})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	caps, ok := client.Capabilities()
+	_assert(ok && caps.ProtocolVersion == handshakeVersion && len(caps.Codecs) >= 2, "wrong capabilities: %+v", caps)
+	_assert(client.InstanceID() == server.InstanceID() && server.InstanceID() != NewServer().InstanceID(), "expect the server instance id in capabilities, got %q", client.InstanceID())
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum after negotiating capabilities: %v", err)
+}
+
+func TestClient_HandshakeAck(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{HandshakeAck: true})
+	_assert(err == nil, "failed to dial: %v", err)
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum after handshake ack: %v", err)
+	_ = client.Close()
+
+	// 服务端拒绝时立即返回原因，而不是等到连接超时
+	for _, opt := range []*Option{
+		{MagicNumber: 0x1234, CodecType: codec.GobType, HandshakeAck: true},
+		{MagicNumber: MagicNumber, CodecType: codec.GobType, StartTLS: true, HandshakeAck: true},
+	} {
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		start := time.Now()
+		_, err = NewClient(conn, opt)
+		_assert(errors.Is(err, ErrHandshakeRejected), "expect handshake rejected, got %v", err)
+		_assert(time.Since(start) < time.Second, "expect fail fast, took %v", time.Since(start))
+		var he *HandshakeError
+		_assert(errors.As(err, &he) && len(he.Codecs) >= 3 && he.Reason != "", "expect the reason and supported codecs, got %#v", err)
+	}
+}
+
+func TestClient_RenegotiateCodec(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	// 前两个连接模拟只支持 Gob 的服务端，之后的连接交给 server
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if i >= 2 {
+				go server.ServerConn(conn)
+				continue
+			}
+			opt, _, _, _ := readHandshake(conn)
+			_assert(opt != nil && opt.ackDetail, "expect the client to ask for the ack detail")
+			_ = writeHandshakeAck(conn, errors.New("invalid codec type "+string(opt.CodecType)), []string{string(codec.GobType)})
+			_ = conn.Close()
+		}
+	}()
+
+	opt := &Option{CodecType: codec.JsonType, HandshakeAck: true}
+	_, err := Dial("tcp", l.Addr().String(), opt)
+	_assert(errors.Is(err, ErrHandshakeRejected), "expect rejected without RenegotiateCodec, got %v", err)
+
+	opt.RenegotiateCodec = true
+	client, err := Dial("tcp", l.Addr().String(), opt)
+	_assert(err == nil, "expect to renegotiate the codec, got %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call after renegotiation: %v", err)
+	conns := server.Conns()
+	_assert(len(conns) == 1 && conns[0].CodecType == codec.GobType, "expect gob, got %+v", conns)
+}
+
+func TestClient_Ping(t *testing.T) {
+	t.Parallel()
+	// 只接受连接，从不回复，模拟被悄悄丢弃的连接
+	l, _ := net.Listen("tcp", ":0")
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+	client, err := Dial("tcp", l.Addr().String(), &Option{PingInterval: 100 * time.Millisecond})
+	_assert(err == nil, "failed to dial: %v", err)
+	time.Sleep(500 * time.Millisecond)
+	_assert(!client.IsAvailable(), "expect client unavailable after ping timeout")
+
+	server := NewServer()
+	l2, _ := net.Listen("tcp", ":0")
+	go server.Accept(l2)
+	client, err = Dial("tcp", l2.Addr().String(), &Option{PingInterval: 100 * time.Millisecond})
+	_assert(err == nil, "failed to dial: %v", err)
+	time.Sleep(500 * time.Millisecond)
+	_assert(client.IsAvailable(), "expect client available when server replies ping")
+}
+
+type Echo int
+
+// Metadata 返回请求中 key 对应的元数据，以及截止时间是否被传递过来
+func (e Echo) Metadata(ctx context.Context, key string, reply *string) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("no deadline")
+	}
+	*reply = MetadataFromContext(ctx)[key]
+	return nil
+}
+
+// Log 用请求的 Logger 打印 msg，返回请求ID
+func (e Echo) Log(ctx context.Context, msg string, reply *string) error {
+	LoggerFromContext(ctx).Info("%s", msg)
+	f, _ := LogFieldsFromContext(ctx)
+	*reply = f.RequestID
+	return nil
+}
+
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) Debug(format string, v ...interface{}) { l.Info(format, v...) }
+func (l *captureLogger) Warn(format string, v ...interface{})  { l.Info(format, v...) }
+func (l *captureLogger) Error(format string, v ...interface{}) { l.Info(format, v...) }
+func (l *captureLogger) Info(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+// find 返回包含 s 的日志
+func (l *captureLogger) find(s string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var found []string
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			found = append(found, line)
+		}
+	}
+	return found
+}
+
+func TestServer_LogFields(t *testing.T) {
+	logs := new(captureLogger)
+	SetLogger(logs)
+	defer SetLogger(nil)
+	server := NewServer()
+	server.SetAccessLogger(DefaultAccessLogger{})
+	var e Echo
+	_ = server.Register(&e)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	ctx := WithMetadata(context.Background(), Metadata{MetadataRequestID: "req-1", MetadataTenant: "acme"})
+	var reply string
+	_assert(client.Call(ctx, "Echo.Log", "hello 100%", &reply) == nil && reply == "req-1", "expect request id from metadata, got %q", reply)
+	found := logs.find("hello 100%")
+	_assert(len(found) == 1, "expect one handler log, got %v", found)
+	for _, field := range []string{"request_id=req-1", "method=Echo.Log", "peer=", "tenant=acme"} {
+		_assert(strings.Contains(found[0], field), "expect %q in %q", field, found[0])
+	}
+	_assert(len(logs.find("rpc access: request_id=req-1")) == 1, "expect access log with the same request id")
+
+	_assert(client.Call(context.Background(), "Echo.Log", "generated", &reply) == nil && reply != "", "expect a generated request id")
+	found = logs.find("generated")
+	_assert(len(found) == 1 && strings.Contains(found[0], "request_id="+reply), "expect handler log with the generated request id, got %v", found)
+
+	// 用服务方法的 ctx 调用下游服务时转发请求ID
+	downstream := withLogFields(context.Background(), &request{h: &codec.Header{Metadata: map[string]string{MetadataRequestID: reply}}})
+	var forwarded string
+	_assert(client.Call(downstream, "Echo.Log", "downstream", &forwarded) == nil && forwarded == reply, "expect request id forwarded downstream, got %q", forwarded)
+}
+
+func TestClient_GoDoneCapacity(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	done := make(chan *Call, 1)
+	var calls [3]int
+	for i := range calls {
+		client.Go("Foo.Sum", Args{Num1: i, Num2: i}, &calls[i], done)
+	}
+	// 结果没有被取走时不能阻塞后续的调用，放不下的结果被丢弃
+	var reply int
+	_assert(client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply) == nil && reply == 3, "expect Call not blocked by pending Go results")
+	time.Sleep(100 * time.Millisecond)
+	_assert(len(done) == 1, "expect one result kept in done, got %d", len(done))
+	call := <-done
+	_assert(call.Error == nil, "failed to call Foo.Sum: %v", call.Error)
+
+	// 无缓冲的 done 换成客户端的通道，没有人等待时结果也不会丢失
+	var sum int
+	call = client.Go("Foo.Sum", Args{Num1: 2, Num2: 3}, &sum, make(chan *Call))
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case c := <-call.Done:
+		_assert(c.Error == nil && sum == 5, "expect the reply kept for an unbuffered done, got %d, %v", sum, c.Error)
+	case <-time.After(time.Second):
+		t.Fatal("expect the reply of an unbuffered done delivered")
+	}
+}
+
+func TestClient_Trailer(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	ctx, trailer := WithTrailer(context.Background())
+	_assert(client.Call(ctx, "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply) == nil && len(trailer) == 0, "expect no trailer by default, got %v", trailer)
+	ctx, trailer = WithTrailer(WithMetadata(context.Background(), Metadata{ReadYourWritesMetadataKey: ReadYourWritesWrite}))
+	_assert(client.Call(ctx, "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply) == nil, "failed to call Foo.Sum")
+	_assert(trailer[TrailerInstance] == server.InstanceID(), "expect the instance id in trailer, got %v", trailer)
+}
+
+func TestClient_Metadata(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var e Echo
+	_ = server.Register(&e)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String())
+	ctx, cancel := context.WithTimeout(WithMetadata(context.Background(), Metadata{"trace": "abc"}), time.Second)
+	defer cancel()
+	ctx, cancel = Downstream(ctx, 100*time.Millisecond)
+	defer cancel()
+	var reply string
+	err := client.Call(ctx, "Echo.Metadata", "trace", &reply)
+	_assert(err == nil && reply == "abc", "expect metadata and deadline forwarded, but got %q, err: %v", reply, err)
+}
+
+// Downstreamed 下游服务收到的截止时间和元数据
+type Downstreamed struct {
+	Deadline time.Time
+	Trace    string
+}
+
+type Backend int
+
+func (b Backend) Inspect(ctx context.Context, args int, reply *Downstreamed) error {
+	reply.Deadline, _ = ctx.Deadline()
+	reply.Trace = MetadataFromContext(ctx)["trace"]
+	return nil
+}
+
+// Relay 用服务端配置的 Caller 调用下游服务，margin 是留给自己的时间
+type Relay int
+
+func (r Relay) Forward(ctx context.Context, margin time.Duration, reply *Downstreamed) error {
+	caller := CallerFromContext(ctx)
+	if caller == nil {
+		return errors.New("no caller")
+	}
+	dctx, cancel := Downstream(ctx, margin)
+	defer cancel()
+	return caller.Call(dctx, "Backend.Inspect", 0, reply)
+}
+
+func TestServer_Caller(t *testing.T) {
+	t.Parallel()
+	backend := NewServer()
+	var b Backend
+	_ = backend.Register(&b)
+	bl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = bl.Close() }()
+	go backend.Accept(bl)
+	downstream, err := Dial("tcp", bl.Addr().String())
+	_assert(err == nil, "failed to dial the backend: %v", err)
+	defer func() { _ = downstream.Close() }()
+
+	frontend := NewServer()
+	frontend.SetCaller(downstream)
+	var r Relay
+	_ = frontend.Register(&r)
+	fl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = fl.Close() }()
+	go frontend.Accept(fl)
+	client, err := Dial("tcp", fl.Addr().String())
+	_assert(err == nil, "failed to dial the frontend: %v", err)
+	defer func() { _ = client.Close() }()
+
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(WithMetadata(context.Background(), Metadata{"trace": "abc"}), deadline)
+	defer cancel()
+	margin := 200 * time.Millisecond
+	var reply Downstreamed
+	err = client.Call(ctx, "Relay.Forward", margin, &reply)
+	_assert(err == nil, "failed to call through the relay: %v", err)
+	_assert(reply.Deadline.Equal(deadline.Add(-margin)), "expect the downstream deadline %v, got %v", deadline.Add(-margin), reply.Deadline)
+	_assert(reply.Trace == "abc", "expect the metadata forwarded downstream, got %q", reply.Trace)
+
+	_assert(CallerFromContext(context.Background()) == nil, "expect no caller in a plain ctx")
+	_assert(CallerFromContext(WithCaller(context.Background(), client)) == client, "expect the caller from WithCaller")
+}
+
+func TestClient_CallOptions(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var e Echo
+	var s Slow
+	_ = server.Register(&e)
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	ctx := WithMetadata(context.Background(), Metadata{"trace": "abc"})
+	var reply string
+	err = client.Call(ctx, "Echo.Metadata", "user", &reply, callopt.WithTimeout(time.Second), callopt.WithMetadata(map[string]string{"user": "bob"}))
+	_assert(err == nil && reply == "bob", "expect metadata and deadline from call options, but got %q, err: %v", reply, err)
+	err = client.Call(callopt.NewContext(ctx, callopt.WithTimeout(time.Second)), "Echo.Metadata", "trace", &reply)
+	_assert(err == nil && reply == "abc", "expect call options from ctx merged with metadata, but got %q, err: %v", reply, err)
+
+	var n int
+	err = client.Call(context.Background(), "Slow.Wait", time.Second, &n, callopt.WithTimeout(50*time.Millisecond))
+	_assert(err != nil && strings.Contains(err.Error(), "deadline exceeded"), "expect timeout from call options, got %v", err)
+	call := client.Go("Echo.Metadata", "trace", &reply, nil, callopt.WithCodec(codec.JsonType))
+	_assert((<-call.Done).Error != nil, "expect error when the codec differs from the connection")
+}
+
+func TestProtocolSpec(t *testing.T) {
+	spec := ProtocolSpec()
+	var size int
+	for _, f := range spec.Handshake {
+		size += f.Size
+	}
+	_assert(size == handshakeLen, "handshake fields add up to %d bytes, expect %d", size, handshakeLen)
+	names := make(map[string]bool)
+	for _, f := range spec.Option {
+		names[f.Name] = true
+	}
+	_assert(names["CodecType"] && !names["TLSConfig"], "wrong option fields: %v", spec.Option)
+	exported := 0
+	for i, ht := 0, reflect.TypeOf(codec.Header{}); i < ht.NumField(); i++ {
+		if ht.Field(i).PkgPath == "" {
+			exported++
+		}
+	}
+	_assert(len(spec.Header) == exported, "expect all exported header fields")
+}
+
+func TestXDial_Unix(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "rpc.sock")
+	// 上一次没有正常退出留下的 socket 文件
+	stale, err := net.Listen("unix", path)
+	_assert(err == nil, "failed to listen: %v", err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	l, err := Listen("unix@" + path)
+	_assert(err == nil, "expect the stale socket removed, got %v", err)
+	defer func() { _ = l.Close() }()
+	_assert(Addr(l) == "unix@"+path && LocalOnly(Addr(l)), "wrong rpc addr %s", Addr(l))
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	go server.Accept(l)
+
+	client, err := XDial(Addr(l))
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call over unix socket: %v", err)
+
+	_, err = Listen("unix@" + path)
+	_assert(err != nil, "expect listening on a socket in use to fail")
+}
+
+func TestXDial_Scheme(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	var dialed int32
+	RegisterScheme("test-tcp", func(addr string, opts ...*Option) (*Client, error) {
+		atomic.AddInt32(&dialed, 1)
+		return Dial("tcp", addr, opts...)
+	})
+	client, err := XDial("test-tcp@" + l.Addr().String())
+	_assert(err == nil, "failed to dial a registered scheme: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call over a registered scheme: %v", err)
+	_assert(atomic.LoadInt32(&dialed) == 1, "expect the registered dial func used")
+
+	// 不接收 ctx 的 dial 在 ctx 已经结束时不会被调用
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = XDialContext(ctx, "test-tcp@"+l.Addr().String())
+	_assert(err != nil && strings.Contains(err.Error(), context.Canceled.Error()), "expect the canceled ctx reported, got %v", err)
+	_assert(atomic.LoadInt32(&dialed) == 1, "expect the dial func skipped after ctx is done")
+
+	// RegisterSchemeContext 的 dial 收到调用方的 ctx
+	RegisterSchemeContext("test-block", func(ctx context.Context, addr string, opts ...*Option) (*Client, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = XDialContext(ctx, "test-block@"+l.Addr().String())
+	_assert(errors.Is(err, context.DeadlineExceeded), "expect the ctx passed to the dial func, got %v", err)
+
+	// 没有注册的 scheme 当作 net.Dial 的 network
+	_, err = XDial("test-unknown@" + l.Addr().String())
+	_assert(err != nil && strings.Contains(err.Error(), "unknown network test-unknown"), "expect an unknown network error, got %v", err)
+	_, err = XDial(l.Addr().String())
+	_assert(err != nil && strings.Contains(err.Error(), "expect protocol@addr"), "expect a format error, got %v", err)
+}
+
+func TestLocalTransport(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+
+	client, err := NewLocalPipe(server, &Option{CodecType: codec.JsonType})
+	_assert(err == nil, "failed to create the local pipe: %v", err)
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call over the local pipe: %v", err)
+	_ = client.Close()
+
+	l, err := Listen("local@foo-test")
+	_assert(err == nil, "failed to listen: %v", err)
+	_assert(Addr(l) == "local@foo-test" && LocalOnly(Addr(l)), "wrong rpc addr %s", Addr(l))
+	_, err = Listen("local@foo-test")
+	_assert(err != nil, "expect the local address in use")
+	go server.Accept(l)
+	client, err = XDial(Addr(l))
+	_assert(err == nil, "failed to dial: %v", err)
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 2, Num2: 2}, &reply)
+	_assert(err == nil && reply == 4, "failed to call over local@: %v", err)
+	_ = client.Close()
+
+	_ = l.Close()
+	_, err = XDial(Addr(l))
+	_assert(err != nil, "expect dialing a closed local listener to fail")
+}
+
+func TestClient_CallLegacy(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	client, err := NewLocalPipe(server)
+	_assert(err == nil, "failed to create the local pipe: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	var opt CallOption = callopt.WithTimeout(time.Second)
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply, opt)
+	_assert(err == nil && reply == 3, "failed to call with the aliased option: %v", err)
+	err = client.CallLegacy(context.Background(), "Foo.Sum", Args{Num1: 2, Num2: 2}, &reply, 10)
+	_assert(err == nil && reply == 4, "failed to call with the legacy signature: %v", err)
+}
+
+func TestLiteClient(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	for _, opt := range []*lite.Options{
+		nil,
+		{CodecType: codec.JsonType, HandshakeAck: true},
+		{CodecType: codec.CompactType},
+	} {
+		client, err := lite.Dial("tcp", l.Addr().String(), opt)
+		_assert(err == nil, "failed to dial with the lite client: %v", err)
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var reply int
+				err := client.Call(context.Background(), "Foo.Sum", Args{Num1: i, Num2: 1}, &reply)
+				_assert(err == nil && reply == i+1, "failed to call Foo.Sum with the lite client: %v", err)
+			}(i)
+		}
+		wg.Wait()
+		var reply int
+		err = client.Call(context.Background(), "Foo.Missing", Args{}, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect the server error, got %v", err)
+		_ = client.Close()
+		err = client.Call(context.Background(), "Foo.Sum", Args{}, &reply)
+		_assert(errors.Is(err, lite.ErrShutdown), "expect ErrShutdown after Close, got %v", err)
+	}
+	_, err := lite.Dial("tcp", l.Addr().String(), &lite.Options{CodecType: "application/unknown"})
+	_assert(err != nil, "expect an unknown codec to be rejected")
+}
+
+func TestClient_DialContext(t *testing.T) {
+	t.Parallel()
+	// 只接受连接不做任何响应的服务端，等待握手确认和 CONNECT 响应的客户端会一直阻塞
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+	opt := func() *Option { return &Option{HandshakeAck: true} }
+	dials := map[string]func(ctx context.Context) error{
+		"DialContext": func(ctx context.Context) error {
+			_, err := DialContext(ctx, "tcp", l.Addr().String(), opt())
+			return err
+		},
+		"XDialContext http": func(ctx context.Context) error {
+			_, err := XDialContext(ctx, "http@"+l.Addr().String(), opt())
+			return err
+		},
+		"NewClientContext": func(ctx context.Context) error {
+			c1, c2 := net.Pipe() // 对端不读，握手的写一直阻塞
+			defer func() { _ = c2.Close() }()
+			_, err := NewClientContext(ctx, c1, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, HandshakeAck: true})
+			return err
+		},
+		"lite.DialContext": func(ctx context.Context) error {
+			_, err := lite.DialContext(ctx, "tcp", l.Addr().String(), &lite.Options{HandshakeAck: true})
+			return err
+		},
+	}
+	for name, dial := range dials {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		err := dial(ctx)
+		cancel()
+		_assert(err != nil && strings.Contains(err.Error(), "deadline exceeded"), "%s: expect the ctx error, got %v", name, err)
+		_assert(time.Since(start) < time.Second, "%s: expect to give up when ctx is done, took %v", name, time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err := DialContext(ctx, "tcp", l.Addr().String(), opt())
+	_assert(err != nil && strings.Contains(err.Error(), "canceled"), "expect the cancellation, got %v", err)
+	_, err = DialContext(context.Background(), "tcp", l.Addr().String(), &Option{HandshakeAck: true, ConnectTimeout: 100 * time.Millisecond})
+	_assert(err != nil && strings.Contains(err.Error(), "connect timeout"), "expect ConnectTimeout to still apply, got %v", err)
+}
+
+// Hold 第一次调用阻塞到 release 关闭，之后立即返回调用的次数
+type Hold struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (h *Hold) Wait(args int, reply *int) error {
+	n := atomic.AddInt32(&h.calls, 1)
+	if n == 1 {
+		<-h.release
+	}
+	*reply = int(n)
+	return nil
+}
+
+func TestReconnectClient(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	hold := &Hold{release: make(chan struct{})}
+	defer close(hold.release)
+	_ = server.Register(hold)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go server.ServerConn(conn)
+		}
+	}()
+	// 模拟服务端重启，断开所有连接
+	restart := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+		conns = nil
+	}
+	ctx := context.Background()
+	policy := &ReconnectPolicy{MinBackoff: 10 * time.Millisecond}
+
+	client, err := NewReconnectClient("tcp@"+l.Addr().String(), policy)
+	_assert(err == nil, "failed to create the client: %v", err)
+	var reply int
+	for i := 0; i < 3; i++ {
+		err = client.Call(ctx, "Foo.Sum", Args{Num1: i, Num2: 1}, &reply)
+		_assert(err == nil && reply == i+1, "failed to call Foo.Sum: %v", err)
+		restart()
+		for client.IsAvailable() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	_assert(client.Reconnects() == 2, "expect 2 reconnects, got %d", client.Reconnects())
+
+	// 已经发出的调用默认返回错误
+	done := make(chan error, 1)
+	go func() { done <- client.Call(ctx, "Hold.Wait", 0, new(int)) }()
+	for atomic.LoadInt32(&hold.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	restart()
+	_assert(<-done != nil, "expect the pending call to fail")
+	_ = client.Close()
+	err = client.Call(ctx, "Foo.Sum", Args{}, &reply)
+	_assert(errors.Is(err, ErrShutdown), "expect ErrShutdown after Close, got %v", err)
+
+	// Resend 时在新连接上重发
+	atomic.StoreInt32(&hold.calls, 0)
+	client, _ = NewReconnectClient("tcp@"+l.Addr().String(), &ReconnectPolicy{MinBackoff: 10 * time.Millisecond, Resend: true})
+	defer func() { _ = client.Close() }()
+	go func() { done <- client.Call(ctx, "Hold.Wait", 0, &reply) }()
+	for atomic.LoadInt32(&hold.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	restart()
+	_assert(<-done == nil && reply == 2, "expect the call resent, got %d", reply)
+
+	// 服务端一直不可用时，一轮重连在 MaxAttempts 次后放弃
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = dead.Close()
+	client, _ = NewReconnectClient("tcp@"+dead.Addr().String(), &ReconnectPolicy{MinBackoff: time.Millisecond, MaxAttempts: 3})
+	defer func() { _ = client.Close() }()
+	err = client.Call(ctx, "Foo.Sum", Args{}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "after 3 attempts"), "expect to give up, got %v", err)
+}
+
+// Blocker 的方法阻塞到 ctx 结束，把 ctx 的错误发到 canceled
+type Blocker struct {
+	started  chan struct{}
+	canceled chan error
+}
+
+func (b *Blocker) Block(ctx context.Context, args int, reply *int) error {
+	b.started <- struct{}{}
+	<-ctx.Done()
+	b.canceled <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestClient_CancelPropagation(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	b := &Blocker{started: make(chan struct{}, 1), canceled: make(chan error, 1)}
+	_ = server.Register(b)
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{NegotiateCapabilities: true})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	caps, _ := client.Capabilities()
+	_assert(caps.CancelRequests, "expect the server to advertise CancelRequests")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- client.Call(ctx, "Blocker.Block", 0, new(int)) }()
+	<-b.started
+	cancel()
+	_assert(<-done != nil, "expect the call to fail after cancel")
+	select {
+	case err := <-b.canceled:
+		_assert(errors.Is(err, context.Canceled), "expect the handler ctx canceled, got %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expect the server to cancel the handler")
+	}
+	// 被取消的请求的响应被丢弃，连接仍然可用
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect the connection still works, got %d, %v", reply, err)
+
+	// 没有协商能力时不发送取消消息，老的服务端会为它再回一个响应
+	plain, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = plain.Close() }()
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { done <- plain.Call(ctx, "Blocker.Block", 0, new(int)) }()
+	<-b.started
+	cancel()
+	_assert(<-done != nil, "expect the call to fail after cancel")
+	select {
+	case err := <-b.canceled:
+		t.Fatalf("expect no cancel message without capabilities, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestClient_StrictCanceled(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var timing Timing
+	_ = server.Register(&timing)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	for _, mode := range []StrictMode{StrictOff, StrictLog} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{Strict: mode})
+		_assert(err == nil, "failed to dial: %v", err)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err = client.Call(ctx, "Timing.Sleep", 100, new(int))
+		cancel()
+		_assert(err != nil, "expect the call to time out")
+
+		// 取消的请求之后才返回的响应不算协议异常
+		time.Sleep(150 * time.Millisecond)
+		_assert(client.Stats().ProtocolErrors == 0, "mode %d: expect the late response expected, got %d errors", mode, client.Stats().ProtocolErrors)
+		_ = client.Close()
+	}
+}
@@ -0,0 +1,164 @@
+// callfix 把老的 Client.Call(ctx, serviceMethod, args, reply, buffSize) 调用改写成新的签名
+//
+//	go run ./cmd/callfix ./...        列出需要改写的文件
+//	go run ./cmd/callfix -w ./...     直接改写
+//
+// 没有类型信息，按调用的形状判断：
+//   - x.CallLegacy(ctx, m, args, reply, n) 改写为 x.Call(ctx, m, args, reply)
+//   - x.Call(ctx, m, args, reply, 10) 第五个参数是整数字面量时去掉它
+//   - x.Call 的第五个参数是 callopt.WithXxx(...) 或 WithXxx(...) 时已经是新的签名
+//   - x.Call 的第五个参数是其他表达式时，可能是 buffSize 变量也可能是新的 CallOption，只输出位置，需要人工确认
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	write := flag.Bool("w", false, "write the result to the source files instead of listing them")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatal("usage: callfix [-w] path ...")
+	}
+	var files []string
+	for _, arg := range flag.Args() {
+		fs, err := goFiles(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		files = append(files, fs...)
+	}
+	for _, path := range files {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		out, changed, warnings, err := rewrite(path, src)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, w := range warnings {
+			fmt.Fprintln(os.Stderr, w)
+		}
+		if !changed {
+			continue
+		}
+		if !*write {
+			fmt.Println(path)
+			continue
+		}
+		if err := os.WriteFile(path, out, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// goFiles 展开参数：文件、目录，或者以 /... 结尾的递归目录
+func goFiles(arg string) ([]string, error) {
+	recursive := strings.HasSuffix(arg, "/...")
+	root := strings.TrimSuffix(arg, "/...")
+	if root == "" || root == "." && recursive {
+		root = "."
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{root}, nil
+	}
+	var files []string
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			name := info.Name()
+			if path != root && (!recursive || name == "vendor" || name == "testdata" ||
+				strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ".go") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// rewrite 改写一个文件，返回改写后的源码、是否有改动以及需要人工确认的位置
+func rewrite(path string, src []byte) ([]byte, bool, []string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	changed := false
+	var warnings []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 5 || call.Ellipsis.IsValid() {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		switch sel.Sel.Name {
+		case "CallLegacy":
+		case "Call":
+			if isCallOption(call.Args[4]) {
+				return true
+			}
+			if lit, ok := call.Args[4].(*ast.BasicLit); !ok || lit.Kind != token.INT {
+				warnings = append(warnings, fmt.Sprintf("%s: check the fifth argument of Call, it may be the removed buffSize",
+					fset.Position(call.Pos())))
+				return true
+			}
+		default:
+			return true
+		}
+		sel.Sel.Name = "Call"
+		call.Args = call.Args[:4]
+		changed = true
+		return true
+	})
+	if !changed {
+		return src, false, warnings, nil
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		return nil, false, nil, err
+	}
+	return buf.Bytes(), true, warnings, nil
+}
+
+// isCallOption 判断表达式是否是 callopt.WithXxx(...) 或 WithXxx(...) 这样构造 CallOption 的调用
+func isCallOption(e ast.Expr) bool {
+	call, ok := e.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	switch fun := call.Fun.(type) {
+	case *ast.SelectorExpr:
+		if pkg, ok := fun.X.(*ast.Ident); ok && pkg.Name == "callopt" {
+			return true
+		}
+		return strings.HasPrefix(fun.Sel.Name, "With")
+	case *ast.Ident:
+		return strings.HasPrefix(fun.Name, "With")
+	}
+	return false
+}
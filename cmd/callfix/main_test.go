@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	src := `package p
+
+func f() {
+	_ = client.Call(ctx, "Foo.Sum", args, &reply, 10)
+	_ = client.CallLegacy(ctx, "Foo.Sum", args, &reply, n)
+	_ = client.Call(ctx, "Foo.Sum", args, &reply, callopt.WithTimeout(d))
+	_ = client.Call(ctx, "Foo.Sum", args, &reply, size)
+	_ = client.Call(ctx, "Foo.Sum", args, &reply)
+}
+`
+	out, changed, warnings, err := rewrite("p.go", []byte(src))
+	if err != nil || !changed {
+		t.Fatalf("expect the file to be rewritten: %v", err)
+	}
+	got := string(out)
+	if strings.Count(got, `client.Call(ctx, "Foo.Sum", args, &reply)`) != 3 || strings.Contains(got, "CallLegacy") {
+		t.Fatalf("unexpected rewrite:\n%s", got)
+	}
+	if !strings.Contains(got, "callopt.WithTimeout(d)") {
+		t.Fatalf("expect the call option kept:\n%s", got)
+	}
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "p.go:7:") {
+		t.Fatalf("expect a warning for the ambiguous call, got %v", warnings)
+	}
+}
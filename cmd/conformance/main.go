@@ -0,0 +1,40 @@
+// conformance 启动协议一致性测试的服务端，供其他语言实现的客户端测试
+//
+//	go run ./cmd/conformance -addr :9999          启动服务端
+//	go run ./cmd/conformance -cases > cases.json  输出用例
+package main
+
+import (
+	"MyRPC"
+	"MyRPC/conformance"
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"os"
+)
+
+func main() {
+	addr := flag.String("addr", ":9999", "listen address")
+	cases := flag.Bool("cases", false, "print the cases as Json and exit")
+	flag.Parse()
+
+	if *cases {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(conformance.Cases()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := MyRPC.NewServer()
+	if err := conformance.Register(server); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("conformance server listening on %s", l.Addr())
+	server.Accept(l)
+}
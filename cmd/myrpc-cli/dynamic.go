@@ -0,0 +1,77 @@
+package main
+
+import (
+	"MyRPC"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// basicTypes 按 reflect.Kind 的名字对应的基本类型
+var basicTypes = map[string]reflect.Type{}
+
+func init() {
+	for _, v := range []interface{}{
+		false, "", int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0), uintptr(0),
+		float32(0), float64(0), complex64(0), complex128(0),
+	} {
+		t := reflect.TypeOf(v)
+		basicTypes[t.Kind().String()] = t
+	}
+}
+
+// dynamicType 按 _meta 返回的类型描述构造一个结构相同的类型。
+// Gob 按字段名和结构匹配类型，不关心类型名，所以构造出来的类型可以和服务端的类型互相编解码；
+// 字段带上 Json 标签，命令行输入的 Json 按服务端类型的 Json 名字解码
+func dynamicType(info *MyRPC.TypeInfo) (reflect.Type, error) {
+	if t, ok := basicTypes[info.Kind]; ok {
+		return t, nil
+	}
+	switch info.Kind {
+	case "ptr", "slice", "array", "map":
+		if info.Elem == nil {
+			return nil, fmt.Errorf("%s without element type", info.Kind)
+		}
+		elem, err := dynamicType(info.Elem)
+		if err != nil {
+			return nil, err
+		}
+		switch info.Kind {
+		case "ptr":
+			return reflect.PtrTo(elem), nil
+		case "slice":
+			return reflect.SliceOf(elem), nil
+		case "array":
+			return reflect.ArrayOf(info.Len, elem), nil
+		}
+		if info.Key == nil {
+			return nil, fmt.Errorf("map without key type")
+		}
+		key, err := dynamicType(info.Key)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.MapOf(key, elem), nil
+	case "struct":
+		// time.Time 没有导出字段，用自己的 GobEncoder 编码
+		if info.Name == "time.Time" {
+			return reflect.TypeOf(time.Time{}), nil
+		}
+		fields := make([]reflect.StructField, 0, len(info.Fields))
+		for _, f := range info.Fields {
+			t, err := dynamicType(f.Type)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", f.Name, err)
+			}
+			field := reflect.StructField{Name: f.Name, Type: t}
+			if f.GoName != "" {
+				field.Name = f.GoName
+				field.Tag = reflect.StructTag(fmt.Sprintf("json:%q", f.Name))
+			}
+			fields = append(fields, field)
+		}
+		return reflect.StructOf(fields), nil
+	}
+	return nil, fmt.Errorf("unsupported type %s (%s), use -codec json", info.Name, info.Kind)
+}
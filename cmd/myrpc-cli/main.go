@@ -0,0 +1,251 @@
+// myrpc-cli 在命令行调用任意 MyRPC 服务端，排查线上问题时不需要写 Go 代码
+//
+//	myrpc-cli call tcp@127.0.0.1:9999 Foo.Sum '{"Num1":1,"Num2":2}'
+//	myrpc-cli call -codec gob -timeout 3s tcp@127.0.0.1:9999 Foo.Sum '{"Num1":1,"Num2":2}'
+//	myrpc-cli call -registry http://127.0.0.1:9999/_geerpc_/registry -broadcast Foo.Sum '{"Num1":1,"Num2":2}'
+//	myrpc-cli list tcp@127.0.0.1:9999            列出服务
+//	myrpc-cli list tcp@127.0.0.1:9999 Foo        列出服务的方法和说明
+//	myrpc-cli describe tcp@127.0.0.1:9999 Foo.Sum
+//
+// 地址可以是逗号分隔的多个 rpcAddr，指定 -registry 时从注册中心获取服务实例，不再需要地址参数。
+// 参数和返回值都是 Json，参数为 - 时从标准输入读取，省略时为 {}。
+// Json 编码时参数原样发给服务端；Gob 和 Compact 编码时先通过服务端内置的 _meta 服务查询方法签名，
+// 按签名构造参数和返回值的类型，再把 Json 解码到参数中
+package main
+
+import (
+	"MyRPC"
+	"MyRPC/codec"
+	"MyRPC/xclient"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const usage = `usage:
+  myrpc-cli call [flags] [addr] Service.Method [args]
+  myrpc-cli list [flags] [addr] [Service]
+  myrpc-cli describe [flags] [addr] Service.Method
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// codecs -codec 的取值
+var codecs = map[string]codec.Type{
+	"json":    codec.JsonType,
+	"gob":     codec.GobType,
+	"compact": codec.CompactType,
+}
+
+// config 命令行参数
+type config struct {
+	codec     codec.Type
+	timeout   time.Duration
+	registry  string
+	broadcast bool
+	token     string
+	args      []string // 去掉 flag 和地址之后的位置参数
+	servers   []string
+}
+
+func parse(cmd string, argv []string) (*config, error) {
+	fs := flag.NewFlagSet("myrpc-cli "+cmd, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	codecName := fs.String("codec", "json", "codec: json, gob or compact")
+	timeout := fs.Duration("timeout", 5*time.Second, "timeout of the whole command, including connecting")
+	registry := fs.String("registry", "", "discover servers from the registry at this URL instead of an address")
+	broadcast := fs.Bool("broadcast", false, "call every server and print each result")
+	token := fs.String("token", "", "authentication token sent in the handshake")
+	if err := fs.Parse(argv); err != nil {
+		return nil, err
+	}
+	cfg := &config{timeout: *timeout, registry: *registry, broadcast: *broadcast, token: *token, args: fs.Args()}
+	var ok bool
+	if cfg.codec, ok = codecs[*codecName]; !ok {
+		return nil, fmt.Errorf("unknown codec %q", *codecName)
+	}
+	if cfg.registry == "" {
+		if len(cfg.args) == 0 {
+			return nil, errors.New("missing server address")
+		}
+		cfg.servers = strings.Split(cfg.args[0], ",")
+		cfg.args = cfg.args[1:]
+	}
+	return cfg, nil
+}
+
+// client 按参数创建 XClient，单个地址也通过 XClient 调用，和广播共用一套逻辑
+func (cfg *config) client() *xclient.XClient {
+	var d xclient.Discovery
+	if cfg.registry != "" {
+		d = xclient.NewMyRegistryDiscovery(cfg.registry, cfg.timeout)
+	} else {
+		d = xclient.NewMultiServerDiscovery(cfg.servers)
+	}
+	return xclient.NewXClient(d, xclient.RandomSelect, &MyRPC.Option{
+		CodecType:      cfg.codec,
+		ConnectTimeout: cfg.timeout,
+		Token:          cfg.token,
+		HandshakeAck:   cfg.token != "",
+	})
+}
+
+func run(argv []string, stdin io.Reader, stdout io.Writer) error {
+	if len(argv) == 0 {
+		return errors.New(usage)
+	}
+	cmd := argv[0]
+	switch cmd {
+	case "call", "list", "describe":
+	default:
+		return fmt.Errorf("unknown command %q\n%s", cmd, usage)
+	}
+	cfg, err := parse(cmd, argv[1:])
+	if err != nil {
+		return fmt.Errorf("%v\n%s", err, usage)
+	}
+	xc := cfg.client()
+	defer func() { _ = xc.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+	defer cancel()
+
+	switch cmd {
+	case "call":
+		if len(cfg.args) == 0 || len(cfg.args) > 2 {
+			return errors.New(usage)
+		}
+		input := "{}"
+		if len(cfg.args) == 2 {
+			input = cfg.args[1]
+		}
+		if input == "-" {
+			b, err := io.ReadAll(stdin)
+			if err != nil {
+				return err
+			}
+			input = string(b)
+		}
+		return call(ctx, xc, cfg, cfg.args[0], []byte(input), stdout)
+	case "list":
+		var names []string
+		var err error
+		switch len(cfg.args) {
+		case 0:
+			err = xc.Call(ctx, MyRPC.MetaServiceName+".ListServices", MyRPC.MetaArgs{}, &names)
+		case 1:
+			err = xc.Call(ctx, MyRPC.MetaServiceName+".ListMethods", MyRPC.MetaArgs{Service: cfg.args[0]}, &names)
+		default:
+			return errors.New(usage)
+		}
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if len(cfg.args) == 0 {
+				fmt.Fprintln(stdout, name)
+				continue
+			}
+			// 列出方法时附上服务提供的说明
+			sig, err := signature(ctx, xc, cfg.args[0]+"."+name)
+			if err != nil {
+				return err
+			}
+			if sig.Description == "" {
+				fmt.Fprintln(stdout, name)
+			} else {
+				fmt.Fprintf(stdout, "%s\t%s\n", name, sig.Description)
+			}
+		}
+		return nil
+	default: // describe
+		if len(cfg.args) != 1 {
+			return errors.New(usage)
+		}
+		sig, err := signature(ctx, xc, cfg.args[0])
+		if err != nil {
+			return err
+		}
+		return printJSON(stdout, sig)
+	}
+}
+
+// signature 通过 _meta 服务查询方法签名
+func signature(ctx context.Context, xc *xclient.XClient, serviceMethod string) (*MyRPC.MethodSignature, error) {
+	dot := strings.LastIndex(serviceMethod, ".")
+	if dot < 0 {
+		return nil, fmt.Errorf("invalid method %q, expect Service.Method", serviceMethod)
+	}
+	var sig MyRPC.MethodSignature
+	args := MyRPC.MetaArgs{Service: serviceMethod[:dot], Method: serviceMethod[dot+1:]}
+	if err := xc.Call(ctx, MyRPC.MetaServiceName+".MethodSignature", args, &sig); err != nil {
+		return nil, err
+	}
+	return &sig, nil
+}
+
+// call 调用 serviceMethod 并输出结果，广播时每个实例输出一行
+func call(ctx context.Context, xc *xclient.XClient, cfg *config, serviceMethod string, input []byte, stdout io.Writer) error {
+	var args, reply interface{}
+	if cfg.codec == codec.JsonType {
+		if !json.Valid(input) {
+			return errors.New("args is not valid Json")
+		}
+		args, reply = json.RawMessage(input), new(json.RawMessage)
+	} else {
+		sig, err := signature(ctx, xc, serviceMethod)
+		if err != nil {
+			return err
+		}
+		argType, err := dynamicType(sig.Args)
+		if err != nil {
+			return fmt.Errorf("args: %v", err)
+		}
+		replyType, err := dynamicType(sig.Reply)
+		if err != nil {
+			return fmt.Errorf("reply: %v", err)
+		}
+		argv := reflect.New(argType)
+		if err := json.Unmarshal(input, argv.Interface()); err != nil {
+			return fmt.Errorf("args: %v", err)
+		}
+		args, reply = argv.Interface(), reflect.New(replyType).Interface()
+	}
+
+	if !cfg.broadcast {
+		if err := xc.Call(ctx, serviceMethod, args, reply); err != nil {
+			return err
+		}
+		return printJSON(stdout, reply)
+	}
+	results, err := xc.BroadcastAll(ctx, serviceMethod, args, reply, xclient.ContinueOnError())
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(stdout, "%s\t%v\terror: %v\n", r.Server, r.Latency, r.Err)
+			continue
+		}
+		b, _ := json.Marshal(r.Reply)
+		fmt.Fprintf(stdout, "%s\t%v\t%s\n", r.Server, r.Latency, b)
+	}
+	return err
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"MyRPC"
+	"MyRPC/registry"
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Arith int
+
+type Args struct {
+	A     int `json:"a"`
+	B     int
+	Scale [2]float64
+}
+
+type Result struct {
+	Sum    int
+	Scaled []float64 `json:"scaled"`
+	From   int
+}
+
+func (a Arith) Add(args Args, reply *Result) error {
+	reply.Sum = args.A + args.B
+	for _, s := range args.Scale {
+		reply.Scaled = append(reply.Scaled, s*float64(reply.Sum))
+	}
+	reply.From = int(a)
+	return nil
+}
+
+func (a Arith) DescribeMethods() map[string]MyRPC.MethodDoc {
+	return map[string]MyRPC.MethodDoc{
+		"Add": {Description: "adds A and B", Example: Args{A: 1, B: 2}},
+	}
+}
+
+func startServer(t *testing.T, a Arith) (*MyRPC.Server, string) {
+	server := MyRPC.NewServer()
+	if err := server.Register(a); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go server.Accept(l)
+	return server, "tcp@" + l.Addr().String()
+}
+
+func runCLI(t *testing.T, stdin string, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := run(args, strings.NewReader(stdin), &out)
+	return out.String(), err
+}
+
+func TestCall(t *testing.T) {
+	_, addr := startServer(t, 1)
+	for _, c := range []string{"json", "gob", "compact"} {
+		out, err := runCLI(t, "", "call", "-codec", c, addr, "Arith.Add", `{"a":1,"B":2,"Scale":[1,0.5]}`)
+		if err != nil {
+			t.Fatalf("%s: %v", c, err)
+		}
+		if !strings.Contains(out, `"Sum": 3`) || !strings.Contains(out, `"scaled": [`) || !strings.Contains(out, "1.5") {
+			t.Fatalf("%s: unexpected output %s", c, out)
+		}
+	}
+	out, err := runCLI(t, `{"a":2}`, "call", addr, "Arith.Add", "-")
+	if err != nil || !strings.Contains(out, `"Sum": 2`) {
+		t.Fatalf("expect args from stdin, got %s, %v", out, err)
+	}
+	if _, err := runCLI(t, "", "call", "-codec", "gob", addr, "Arith.Sub", "{}"); err == nil || !strings.Contains(err.Error(), "can't find method") {
+		t.Fatalf("expect unknown method, got %v", err)
+	}
+	if _, err := runCLI(t, "", "call", addr, "Arith.Add", "{"); err == nil {
+		t.Fatal("expect invalid Json args to fail")
+	}
+	if _, err := runCLI(t, "", "call", "-codec", "xml", addr, "Arith.Add"); err == nil {
+		t.Fatal("expect unknown codec to fail")
+	}
+}
+
+func TestListAndDescribe(t *testing.T) {
+	_, addr := startServer(t, 1)
+	out, err := runCLI(t, "", "list", addr)
+	if err != nil || out != "Arith\n" {
+		t.Fatalf("unexpected services %q, %v", out, err)
+	}
+	out, err = runCLI(t, "", "list", "-codec", "gob", addr, "Arith")
+	if err != nil || out != "Add\tadds A and B\n" {
+		t.Fatalf("unexpected methods %q, %v", out, err)
+	}
+	out, err = runCLI(t, "", "describe", addr, "Arith.Add")
+	if err != nil || !strings.Contains(out, `"Name": "main.Args"`) || !strings.Contains(out, `"GoName": "A"`) ||
+		!strings.Contains(out, `"Description": "adds A and B"`) || !strings.Contains(out, `"Example": {`) {
+		t.Fatalf("unexpected signature %s, %v", out, err)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	r := registry.New(time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	s1, addr1 := startServer(t, 1)
+	s2, addr2 := startServer(t, 2)
+	s1.Heartbeat(ts.URL, addr1, time.Minute)
+	s2.Heartbeat(ts.URL, addr2, time.Minute)
+
+	for _, target := range [][]string{{addr1 + "," + addr2}, {"-registry", ts.URL}} {
+		args := append(append([]string{"call", "-broadcast"}, target...), "Arith.Add", `{"a":1}`)
+		out, err := runCLI(t, "", args...)
+		if err != nil {
+			t.Fatalf("%v: %v", target, err)
+		}
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		if len(lines) != 2 || !strings.Contains(out, `"From":1`) || !strings.Contains(out, `"From":2`) {
+			t.Fatalf("%v: expect a result from each server, got %s", target, out)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+// 插件用到的 descriptor.proto 和 plugin.proto 中的字段，字段编号见注释
+
+// request CodeGeneratorRequest
+type request struct {
+	FileToGenerate []string     // 1
+	Parameter      string       // 2
+	ProtoFiles     []*protoFile // 15
+}
+
+// protoFile FileDescriptorProto
+type protoFile struct {
+	Name      string     // 1
+	Package   string     // 2
+	Messages  []*message // 4
+	Services  []*service // 6
+	GoPackage string     // 8 options 中的 11 go_package
+}
+
+// message DescriptorProto
+type message struct {
+	Name   string     // 1
+	Nested []*message // 3
+}
+
+// service ServiceDescriptorProto
+type service struct {
+	Name    string    // 1
+	Methods []*method // 2
+}
+
+// method MethodDescriptorProto
+type method struct {
+	Name            string // 1
+	InputType       string // 2 完整的消息名，以 . 开头
+	OutputType      string // 3
+	ClientStreaming bool   // 5
+	ServerStreaming bool   // 6
+}
+
+func decodeRequest(b []byte) (*request, error) {
+	req := new(request)
+	err := walk(b, func(num int, data []byte, v uint64) error {
+		switch num {
+		case 1:
+			req.FileToGenerate = append(req.FileToGenerate, string(data))
+		case 2:
+			req.Parameter = string(data)
+		case 15:
+			f, err := decodeFile(data)
+			if err != nil {
+				return err
+			}
+			req.ProtoFiles = append(req.ProtoFiles, f)
+		}
+		return nil
+	})
+	return req, err
+}
+
+func decodeFile(b []byte) (*protoFile, error) {
+	f := new(protoFile)
+	err := walk(b, func(num int, data []byte, v uint64) error {
+		switch num {
+		case 1:
+			f.Name = string(data)
+		case 2:
+			f.Package = string(data)
+		case 4:
+			m, err := decodeMessage(data)
+			if err != nil {
+				return err
+			}
+			f.Messages = append(f.Messages, m)
+		case 6:
+			s, err := decodeService(data)
+			if err != nil {
+				return err
+			}
+			f.Services = append(f.Services, s)
+		case 8:
+			return walk(data, func(num int, data []byte, v uint64) error {
+				if num == 11 {
+					f.GoPackage = string(data)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return f, err
+}
+
+func decodeMessage(b []byte) (*message, error) {
+	m := new(message)
+	err := walk(b, func(num int, data []byte, v uint64) error {
+		switch num {
+		case 1:
+			m.Name = string(data)
+		case 3:
+			nested, err := decodeMessage(data)
+			if err != nil {
+				return err
+			}
+			m.Nested = append(m.Nested, nested)
+		}
+		return nil
+	})
+	return m, err
+}
+
+func decodeService(b []byte) (*service, error) {
+	s := new(service)
+	err := walk(b, func(num int, data []byte, v uint64) error {
+		switch num {
+		case 1:
+			s.Name = string(data)
+		case 2:
+			m := new(method)
+			err := walk(data, func(num int, data []byte, v uint64) error {
+				switch num {
+				case 1:
+					m.Name = string(data)
+				case 2:
+					m.InputType = string(data)
+				case 3:
+					m.OutputType = string(data)
+				case 5:
+					m.ClientStreaming = v != 0
+				case 6:
+					m.ServerStreaming = v != 0
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			s.Methods = append(s.Methods, m)
+		}
+		return nil
+	})
+	return s, err
+}
+
+// generatedFile CodeGeneratorResponse.File
+type generatedFile struct {
+	Name    string // 1
+	Content string // 15
+}
+
+// 声明支持 proto3 的 optional 字段，插件不关心字段，可以直接声明
+const featureProto3Optional = 1
+
+// encodeResponse 编码 CodeGeneratorResponse，genErr 不为 nil 时只返回错误
+func encodeResponse(files []generatedFile, genErr error) []byte {
+	var b []byte
+	if genErr != nil {
+		return appendString(b, 1, genErr.Error())
+	}
+	b = appendVarint(b, 2, featureProto3Optional)
+	for _, f := range files {
+		var fb []byte
+		fb = appendString(fb, 1, f.Name)
+		fb = appendString(fb, 15, f.Content)
+		b = appendBytes(b, 15, fb)
+	}
+	return b
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// goPackage 一个 .proto 文件对应的 Go 包
+type goPackage struct {
+	importPath string // 为空时表示和生成的文件在同一个包
+	name       string
+}
+
+// packageOf 根据 go_package 选项确定 Go 包，没有该选项时用 proto 的包名
+func packageOf(f *protoFile) goPackage {
+	if f.GoPackage != "" {
+		importPath, name := f.GoPackage, ""
+		if i := strings.Index(f.GoPackage, ";"); i >= 0 {
+			importPath, name = f.GoPackage[:i], f.GoPackage[i+1:]
+		}
+		if name == "" {
+			name = path.Base(importPath)
+		}
+		return goPackage{importPath: importPath, name: sanitize(name)}
+	}
+	if f.Package != "" {
+		return goPackage{name: sanitize(f.Package)}
+	}
+	return goPackage{name: sanitize(strings.TrimSuffix(path.Base(f.Name), ".proto"))}
+}
+
+func sanitize(name string) string {
+	return strings.NewReplacer(".", "_", "-", "_", "/", "_").Replace(name)
+}
+
+// goType 一个消息对应的 Go 类型
+type goType struct {
+	pkg   goPackage
+	name  string
+	proto string // 消息所在的 proto 包，没有 go_package 时只有同一个 proto 包的消息在同一个 Go 包中
+}
+
+// messageTypes 收集所有文件中的消息，键是以 . 开头的完整消息名，嵌套消息的 Go 类型名用 _ 连接
+func messageTypes(files []*protoFile) map[string]goType {
+	types := make(map[string]goType)
+	var add func(f *protoFile, prefix, goPrefix string, msgs []*message)
+	add = func(f *protoFile, prefix, goPrefix string, msgs []*message) {
+		for _, m := range msgs {
+			full, goName := prefix+"."+m.Name, goPrefix+m.Name
+			types[full] = goType{pkg: packageOf(f), name: goName, proto: f.Package}
+			add(f, full, goName+"_", m.Nested)
+		}
+	}
+	for _, f := range files {
+		prefix := ""
+		if f.Package != "" {
+			prefix = "." + f.Package
+		}
+		add(f, prefix, "", f.Messages)
+	}
+	return types
+}
+
+// imports 生成文件中引用其他 Go 包的别名
+type imports struct {
+	self    goPackage
+	proto   string
+	aliases map[string]string // importPath -> alias
+	used    map[string]bool
+}
+
+// qualify 返回在生成的文件中引用 t 的写法
+func (im *imports) qualify(t goType) string {
+	if t.pkg.importPath == im.self.importPath && (t.pkg.importPath != "" || t.proto == im.proto) {
+		return t.name
+	}
+	if t.pkg.importPath == "" {
+		// 没有 go_package 的其他 proto 包无法确定导入路径
+		return t.name
+	}
+	alias, ok := im.aliases[t.pkg.importPath]
+	if !ok {
+		alias = t.pkg.name
+		for i := 1; im.used[alias] || alias == im.self.name; i++ {
+			alias = fmt.Sprintf("%s%d", t.pkg.name, i)
+		}
+		im.aliases[t.pkg.importPath] = alias
+		im.used[alias] = true
+	}
+	return alias + "." + t.name
+}
+
+type methodData struct {
+	Name, Input, Output string
+}
+
+type serviceData struct {
+	Name    string
+	Methods []methodData
+	Skipped []string // 流式方法
+}
+
+type fileData struct {
+	Source   string
+	Package  string
+	Imports  [][2]string // alias, path
+	Services []serviceData
+}
+
+// generate 为 files 中要生成的文件生成代码，sourceRelative 为 true 时输出到 .proto 文件所在的目录
+func generate(req *request) ([]generatedFile, error) {
+	sourceRelative := true
+	for _, p := range strings.Split(req.Parameter, ",") {
+		switch strings.TrimSpace(p) {
+		case "", "paths=source_relative":
+		case "paths=import":
+			sourceRelative = false
+		default:
+			return nil, fmt.Errorf("protoc-gen-myrpc: unknown parameter %q", p)
+		}
+	}
+	byName := make(map[string]*protoFile, len(req.ProtoFiles))
+	for _, f := range req.ProtoFiles {
+		byName[f.Name] = f
+	}
+	types := messageTypes(req.ProtoFiles)
+	var out []generatedFile
+	for _, name := range req.FileToGenerate {
+		f := byName[name]
+		if f == nil {
+			return nil, fmt.Errorf("protoc-gen-myrpc: %s not found in the request", name)
+		}
+		if len(f.Services) == 0 {
+			continue
+		}
+		content, err := generateFile(f, types)
+		if err != nil {
+			return nil, err
+		}
+		base := strings.TrimSuffix(f.Name, ".proto") + ".myrpc.go"
+		if !sourceRelative && f.GoPackage != "" {
+			base = path.Join(packageOf(f).importPath, path.Base(base))
+		}
+		out = append(out, generatedFile{Name: base, Content: content})
+	}
+	return out, nil
+}
+
+func generateFile(f *protoFile, types map[string]goType) (string, error) {
+	self := packageOf(f)
+	im := &imports{self: self, proto: f.Package, aliases: map[string]string{},
+		used: map[string]bool{"MyRPC": true, "context": true}}
+	data := fileData{Source: f.Name, Package: self.name}
+	for _, s := range f.Services {
+		sd := serviceData{Name: s.Name}
+		for _, m := range s.Methods {
+			if m.ClientStreaming || m.ServerStreaming {
+				sd.Skipped = append(sd.Skipped, m.Name)
+				continue
+			}
+			in, ok := types[m.InputType]
+			if !ok {
+				return "", fmt.Errorf("protoc-gen-myrpc: unknown message %s in %s.%s", m.InputType, s.Name, m.Name)
+			}
+			out, ok := types[m.OutputType]
+			if !ok {
+				return "", fmt.Errorf("protoc-gen-myrpc: unknown message %s in %s.%s", m.OutputType, s.Name, m.Name)
+			}
+			sd.Methods = append(sd.Methods, methodData{Name: m.Name, Input: im.qualify(in), Output: im.qualify(out)})
+		}
+		data.Services = append(data.Services, sd)
+	}
+	for p, alias := range im.aliases {
+		data.Imports = append(data.Imports, [2]string{alias, p})
+	}
+	sort.Slice(data.Imports, func(i, j int) bool { return data.Imports[i][1] < data.Imports[j][1] })
+
+	var buf bytes.Buffer
+	if err := fileTemplate.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("protoc-gen-myrpc: format %s: %v", f.Name, err)
+	}
+	return string(src), nil
+}
+
+var fileTemplate = template.Must(template.New("file").Parse(`// Code generated by protoc-gen-myrpc. DO NOT EDIT.
+// source: {{.Source}}
+
+package {{.Package}}
+
+import (
+	"MyRPC"
+	"context"
+{{- range .Imports}}
+	{{index . 0}} "{{index . 1}}"
+{{- end}}
+)
+{{range .Services}}{{$svc := .}}
+// {{.Name}}ServiceName {{.Name}} 在 MyRPC 中的服务名
+const {{.Name}}ServiceName = "{{.Name}}"
+
+// {{.Name}}Server {{.Name}} 服务端需要实现的接口
+type {{.Name}}Server interface {
+{{- range .Methods}}
+	{{.Name}}(ctx context.Context, req *{{.Input}}) (*{{.Output}}, error)
+{{- end}}
+}
+{{- range .Skipped}}
+
+// 流式方法 {{.}} 不支持，没有生成
+{{- end}}
+
+// {{.Name}}Service 把 {{.Name}}Server 适配成 MyRPC 的服务方法
+type {{.Name}}Service struct {
+	impl {{.Name}}Server
+}
+
+// Register{{.Name}}Server 以 {{.Name}}ServiceName 把 impl 注册到 server
+func Register{{.Name}}Server(server *MyRPC.Server, impl {{.Name}}Server) error {
+	return server.RegisterName({{.Name}}ServiceName, &{{.Name}}Service{impl: impl})
+}
+{{range .Methods}}
+func (s *{{$svc.Name}}Service) {{.Name}}(ctx context.Context, req *{{.Input}}, reply **{{.Output}}) error {
+	resp, err := s.impl.{{.Name}}(ctx, req)
+	if err != nil {
+		return err
+	}
+	if resp == nil {
+		resp = new({{.Output}})
+	}
+	*reply = resp
+	return nil
+}
+{{end}}
+// {{.Name}}Client {{.Name}} 的客户端，c 可以是 *MyRPC.Client、*xclient.XClient 等任意 MyRPC.Caller
+type {{.Name}}Client struct {
+	c MyRPC.Caller
+}
+
+// New{{.Name}}Client 创建 {{.Name}} 的客户端
+func New{{.Name}}Client(c MyRPC.Caller) *{{.Name}}Client {
+	return &{{.Name}}Client{c: c}
+}
+{{range .Methods}}
+func (c *{{$svc.Name}}Client) {{.Name}}(ctx context.Context, req *{{.Input}}, opts ...MyRPC.CallOption) (*{{.Output}}, error) {
+	reply := new({{.Output}})
+	if err := c.c.Call(ctx, {{$svc.Name}}ServiceName+".{{.Name}}", req, reply, opts...); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+{{end}}{{end}}`))
@@ -0,0 +1,31 @@
+// protoc-gen-myrpc 是 protoc 的插件，根据 .proto 中的服务定义生成 MyRPC 的服务端骨架和客户端桩代码，
+// 消息类型仍然由 protoc-gen-go 生成，两者输出到同一个包：
+//
+//	go install MyRPC/cmd/protoc-gen-myrpc
+//	protoc --go_out=. --go_opt=paths=source_relative --myrpc_out=. --myrpc_opt=paths=source_relative helloworld.proto
+//
+// 服务以 proto 中的服务名注册，MyRPC 的服务名不能带 .，所以不包括 proto 的包名：helloworld.Greeter 的方法是 Greeter.SayHello，
+// 其他语言的客户端按同样的名字调用，同一个服务端上不同 proto 包的同名服务会冲突。消息体按连接协商的编码方式编码，跨语言时建议使用 JsonType。
+// 流式方法暂不支持，生成时跳过
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+)
+
+func main() {
+	in, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req, err := decodeRequest(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	files, err := generate(req)
+	if _, err := os.Stdout.Write(encodeResponse(files, err)); err != nil {
+		log.Fatal(err)
+	}
+}
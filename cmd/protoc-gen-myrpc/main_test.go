@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testRequest 构造 helloworld.proto 的 CodeGeneratorRequest，它引用了另一个文件中的 common.Empty
+func testRequest() []byte {
+	method := func(name, in, out string, streaming bool) []byte {
+		var b []byte
+		b = appendString(b, 1, name)
+		b = appendString(b, 2, in)
+		b = appendString(b, 3, out)
+		if streaming {
+			b = appendVarint(b, 6, 1)
+		}
+		return b
+	}
+	var svc []byte
+	svc = appendString(svc, 1, "Greeter")
+	svc = appendBytes(svc, 2, method("SayHello", ".helloworld.HelloRequest", ".helloworld.HelloReply", false))
+	svc = appendBytes(svc, 2, method("Ping", ".common.Empty", ".helloworld.HelloReply.Status", false))
+	svc = appendBytes(svc, 2, method("Watch", ".helloworld.HelloRequest", ".helloworld.HelloReply", true))
+
+	var hello []byte
+	hello = appendString(hello, 1, "helloworld.proto")
+	hello = appendString(hello, 2, "helloworld")
+	hello = appendBytes(hello, 4, appendString(nil, 1, "HelloRequest"))
+	reply := appendString(nil, 1, "HelloReply")
+	reply = appendBytes(reply, 3, appendString(nil, 1, "Status"))
+	hello = appendBytes(hello, 4, reply)
+	hello = appendBytes(hello, 6, svc)
+	hello = appendBytes(hello, 8, appendString(nil, 11, "example.com/hello/hellopb"))
+
+	var common []byte
+	common = appendString(common, 1, "common.proto")
+	common = appendString(common, 2, "common")
+	common = appendBytes(common, 4, appendString(nil, 1, "Empty"))
+	common = appendBytes(common, 8, appendString(nil, 11, "example.com/common;commonpb"))
+
+	var req []byte
+	req = appendString(req, 1, "helloworld.proto")
+	req = appendBytes(req, 15, common)
+	req = appendBytes(req, 15, hello)
+	return req
+}
+
+func TestGenerate(t *testing.T) {
+	req, err := decodeRequest(testRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := generate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "helloworld.myrpc.go" {
+		t.Fatalf("expect helloworld.myrpc.go, got %+v", files)
+	}
+	src := files[0].Content
+	for _, want := range []string{
+		"package hellopb",
+		`commonpb "example.com/common"`,
+		`const GreeterServiceName = "Greeter"`,
+		"SayHello(ctx context.Context, req *HelloRequest) (*HelloReply, error)",
+		"Ping(ctx context.Context, req *commonpb.Empty) (*HelloReply_Status, error)",
+		"func RegisterGreeterServer(server *MyRPC.Server, impl GreeterServer) error",
+		"func (c *GreeterClient) SayHello(ctx context.Context, req *HelloRequest, opts ...MyRPC.CallOption) (*HelloReply, error)",
+		"// 流式方法 Watch 不支持，没有生成",
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("expect %q in the generated code:\n%s", want, src)
+		}
+	}
+
+	req.Parameter = "paths=import"
+	if files, err = generate(req); err != nil || files[0].Name != "example.com/hello/hellopb/helloworld.myrpc.go" {
+		t.Fatalf("expect the file placed by import path, got %+v: %v", files, err)
+	}
+	req.Parameter = "plugins=grpc"
+	if _, err = generate(req); err == nil {
+		t.Fatal("expect an unknown parameter to be rejected")
+	}
+}
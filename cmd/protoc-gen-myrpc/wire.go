@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//
+// protobuf 编码
+// 插件只需要 CodeGeneratorRequest 中的少数字段，为了不依赖 google.golang.org/protobuf，这里直接解析线上格式，
+// 只处理用得到的字段，其余的跳过
+//
+
+// 线上格式的类型
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errMalformed = errors.New("protoc-gen-myrpc: malformed protobuf message")
+
+// walk 依次把消息中的每个字段交给 f，长度前缀的字段传 data，varint 字段传 v
+func walk(b []byte, f func(num int, data []byte, v uint64) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errMalformed
+		}
+		b = b[n:]
+		num, typ := int(key>>3), key&7
+		var data []byte
+		var v uint64
+		switch typ {
+		case wireVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errMalformed
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errMalformed
+			}
+			b = b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errMalformed
+			}
+			b = b[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errMalformed
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return errMalformed
+		}
+		if err := f(num, data, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendKey(b []byte, num int, typ uint64) []byte {
+	return appendUvarint(b, uint64(num)<<3|typ)
+}
+
+// appendBytes 追加一个长度前缀的字段
+func appendBytes(b []byte, num int, data []byte) []byte {
+	b = appendKey(b, num, wireBytes)
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendString(b []byte, num int, s string) []byte {
+	return appendBytes(b, num, []byte(s))
+}
+
+func appendVarint(b []byte, num int, v uint64) []byte {
+	return appendUvarint(appendKey(b, num, wireVarint), v)
+}
@@ -0,0 +1,19 @@
+// wirespec 以 Json 输出 MyRPC 当前的线上协议描述，供其他语言的客户端实现核对
+//
+//	go run ./cmd/wirespec > wirespec.json
+package main
+
+import (
+	"MyRPC"
+	"encoding/json"
+	"log"
+	"os"
+)
+
+func main() {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(MyRPC.ProtocolSpec()); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,87 @@
+package codec
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+//
+// 批量写
+// Gob 消息通常很小，每条消息 Flush 一次就是一次 write 系统调用，小请求的吞吐被系统调用主导。
+// batchConn 把一个时间窗口内（或者攒够一定条数）的写操作合并成一次 write。
+//
+
+const defaultBatchSize = 32
+
+// batchConn 合并写操作的连接，读操作直接透传
+type batchConn struct {
+	io.ReadWriteCloser
+	mu     sync.Mutex
+	buf    *bufio.Writer
+	window time.Duration // 第一次写入后最多等待多久刷新
+	size   int           // 攒够多少次写入后立即刷新
+	n      int           // 当前缓冲区中的写入次数
+	timer  *time.Timer   // 窗口定时器
+	err    error         // 异步刷新时产生的错误，下次写入时返回
+}
+
+// NewBatchConn 包装连接，把 window 时间内或者 size 次的写操作合并成一次，size 为 0 时默认 32
+func NewBatchConn(conn io.ReadWriteCloser, window time.Duration, size int) io.ReadWriteCloser {
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	return &batchConn{
+		ReadWriteCloser: conn,
+		buf:             bufio.NewWriterSize(conn, 64*1024),
+		window:          window,
+		size:            size,
+	}
+}
+
+func (c *batchConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.buf.Write(p)
+	if err != nil {
+		return n, err
+	}
+	c.n++
+	if c.n >= c.size {
+		return n, c.flushLocked()
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.window, c.flush)
+	}
+	return n, nil
+}
+
+// flush 定时器到期时刷新
+func (c *batchConn) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.flushLocked(); err != nil && c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *batchConn) flushLocked() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.n = 0
+	return c.buf.Flush()
+}
+
+// Close 关闭前把缓冲区中的数据写出去
+func (c *batchConn) Close() error {
+	c.mu.Lock()
+	_ = c.flushLocked()
+	c.mu.Unlock()
+	return c.ReadWriteCloser.Close()
+}
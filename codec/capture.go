@@ -0,0 +1,172 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+//
+// 抓包
+// 排查协议层的问题时，tcpdump 抓到的是 Gob 或者压缩之后的字节，还要手动解码。开启抓包后，
+// 编解码器把每条解码后的消息连同时间和方向写入文件，之后用 CaptureReader 离线读取。文件格式：
+//
+//	| Magic "MYRPCAP1"(8) | Record | Record | ...
+//	Record: | Length(uint32) | CaptureRecord(Json) |
+//
+// 消息体用 Json 编码，配置了消息体加密的方法记录的是加密后的 Envelope，抓包文件中不会出现明文
+//
+
+const (
+	captureMagic     = "MYRPCAP1"
+	maxCaptureRecord = 64 << 20
+)
+
+// ErrNotCapture 文件不是抓包文件
+var ErrNotCapture = errors.New("rpc codec: not a capture file")
+
+// CaptureDirection 消息的方向，相对于抓包的一端
+type CaptureDirection string
+
+const (
+	CaptureSend CaptureDirection = "send"
+	CaptureRecv CaptureDirection = "recv"
+)
+
+// CaptureRecord 抓包文件中的一条消息
+type CaptureRecord struct {
+	Time      time.Time
+	Conn      string // 连接对端的地址
+	Direction CaptureDirection
+	Header    Header
+	Body      json.RawMessage `json:",omitempty"` // Json 编码的消息体，读端丢弃的消息体为空
+	BodyError string          `json:",omitempty"` // 消息体无法编码为 Json 的原因
+}
+
+// Capture 抓包文件的写入端，可以被多个连接共用
+type Capture struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewCapture 创建写入 w 的抓包，先写入文件头
+func NewCapture(w io.Writer) (*Capture, error) {
+	if _, err := io.WriteString(w, captureMagic); err != nil {
+		return nil, err
+	}
+	return &Capture{w: w}, nil
+}
+
+// Err 返回第一次写入失败的错误，写入失败后不再记录
+func (c *Capture) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Capture) record(conn string, dir CaptureDirection, h *Header, body interface{}) {
+	r := CaptureRecord{Time: time.Now(), Conn: conn, Direction: dir, Header: *h}
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			r.BodyError = err.Error()
+		} else {
+			r.Body = b
+		}
+	}
+	data, err := json.Marshal(&r)
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		_, c.err = c.w.Write(append(buf, data...))
+	}
+}
+
+// NewCaptureCodec 包装编解码器的构造函数，把连接上的消息记录到 c，conn 是连接对端的地址
+func NewCaptureCodec(f NewCodecFunc, c *Capture, conn string) NewCodecFunc {
+	return func(rwc io.ReadWriteCloser) Codec {
+		return &captureCodec{Codec: f(rwc), c: c, conn: conn}
+	}
+}
+
+// captureCodec 读到消息体之后和请求头一起记录，写出时整条记录
+type captureCodec struct {
+	Codec
+	c      *Capture
+	conn   string
+	header Header // 最近读到的头部，读是串行的
+}
+
+func (c *captureCodec) ReadHeader(h *Header) error {
+	err := c.Codec.ReadHeader(h)
+	if err == nil {
+		c.header = *h
+	}
+	return err
+}
+
+func (c *captureCodec) ReadBody(body interface{}) error {
+	err := c.Codec.ReadBody(body)
+	if err == nil {
+		c.c.record(c.conn, CaptureRecv, &c.header, body)
+	}
+	return err
+}
+
+func (c *captureCodec) Write(h *Header, body interface{}) error {
+	err := c.Codec.Write(h, body)
+	if err == nil {
+		c.c.record(c.conn, CaptureSend, h, body)
+	}
+	return err
+}
+
+// CaptureReader 读取抓包文件
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+// NewCaptureReader 检查文件头，不是抓包文件时返回 ErrNotCapture
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != captureMagic {
+		return nil, ErrNotCapture
+	}
+	return &CaptureReader{r: br}, nil
+}
+
+// Next 读取下一条消息，读完时返回 io.EOF，文件被截断时返回 io.ErrUnexpectedEOF
+func (r *CaptureReader) Next() (*CaptureRecord, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r.r, head[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(head[:])
+	if n > maxCaptureRecord {
+		return nil, fmt.Errorf("rpc codec: capture record too large: %d", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	var rec CaptureRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
@@ -0,0 +1,77 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	var file bytes.Buffer
+	c, err := NewCapture(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	w := NewCaptureCodec(NewGobCodec, c, "client")(c1)
+	r := NewCaptureCodec(NewGobCodec, c, "server")(c2)
+	written := make(chan error, 1)
+	go func() {
+		written <- w.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1, Metadata: map[string]string{"k": "v"}}, map[string]int{"Num1": 1})
+	}()
+	var h Header
+	var body map[string]int
+	if err := r.ReadHeader(&h); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ReadBody(&body); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	cr, err := NewCaptureReader(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*CaptureRecord
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expect a send and a recv record, got %d", len(records))
+	}
+	dirs := map[CaptureDirection]*CaptureRecord{}
+	for _, rec := range records {
+		dirs[rec.Direction] = rec
+	}
+	recv := dirs[CaptureRecv]
+	if recv == nil || recv.Conn != "server" || recv.Header.ServiceMethod != "Foo.Sum" || recv.Header.Metadata["k"] != "v" ||
+		string(recv.Body) != `{"Num1":1}` || recv.Time.IsZero() {
+		t.Fatalf("unexpected recv record %+v", recv)
+	}
+	if send := dirs[CaptureSend]; send == nil || send.Conn != "client" || send.Header.Seq != 1 {
+		t.Fatalf("unexpected send record %+v", send)
+	}
+
+	if _, err := NewCaptureReader(bytes.NewReader([]byte("not a capture"))); err != ErrNotCapture {
+		t.Fatalf("expect ErrNotCapture, got %v", err)
+	}
+	if _, err := cr.Next(); err != io.EOF {
+		t.Fatalf("expect io.EOF, got %v", err)
+	}
+	truncated, _ := NewCaptureReader(bytes.NewReader(file.Bytes()[:file.Len()-1]))
+	_, _ = truncated.Next()
+	if _, err := truncated.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expect io.ErrUnexpectedEOF, got %v", err)
+	}
+}
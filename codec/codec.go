@@ -9,6 +9,21 @@ type Header struct {
 	ServiceMethod string // 服务名.方法名
 	Seq           uint64 // 请求的序号，用来区分不同的请求
 	Error         string // 错误信息，客户端置为空，服务端如果发送错误，将信息存在Error中
+
+	Code    uint32            // 错误码，见 MyRPC.ErrorCode，0表示没有错误码（老版本的服务端），只在响应中使用
+	Details map[string]string // 错误的附加信息，只在响应中使用
+
+	Deadline int64             // 请求的截止时间（Unix纳秒），0表示没有截止时间，只在请求中使用
+	Metadata map[string]string // 随请求传递的元数据，只在请求中使用
+	Trailer  map[string]string // 响应附带的额外信息，比如服务端各阶段的耗时，只在响应中使用
+
+	methodID uint64 // 方法在连接的方法表中的编号，只在本地使用，不会被编码
+}
+
+// MethodID 方法在这个连接的方法表中的编号，同一个连接上编号相同的请求调用同一个方法，
+// 服务端据此缓存查找服务的结果。只有 CompactType 会分配编号，其他编码方式返回0
+func (h *Header) MethodID() uint64 {
+	return h.methodID
 }
 
 // Codec 抽象出对消息体进行编码解码的接口 可屏蔽下面具体的编码方式 编解码器：主要是读写关闭
@@ -19,6 +34,18 @@ type Codec interface {
 	Write(*Header, interface{}) error
 }
 
+// ConcurrentWriter 可以被多个协程同时调用 Write 的编解码器实现它，比如每个请求使用独立流的多路复用传输（QUIC、HTTP/2）。
+// 客户端对这样的编解码器不再串行发送请求。包装其他编解码器的实现需要转发被包装者的结果，否则按不支持处理
+type ConcurrentWriter interface {
+	ConcurrentWrites() bool
+}
+
+// ConcurrentWrites cc 是否可以被多个协程同时调用 Write
+func ConcurrentWrites(cc Codec) bool {
+	w, ok := cc.(ConcurrentWriter)
+	return ok && w.ConcurrentWrites()
+}
+
 // 定义编码解码的格式
 // 这里定义了两种Codec，Gob和Json。实际代码只用了Gob
 
@@ -31,6 +58,8 @@ const (
 	JsonType Type = "application/json"
 )
 
+// CompactType 见 compact.go，二进制编码的头部加 Gob 编码的消息体
+
 var NewCodecFuncMap map[Type]NewCodecFunc
 
 func init() {
@@ -38,4 +67,5 @@ func init() {
 	NewCodecFuncMap = make(map[Type]NewCodecFunc)
 	NewCodecFuncMap[GobType] = NewGobCodec
 	NewCodecFuncMap[JsonType] = NewJsonCodec
+	NewCodecFuncMap[CompactType] = NewCompactCodec
 }
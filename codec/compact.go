@@ -0,0 +1,379 @@
+package codec
+
+import (
+	"MyRPC/logger"
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+//
+// 紧凑头部
+// Gob 每条消息都会完整编码 服务名.方法名，消息体只有几十字节时头部占了大部分流量。
+// CompactType 用二进制编码头部，消息体仍然使用 Gob：
+//
+//	| Flags(1) | Seq(uvarint) | Method(uvarint) | [Error] | [Deadline(varint)] | [Metadata] | [Trailer] | [Code(uvarint)] | [Details] |
+//
+// Method 为0时后面跟着方法名 | Length(uvarint) | Bytes |，非0时是方法表中的编号（从1开始）。
+// 每个方向各有一张方法表：发送方第一次发送某个方法名时写出全名并加入表中，接收方按同样的顺序加入，
+// 之后只发送编号，表的大小不超过 maxMethodTable。接收方通过 Header.MethodID 拿到编号，服务端按编号缓存查找服务的结果。
+// Error 是一个字符串，Metadata、Trailer 和 Details 是 | Count(uvarint) | Key | Value | ...，
+// Key 和 Method 一样是 | Id(uvarint) |，为0时后面跟着 key 的字符串，这几个 map 共用每个方向的一张 key 表，
+// 大小不超过 maxKeyTable，追踪 ID 这类每个请求都带的 key 之后只占一两个字节。
+// 字符串都是 | Length(uvarint) | Bytes |，方括号中的字段只在 Flags 中对应的位设置时出现。
+// Code 和 Details 是后来加的，老版本的接收方不认识这两位，会留下没有读的字节，所以只有对端在握手中
+// 声明支持时（见 WithErrorCodes）才发送，否则错误响应只有 Error
+//
+
+const CompactType Type = "application/x-myrpc-compact"
+
+// 头部 Flags 中的位
+const (
+	compactError    = 1 << iota // 有 Error
+	compactDeadline             // 有 Deadline
+	compactMetadata             // 有 Metadata
+	compactTrailer              // 有 Trailer
+	compactCode                 // 有 Code
+	compactDetails              // 有 Details
+)
+
+// maxMethodTable 每个方向方法表的最大长度，超过之后的方法名每次都完整发送
+const maxMethodTable = 1024
+
+// maxKeyTable 每个方向元数据 key 表的最大长度，超过之后的 key 每次都完整发送
+const maxKeyTable = 256
+
+// 长度和个数来自对端，不能按它们一次性分配：字符串超过 maxStringPrealloc 时边读边扩容，
+// 键值对最多预留 maxMapPrealloc 个位置，之后按实际读到的数量增长
+const (
+	maxStringPrealloc = 4 << 10
+	maxMapPrealloc    = 16
+)
+
+// detailsLimits 读取错误附加信息时的限制
+var detailsLimits = MetadataLimits{MaxPairs: 64, MaxBytes: 16 << 10}
+
+var (
+	errUnknownMethodID = errors.New("rpc codec: unknown method id")
+	errUnknownKeyID    = errors.New("rpc codec: unknown metadata key id")
+)
+
+type CompactCodec struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader // 头部和 Gob 消息体共用，gob.Decoder 读 io.ByteReader 时不会多读
+	buf  *bufio.Writer
+	dec  *gob.Decoder
+	enc  *gob.Encoder
+	wtab map[string]uint64 // 发送方向的方法表
+	rtab []string          // 接收方向的方法表
+	wkey map[string]uint64 // 发送方向的 key 表
+	rkey []string          // 接收方向的 key 表
+	head []byte            // 编码头部的缓冲
+
+	limits     MetadataLimits // 读取 Metadata 时的限制
+	errorCodes bool           // 对端能读取 Code 和 Details
+}
+
+func NewCompactCodec(conn io.ReadWriteCloser) Codec {
+	r := bufio.NewReader(conn)
+	buf := bufio.NewWriter(conn)
+	return &CompactCodec{
+		conn: conn,
+		r:    r,
+		buf:  buf,
+		dec:  gob.NewDecoder(r),
+		enc:  gob.NewEncoder(buf),
+		wtab: make(map[string]uint64),
+		wkey: make(map[string]uint64),
+	}
+}
+
+func (c *CompactCodec) setMetadataLimits(l MetadataLimits) {
+	c.limits = l
+}
+
+func (c *CompactCodec) setErrorCodes() {
+	c.errorCodes = true
+}
+
+// errorCoder 需要知道对端能否读取错误码的编解码器
+type errorCoder interface {
+	setErrorCodes()
+}
+
+// WithErrorCodes 返回的构造函数创建的编解码器在响应中发送 Code 和 Details，对端在握手中声明支持时使用。
+// 只影响 CompactType，Gob 和 Json 的接收方会忽略不认识的字段
+func WithErrorCodes(f NewCodecFunc) NewCodecFunc {
+	return func(conn io.ReadWriteCloser) Codec {
+		c := f(conn)
+		if ec, ok := c.(errorCoder); ok {
+			ec.setErrorCodes()
+		}
+		return c
+	}
+}
+
+func (c *CompactCodec) ReadHeader(h *Header) error {
+	flags, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	*h = Header{}
+	if h.Seq, err = binary.ReadUvarint(c.r); err != nil {
+		return err
+	}
+	if h.ServiceMethod, h.methodID, err = c.readMethod(); err != nil {
+		return err
+	}
+	if flags&compactError != 0 {
+		if h.Error, err = c.readString(); err != nil {
+			return err
+		}
+	}
+	if flags&compactDeadline != 0 {
+		if h.Deadline, err = binary.ReadVarint(c.r); err != nil {
+			return err
+		}
+	}
+	if flags&compactMetadata != 0 {
+		if h.Metadata, err = c.readMap(c.limits); err != nil {
+			return err
+		}
+	}
+	if flags&compactTrailer != 0 {
+		if h.Trailer, err = c.readMap(MetadataLimits{}); err != nil {
+			return err
+		}
+	}
+	if flags&compactCode != 0 {
+		code, err := binary.ReadUvarint(c.r)
+		if err != nil {
+			return err
+		}
+		h.Code = uint32(code)
+	}
+	if flags&compactDetails != 0 {
+		if h.Details, err = c.readMap(detailsLimits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMethod 读取方法名和它在方法表中的编号，方法表里的方法名总是返回同一个字符串，不会重复分配
+func (c *CompactCodec) readMethod() (string, uint64, error) {
+	id, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return "", 0, err
+	}
+	if id > 0 {
+		if id > uint64(len(c.rtab)) {
+			return "", 0, errUnknownMethodID
+		}
+		return c.rtab[id-1], id, nil
+	}
+	method, err := c.readString()
+	if err == nil && method != "" && len(c.rtab) < maxMethodTable {
+		c.rtab = append(c.rtab, method)
+		id = uint64(len(c.rtab))
+	}
+	return method, id, err
+}
+
+func (c *CompactCodec) readString() (string, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return "", err
+	}
+	if n > MaxFrameSize {
+		return "", ErrFrameTooLarge
+	}
+	if n <= maxStringPrealloc {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	var sb strings.Builder
+	sb.Grow(maxStringPrealloc)
+	if _, err := io.CopyN(&sb, c.r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// readMap 读取键值对，超过 l 时立即返回 ErrMetadataTooLarge，此时连接上剩下的数据已经无法解析
+func (c *CompactCodec) readMap(l MetadataLimits) (map[string]string, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	if l.MaxPairs > 0 && n > uint64(l.MaxPairs) {
+		return nil, ErrMetadataTooLarge
+	}
+	prealloc := n
+	if prealloc > maxMapPrealloc {
+		prealloc = maxMapPrealloc
+	}
+	m := make(map[string]string, prealloc)
+	size := 0
+	for i := uint64(0); i < n; i++ {
+		k, err := c.readKey()
+		if err != nil {
+			return nil, err
+		}
+		v, err := c.readString()
+		if err != nil {
+			return nil, err
+		}
+		if size += len(k) + len(v); l.MaxBytes > 0 && size > l.MaxBytes {
+			return nil, ErrMetadataTooLarge
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// readKey 读取 key，key 表里的 key 总是返回同一个字符串
+func (c *CompactCodec) readKey() (string, error) {
+	id, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return "", err
+	}
+	if id > 0 {
+		if id > uint64(len(c.rkey)) {
+			return "", errUnknownKeyID
+		}
+		return c.rkey[id-1], nil
+	}
+	k, err := c.readString()
+	if err == nil && k != "" && len(c.rkey) < maxKeyTable {
+		c.rkey = append(c.rkey, k)
+	}
+	return k, err
+}
+
+func (c *CompactCodec) ReadBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *CompactCodec) Write(h *Header, body interface{}) (err error) {
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close() // 出错要关闭连接，方法表已经和对端不一致
+		}
+	}()
+	if _, err := c.buf.Write(c.encodeHeader(h)); err != nil {
+		logger.Errorf("rpc codec: compact error writing header: %v", err)
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		logger.Errorf("rpc codec: compact error encoding body: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (c *CompactCodec) encodeHeader(h *Header) []byte {
+	var flags byte
+	if h.Error != "" {
+		flags |= compactError
+	}
+	if h.Deadline != 0 {
+		flags |= compactDeadline
+	}
+	if len(h.Metadata) > 0 {
+		flags |= compactMetadata
+	}
+	if len(h.Trailer) > 0 {
+		flags |= compactTrailer
+	}
+	if h.Code != 0 && c.errorCodes {
+		flags |= compactCode
+	}
+	if len(h.Details) > 0 && c.errorCodes {
+		flags |= compactDetails
+	}
+	b := append(c.head[:0], flags)
+	b = appendUvarint(b, h.Seq)
+	if id, ok := c.wtab[h.ServiceMethod]; ok {
+		b = appendUvarint(b, id)
+	} else {
+		b = appendUvarint(b, 0)
+		b = appendString(b, h.ServiceMethod)
+		if h.ServiceMethod != "" && len(c.wtab) < maxMethodTable {
+			c.wtab[h.ServiceMethod] = uint64(len(c.wtab) + 1)
+		}
+	}
+	if flags&compactError != 0 {
+		b = appendString(b, h.Error)
+	}
+	if flags&compactDeadline != 0 {
+		var tmp [binary.MaxVarintLen64]byte
+		b = append(b, tmp[:binary.PutVarint(tmp[:], h.Deadline)]...)
+	}
+	if flags&compactMetadata != 0 {
+		b = c.appendMap(b, h.Metadata)
+	}
+	if flags&compactTrailer != 0 {
+		b = c.appendMap(b, h.Trailer)
+	}
+	if flags&compactCode != 0 {
+		b = appendUvarint(b, uint64(h.Code))
+	}
+	if flags&compactDetails != 0 {
+		b = c.appendMap(b, h.Details)
+	}
+	c.head = b
+	return b
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(b, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+// appendMap 按 key 排序写出，相同的内容总是得到相同的字节
+func (c *CompactCodec) appendMap(b []byte, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b = appendUvarint(b, uint64(len(keys)))
+	for _, k := range keys {
+		b = appendString(c.appendKey(b, k), m[k])
+	}
+	return b
+}
+
+// appendKey 写出 key 在 key 表中的编号，第一次出现的 key 写出全文并加入表中
+func (c *CompactCodec) appendKey(b []byte, k string) []byte {
+	if id, ok := c.wkey[k]; ok {
+		return appendUvarint(b, id)
+	}
+	if k != "" && len(c.wkey) < maxKeyTable {
+		c.wkey[k] = uint64(len(c.wkey) + 1)
+	}
+	return appendString(appendUvarint(b, 0), k)
+}
+
+func (c *CompactCodec) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,170 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestCompactCodec(t *testing.T) {
+	c1, c2 := net.Pipe()
+	w := WithErrorCodes(NewCompactCodec)(c1).(*CompactCodec)
+	r := NewCompactCodec(c2)
+	headers := []*Header{
+		{ServiceMethod: "Foo.Sum", Seq: 1, Deadline: 12345, Metadata: map[string]string{"k": "v"}},
+		{ServiceMethod: "Foo.Sum", Seq: 2},
+		{ServiceMethod: "Foo.Sum", Seq: 300, Error: "failed", Trailer: map[string]string{"a": "1", "b": "2"}},
+		{ServiceMethod: "Foo.Sum", Seq: 301, Error: "not found", Code: 5, Details: map[string]string{"a": "3"}},
+	}
+	if first, second := len(w.encodeHeader(headers[0])), len(w.encodeHeader(headers[1])); second >= first || second > 4 {
+		t.Fatalf("expect the method name replaced by its id, got %d then %d bytes", first, second)
+	}
+	w.wtab, w.wkey = make(map[string]uint64), make(map[string]uint64)
+	go func() {
+		for i, h := range headers {
+			_ = w.Write(h, i)
+		}
+	}()
+
+	for i, want := range headers {
+		var h Header
+		if err := r.ReadHeader(&h); err != nil {
+			t.Fatalf("failed to read header: %v", err)
+		}
+		if h.MethodID() != 1 {
+			t.Fatalf("expect method id 1, but got %d", h.MethodID())
+		}
+		h.methodID = 0
+		if !reflect.DeepEqual(&h, want) {
+			t.Fatalf("expect %+v, but got %+v", want, h)
+		}
+		var body int
+		if err := r.ReadBody(&body); err != nil || body != i {
+			t.Fatalf("expect body %d, but got %d, %v", i, body, err)
+		}
+	}
+}
+
+func TestCompactCodec_ErrorCodes(t *testing.T) {
+	c1, c2 := net.Pipe()
+	w := NewCompactCodec(c1)
+	r := NewCompactCodec(c2)
+	go func() {
+		_ = w.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1, Error: "not found", Code: 5, Details: map[string]string{"a": "3"}}, 1)
+		_ = w.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, 2)
+	}()
+	// 对端没有声明支持错误码时只发送 Error，老版本的接收方不会读错位置
+	var h Header
+	if err := r.ReadHeader(&h); err != nil || h.Error != "not found" || h.Code != 0 || h.Details != nil {
+		t.Fatalf("expect only the error text, got %+v, %v", h, err)
+	}
+	var body int
+	if err := r.ReadBody(&body); err != nil || body != 1 {
+		t.Fatalf("expect body 1, got %d, %v", body, err)
+	}
+	if err := r.ReadHeader(&h); err != nil || h.Seq != 2 {
+		t.Fatalf("expect the next header, got %+v, %v", h, err)
+	}
+	_ = r.ReadBody(&body)
+
+	// 附加信息超过限制
+	c3, c4 := net.Pipe()
+	w = WithErrorCodes(NewCompactCodec)(c3)
+	r = NewCompactCodec(c4)
+	details := make(map[string]string)
+	for i := 0; i <= detailsLimits.MaxPairs; i++ {
+		details[strconv.Itoa(i)] = "v"
+	}
+	go func() { _ = w.Write(&Header{Seq: 1, Error: "x", Code: 2, Details: details}, 1) }()
+	if err := r.ReadHeader(&h); !errors.Is(err, ErrMetadataTooLarge) {
+		t.Fatalf("expect ErrMetadataTooLarge, got %v", err)
+	}
+	_ = c4.Close()
+}
+
+func TestCompactCodec_MetadataKeys(t *testing.T) {
+	c1, c2 := net.Pipe()
+	w := NewCompactCodec(c1).(*CompactCodec)
+	r := NewCompactCodec(c2).(*CompactCodec)
+	h := &Header{ServiceMethod: "Foo.Sum", Seq: 1, Metadata: map[string]string{"trace-id": "1", "user": "bob"}}
+	if first, second := len(w.encodeHeader(h)), len(w.encodeHeader(h)); second > first-len("Foo.Sum")-len("trace-id")-len("user") {
+		t.Fatalf("expect metadata keys replaced by their ids, got %d then %d bytes", first, second)
+	}
+	w.wtab, w.wkey = make(map[string]uint64), make(map[string]uint64)
+	r.setMetadataLimits(MetadataLimits{MaxPairs: 2, MaxBytes: 16})
+	headers := []*Header{
+		h,
+		{ServiceMethod: "Foo.Sum", Seq: 2, Metadata: map[string]string{"trace-id": "2"}, Trailer: map[string]string{"user": "alice"}},
+		{ServiceMethod: "Foo.Sum", Seq: 3, Metadata: map[string]string{"trace-id": "3", "user": "bob", "extra": "x"}},
+	}
+	go func() {
+		for i, h := range headers {
+			_ = w.Write(h, i)
+		}
+	}()
+
+	for i, want := range headers[:2] {
+		var h Header
+		if err := r.ReadHeader(&h); err != nil {
+			t.Fatalf("failed to read header: %v", err)
+		}
+		h.methodID = 0
+		if !reflect.DeepEqual(&h, want) {
+			t.Fatalf("expect %+v, but got %+v", want, h)
+		}
+		var body int
+		if err := r.ReadBody(&body); err != nil || body != i {
+			t.Fatalf("expect body %d, but got %d, %v", i, body, err)
+		}
+	}
+	var h3 Header
+	if err := r.ReadHeader(&h3); err != ErrMetadataTooLarge {
+		t.Fatalf("expect %v, but got %v", ErrMetadataTooLarge, err)
+	}
+	_ = r.Close()
+}
+
+func TestMetadataLimits_Check(t *testing.T) {
+	l := MetadataLimits{MaxPairs: 2, MaxBytes: 8}
+	if err := l.Check(map[string]string{"a": "1", "b": "2"}); err != nil {
+		t.Fatalf("expect metadata within limits, got %v", err)
+	}
+	if err := l.Check(map[string]string{"a": "1", "b": "2", "c": "3"}); err != ErrMetadataTooLarge {
+		t.Fatalf("expect too many pairs rejected, got %v", err)
+	}
+	if err := l.Check(map[string]string{"key": "values"}); err != ErrMetadataTooLarge {
+		t.Fatalf("expect too many bytes rejected, got %v", err)
+	}
+	if err := (MetadataLimits{}).Check(map[string]string{"key": "value"}); err != nil {
+		t.Fatalf("expect zero limits unlimited, got %v", err)
+	}
+}
+
+func TestCompactCodec_UntrustedLength(t *testing.T) {
+	c1, c2 := net.Pipe()
+	r := NewCompactCodec(c2)
+	// 方法名声明为 MaxFrameSize 字节，实际只发送了 3 个字节
+	frame := make([]byte, 3+binary.MaxVarintLen64)
+	frame[1] = 1
+	n := binary.PutUvarint(frame[3:], MaxFrameSize)
+	frame = append(frame[:3+n], "abc"...)
+	go func() {
+		_, _ = c1.Write(frame)
+		_ = c1.Close()
+	}()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var h Header
+	if err := r.ReadHeader(&h); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expect io.ErrUnexpectedEOF, got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Fatalf("expect allocation to follow the bytes actually read, allocated %d bytes", alloc)
+	}
+}
@@ -0,0 +1,248 @@
+package codec
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+//
+// 压缩
+// 在编解码器和连接之间加一层压缩，对编码方式透明。每次写操作之后都会Flush压缩器，保证对端能立即解出完整的消息。
+// 内置gzip和deflate，zstd在单独的模块 MyRPC/codec/zstd 中，引入后自动注册，不使用的程序不需要下载它的依赖；snappy等其他算法通过RegisterCompressor接入。
+//
+// 预置字典
+// 几百字节的小消息单独压缩几乎没有效果，因为压缩器还没来得及积累可以引用的内容。预置字典把这些消息中常见的片段
+// （字段名、枚举值等）提前交给压缩器，消息中出现的片段直接引用字典。字典用 RegisterDictionary 按编号注册，
+// 客户端在握手中通过 Option.CompressDict 指定编号，服务端没有这个字典时拒绝握手。
+// 支持字典的算法需要提供 NewWriterDict 和 NewReaderDict，deflate 和 MyRPC/codec/zstd 都实现了预置字典
+//
+
+type CompressType string
+
+const (
+	CompressNone    CompressType = ""
+	CompressGzip    CompressType = "gzip"
+	CompressDeflate CompressType = "deflate" // 支持预置字典
+)
+
+// FlushWriter 压缩器的写端，需要支持Flush
+type FlushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Compressor 一种压缩算法，NewWriterDict 和 NewReaderDict 为 nil 时不支持预置字典
+type Compressor struct {
+	NewWriter     func(w io.Writer) FlushWriter
+	NewReader     func(r io.Reader) (io.Reader, error)
+	NewWriterDict func(w io.Writer, dict []byte) FlushWriter
+	NewReaderDict func(r io.Reader, dict []byte) (io.Reader, error)
+}
+
+var (
+	compressorMu sync.RWMutex
+	compressors  = map[CompressType]Compressor{
+		CompressGzip: {
+			NewWriter: func(w io.Writer) FlushWriter {
+				return gzip.NewWriter(w)
+			},
+			NewReader: func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			},
+		},
+		CompressDeflate: {
+			NewWriter: func(w io.Writer) FlushWriter {
+				fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+				return fw
+			},
+			NewReader: func(r io.Reader) (io.Reader, error) {
+				return flate.NewReader(r), nil
+			},
+			// 每条消息写完都会 Flush，只有最高压缩级别才会在这么短的输入上引用字典
+			NewWriterDict: func(w io.Writer, dict []byte) FlushWriter {
+				fw, _ := flate.NewWriterDict(w, flate.BestCompression, dict)
+				return fw
+			},
+			NewReaderDict: func(r io.Reader, dict []byte) (io.Reader, error) {
+				return flate.NewReaderDict(r, dict), nil
+			},
+		},
+	}
+)
+
+// RegisterCompressor 注册压缩算法，已存在时覆盖
+func RegisterCompressor(t CompressType, c Compressor) {
+	compressorMu.Lock()
+	defer compressorMu.Unlock()
+	compressors[t] = c
+}
+
+// Compressors 返回已注册的压缩算法，按名称排序
+func Compressors() []string {
+	compressorMu.RLock()
+	defer compressorMu.RUnlock()
+	names := make([]string, 0, len(compressors))
+	for t := range compressors {
+		names = append(names, string(t))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewCompressConn 用t对应的压缩算法包装连接，t为空时原样返回
+func NewCompressConn(conn io.ReadWriteCloser, t CompressType) (io.ReadWriteCloser, error) {
+	return NewCompressConnDict(conn, t, 0)
+}
+
+// NewCompressConnDict 用t对应的压缩算法和编号为 dictID 的预置字典包装连接，dictID 为0时不使用字典
+func NewCompressConnDict(conn io.ReadWriteCloser, t CompressType, dictID uint32) (io.ReadWriteCloser, error) {
+	if t == CompressNone {
+		return conn, nil
+	}
+	c, dict, err := compressorFor(t, dictID)
+	if err != nil {
+		return nil, err
+	}
+	cc := &compressConn{conn: conn, c: c, dict: dict}
+	if dict != nil {
+		cc.w = c.NewWriterDict(conn, dict)
+	} else {
+		cc.w = c.NewWriter(conn)
+	}
+	return cc, nil
+}
+
+// compressorFor 查找压缩算法和字典
+func compressorFor(t CompressType, dictID uint32) (Compressor, []byte, error) {
+	compressorMu.RLock()
+	c, ok := compressors[t]
+	compressorMu.RUnlock()
+	if !ok {
+		return c, nil, fmt.Errorf("rpc codec: invalid compress type %s", t)
+	}
+	if dictID == 0 {
+		return c, nil, nil
+	}
+	if c.NewWriterDict == nil || c.NewReaderDict == nil {
+		return c, nil, fmt.Errorf("rpc codec: compress type %s does not support dictionaries", t)
+	}
+	dict, ok := Dictionary(dictID)
+	if !ok {
+		return c, nil, fmt.Errorf("rpc codec: unknown compression dictionary %d", dictID)
+	}
+	return c, dict, nil
+}
+
+// CheckCompress 检查压缩算法和字典是否可用，握手时服务端据此拒绝无法处理的连接
+func CheckCompress(t CompressType, dictID uint32) error {
+	if t == CompressNone {
+		if dictID != 0 {
+			return fmt.Errorf("rpc codec: compression dictionary %d without compress type", dictID)
+		}
+		return nil
+	}
+	_, _, err := compressorFor(t, dictID)
+	return err
+}
+
+type compressConn struct {
+	conn io.ReadWriteCloser
+	c    Compressor
+	dict []byte // 预置字典，为nil时不使用
+
+	rmu    sync.Mutex // 保护r，Close 关闭解压器时可能还在读
+	r      io.Reader  // 第一次读的时候才创建，gzip.NewReader会阻塞读取头部
+	closed bool
+
+	mu sync.Mutex // 保护w，Close 写压缩流的结尾时可能还有请求在写
+	w  FlushWriter
+}
+
+func (c *compressConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if c.r == nil {
+		var r io.Reader
+		var err error
+		if c.dict != nil {
+			r, err = c.c.NewReaderDict(c.conn, c.dict)
+		} else {
+			r, err = c.c.NewReader(c.conn)
+		}
+		if err != nil {
+			return 0, err
+		}
+		c.r = r
+	}
+	return c.r.Read(p)
+}
+
+func (c *compressConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+// Close 关闭压缩器、连接和解压器。解压器实现了 io.Closer 时才需要关闭，比如 zstd 的解压器持有后台的协程。
+// 先关闭连接让还在进行的 Read 返回，再关闭解压器
+func (c *compressConn) Close() error {
+	c.mu.Lock()
+	_ = c.w.Close()
+	c.mu.Unlock()
+	err := c.conn.Close()
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if rc, ok := c.r.(io.Closer); ok && !c.closed {
+		_ = rc.Close()
+	}
+	c.closed = true
+	return err
+}
+
+var (
+	dictMu       sync.RWMutex
+	dictionaries = make(map[uint32][]byte)
+)
+
+// RegisterDictionary 注册编号为 id 的预置字典，id 不能为0。同一个编号的字典内容必须在客户端和服务端完全相同，
+// 修改字典时应该使用新的编号
+func RegisterDictionary(id uint32, dict []byte) error {
+	if id == 0 {
+		return fmt.Errorf("rpc codec: dictionary id must not be 0")
+	}
+	dictMu.Lock()
+	defer dictMu.Unlock()
+	dictionaries[id] = append([]byte(nil), dict...)
+	return nil
+}
+
+// Dictionary 返回编号为 id 的预置字典
+func Dictionary(id uint32) ([]byte, bool) {
+	dictMu.RLock()
+	defer dictMu.RUnlock()
+	dict, ok := dictionaries[id]
+	return dict, ok
+}
+
+// Dictionaries 返回已注册的字典编号，从小到大排序
+func Dictionaries() []uint32 {
+	dictMu.RLock()
+	defer dictMu.RUnlock()
+	ids := make([]uint32, 0, len(dictionaries))
+	for id := range dictionaries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
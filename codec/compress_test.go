@@ -0,0 +1,92 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"testing"
+)
+
+// nopCloser 把 bytes.Buffer 当作连接使用
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestCompressConn_Dictionary(t *testing.T) {
+	dict := []byte(`{"user_id":,"tenant":"acme","status":"active","created_at":"2024-01-01T00:00:00Z"}`)
+	msg := []byte(`{"user_id":42,"tenant":"acme","status":"active","created_at":"2024-03-05T10:20:30Z"}`)
+	if err := RegisterDictionary(7, dict); err != nil {
+		t.Fatal(err)
+	}
+	compress := func(dictID uint32) []byte {
+		var buf bytes.Buffer
+		conn, err := NewCompressConnDict(nopCloser{&buf}, CompressDeflate, dictID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	plain, withDict := compress(0), compress(7)
+	if len(withDict) >= len(plain)/2 {
+		t.Fatalf("expect the dictionary to shrink the payload, got %d bytes without and %d with", len(plain), len(withDict))
+	}
+
+	conn, _ := NewCompressConnDict(nopCloser{bytes.NewBuffer(withDict)}, CompressDeflate, 7)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("expect %s, got %s: %v", msg, got, err)
+	}
+
+	if err := CheckCompress(CompressDeflate, 8); err == nil {
+		t.Fatal("expect an unknown dictionary to be rejected")
+	}
+	if err := CheckCompress(CompressGzip, 7); err == nil {
+		t.Fatal("expect gzip with a dictionary to be rejected")
+	}
+}
+
+// closeReader 记录是否被关闭的解压器
+type closeReader struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+// 关闭连接时同时关闭实现了 io.Closer 的解压器
+func TestCompressConn_CloseReader(t *testing.T) {
+	var readers []*closeReader
+	RegisterCompressor("test-closer", Compressor{
+		NewWriter: func(w io.Writer) FlushWriter {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		},
+		NewReader: func(r io.Reader) (io.Reader, error) {
+			cr := &closeReader{Reader: flate.NewReader(r)}
+			readers = append(readers, cr)
+			return cr, nil
+		},
+	})
+	var buf bytes.Buffer
+	w, _ := NewCompressConn(nopCloser{&buf}, "test-closer")
+	_, _ = w.Write([]byte("hello"))
+	r, _ := NewCompressConn(nopCloser{&buf}, "test-closer")
+	if _, err := io.ReadFull(r, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Close()
+	if len(readers) != 1 || !readers[0].closed {
+		t.Fatal("expect the decompressor closed with the connection")
+	}
+	if _, err := r.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expect reads after Close to fail")
+	}
+}
@@ -0,0 +1,219 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+)
+
+//
+// 消息体加密
+// 处理个人敏感信息的方法即使走了TLS，网关、流量录制这类中间环节仍然能看到明文。
+// 对这些方法的消息体做信封加密：每条消息随机生成一个数据密钥，用AES-GCM加密消息体，
+// 数据密钥交给 KeyManager（通常对接KMS）包装后随消息一起发送。头部保持明文，中间环节仍然可以路由
+//
+
+// KeyManager 包装和解包数据密钥，通常对接KMS
+type KeyManager interface {
+	WrapKey(dataKey []byte) (keyID string, wrapped []byte, err error)
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Encryption 消息体加密的配置，Methods 使用 path.Match 的模式匹配 服务名.方法名
+type Encryption struct {
+	Methods []string
+	KMS     KeyManager
+}
+
+// Required 判断方法的消息体是否需要加密
+func (e *Encryption) Required(serviceMethod string) bool {
+	for _, p := range e.Methods {
+		if ok, _ := path.Match(p, serviceMethod); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Envelope 加密后的消息体
+type Envelope struct {
+	KeyID      string
+	WrappedKey []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+var ErrNotEncrypted = errors.New("rpc codec: body of encrypted method is not an envelope")
+
+const dataKeyLen = 32
+
+// NewEncryptCodec 包装编解码器的构造函数，匹配的方法的消息体以 Envelope 的形式收发。
+// 消息体先用t对应的编码方式编码成明文，再加密
+func NewEncryptCodec(f NewCodecFunc, t Type, e *Encryption) NewCodecFunc {
+	return func(conn io.ReadWriteCloser) Codec {
+		return &encryptCodec{Codec: f(conn), typ: t, enc: e}
+	}
+}
+
+type encryptCodec struct {
+	Codec
+	typ    Type
+	enc    *Encryption
+	method string // 最近读到的头部对应的方法，读是串行的
+}
+
+func (c *encryptCodec) ReadHeader(h *Header) error {
+	err := c.Codec.ReadHeader(h)
+	c.method = h.ServiceMethod
+	return err
+}
+
+func (c *encryptCodec) ReadBody(body interface{}) error {
+	if !c.enc.Required(c.method) || body == nil {
+		return c.Codec.ReadBody(body)
+	}
+	var env Envelope
+	if err := c.Codec.ReadBody(&env); err != nil {
+		return err
+	}
+	if len(env.Ciphertext) == 0 {
+		return ErrNotEncrypted
+	}
+	plain, err := c.open(&env)
+	if err != nil {
+		return err
+	}
+	return unmarshalBody(c.typ, plain, body)
+}
+
+func (c *encryptCodec) Write(h *Header, body interface{}) error {
+	if !c.enc.Required(h.ServiceMethod) {
+		return c.Codec.Write(h, body)
+	}
+	plain, err := marshalBody(c.typ, body)
+	if err != nil {
+		return err
+	}
+	env, err := c.seal(plain)
+	if err != nil {
+		return err
+	}
+	return c.Codec.Write(h, env)
+}
+
+// seal 生成数据密钥并加密
+func (c *encryptCodec) seal(plain []byte) (*Envelope, error) {
+	key := make([]byte, dataKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	keyID, wrapped, err := c.enc.KMS.WrapKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("rpc codec: wrap key: %w", err)
+	}
+	nonce, ciphertext, err := aesSeal(key, plain)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{KeyID: keyID, WrappedKey: wrapped, Nonce: nonce, Ciphertext: ciphertext}, nil
+}
+
+// open 解包数据密钥并解密
+func (c *encryptCodec) open(env *Envelope) ([]byte, error) {
+	key, err := c.enc.KMS.UnwrapKey(env.KeyID, env.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("rpc codec: unwrap key: %w", err)
+	}
+	return aesOpen(key, env.Nonce, env.Ciphertext)
+}
+
+func aesSeal(key, plain []byte) (nonce, ciphertext []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, plain, nil), nil
+}
+
+func aesOpen(key, nonce, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("rpc codec: invalid nonce")
+	}
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// marshalBody 用t对应的编码方式把消息体单独编码
+func marshalBody(t Type, body interface{}) ([]byte, error) {
+	switch t {
+	case GobType, CompactType: // 紧凑头部的消息体也是 Gob
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(body)
+		return buf.Bytes(), err
+	case JsonType:
+		return json.Marshal(body)
+	}
+	return nil, fmt.Errorf("rpc codec: encryption does not support codec type %s", t)
+}
+
+func unmarshalBody(t Type, data []byte, body interface{}) error {
+	switch t {
+	case GobType, CompactType:
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(body)
+	case JsonType:
+		return json.Unmarshal(data, body)
+	}
+	return fmt.Errorf("rpc codec: encryption does not support codec type %s", t)
+}
+
+// staticKeyManager 用固定的主密钥包装数据密钥
+type staticKeyManager struct {
+	keyID string
+	key   []byte
+}
+
+// NewStaticKeyManager 用固定的 AES 主密钥（16、24 或 32 字节）包装数据密钥，适合测试或者没有KMS的环境
+func NewStaticKeyManager(keyID string, key []byte) KeyManager {
+	return &staticKeyManager{keyID: keyID, key: key}
+}
+
+func (m *staticKeyManager) WrapKey(dataKey []byte) (string, []byte, error) {
+	nonce, ciphertext, err := aesSeal(m.key, dataKey)
+	if err != nil {
+		return "", nil, err
+	}
+	return m.keyID, append(nonce, ciphertext...), nil
+}
+
+func (m *staticKeyManager) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	if keyID != m.keyID {
+		return nil, fmt.Errorf("rpc codec: unknown key id %q", keyID)
+	}
+	const nonceSize = 12
+	if len(wrapped) < nonceSize {
+		return nil, errors.New("rpc codec: invalid wrapped key")
+	}
+	return aesOpen(m.key, wrapped[:nonceSize], wrapped[nonceSize:])
+}
@@ -0,0 +1,71 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+//
+// 长度前缀的帧
+// 每次写操作作为一帧发送：| Length(uint32, 大端) | Payload(Length 字节) |
+// 编解码器每条消息Flush一次，所以一条不超过缓冲区大小的消息正好是一帧。
+// 读端按帧读取，对端的数据不会因为某一层多读了缓冲而错位
+//
+
+// MaxFrameSize 单帧的最大长度，超过时认为是错误的数据，直接断开连接
+const MaxFrameSize = 64 << 20
+
+var ErrFrameTooLarge = errors.New("rpc codec: frame too large")
+
+type frameConn struct {
+	io.ReadWriteCloser
+	wmu  sync.Mutex
+	rest uint32 // 当前帧还没有读完的字节数
+}
+
+// NewFrameConn 用长度前缀的帧包装连接
+func NewFrameConn(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	return &frameConn{ReadWriteCloser: conn}
+}
+
+func (c *frameConn) Read(p []byte) (int, error) {
+	for c.rest == 0 {
+		var prefix [4]byte
+		if _, err := io.ReadFull(c.ReadWriteCloser, prefix[:]); err != nil {
+			return 0, err
+		}
+		c.rest = binary.BigEndian.Uint32(prefix[:])
+		if c.rest > MaxFrameSize {
+			return 0, ErrFrameTooLarge
+		}
+	}
+	if uint32(len(p)) > c.rest {
+		p = p[:c.rest]
+	}
+	n, err := c.ReadWriteCloser.Read(p)
+	c.rest -= uint32(n)
+	if err == io.EOF && c.rest > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *frameConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(p) > MaxFrameSize {
+		return 0, ErrFrameTooLarge
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	frame := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint32(frame, uint32(len(p)))
+	copy(frame[4:], p)
+	if _, err := c.ReadWriteCloser.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
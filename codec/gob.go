@@ -1,10 +1,10 @@
 package codec
 
 import (
+	"MyRPC/logger"
 	"bufio"
 	"encoding/gob"
 	"io"
-	"log"
 )
 
 /*
@@ -63,11 +63,11 @@ func (c *GobCodec) Write(h *Header, body interface{}) (err error) {
 		}
 	}()
 	if err := c.enc.Encode(h); err != nil {
-		log.Println("rpc codec: gob error encoding header: ", err)
+		logger.Errorf("rpc codec: gob error encoding header: %v", err)
 		return err
 	}
 	if err := c.enc.Encode(body); err != nil {
-		log.Println("rpc codec: gob error encoding body: ", err)
+		logger.Errorf("rpc codec: gob error encoding body: %v", err)
 		return err
 	}
 	return nil
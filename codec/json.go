@@ -1,10 +1,12 @@
 package codec
 
 import (
+	"MyRPC/logger"
 	"bufio"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
+	"reflect"
 )
 
 /*
@@ -22,20 +24,61 @@ import (
 	4. 编码器
 */
 
+// JsonOption Json编解码的可选行为，默认值与encoding/json保持一致
+type JsonOption struct {
+	UseNumber             bool   // 数字解码为json.Number而不是float64，避免int64的ID丢失精度
+	DisallowUnknownFields bool   // 解码时遇到结构体中不存在的字段直接报错，而不是悄悄丢弃
+	DisableHTMLEscape     bool   // 关闭 <、>、& 的转义
+	TimeFormat            string // time.Time（包括结构体字段、切片元素和map的值）使用的格式，为空则使用time.RFC3339Nano，见 jsontime.go
+	StreamArray           bool   // body是切片时逐个元素写出数组，每写完StreamChunk个元素刷新一次缓冲区
+	StreamChunk           int    // 流式数组每次刷新的元素个数，默认64
+}
+
+const defaultStreamChunk = 64
+
+// ArrayReceiver reply实现该接口时，Json编解码器会逐个元素地解码数组，
+// 每解码出一个元素就回调一次OnElem，调用方不必等整个列表到达就能开始处理
+type ArrayReceiver interface {
+	NewElem() interface{}          // 返回一个用于解码的元素指针
+	OnElem(elem interface{}) error // 处理解码出的元素
+}
+
 type JsonCodec struct {
 	conn io.ReadWriteCloser
 	buf  *bufio.Writer
 	dec  *json.Decoder
 	enc  *json.Encoder
+	opt  JsonOption
 }
 
 func NewJsonCodec(conn io.ReadWriteCloser) Codec {
+	return newJsonCodec(conn, JsonOption{})
+}
+
+// NewJsonCodecWithOption 返回按照opt配置的Json编解码器的构造函数
+func NewJsonCodecWithOption(opt JsonOption) NewCodecFunc {
+	return func(conn io.ReadWriteCloser) Codec {
+		return newJsonCodec(conn, opt)
+	}
+}
+
+func newJsonCodec(conn io.ReadWriteCloser, opt JsonOption) *JsonCodec {
 	buf := bufio.NewWriter(conn)
+	dec := json.NewDecoder(conn)
+	if opt.UseNumber {
+		dec.UseNumber()
+	}
+	if opt.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(!opt.DisableHTMLEscape)
 	return &JsonCodec{
 		conn: conn,
 		buf:  buf,
-		dec:  json.NewDecoder(conn),
-		enc:  json.NewEncoder(buf),
+		dec:  dec,
+		enc:  enc,
+		opt:  opt,
 	}
 }
 
@@ -44,7 +87,41 @@ func (j *JsonCodec) ReadHeader(h *Header) error {
 }
 
 func (j *JsonCodec) ReadBody(body interface{}) error {
-	return j.dec.Decode(body)
+	if body == nil {
+		// 与gob一致，body为nil时丢弃这条消息
+		var discard json.RawMessage
+		return j.dec.Decode(&discard)
+	}
+	if r, ok := body.(ArrayReceiver); ok {
+		return j.readArray(r)
+	}
+	return j.decodeValue(body)
+}
+
+// readArray 逐个元素解码数组 [elem, elem, ...]，null视为空数组
+func (j *JsonCodec) readArray(r ArrayReceiver) error {
+	tok, err := j.dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("rpc codec: json expect array, but got %v", tok)
+	}
+	for j.dec.More() {
+		elem := r.NewElem()
+		if err := j.decodeValue(elem); err != nil {
+			return err
+		}
+		if err := r.OnElem(elem); err != nil {
+			return err
+		}
+	}
+	// 读出结尾的 ]
+	_, err = j.dec.Token()
+	return err
 }
 
 func (j *JsonCodec) Write(h *Header, body interface{}) (err error) {
@@ -55,11 +132,16 @@ func (j *JsonCodec) Write(h *Header, body interface{}) (err error) {
 		}
 	}()
 	if err := j.enc.Encode(h); err != nil {
-		log.Println("rpc codec: json error encoding header: ", err)
+		logger.Errorf("rpc codec: json error encoding header: %v", err)
 		return err
 	}
-	if err := j.enc.Encode(body); err != nil {
-		log.Println("rpc codec: json error encoding body: ", err)
+	if j.opt.StreamArray {
+		if v := reflect.Indirect(reflect.ValueOf(body)); v.Kind() == reflect.Slice && !v.IsNil() {
+			return j.writeArray(v)
+		}
+	}
+	if err := j.enc.Encode(j.withTimeFormat(body)); err != nil {
+		logger.Errorf("rpc codec: json error encoding body: %v", err)
 		return err
 	}
 	return nil
@@ -68,3 +150,32 @@ func (j *JsonCodec) Write(h *Header, body interface{}) (err error) {
 func (j *JsonCodec) Close() error {
 	return j.conn.Close()
 }
+
+// writeArray 逐个元素写出切片，每StreamChunk个元素刷新一次，让对端尽早开始解码
+func (j *JsonCodec) writeArray(v reflect.Value) error {
+	chunk := j.opt.StreamChunk
+	if chunk <= 0 {
+		chunk = defaultStreamChunk
+	}
+	if err := j.buf.WriteByte('['); err != nil {
+		return err
+	}
+	for i := 0; i < v.Len(); i++ {
+		if i > 0 {
+			if err := j.buf.WriteByte(','); err != nil {
+				return err
+			}
+		}
+		if err := j.enc.Encode(j.withTimeFormat(v.Index(i).Interface())); err != nil {
+			logger.Errorf("rpc codec: json error encoding array element: %v", err)
+			return err
+		}
+		if (i+1)%chunk == 0 {
+			if err := j.buf.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := j.buf.WriteString("]\n")
+	return err
+}
@@ -0,0 +1,197 @@
+package codec
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type intReceiver struct {
+	got []int
+}
+
+func (r *intReceiver) NewElem() interface{} {
+	return new(int)
+}
+
+func (r *intReceiver) OnElem(elem interface{}) error {
+	r.got = append(r.got, *elem.(*int))
+	return nil
+}
+
+func TestJsonCodec_StreamArray(t *testing.T) {
+	c1, c2 := net.Pipe()
+	w := NewJsonCodecWithOption(JsonOption{StreamArray: true, StreamChunk: 2})(c1)
+	r := NewJsonCodec(c2)
+	list := []int{1, 2, 3, 4, 5}
+	go func() {
+		_ = w.Write(&Header{ServiceMethod: "Foo.List", Seq: 1}, &list)
+	}()
+
+	var h Header
+	if err := r.ReadHeader(&h); err != nil || h.Seq != 1 {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	var recv intReceiver
+	if err := r.ReadBody(&recv); err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if len(recv.got) != len(list) || recv.got[4] != 5 {
+		t.Fatalf("expect %v, but got %v", list, recv.got)
+	}
+}
+
+// jsonRoundTrip 用 wopt 写出 body，再用 ropt 读到 reply 中
+func jsonRoundTrip(t *testing.T, wopt, ropt JsonOption, body, reply interface{}) error {
+	c1, c2 := net.Pipe()
+	defer func() { _ = c2.Close() }()
+	w := NewJsonCodecWithOption(wopt)(c1)
+	r := NewJsonCodecWithOption(ropt)(c2)
+	go func() { _ = w.Write(&Header{ServiceMethod: "Foo.Bar", Seq: 1}, body) }()
+	var h Header
+	if err := r.ReadHeader(&h); err != nil || h.Seq != 1 {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	return r.ReadBody(reply)
+}
+
+func TestJsonCodec_UseNumber(t *testing.T) {
+	id := int64(1<<53 + 1) // float64 无法精确表示
+	body := map[string]int64{"id": id}
+
+	var reply map[string]interface{}
+	if err := jsonRoundTrip(t, JsonOption{}, JsonOption{UseNumber: true}, body, &reply); err != nil {
+		t.Fatal(err)
+	}
+	n, ok := reply["id"].(json.Number)
+	if !ok {
+		t.Fatalf("expect json.Number, got %T", reply["id"])
+	}
+	if v, err := n.Int64(); err != nil || v != id {
+		t.Fatalf("expect %d, got %s: %v", id, n, err)
+	}
+
+	reply = nil
+	if err := jsonRoundTrip(t, JsonOption{}, JsonOption{}, body, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := reply["id"].(float64); !ok || int64(f) == id {
+		t.Fatalf("expect float64 losing precision by default, got %v", reply["id"])
+	}
+}
+
+func TestJsonCodec_DisallowUnknownFields(t *testing.T) {
+	type small struct{ A int }
+	body := map[string]int{"A": 1, "B": 2}
+
+	var reply small
+	if err := jsonRoundTrip(t, JsonOption{}, JsonOption{}, body, &reply); err != nil || reply.A != 1 {
+		t.Fatalf("expect unknown fields dropped by default, got %+v, %v", reply, err)
+	}
+	err := jsonRoundTrip(t, JsonOption{}, JsonOption{DisallowUnknownFields: true}, body, &reply)
+	if err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Fatalf("expect an unknown field error, got %v", err)
+	}
+}
+
+func TestJsonCodec_TimeFormat(t *testing.T) {
+	opt := JsonOption{TimeFormat: "2006-01-02 15:04"}
+	now := time.Date(2024, 5, 6, 7, 8, 0, 0, time.UTC)
+
+	var got time.Time
+	if err := jsonRoundTrip(t, opt, opt, now, &got); err != nil || !got.Equal(now) {
+		t.Fatalf("expect %v, got %v, %v", now, got, err)
+	}
+	got = time.Time{}
+	if err := jsonRoundTrip(t, opt, opt, &now, &got); err != nil || !got.Equal(now) {
+		t.Fatalf("expect %v from a pointer, got %v, %v", now, got, err)
+	}
+	// 写出的是按格式转换的字符串
+	var s string
+	if err := jsonRoundTrip(t, opt, JsonOption{}, now, &s); err != nil || s != "2024-05-06 07:08" {
+		t.Fatalf("expect the formatted time, got %q, %v", s, err)
+	}
+
+	// 结构体字段、指针、切片元素和map的值都按格式转换
+	type Event struct {
+		At    time.Time            `json:"at"`
+		Since *time.Time           `json:"since,omitempty"`
+		Times []time.Time          `json:"times"`
+		ByKey map[string]time.Time `json:"by_key"`
+		Next  *Event               `json:"next,omitempty"`
+	}
+	later := now.Add(time.Hour)
+	in := Event{At: now, Since: &later, Times: []time.Time{now, later}, ByKey: map[string]time.Time{"a": later},
+		Next: &Event{At: later}}
+	var out Event
+	if err := jsonRoundTrip(t, opt, opt, in, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.At.Equal(now) || out.Since == nil || !out.Since.Equal(later) || len(out.Times) != 2 ||
+		!out.Times[1].Equal(later) || !out.ByKey["a"].Equal(later) || out.Next == nil || !out.Next.At.Equal(later) {
+		t.Fatalf("expect %+v, got %+v", in, out)
+	}
+	var raw map[string]interface{}
+	if err := jsonRoundTrip(t, opt, JsonOption{}, in, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["at"] != "2024-05-06 07:08" || raw["since"] != "2024-05-06 08:08" ||
+		raw["by_key"].(map[string]interface{})["a"] != "2024-05-06 08:08" ||
+		raw["next"].(map[string]interface{})["at"] != "2024-05-06 08:08" {
+		t.Fatalf("expect the nested times formatted, got %v", raw)
+	}
+}
+
+func TestJsonCodec_TimeFormatFields(t *testing.T) {
+	opt := JsonOption{TimeFormat: "2006-01-02 15:04"}
+	now := time.Date(2024, 5, 6, 7, 8, 0, 0, time.UTC)
+	type Base struct {
+		ID uint64 `json:"id,string"`
+	}
+	type Record struct {
+		Zone  string    `json:"zone"`
+		Base            // 匿名字段提升到外层
+		At    time.Time `json:"at"`
+		Big   int64     `json:"big"`
+		Note  string    `json:"note,omitempty"`
+		Extra interface{}
+		Alpha string `json:"alpha"`
+	}
+	in := Record{Zone: "2024-05-06T07:08:00Z", Base: Base{ID: 1<<64 - 1}, At: now, Big: 1<<62 + 1,
+		Extra: map[string]int64{"n": 1<<53 + 1}, Alpha: "<a&b>"}
+
+	// 字段按结构体的顺序写出，和 encoding/json 一致，只有 At 换成指定的格式
+	var raw json.RawMessage
+	if err := jsonRoundTrip(t, opt, JsonOption{}, in, &raw); err != nil {
+		t.Fatal(err)
+	}
+	expect := `{"zone":"2024-05-06T07:08:00Z","id":"18446744073709551615","at":"2024-05-06 07:08","big":4611686018427387905,` +
+		`"Extra":{"n":9007199254740993},"alpha":"\u003ca\u0026b\u003e"}`
+	if string(raw) != expect {
+		t.Fatalf("expect %s, got %s", expect, raw)
+	}
+	if err := jsonRoundTrip(t, JsonOption{TimeFormat: opt.TimeFormat, DisableHTMLEscape: true}, JsonOption{}, in, &raw); err != nil ||
+		!strings.Contains(string(raw), `"alpha":"<a&b>"`) {
+		t.Fatalf("expect HTML not escaped, got %s, %v", raw, err)
+	}
+
+	// 大整数不经过 float64，像时间的普通字符串不被转换
+	var out Record
+	if err := jsonRoundTrip(t, opt, JsonOption{TimeFormat: opt.TimeFormat, UseNumber: true}, in, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.ID != in.ID || out.Big != in.Big || out.Zone != in.Zone || !out.At.Equal(now) || out.Alpha != in.Alpha {
+		t.Fatalf("expect %+v, got %+v", in, out)
+	}
+	if n, ok := out.Extra.(map[string]interface{})["n"].(json.Number); !ok || n.String() != "9007199254740993" {
+		t.Fatalf("expect json.Number for the interface field, got %#v", out.Extra)
+	}
+
+	err := jsonRoundTrip(t, JsonOption{}, JsonOption{TimeFormat: opt.TimeFormat, DisallowUnknownFields: true},
+		map[string]string{"at": "2024-05-06 07:08", "other": "x"}, &out)
+	if err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Fatalf("expect an unknown field error, got %v", err)
+	}
+}
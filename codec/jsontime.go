@@ -0,0 +1,474 @@
+package codec
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Json 时间格式
+// encoding/json 总是用 RFC3339 编解码 time.Time，JsonOption.TimeFormat 不为空时改用指定的格式。
+// body 的类型中含有 time.Time 时（包括结构体字段、指针、切片和数组的元素、map 的值），按类型逐层处理，
+// 只有 time.Time 按指定的格式编解码，路径上的结构体、切片和 map 按 encoding/json 的规则（字段顺序、json 标签、
+// omitempty 和 string 选项）写出，其余的值直接交给 encoding/json，数字和字符串原样保留。
+// 实现了 json.Marshaler 或 json.Unmarshaler 的类型自己决定格式，interface{} 类型的字段在解码时不知道具体的类型，
+// 通过未导出的匿名结构体提升的字段无法访问，这几种都不做转换
+//
+
+var (
+	timeType            = reflect.TypeOf(time.Time{})
+	marshalerType       = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	unmarshalerType     = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+	timeTypes sync.Map // reflect.Type -> bool，类型中是否含有需要转换的 time.Time
+)
+
+// hasTime 判断类型中是否含有需要按 TimeFormat 转换的 time.Time
+func hasTime(t reflect.Type) bool {
+	if t == nil {
+		return false
+	}
+	if v, ok := timeTypes.Load(t); ok {
+		return v.(bool)
+	}
+	found := scanTime(t, make(map[reflect.Type]bool))
+	timeTypes.Store(t, found)
+	return found
+}
+
+// scanTime 递归检查类型，visiting 是正在检查的类型，递归的类型再次遇到时当作不含有
+func scanTime(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	if t == timeType {
+		return true
+	}
+	if v, ok := timeTypes.Load(t); ok {
+		return v.(bool)
+	}
+	if visiting[t] {
+		return false
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+	if t.Kind() == reflect.Ptr {
+		return scanTime(t.Elem(), visiting)
+	}
+	if t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType) || reflect.PtrTo(t).Implements(unmarshalerType) {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		return scanTime(t.Elem(), visiting)
+	case reflect.Map:
+		// 键实现了 TextMarshaler 时 encoding/json 用它生成键，这里不处理
+		key := t.Key()
+		if key.Kind() != reflect.String || key.Implements(textMarshalerType) || reflect.PtrTo(key).Implements(textUnmarshalerType) {
+			return false
+		}
+		return scanTime(t.Elem(), visiting)
+	case reflect.Struct:
+		found := false
+		for _, f := range jsonFields(t) {
+			if f.hidden {
+				return false
+			}
+			if scanTime(t.FieldByIndex(f.index).Type, visiting) {
+				found = true
+			}
+		}
+		return found
+	}
+	return false
+}
+
+// jsonField 结构体在 Json 中的一个字段
+type jsonField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+	quoted    bool // string 选项，数字、布尔值和字符串编码成 Json 字符串
+	hidden    bool // 经过未导出的匿名结构体，反射无法读写
+}
+
+var fieldCache sync.Map // reflect.Type -> []jsonField
+
+// jsonFields 结构体在 Json 中的字段，按 encoding/json 的规则处理 json 标签和匿名字段，
+// 浅层的字段优先，顺序和 encoding/json 写出的顺序相同
+func jsonFields(t reflect.Type) []jsonField {
+	if v, ok := fieldCache.Load(t); ok {
+		return v.([]jsonField)
+	}
+	byName := make(map[string]jsonField)
+	var walk func(t reflect.Type, index []int, hidden bool, visited map[reflect.Type]bool)
+	walk = func(t reflect.Type, index []int, hidden bool, visited map[reflect.Type]bool) {
+		if visited[t] {
+			return
+		}
+		visited[t] = true
+		defer delete(visited, t)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			opts := strings.Split(tag, ",")
+			name := opts[0]
+			idx := append(append([]int(nil), index...), i)
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+				walk(ft, idx, hidden || f.PkgPath != "", visited)
+				continue
+			}
+			if f.PkgPath != "" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			jf := jsonField{name: name, index: idx, hidden: hidden}
+			for _, opt := range opts[1:] {
+				jf.omitEmpty = jf.omitEmpty || opt == "omitempty"
+				jf.quoted = jf.quoted || opt == "string"
+			}
+			if old, ok := byName[name]; !ok || len(idx) < len(old.index) {
+				byName[name] = jf
+			}
+		}
+	}
+	walk(t, nil, false, make(map[reflect.Type]bool))
+	fields := make([]jsonField, 0, len(byName))
+	for _, f := range byName {
+		fields = append(fields, f)
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		a, b := fields[i].index, fields[j].index
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+// lookupField 解码时按 Json 中的字段名找到结构体字段，和 encoding/json 一样大小写不敏感
+func lookupField(fields []jsonField, key string) (jsonField, bool) {
+	for _, f := range fields {
+		if f.name == key {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, key) {
+			return f, true
+		}
+	}
+	return jsonField{}, false
+}
+
+// withTimeFormat 编码前调用，body 中含有 time.Time 时返回按 TimeFormat 编码好的 Json，否则原样返回
+func (j *JsonCodec) withTimeFormat(body interface{}) interface{} {
+	if j.opt.TimeFormat == "" || !hasTime(reflect.TypeOf(body)) {
+		return body
+	}
+	var buf bytes.Buffer
+	if err := j.encodeValue(&buf, reflect.ValueOf(body)); err != nil {
+		// 交给编码器报告错误
+		return body
+	}
+	return json.RawMessage(buf.Bytes())
+}
+
+// encodeValue 把 v 编码到 buf，只有 time.Time 按 TimeFormat 编码
+func (j *JsonCodec) encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	if !hasTime(v.Type()) {
+		return j.marshal(buf, v.Interface())
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		return j.encodeValue(buf, v.Elem())
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return j.marshal(buf, v.Interface().(time.Time).Format(j.opt.TimeFormat))
+		}
+		buf.WriteByte('{')
+		first := true
+		for _, f := range jsonFields(v.Type()) {
+			fv, ok := field(v, f.index)
+			if !ok || f.omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			if err := j.marshal(buf, f.name); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if f.quoted && quotable(fv.Kind()) {
+				var quoted bytes.Buffer
+				if err := j.marshal(&quoted, fv.Interface()); err != nil {
+					return err
+				}
+				if err := j.marshal(buf, quoted.String()); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := j.encodeValue(buf, fv); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		buf.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := j.encodeValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		// 和 encoding/json 一样按键排序
+		keys := v.MapKeys()
+		sort.Slice(keys, func(a, b int) bool { return keys[a].String() < keys[b].String() })
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := j.marshal(buf, key.String()); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := j.encodeValue(buf, v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return j.marshal(buf, v.Interface())
+	}
+	return nil
+}
+
+// marshal 按编解码器的 HTML 转义设置编码一个值，不带结尾的换行
+func (j *JsonCodec) marshal(buf *bytes.Buffer, v interface{}) error {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(!j.opt.DisableHTMLEscape)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
+
+// field 按下标取字段，经过的匿名指针为 nil 时返回 false
+func field(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return v, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// fieldForSet 按下标取字段用于解码，经过的匿名指针为 nil 时分配
+func fieldForSet(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// isEmptyValue 和 encoding/json 的 omitempty 判断相同
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// quotable string 选项只对数字、布尔值和字符串生效
+func quotable(k reflect.Kind) bool {
+	switch k {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// decodeValue 解码一个值到 v，v 中含有 time.Time 时按类型逐层解码，其中的时间按 TimeFormat 解析
+func (j *JsonCodec) decodeValue(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if j.opt.TimeFormat == "" || rv.Kind() != reflect.Ptr || rv.IsNil() || !hasTime(rv.Type()) {
+		return j.dec.Decode(v)
+	}
+	var raw json.RawMessage
+	if err := j.dec.Decode(&raw); err != nil {
+		return err
+	}
+	return j.decodeInto(raw, rv.Elem())
+}
+
+// decodeInto 把 data 解码到可以设置的 v
+func (j *JsonCodec) decodeInto(data []byte, v reflect.Value) error {
+	if !hasTime(v.Type()) {
+		return j.unmarshal(data, v.Addr().Interface())
+	}
+	if string(bytes.TrimSpace(data)) == "null" {
+		// 和 encoding/json 一样，null 只清空指针、切片和 map
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return j.decodeInto(data, v.Elem())
+	case reflect.Struct:
+		if v.Type() == timeType {
+			var s string
+			if err := json.Unmarshal(data, &s); err != nil {
+				return err
+			}
+			t, err := time.Parse(j.opt.TimeFormat, s)
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.ValueOf(t))
+			return nil
+		}
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		fields := jsonFields(v.Type())
+		for key, raw := range m {
+			f, ok := lookupField(fields, key)
+			if !ok {
+				if j.opt.DisallowUnknownFields {
+					return fmt.Errorf("json: unknown field %q", key)
+				}
+				continue
+			}
+			fv := fieldForSet(v, f.index)
+			if f.quoted && quotable(fv.Kind()) {
+				var s string
+				if err := json.Unmarshal(raw, &s); err != nil {
+					return err
+				}
+				raw = json.RawMessage(s)
+			}
+			if err := j.decodeInto(raw, fv); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		var arr []json.RawMessage
+		if err := json.Unmarshal(data, &arr); err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(v.Type(), len(arr), len(arr)))
+		}
+		for i := 0; i < v.Len(); i++ {
+			if i >= len(arr) {
+				// 数组比 Json 长时多出的元素置零
+				v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+				continue
+			}
+			if err := j.decodeInto(arr[i], v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), len(m)))
+		}
+		for key, raw := range m {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := j.decodeInto(raw, elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+	default:
+		return j.unmarshal(data, v.Addr().Interface())
+	}
+	return nil
+}
+
+// unmarshal 按编解码器的设置解码不含时间的值
+func (j *JsonCodec) unmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if j.opt.UseNumber {
+		dec.UseNumber()
+	}
+	if j.opt.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
@@ -0,0 +1,54 @@
+package codec
+
+import (
+	"errors"
+	"io"
+)
+
+//
+// 元数据限制
+// 请求头中的 Metadata 由客户端任意填写，几个字节的请求可以带上大量的键值对，服务端解码、限流、
+// 传给服务方法时都要处理它们。MetadataLimits 限制键值对的个数和总字节数，超过限制的请求被拒绝。
+// CompactType 在解码时就检查，超过限制后不再继续分配；其他编码方式由服务端在读出头部之后检查
+//
+
+// ErrMetadataTooLarge 元数据超过了 MetadataLimits
+var ErrMetadataTooLarge = errors.New("rpc codec: metadata too large")
+
+// MetadataLimits 元数据的限制，0 表示不限制
+type MetadataLimits struct {
+	MaxPairs int // 最多的键值对个数
+	MaxBytes int // 所有 key 和 value 的总字节数
+}
+
+// Check 检查 md 是否超过限制
+func (l MetadataLimits) Check(md map[string]string) error {
+	if l.MaxPairs > 0 && len(md) > l.MaxPairs {
+		return ErrMetadataTooLarge
+	}
+	if l.MaxBytes > 0 {
+		n := 0
+		for k, v := range md {
+			if n += len(k) + len(v); n > l.MaxBytes {
+				return ErrMetadataTooLarge
+			}
+		}
+	}
+	return nil
+}
+
+// metadataLimiter 能在解码时检查元数据限制的编解码器
+type metadataLimiter interface {
+	setMetadataLimits(l MetadataLimits)
+}
+
+// WithMetadataLimits 返回的构造函数创建的编解码器支持时，在解码时检查元数据限制
+func WithMetadataLimits(f NewCodecFunc, l MetadataLimits) NewCodecFunc {
+	return func(conn io.ReadWriteCloser) Codec {
+		c := f(conn)
+		if ml, ok := c.(metadataLimiter); ok {
+			ml.setMetadataLimits(l)
+		}
+		return c
+	}
+}
@@ -0,0 +1,98 @@
+package codec
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Stats 单个连接上编解码器的统计信息，字段通过原子操作更新，读取请使用Snapshot
+type Stats struct {
+	FramesRead    uint64 // 成功读取的帧数，header和body各算一帧
+	FramesWritten uint64 // 成功写出的消息数，一次Write(header+body)算一条
+	DecodeErrors  uint64 // 解码失败次数（不包括对端正常关闭产生的EOF）
+	EncodeErrors  uint64 // 编码失败次数
+	BytesRead     uint64 // 从连接上读取的字节数
+	BytesWritten  uint64 // 写入连接的字节数
+
+	ProtocolErrors uint64 // 协议异常次数，由上层的严格模式更新
+}
+
+// Snapshot 返回当前统计信息的一份拷贝
+func (s *Stats) Snapshot() Stats {
+	return Stats{
+		FramesRead:    atomic.LoadUint64(&s.FramesRead),
+		FramesWritten: atomic.LoadUint64(&s.FramesWritten),
+		DecodeErrors:  atomic.LoadUint64(&s.DecodeErrors),
+		EncodeErrors:  atomic.LoadUint64(&s.EncodeErrors),
+		BytesRead:     atomic.LoadUint64(&s.BytesRead),
+		BytesWritten:  atomic.LoadUint64(&s.BytesWritten),
+
+		ProtocolErrors: atomic.LoadUint64(&s.ProtocolErrors),
+	}
+}
+
+// NewStatsCodec 包装编解码器的构造函数，把连接上的帧数、错误数和字节数记录到stats中
+func NewStatsCodec(f NewCodecFunc, stats *Stats) NewCodecFunc {
+	return func(conn io.ReadWriteCloser) Codec {
+		return &statsCodec{
+			Codec: f(&statsConn{ReadWriteCloser: conn, stats: stats}),
+			stats: stats,
+		}
+	}
+}
+
+// statsConn 统计经过连接的字节数
+type statsConn struct {
+	io.ReadWriteCloser
+	stats *Stats
+}
+
+func (c *statsConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	atomic.AddUint64(&c.stats.BytesRead, uint64(n))
+	return n, err
+}
+
+func (c *statsConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	atomic.AddUint64(&c.stats.BytesWritten, uint64(n))
+	return n, err
+}
+
+// statsCodec 统计帧数和编解码错误
+type statsCodec struct {
+	Codec
+	stats *Stats
+}
+
+func (c *statsCodec) ReadHeader(h *Header) error {
+	return c.read(c.Codec.ReadHeader(h))
+}
+
+func (c *statsCodec) ReadBody(body interface{}) error {
+	return c.read(c.Codec.ReadBody(body))
+}
+
+func (c *statsCodec) read(err error) error {
+	switch {
+	case err == nil:
+		atomic.AddUint64(&c.stats.FramesRead, 1)
+	case err != io.EOF && err != io.ErrUnexpectedEOF:
+		atomic.AddUint64(&c.stats.DecodeErrors, 1)
+	}
+	return err
+}
+
+// ConcurrentWrites 统计使用原子操作，是否支持并发写取决于被包装的编解码器
+func (c *statsCodec) ConcurrentWrites() bool {
+	return ConcurrentWrites(c.Codec)
+}
+
+func (c *statsCodec) Write(h *Header, body interface{}) error {
+	if err := c.Codec.Write(h, body); err != nil {
+		atomic.AddUint64(&c.stats.EncodeErrors, 1)
+		return err
+	}
+	atomic.AddUint64(&c.stats.FramesWritten, 1)
+	return nil
+}
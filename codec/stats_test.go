@@ -0,0 +1,51 @@
+package codec
+
+import (
+	"net"
+	"testing"
+)
+
+func TestStatsCodec(t *testing.T) {
+	c1, c2 := net.Pipe()
+	var ws, rs Stats
+	w := NewStatsCodec(NewGobCodec, &ws)(c1)
+	r := NewStatsCodec(NewGobCodec, &rs)(c2)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = w.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, 1)
+		_ = w.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, "not an int")
+	}()
+
+	var h Header
+	var body int
+	if err := r.ReadHeader(&h); err != nil || h.Seq != 1 {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	if err := r.ReadBody(&body); err != nil || body != 1 {
+		t.Fatalf("failed to read body: %d, %v", body, err)
+	}
+	if err := r.ReadHeader(&h); err != nil || h.Seq != 2 {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	if err := r.ReadBody(&body); err == nil {
+		t.Fatal("expect a decode error for a string body")
+	}
+	<-done
+	written := ws.Snapshot().BytesWritten
+	go func() { _, _ = c2.Read(make([]byte, 1024)) }()
+	if err := w.Write(&Header{Seq: 3}, make(chan int)); err == nil {
+		t.Fatal("expect an encode error for a channel body")
+	}
+
+	got, sent := rs.Snapshot(), ws.Snapshot()
+	if got.FramesRead != 3 || got.DecodeErrors != 1 {
+		t.Fatalf("expect 3 frames read and 1 decode error, got %+v", got)
+	}
+	if sent.FramesWritten != 2 || sent.EncodeErrors != 1 {
+		t.Fatalf("expect 2 messages written and 1 encode error, got %+v", sent)
+	}
+	if got.BytesRead == 0 || got.BytesRead != written {
+		t.Fatalf("expect bytes read %d to match bytes written %d", got.BytesRead, written)
+	}
+}
@@ -0,0 +1,10 @@
+module MyRPC/codec/zstd
+
+go 1.17
+
+require (
+	MyRPC v0.0.0
+	github.com/klauspost/compress v1.15.15
+)
+
+replace MyRPC => ../..
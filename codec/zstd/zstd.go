@@ -0,0 +1,62 @@
+// Package zstd 把 zstd 压缩注册为 codec.CompressZstd，引入这个包即可在 Option.CompressType 中使用 "zstd"，
+// 同样支持 codec.RegisterDictionary 注册的预置字典。客户端和服务端都需要引入。
+// 这是单独的模块，github.com/klauspost/compress 只有引入它的程序才需要
+package zstd
+
+import (
+	"MyRPC/codec"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressZstd zstd 压缩，支持预置字典
+const CompressZstd codec.CompressType = "zstd"
+
+// dictID 写在帧头中的字典编号。双方使用的字典在握手时已经按 Option.CompressDict 确定，
+// 所以这里固定一个编号即可，不能为0，0表示没有字典
+const dictID = 1
+
+func init() {
+	codec.RegisterCompressor(CompressZstd, codec.Compressor{
+		NewWriter: func(w io.Writer) codec.FlushWriter {
+			return newWriter(w)
+		},
+		NewReader: func(r io.Reader) (io.Reader, error) {
+			return newReader(r)
+		},
+		// 默认级别在这么短的输入上不会引用预置字典，和 deflate 一样使用更高的压缩级别
+		NewWriterDict: func(w io.Writer, dict []byte) codec.FlushWriter {
+			return newWriter(w, zstd.WithEncoderLevel(zstd.SpeedBetterCompression), zstd.WithEncoderDictRaw(dictID, dict))
+		},
+		NewReaderDict: func(r io.Reader, dict []byte) (io.Reader, error) {
+			return newReader(r, zstd.WithDecoderDictRaw(dictID, dict))
+		},
+	})
+}
+
+// newWriter 单线程压缩，每次 Flush 都把已写入的内容作为一个完整的块写出
+func newWriter(w io.Writer, opts ...zstd.EOption) *zstd.Encoder {
+	// 选项都是合法的，不会出错
+	enc, _ := zstd.NewWriter(w, append([]zstd.EOption{zstd.WithEncoderConcurrency(1)}, opts...)...)
+	return enc
+}
+
+// newReader 单线程解压，不预读后面的数据，读到一个完整的块就返回
+func newReader(r io.Reader, opts ...zstd.DOption) (io.Reader, error) {
+	dec, err := zstd.NewReader(r, append([]zstd.DOption{zstd.WithDecoderConcurrency(1)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	return decoder{dec}, nil
+}
+
+// decoder 解压器持有后台的协程，实现 io.Closer 让连接关闭时释放它们
+type decoder struct {
+	*zstd.Decoder
+}
+
+func (d decoder) Close() error {
+	d.Decoder.Close()
+	return nil
+}
@@ -0,0 +1,141 @@
+package zstd_test
+
+import (
+	"MyRPC"
+	"MyRPC/codec"
+	"MyRPC/codec/zstd"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+type Foo int
+
+type Args struct{ Num1, Num2 int }
+
+func (f Foo) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+// nopCloser 把 bytes.Buffer 当作连接使用
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// 每次写完对端就能读出完整的消息，不需要等后面的数据
+func TestCompressConn_Stream(t *testing.T) {
+	if err := codec.RegisterDictionary(51, []byte(`{"user_id":,"tenant":"acme","status":"active"}`)); err != nil {
+		t.Fatal(err)
+	}
+	for _, dictID := range []uint32{0, 51} {
+		c1, c2 := net.Pipe()
+		w, err := codec.NewCompressConnDict(c1, zstd.CompressZstd, dictID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _ := codec.NewCompressConnDict(c2, zstd.CompressZstd, dictID)
+		for _, msg := range []string{`{"user_id":1,"tenant":"acme","status":"active"}`, `{"user_id":2}`} {
+			written := make(chan struct{})
+			go func(msg string) {
+				defer close(written)
+				_, _ = w.Write([]byte(msg))
+			}(msg)
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(r, got); err != nil || string(got) != msg {
+				t.Fatalf("expect %s with dictionary %d, got %s: %v", msg, dictID, got, err)
+			}
+			// 写完一条再写下一条，连接上的写不能同时进行
+			<-written
+		}
+		_ = r.Close()
+		_ = w.Close()
+	}
+}
+
+// 连接关闭时解压器的后台协程随之退出
+func TestCompressConn_CloseDecoder(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		c1, c2 := net.Pipe()
+		w, _ := codec.NewCompressConn(c1, zstd.CompressZstd)
+		r, _ := codec.NewCompressConn(c2, zstd.CompressZstd)
+		go func() { _, _ = w.Write([]byte("hello")) }()
+		if _, err := io.ReadFull(r, make([]byte, 5)); err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Close()
+		_ = w.Close()
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("expect the decoder goroutines to exit, %d before and %d after", before, n)
+	}
+}
+
+func TestCompressConn_Dictionary(t *testing.T) {
+	dict := []byte(`{"user_id":,"tenant":"acme","status":"active","created_at":"2024-01-01T00:00:00Z"}`)
+	msg := []byte(`{"user_id":42,"tenant":"acme","status":"active","created_at":"2024-03-05T10:20:30Z"}`)
+	if err := codec.RegisterDictionary(52, dict); err != nil {
+		t.Fatal(err)
+	}
+	compress := func(dictID uint32) []byte {
+		var buf bytes.Buffer
+		conn, err := codec.NewCompressConnDict(nopCloser{&buf}, zstd.CompressZstd, dictID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	plain, withDict := compress(0), compress(52)
+	if len(withDict) >= len(plain)/2 {
+		t.Fatalf("expect the dictionary to shrink the payload, got %d bytes without and %d with", len(plain), len(withDict))
+	}
+
+	conn, _ := codec.NewCompressConnDict(nopCloser{bytes.NewBuffer(withDict)}, zstd.CompressZstd, 52)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("expect %s, got %s: %v", msg, got, err)
+	}
+	if err := codec.CheckCompress(zstd.CompressZstd, 53); err == nil {
+		t.Fatal("expect an unknown dictionary to be rejected")
+	}
+}
+
+func TestClient_Zstd(t *testing.T) {
+	if err := codec.RegisterDictionary(54, []byte(`{"Num1":,"Num2":}`)); err != nil {
+		t.Fatal(err)
+	}
+	server := MyRPC.NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	for _, dictID := range []uint32{0, 54} {
+		opt := &MyRPC.Option{CodecType: codec.JsonType, CompressType: zstd.CompressZstd, CompressDict: dictID, HandshakeAck: true}
+		client, err := MyRPC.Dial("tcp", l.Addr().String(), opt)
+		if err != nil {
+			t.Fatalf("failed to dial with dictionary %d: %v", dictID, err)
+		}
+		for i := 0; i < 3; i++ {
+			var reply int
+			if err := client.Call(context.Background(), "Foo.Sum", Args{Num1: i, Num2: 1}, &reply); err != nil || reply != i+1 {
+				t.Fatalf("expect %d with dictionary %d, got %d: %v", i+1, dictID, reply, err)
+			}
+		}
+		_ = client.Close()
+	}
+}
@@ -0,0 +1,164 @@
+// Package conformance 提供协议一致性测试的服务端和脚本化的用例。
+//
+// 其他语言实现的客户端连接到 cmd/conformance 启动的服务端，按 Cases 返回的用例逐条调用，
+// 比较响应和期望值，就能确认握手、编码、超时、取消和错误信息都与 Go 的实现一致。
+// 用例的参数和返回值都是 Json，客户端需要使用 application/json 编码方式。
+package conformance
+
+import (
+	"MyRPC"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ServiceName 一致性测试服务注册的名字
+const ServiceName = "Conformance"
+
+// Service 一致性测试服务
+type Service struct{}
+
+type EchoArgs struct {
+	Text string
+}
+
+type AddArgs struct {
+	A, B int
+}
+
+type FailArgs struct {
+	Message string
+}
+
+type SleepArgs struct {
+	Millis int
+}
+
+// Echo 原样返回参数
+func (s *Service) Echo(args EchoArgs, reply *EchoArgs) error {
+	*reply = args
+	return nil
+}
+
+// Add 返回两数之和
+func (s *Service) Add(args AddArgs, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+// Fail 以参数中的信息返回错误
+func (s *Service) Fail(args FailArgs, reply *struct{}) error {
+	return errors.New(args.Message)
+}
+
+// Sleep 等待指定的时间，请求的截止时间先到时返回 ctx 的错误
+func (s *Service) Sleep(ctx context.Context, args SleepArgs, reply *int) error {
+	select {
+	case <-time.After(time.Duration(args.Millis) * time.Millisecond):
+		*reply = args.Millis
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Metadata 返回请求携带的元数据
+func (s *Service) Metadata(ctx context.Context, args struct{}, reply *map[string]string) error {
+	*reply = MyRPC.MetadataFromContext(ctx)
+	return nil
+}
+
+// Register 把一致性测试服务注册到 server
+func Register(server *MyRPC.Server) error {
+	return server.RegisterName(ServiceName, new(Service))
+}
+
+// Case 一条用例
+type Case struct {
+	Name          string
+	ServiceMethod string
+	Args          json.RawMessage
+	Metadata      map[string]string `json:",omitempty"`
+	Deadline      int               `json:",omitempty"` // 请求的截止时间，单位毫秒，相对于发送时刻
+	Reply         json.RawMessage   `json:",omitempty"` // 期望的响应，Error 不为空时忽略
+	Error         string            `json:",omitempty"` // 期望响应头 Error 以此开头
+	Abandon       int               `json:",omitempty"` // 客户端等待多少毫秒后放弃这次调用，之后的用例必须仍能在同一连接上成功
+}
+
+// Cases 按顺序执行的用例，所有用例在同一个连接上执行
+func Cases() []Case {
+	return []Case{
+		{Name: "echo", ServiceMethod: "Conformance.Echo", Args: raw(`{"Text":"hello"}`), Reply: raw(`{"Text":"hello"}`)},
+		{Name: "add", ServiceMethod: "Conformance.Add", Args: raw(`{"A":1,"B":2}`), Reply: raw(`3`)},
+		{Name: "ping", ServiceMethod: "_myrpc.Ping", Args: raw(`null`), Reply: raw(`true`)},
+		{Name: "metadata", ServiceMethod: "Conformance.Metadata", Args: raw(`{}`), Metadata: map[string]string{"trace": "abc"}, Reply: raw(`{"trace":"abc"}`)},
+		{Name: "error", ServiceMethod: "Conformance.Fail", Args: raw(`{"Message":"boom"}`), Error: "boom"},
+		{Name: "unknown service", ServiceMethod: "Nope.Echo", Args: raw(`{}`), Error: "rpc server: can't find service"},
+		{Name: "unknown method", ServiceMethod: "Conformance.Nope", Args: raw(`{}`), Error: "rpc server: can't find method"},
+		{Name: "ill-formed method", ServiceMethod: "Echo", Args: raw(`{}`), Error: "rpc server: server/method request ill-formed"},
+		{Name: "deadline", ServiceMethod: "Conformance.Sleep", Args: raw(`{"Millis":1000}`), Deadline: 50, Error: context.DeadlineExceeded.Error()},
+		{Name: "abandon", ServiceMethod: "Conformance.Sleep", Args: raw(`{"Millis":200}`), Abandon: 20},
+		{Name: "after abandon", ServiceMethod: "Conformance.Echo", Args: raw(`{"Text":"still alive"}`), Reply: raw(`{"Text":"still alive"}`)},
+	}
+}
+
+func raw(s string) json.RawMessage {
+	return json.RawMessage(s)
+}
+
+// Run 用 Go 的客户端执行所有用例，client 需要使用 Json 编码方式，返回第一个不符合期望的用例的错误
+func Run(client *MyRPC.Client) error {
+	for _, c := range Cases() {
+		if err := runCase(client, c); err != nil {
+			return fmt.Errorf("conformance: case %q: %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+func runCase(client *MyRPC.Client, c Case) error {
+	ctx := context.Background()
+	if c.Metadata != nil {
+		ctx = MyRPC.WithMetadata(ctx, c.Metadata)
+	}
+	var cancel context.CancelFunc = func() {}
+	if c.Deadline > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.Deadline)*time.Millisecond)
+	}
+	if c.Abandon > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.Abandon)*time.Millisecond)
+	}
+	defer cancel()
+	var reply json.RawMessage
+	err := client.Call(ctx, c.ServiceMethod, c.Args, &reply)
+	switch {
+	case c.Abandon > 0:
+		if err == nil {
+			return errors.New("expect the call to be abandoned")
+		}
+		return nil
+	case c.Error != "":
+		// 截止时间到达时 Go 的客户端可能先于服务端返回，错误信息带有前缀，所以这里只检查包含
+		if err == nil || !strings.Contains(err.Error(), c.Error) {
+			return fmt.Errorf("expect error %q, got %v", c.Error, err)
+		}
+		return nil
+	case err != nil:
+		return err
+	}
+	var got, want interface{}
+	if err := json.Unmarshal(reply, &got); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(c.Reply, &want); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("expect reply %s, got %s", c.Reply, reply)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package conformance
+
+import (
+	"MyRPC"
+	"MyRPC/codec"
+	"net"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	server := MyRPC.NewServer()
+	if err := Register(server); err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+
+	client, err := MyRPC.Dial("tcp", l.Addr().String(), &MyRPC.Option{
+		MagicNumber: MyRPC.MagicNumber,
+		CodecType:   codec.JsonType,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := Run(client); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,79 @@
+package MyRPC
+
+import (
+	"MyRPC/client"
+	"MyRPC/codec"
+	"context"
+	"io"
+	"sort"
+	"time"
+)
+
+//
+// 连接信息与统计
+// 当解码错误的指标突然升高时，需要能定位到是哪一个对端在发送错误的帧，所以每个连接都单独记录编解码器的统计信息
+//
+
+// ConnInfo 一个连接的基本信息和编解码统计
+type ConnInfo struct {
+	RemoteAddr string      // 对端地址，无法获取时为空
+	CodecType  codec.Type  // 协商的编码方式
+	Since      time.Time   // 连接建立的时间
+	Pending    int         // 正在处理的请求数
+	Stats      codec.Stats // 编解码统计
+}
+
+// connInfo 服务端内部记录的连接，stats由编解码器实时更新
+type connInfo struct {
+	remoteAddr string
+	codecType  codec.Type
+	since      time.Time
+	stats      codec.Stats
+	active     *seqSet // 正在处理的请求的seq
+	token      string  // 握手时的鉴权令牌，供 Authorizer 使用，不出现在 ConnInfo 中
+
+	// 连接的 ctx，处理请求的 ctx 都从它派生。cancel 不为 nil 时，读请求的循环结束（连接断开）后调用它，
+	// 取消还在处理的请求
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (ci *connInfo) info() ConnInfo {
+	return ConnInfo{
+		RemoteAddr: ci.remoteAddr,
+		CodecType:  ci.codecType,
+		Since:      ci.since,
+		Pending:    ci.active.len(),
+		Stats:      ci.stats.Snapshot(),
+	}
+}
+
+// trackConn 开始记录一个连接，返回的函数用于在连接关闭时移除记录
+func (server *Server) trackConn(conn io.ReadWriteCloser, opt *Option) (*connInfo, func()) {
+	ci := &connInfo{
+		remoteAddr: client.RemoteAddr(conn),
+		codecType:  opt.CodecType,
+		since:      time.Now(),
+		active:     newSeqSet(),
+		token:      opt.Token,
+	}
+	ci.ctx, ci.cancel = context.WithCancel(context.Background())
+	server.conns.Store(ci, struct{}{})
+	return ci, func() {
+		ci.cancel()
+		server.conns.Delete(ci)
+	}
+}
+
+// Conns 返回当前所有连接的信息，按建立时间排序
+func (server *Server) Conns() []ConnInfo {
+	var conns []ConnInfo
+	server.conns.Range(func(ci, _ interface{}) bool {
+		conns = append(conns, ci.(*connInfo).info())
+		return true
+	})
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Since.Before(conns[j].Since)
+	})
+	return conns
+}
@@ -0,0 +1,118 @@
+// Package etcd 基于 etcd 的服务发现，服务端使用 registry.EtcdRegistrar 注册。
+// 引入这个包后 xclient.NewDiscovery 支持 etcd://10.0.0.1:2379,10.0.0.2:2379/myrpc/servers/ 这样的地址
+package etcd
+
+import (
+	"MyRPC/logger"
+	"MyRPC/registry"
+	"MyRPC/xclient"
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+func init() {
+	xclient.RegisterDiscoveryProvider("etcd", newDiscovery)
+}
+
+type Discovery struct {
+	*xclient.MultiServersDiscovery
+	mu         sync.Mutex
+	client     *registry.EtcdClient
+	prefix     string        // 服务列表的前缀，和服务端注册时一致
+	timeout    time.Duration // 服务列表的过期时间
+	lastUpdate time.Time
+}
+
+var _ xclient.KeyedDiscovery = (*Discovery)(nil)
+
+// NewDiscovery 创建基于 etcd 的服务发现，prefix 为空时使用 registry.DefaultEtcdPrefix
+func NewDiscovery(endpoints []string, prefix string, timeout time.Duration) *Discovery {
+	if prefix == "" {
+		prefix = registry.DefaultEtcdPrefix
+	}
+	if timeout == 0 {
+		timeout = xclient.DefaultUpdateTimeout
+	}
+	return &Discovery{
+		MultiServersDiscovery: xclient.NewMultiServerDiscovery(make([]string, 0)),
+		client:                registry.NewEtcdClient(endpoints),
+		prefix:                prefix,
+		timeout:               timeout,
+	}
+}
+
+// newDiscovery etcd://host:2379,host2:2379/前缀?timeout=
+func newDiscovery(target *url.URL) (xclient.Discovery, error) {
+	timeout, err := xclient.TargetTimeout(target)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	for _, h := range xclient.TargetHosts(target) {
+		endpoints = append(endpoints, "http://"+h)
+	}
+	prefix := target.Path
+	if prefix == "/" {
+		prefix = ""
+	}
+	return NewDiscovery(endpoints, prefix, timeout), nil
+}
+
+func (d *Discovery) Update(servers []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastUpdate = time.Now()
+	return d.MultiServersDiscovery.Update(servers)
+}
+
+// Refresh 服务列表过期后从 etcd 重新读取
+func (d *Discovery) Refresh() error {
+	return d.RefreshContext(context.Background())
+}
+
+// RefreshContext 和 Refresh 相同，ctx 结束时放弃向 etcd 的请求
+func (d *Discovery) RefreshContext(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lastUpdate.Add(d.timeout).After(time.Now()) {
+		return nil
+	}
+	logger.Debugf("rpc registry: refresh servers from etcd prefix %s", d.prefix)
+	servers, err := d.client.RangeContext(ctx, d.prefix)
+	if err != nil {
+		logger.Warnf("rpc registry refresh err: %v", err)
+		return err
+	}
+	d.lastUpdate = time.Now()
+	return d.MultiServersDiscovery.Update(servers)
+}
+
+func (d *Discovery) Get(mode xclient.SelectMode) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServersDiscovery.Get(mode)
+}
+
+func (d *Discovery) GetFor(key string) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServersDiscovery.GetFor(key)
+}
+
+func (d *Discovery) GetAll() ([]string, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.MultiServersDiscovery.GetAll()
+}
+
+func (d *Discovery) Members() ([]string, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.MultiServersDiscovery.Members()
+}
@@ -0,0 +1,52 @@
+package etcd
+
+import (
+	"MyRPC/registry"
+	"MyRPC/registry/registrytest"
+	"MyRPC/xclient"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiscovery(t *testing.T) {
+	_, ts := registrytest.StartEtcd()
+	defer ts.Close()
+	r := registry.NewEtcdRegistrar([]string{ts.URL}, "/test/", time.Minute)
+	defer func() { _ = r.Close() }()
+	for _, addr := range []string{"tcp@a", "tcp@b"} {
+		if err := r.Register(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewDiscovery([]string{ts.URL}, "/test/", time.Nanosecond)
+	if servers, err := d.GetAll(); err != nil || strings.Join(servers, ",") != "tcp@a,tcp@b" {
+		t.Fatalf("expect tcp@a,tcp@b, got %v, %v", servers, err)
+	}
+	if err := r.Deregister("tcp@a"); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := d.Get(xclient.RoundRobinSelect); err != nil || s != "tcp@b" {
+		t.Fatalf("expect tcp@b after tcp@a deregistered, got %s, %v", s, err)
+	}
+}
+
+// 引入本包后 xclient.NewDiscovery 支持 etcd:// 地址
+func TestNewDiscovery_Etcd(t *testing.T) {
+	_, ts := registrytest.StartEtcd()
+	defer ts.Close()
+	r := registry.NewEtcdRegistrar([]string{ts.URL}, "/test/", time.Minute)
+	defer func() { _ = r.Close() }()
+	if err := r.Register("tcp@a"); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := xclient.NewDiscovery("etcd://" + strings.TrimPrefix(ts.URL, "http://") + "/test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if servers, err := d.GetAll(); err != nil || strings.Join(servers, ",") != "tcp@a" {
+		t.Fatalf("expect tcp@a from etcd, got %v, %v", servers, err)
+	}
+}
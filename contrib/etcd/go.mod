@@ -0,0 +1,7 @@
+module MyRPC/contrib/etcd
+
+go 1.17
+
+require MyRPC v0.0.0
+
+replace MyRPC => ../..
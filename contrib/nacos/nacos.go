@@ -0,0 +1,199 @@
+// Package nacos 基于 Nacos 的服务发现，通过 Nacos 的 Open API（/nacos/v1/ns/instance/list）读取健康的实例。
+// 实例的 metadata 中 protocol 作为 protocol@addr 中的协议，没有时使用 tcp。
+// 引入这个包后 xclient.NewDiscovery 支持 nacos://127.0.0.1:8848/Foo?group=DEFAULT_GROUP 这样的地址
+package nacos
+
+import (
+	"MyRPC/logger"
+	"MyRPC/xclient"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	xclient.RegisterDiscoveryProvider("nacos", newDiscovery)
+}
+
+type Discovery struct {
+	*xclient.MultiServersDiscovery
+	mu         sync.Mutex
+	endpoints  []string // Nacos 地址，当前地址不可用则依次尝试后面的地址
+	current    int
+	service    string
+	group      string
+	namespace  string
+	timeout    time.Duration
+	lastUpdate time.Time
+	client     *http.Client
+}
+
+var _ xclient.KeyedDiscovery = (*Discovery)(nil)
+
+// Option Nacos 服务发现的配置
+type Option struct {
+	Servers   []string      // Nacos 地址，形如 http://127.0.0.1:8848
+	Service   string        // 服务名
+	Group     string        // 分组，为空时使用 Nacos 的默认分组
+	Namespace string        // 命名空间 ID，为空时使用 public
+	Timeout   time.Duration // 服务列表的过期时间
+}
+
+func NewDiscovery(opt Option) *Discovery {
+	if opt.Timeout == 0 {
+		opt.Timeout = xclient.DefaultUpdateTimeout
+	}
+	return &Discovery{
+		MultiServersDiscovery: xclient.NewMultiServerDiscovery(make([]string, 0)),
+		endpoints:             opt.Servers,
+		service:               opt.Service,
+		group:                 opt.Group,
+		namespace:             opt.Namespace,
+		timeout:               opt.Timeout,
+		client:                &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// newDiscovery nacos://host:8848,host2:8848/服务名?group=&namespace=&timeout=
+func newDiscovery(target *url.URL) (xclient.Discovery, error) {
+	timeout, err := xclient.TargetTimeout(target)
+	if err != nil {
+		return nil, err
+	}
+	opt := Option{
+		Service:   strings.TrimPrefix(target.Path, "/"),
+		Group:     target.Query().Get("group"),
+		Namespace: target.Query().Get("namespace"),
+		Timeout:   timeout,
+	}
+	if opt.Service == "" {
+		return nil, errors.New("rpc discovery: nacos service name is required")
+	}
+	for _, h := range xclient.TargetHosts(target) {
+		opt.Servers = append(opt.Servers, "http://"+h)
+	}
+	return NewDiscovery(opt), nil
+}
+
+func (d *Discovery) Update(servers []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastUpdate = time.Now()
+	return d.MultiServersDiscovery.Update(servers)
+}
+
+// Refresh 服务列表过期后从 Nacos 重新读取
+func (d *Discovery) Refresh() error {
+	return d.RefreshContext(context.Background())
+}
+
+// RefreshContext 和 Refresh 相同，ctx 结束时放弃向 Nacos 的请求
+func (d *Discovery) RefreshContext(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lastUpdate.Add(d.timeout).After(time.Now()) {
+		return nil
+	}
+	var err error
+	for i := 0; i < len(d.endpoints); i++ {
+		idx := (d.current + i) % len(d.endpoints)
+		var servers []string
+		if servers, err = d.fetch(ctx, d.endpoints[idx]); err == nil {
+			d.current = idx
+			d.lastUpdate = time.Now()
+			return d.MultiServersDiscovery.Update(servers)
+		}
+		logger.Warnf("rpc registry: nacos %s unavailable: %v", d.endpoints[idx], err)
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+	if err == nil {
+		err = errors.New("rpc registry: no nacos server configured")
+	}
+	return err
+}
+
+type nacosInstance struct {
+	IP       string            `json:"ip"`
+	Port     int               `json:"port"`
+	Healthy  bool              `json:"healthy"`
+	Enabled  bool              `json:"enabled"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// fetch 读取服务的健康实例
+func (d *Discovery) fetch(ctx context.Context, server string) ([]string, error) {
+	q := url.Values{"serviceName": {d.service}, "healthyOnly": {"true"}}
+	if d.group != "" {
+		q.Set("groupName", d.group)
+	}
+	if d.namespace != "" {
+		q.Set("namespaceId", d.namespace)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(server, "/")+"/nacos/v1/ns/instance/list?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("rpc registry: nacos unexpected status " + resp.Status)
+	}
+	var out struct {
+		Hosts []nacosInstance `json:"hosts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	servers := make([]string, 0, len(out.Hosts))
+	for _, h := range out.Hosts {
+		if !h.Healthy || !h.Enabled {
+			continue
+		}
+		protocol := h.Metadata["protocol"]
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		servers = append(servers, protocol+"@"+net.JoinHostPort(h.IP, strconv.Itoa(h.Port)))
+	}
+	return servers, nil
+}
+
+func (d *Discovery) Get(mode xclient.SelectMode) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServersDiscovery.Get(mode)
+}
+
+func (d *Discovery) GetFor(key string) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServersDiscovery.GetFor(key)
+}
+
+func (d *Discovery) GetAll() ([]string, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.MultiServersDiscovery.GetAll()
+}
+
+func (d *Discovery) Members() ([]string, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.MultiServersDiscovery.Members()
+}
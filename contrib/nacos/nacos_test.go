@@ -0,0 +1,33 @@
+package nacos
+
+import (
+	"MyRPC/xclient"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewDiscovery_Nacos(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		if req.URL.Path != "/nacos/v1/ns/instance/list" || q.Get("serviceName") != "Foo" || q.Get("groupName") != "g" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"hosts":[
+			{"ip":"10.0.0.1","port":9999,"healthy":true,"enabled":true},
+			{"ip":"10.0.0.2","port":9999,"healthy":true,"enabled":true,"metadata":{"protocol":"unix"}},
+			{"ip":"10.0.0.3","port":9999,"healthy":true,"enabled":false}]}`))
+	}))
+	defer ts.Close()
+
+	host := strings.TrimPrefix(ts.URL, "http://")
+	d, err := xclient.NewDiscovery("nacos://127.0.0.1:1," + host + "/Foo?group=g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if servers, err := d.GetAll(); err != nil || strings.Join(servers, ",") != "tcp@10.0.0.1:9999,unix@10.0.0.2:9999" {
+		t.Fatalf("expect enabled instances from nacos, got %v, %v", servers, err)
+	}
+}
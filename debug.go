@@ -1,28 +1,115 @@
 package MyRPC
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
+	"sort"
+	"time"
 )
 
 //
 // 我们在 /debug/myrpc 上展示服务的调用统计视图。
+// 除了注册的服务和方法，还有服务端的运行状态、每个连接正在处理的请求数、注册中心的心跳状态以及最近的慢调用，
+// 带上 ?format=json 时以 JSON 输出，方便监控面板抓取
 //
 
 const debugText = `<html>
 	<body>
 	<title>MyRPC Services</title>
-	{{range .}}
+	{{range .Services}}
 	<hr>
 	Service {{.Name}}
 	<hr>
 		<table>
-		<th align=center>Method</th><th align=center>Calls</th>
-		{{range $name, $mtype := .Method}}
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Errors</th><th align=center>Inflight</th>
+		<th align=center>P50</th><th align=center>P90</th><th align=center>P99</th>
+		{{range .Methods}}
 			<tr>
-			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
-			<td align=center>{{$mtype.NumCalls}}</td>
+			<td align=left font=fixed>{{.Name}}({{.ArgType}}, {{.ReplyType}}) error</td>
+			<td align=center>{{.Calls}}</td>
+			<td align=center>{{.Errors}}</td>
+			<td align=center>{{.Inflight}}</td>
+			<td align=center>{{.P50}}</td>
+			<td align=center>{{.P90}}</td>
+			<td align=center>{{.P99}}</td>
+			</tr>
+			{{if or .Description .Example}}
+			<tr>
+			<td align=left colspan=7>{{.Description}}{{if .Example}}<br>example: <code>{{.Example}}</code>{{end}}{{if .ExampleReply}} =&gt; <code>{{.ExampleReply}}</code>{{end}}</td>
+			</tr>
+			{{end}}
+		{{end}}
+		</table>
+	{{end}}
+	<hr>
+	Server
+	<hr>
+		<table>
+		<th align=center>Inflight</th><th align=center>Rejected</th><th align=center>Connections</th>
+			<tr>
+			<td align=center>{{.Stats.Inflight}}</td>
+			<td align=center>{{.Stats.Rejected}}</td>
+			<td align=center>{{.Stats.Conns}}</td>
+			</tr>
+		</table>
+	<hr>
+	Connections
+	<hr>
+		<table>
+		<th align=center>Remote</th><th align=center>Codec</th><th align=center>Since</th><th align=center>Pending</th>
+		<th align=center>Frames In</th><th align=center>Frames Out</th><th align=center>Decode Errors</th>
+		<th align=center>Encode Errors</th><th align=center>Bytes In</th><th align=center>Bytes Out</th>
+		{{range .Conns}}
+			<tr>
+			<td align=left font=fixed>{{.RemoteAddr}}</td>
+			<td align=center>{{.CodecType}}</td>
+			<td align=center>{{.Since.Format "2006-01-02 15:04:05"}}</td>
+			<td align=center>{{.Pending}}</td>
+			<td align=center>{{.Stats.FramesRead}}</td>
+			<td align=center>{{.Stats.FramesWritten}}</td>
+			<td align=center>{{.Stats.DecodeErrors}}</td>
+			<td align=center>{{.Stats.EncodeErrors}}</td>
+			<td align=center>{{.Stats.BytesRead}}</td>
+			<td align=center>{{.Stats.BytesWritten}}</td>
+			</tr>
+		{{end}}
+		</table>
+	<hr>
+	Registry Heartbeat
+	<hr>
+		{{with .Heartbeat}}
+		{{if .Last.IsZero}}
+		never sent
+		{{else}}
+		<table>
+		<th align=center>Registry</th><th align=center>Addr</th><th align=center>Last</th><th align=center>Error</th>
+			<tr>
+			<td align=left font=fixed>{{.Registry}}</td>
+			<td align=left font=fixed>{{.Addr}}</td>
+			<td align=center>{{.Last.Format "2006-01-02 15:04:05"}}</td>
+			<td align=left>{{.LastError}}</td>
+			</tr>
+		</table>
+		{{end}}
+		{{end}}
+	{{if .SlowCalls}}
+	<hr>
+	Slow Calls
+	<hr>
+		<table>
+		<th align=center>Start</th><th align=center>Method</th><th align=center>Remote</th><th align=center>Request ID</th>
+		<th align=center>Duration</th><th align=center>Args</th><th align=center>Error</th>
+		{{range .SlowCalls}}
+			<tr>
+			<td align=center>{{.Start.Format "2006-01-02 15:04:05"}}</td>
+			<td align=left font=fixed>{{.ServiceMethod}}</td>
+			<td align=left font=fixed>{{.RemoteAddr}}</td>
+			<td align=left font=fixed>{{.RequestID}}</td>
+			<td align=center>{{.Duration}}</td>
+			<td align=left><code>{{.Args}}</code></td>
+			<td align=left>{{.Error}}</td>
 			</tr>
 		{{end}}
 		</table>
@@ -36,24 +123,84 @@ type debugHTTP struct {
 	*Server
 }
 
+type debugMethod struct {
+	Name         string
+	ArgType      string
+	ReplyType    string
+	Calls        uint64
+	Errors       uint64
+	Inflight     int64
+	P50          time.Duration
+	P90          time.Duration
+	P99          time.Duration
+	Description  string `json:",omitempty"`
+	Example      string `json:",omitempty"` // 参数示例的 Json
+	ExampleReply string `json:",omitempty"`
+}
+
 type debugService struct {
-	Name   string
-	Method map[string]*methodType
+	Name    string
+	Methods []debugMethod
 }
 
-// Runs at /debug/myrpc
-func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	// Build a sorted version of the data.
+// debugData 调试页面展示的全部数据
+type debugData struct {
+	Services  []debugService
+	Stats     ServerStats
+	Conns     []ConnInfo
+	Heartbeat HeartbeatStatus
+	SlowCalls []SlowCall `json:",omitempty"`
+}
+
+// debugData 收集服务端当前的状态，服务和方法按名称排序
+func (server debugHTTP) debugData() debugData {
 	var services []debugService
 	server.serviceMap.Range(func(namei, svci interface{}) bool {
 		svc := svci.(*service)
-		services = append(services, debugService{
-			Name:   namei.(string),
-			Method: svc.method,
-		})
+		ds := debugService{Name: namei.(string)}
+		for name, mtype := range svc.method {
+			st := mtype.snapshot(ds.Name + "." + name)
+			ds.Methods = append(ds.Methods, debugMethod{
+				Name:      name,
+				ArgType:   mtype.ArgType.String(),
+				ReplyType: mtype.ReplyType.String(),
+				Calls:     st.Calls,
+				Errors:    st.Errors,
+				Inflight:  st.Inflight,
+				P50:       st.P50,
+				P90:       st.P90,
+				P99:       st.P99,
+
+				Description:  mtype.doc.description,
+				Example:      string(mtype.doc.example),
+				ExampleReply: string(mtype.doc.exampleReply),
+			})
+		}
+		sort.Slice(ds.Methods, func(i, j int) bool { return ds.Methods[i].Name < ds.Methods[j].Name })
+		services = append(services, ds)
 		return true
 	})
-	err := debug.Execute(w, services)
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return debugData{
+		Services:  services,
+		Stats:     server.Stats(),
+		Conns:     server.Conns(),
+		Heartbeat: server.LastHeartbeat(),
+		SlowCalls: server.SlowCalls(),
+	}
+}
+
+// Runs at /debug/myrpc
+func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data := server.debugData()
+	if req.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	err := debug.Execute(w, data)
 	if err != nil {
 		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
 	}
@@ -0,0 +1,96 @@
+package MyRPC
+
+import (
+	"go/build"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 客户端和服务端只通过 regclient 访问注册中心，不引入注册中心本身的代码；regclient 只依赖标准库；
+// lite 是精简的客户端，只依赖 codec 和握手常量所在的 wire。新增的依赖需要在这里确认。
+// client 和 xclient 不引入服务端，只调用服务的程序不会链接服务端和调试页面；etcd、Nacos 等服务发现后端在 contrib 中，
+// xclient 不依赖它们
+var allowedDeps = map[string][]string{
+	"MyRPC":                    {"MyRPC/callopt", "MyRPC/client", "MyRPC/codec", "MyRPC/logger", "MyRPC/registry/regclient", "MyRPC/wire"},
+	"MyRPC/client":             {"MyRPC/callopt", "MyRPC/codec", "MyRPC/logger", "MyRPC/wire"},
+	"MyRPC/xclient":            {"MyRPC/callopt", "MyRPC/client", "MyRPC/codec", "MyRPC/logger", "MyRPC/registry/regclient", "MyRPC/wire"},
+	"MyRPC/codec":              {"MyRPC/logger"},
+	"MyRPC/callopt":            {"MyRPC/codec", "MyRPC/logger"},
+	"MyRPC/registry/regclient": nil,
+	"MyRPC/lite":               {"MyRPC/codec", "MyRPC/logger", "MyRPC/wire"},
+	"MyRPC/wire":               {"MyRPC/codec", "MyRPC/logger"},
+}
+
+// forbiddenDeps 包不能引入的标准库，包括间接依赖
+var forbiddenDeps = map[string][]string{
+	"MyRPC/lite":    {"net/http", "crypto/tls"},
+	"MyRPC/client":  {"html/template"},
+	"MyRPC/xclient": {"html/template"},
+}
+
+// moduleDeps 把 pkg 依赖的本模块中的包（不包括测试文件）记录到 seen，包括间接依赖；
+// std 不为 nil 时同时记录标准库的包
+func moduleDeps(t *testing.T, pkg string, seen, std map[string]bool) {
+	var p *build.Package
+	var err error
+	if inModule(pkg) {
+		dir := filepath.FromSlash(strings.TrimPrefix(strings.TrimPrefix(pkg, "MyRPC"), "/"))
+		if dir == "" {
+			dir = "."
+		}
+		p, err = build.ImportDir(dir, 0)
+	} else {
+		p, err = build.Import(pkg, "", 0)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, imp := range p.Imports {
+		switch {
+		case inModule(imp) && !seen[imp]:
+			seen[imp] = true
+			moduleDeps(t, imp, seen, std)
+		case !inModule(imp) && std != nil && !std[imp] && isStd(imp):
+			std[imp] = true
+			moduleDeps(t, imp, seen, std)
+		}
+	}
+}
+
+// isStd 标准库中可以解析的包，标准库内部 vendor 的 golang.org/x 包不关心
+func isStd(pkg string) bool {
+	return pkg != "C" && pkg != "unsafe" && !strings.Contains(strings.SplitN(pkg, "/", 2)[0], ".")
+}
+
+func inModule(pkg string) bool {
+	return pkg == "MyRPC" || strings.HasPrefix(pkg, "MyRPC/")
+}
+
+func TestPackageDeps(t *testing.T) {
+	for pkg, allowed := range allowedDeps {
+		seen := make(map[string]bool)
+		moduleDeps(t, pkg, seen, nil)
+		var got []string
+		for dep := range seen {
+			got = append(got, dep)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(allowed, ",") {
+			t.Errorf("%s depends on %v, expect %v", pkg, got, allowed)
+		}
+	}
+}
+
+func TestPackageDeps_Forbidden(t *testing.T) {
+	for pkg, forbidden := range forbiddenDeps {
+		seen, std := make(map[string]bool), make(map[string]bool)
+		moduleDeps(t, pkg, seen, std)
+		for _, dep := range forbidden {
+			if std[dep] {
+				t.Errorf("%s must not depend on %s", pkg, dep)
+			}
+		}
+	}
+}
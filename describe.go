@@ -0,0 +1,67 @@
+package MyRPC
+
+import (
+	"MyRPC/logger"
+	"encoding/json"
+	"reflect"
+)
+
+//
+// 方法的说明和示例
+// 服务实现 Describer 时，注册时读取每个方法的说明以及参数和返回值的示例，
+// 通过 _meta.MethodSignature、调试页面、myrpc-cli describe 和网关的 /openapi.json 展示，
+// 调用方不用读服务端的源码就知道方法做什么、参数怎么填。示例在注册时编码成 Json 保存
+//
+
+// MethodDoc 一个方法的说明和示例
+type MethodDoc struct {
+	Description  string      // 方法的说明
+	Example      interface{} // 参数的示例，类型应当与方法的参数相同
+	ExampleReply interface{} // 返回值的示例
+}
+
+// Describer 服务可以实现的接口，返回方法名到说明的映射，注册时调用一次
+type Describer interface {
+	DescribeMethods() map[string]MethodDoc
+}
+
+var typeOfDescriber = reflect.TypeOf((*Describer)(nil)).Elem()
+
+// methodDoc 注册后保存的说明，示例已经编码成 Json
+type methodDoc struct {
+	description  string
+	example      json.RawMessage
+	exampleReply json.RawMessage
+}
+
+// describeMethods 读取服务的说明和示例，没有对应方法的条目和无法编码的示例只记录警告
+func (s *service) describeMethods(rcvr interface{}) {
+	d, ok := rcvr.(Describer)
+	if !ok {
+		return
+	}
+	for name, doc := range d.DescribeMethods() {
+		mtype := s.method[name]
+		if mtype == nil {
+			logger.Warnf("rpc server: %s describes unknown method %s", s.name, name)
+			continue
+		}
+		mtype.doc = methodDoc{
+			description:  doc.Description,
+			example:      exampleJSON(s.name, name, doc.Example),
+			exampleReply: exampleJSON(s.name, name, doc.ExampleReply),
+		}
+	}
+}
+
+func exampleJSON(service, method string, v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger.Warnf("rpc server: example of %s.%s can't be encoded: %v", service, method, err)
+		return nil
+	}
+	return b
+}
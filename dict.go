@@ -0,0 +1,50 @@
+package MyRPC
+
+import (
+	"MyRPC/codec"
+	"MyRPC/registry/regclient"
+	"context"
+	"strconv"
+)
+
+//
+// 压缩字典的分发
+// 预置字典需要在客户端和服务端完全一致，由注册中心的键值存储统一分发：
+// 训练好字典后用 PublishDictionary 写入注册中心，服务端和客户端启动时用 LoadDictionary 读取并注册，
+// 之后客户端在 Option 中设置 CompressDict 即可。同一个编号的字典不能修改，更新字典时使用新的编号
+//
+
+// dictKeyPrefix 字典在注册中心中的键前缀，后面跟着字典编号
+const dictKeyPrefix = "myrpc/dict/"
+
+func dictKey(id uint32) string {
+	return dictKeyPrefix + strconv.FormatUint(uint64(id), 10)
+}
+
+// PublishDictionary 把编号为 id 的字典写入注册中心，并在本地注册
+func PublishDictionary(registryAddr string, id uint32, dict []byte) error {
+	return PublishDictionaryContext(context.Background(), registryAddr, id, dict)
+}
+
+// PublishDictionaryContext 和 PublishDictionary 相同，ctx 结束时放弃写入注册中心。
+// 注册中心设置了令牌时，用 regclient.WithToken 把令牌放进 ctx
+func PublishDictionaryContext(ctx context.Context, registryAddr string, id uint32, dict []byte) error {
+	if err := codec.RegisterDictionary(id, dict); err != nil {
+		return err
+	}
+	return regclient.PutValueContext(ctx, registryAddr, dictKey(id), dict)
+}
+
+// LoadDictionary 从注册中心读取编号为 id 的字典并在本地注册
+func LoadDictionary(registryAddr string, id uint32) error {
+	return LoadDictionaryContext(context.Background(), registryAddr, id)
+}
+
+// LoadDictionaryContext 和 LoadDictionary 相同，ctx 结束时放弃读取
+func LoadDictionaryContext(ctx context.Context, registryAddr string, id uint32) error {
+	dict, err := regclient.GetValueContext(ctx, registryAddr, dictKey(id))
+	if err != nil {
+		return err
+	}
+	return codec.RegisterDictionary(id, dict)
+}
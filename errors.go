@@ -0,0 +1,17 @@
+package MyRPC
+
+import (
+	"MyRPC/codec"
+	"errors"
+)
+
+// 错误码见 client/errors.go
+
+// setError 把错误写入响应头。包装了 *Error 的错误使用它的错误码，错误信息是完整的错误文本
+func setError(h *codec.Header, err error) {
+	h.Error, h.Code, h.Details = err.Error(), uint32(Code(err)), nil
+	var e *Error
+	if errors.As(err, &e) {
+		h.Details = e.Details
+	}
+}
@@ -0,0 +1,266 @@
+// Package gateway 把 MyRPC 服务暴露成 HTTP/Json 接口，浏览器和其他语言的调用方不需要实现 MyRPC 的协议：
+//
+//	POST /Foo/Sum  {"Num1":1,"Num2":2}   ->  200 3
+//	GET  /Foo/Sum                        ->  200 方法签名，见 MyRPC.MethodSignature
+//	GET  /openapi.json                   ->  200 所有方法的 OpenAPI 3.0 文档，见 openapi.go
+//
+// 网关不需要知道服务的类型：请求体原样作为 Json 编码的参数发给服务端，服务端的 Json 响应原样写回，
+// 所以调用一定使用 Json 编码。通过 XClient 调用时按 callopt.WithCodec 单独建立 Json 连接；
+// 直接使用 *MyRPC.Client 时客户端本身需要使用 Json 编码。
+//
+// 请求头：
+//
+//	X-Myrpc-Timeout       本次调用的超时时间，time.ParseDuration 的格式，不超过 Options.Timeout
+//	X-Request-Id          作为元数据 request-id 传给服务端
+//	X-Myrpc-Meta-<Key>    作为元数据 <key>（小写）传给服务端
+//
+// 出错时响应体是 {"error": "...", "code": "NotFound"}，code 是 MyRPC.Code 的名字。状态码由错误码决定：
+// 参数不合法 400，没有通过鉴权 401，没有权限或者服务不在 Options.Services 中 403，服务或方法不存在 404，
+// 被限流 429，没有实现 501，实例不可用或者没有可用的实例 503，超时 504，连接失败 502，其他错误 500
+package gateway
+
+import (
+	"MyRPC"
+	"MyRPC/callopt"
+	"MyRPC/codec"
+	"MyRPC/xclient"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	timeoutHeader    = "X-Myrpc-Timeout"
+	requestIDHeader  = "X-Request-Id"
+	metaHeaderPrefix = "X-Myrpc-Meta-"
+)
+
+// 默认值
+const (
+	defaultTimeout     = 10 * time.Second
+	defaultMaxBodySize = 1 << 20
+)
+
+// Options 网关的配置
+type Options struct {
+	Services    []string      // 允许访问的服务，为空时允许所有服务，内置的 _meta 服务只能通过 GET 查询签名
+	Timeout     time.Duration // 每次调用的最长时间，默认10s
+	MaxBodySize int64         // 请求体的最大字节数，默认1MB
+}
+
+// Gateway 把 HTTP 请求翻译成 RPC 调用，是一个 http.Handler
+type Gateway struct {
+	caller  MyRPC.Caller
+	opt     Options
+	allowed map[string]bool
+	closer  io.Closer // NewWithRegistry 创建的 XClient，Close 时关闭
+}
+
+var _ http.Handler = (*Gateway)(nil)
+
+// New 创建通过 caller 调用服务的网关，caller 通常是 *xclient.XClient，opt 为 nil 时使用默认配置
+func New(caller MyRPC.Caller, opt *Options) *Gateway {
+	g := &Gateway{caller: caller}
+	if opt != nil {
+		g.opt = *opt
+	}
+	if g.opt.Timeout <= 0 {
+		g.opt.Timeout = defaultTimeout
+	}
+	if g.opt.MaxBodySize <= 0 {
+		g.opt.MaxBodySize = defaultMaxBodySize
+	}
+	if len(g.opt.Services) > 0 {
+		g.allowed = make(map[string]bool, len(g.opt.Services))
+		for _, s := range g.opt.Services {
+			g.allowed[s] = true
+		}
+	}
+	return g
+}
+
+// NewWithRegistry 创建从注册中心发现服务实例的网关，只调用提供对应服务的实例，需要 Close
+func NewWithRegistry(registryAddr string, opt *Options) *Gateway {
+	d := xclient.NewMyRegistryDiscovery(registryAddr, 0)
+	xc := xclient.NewXClient(d, xclient.RandomSelect, &MyRPC.Option{CodecType: codec.JsonType})
+	g := New(xc, opt)
+	g.closer = xc
+	return g
+}
+
+// Close 关闭 NewWithRegistry 创建的客户端，New 传入的 caller 由调用方关闭
+func (g *Gateway) Close() error {
+	if g.closer != nil {
+		return g.closer.Close()
+	}
+	return nil
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == OpenAPIPath && req.Method == "GET" {
+		g.serveOpenAPI(w, req)
+		return
+	}
+	service, method, ok := splitPath(req.URL.Path)
+	if !ok {
+		writeError(w, http.StatusNotFound, "gateway: path must be /Service/Method")
+		return
+	}
+	switch req.Method {
+	case "POST":
+		if service == MyRPC.MetaServiceName || g.allowed != nil && !g.allowed[service] {
+			writeError(w, http.StatusForbidden, "gateway: service "+service+" is not exposed")
+			return
+		}
+		g.call(w, req, service+"."+method)
+	case "GET":
+		if g.allowed != nil && !g.allowed[service] {
+			writeError(w, http.StatusForbidden, "gateway: service "+service+" is not exposed")
+			return
+		}
+		g.describe(w, req, service, method)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, "gateway: method "+req.Method+" not allowed")
+	}
+}
+
+// splitPath 把 /Service/Method 拆成服务名和方法名
+func splitPath(path string) (service, method string, ok bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func (g *Gateway) call(w http.ResponseWriter, req *http.Request, serviceMethod string) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, g.opt.MaxBodySize+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "gateway: read body: "+err.Error())
+		return
+	}
+	if int64(len(body)) > g.opt.MaxBodySize {
+		writeError(w, http.StatusRequestEntityTooLarge, "gateway: body too large")
+		return
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		body = []byte("{}")
+	}
+	if !json.Valid(body) {
+		writeError(w, http.StatusBadRequest, "gateway: body is not valid Json")
+		return
+	}
+	ctx, cancel, err := g.context(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer cancel()
+	var reply json.RawMessage
+	if err := g.caller.Call(ctx, serviceMethod, json.RawMessage(body), &reply, callopt.WithCodec(codec.JsonType)); err != nil {
+		writeCallError(w, ctx, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(reply)
+}
+
+// describe 通过服务端的 _meta 服务返回方法签名
+func (g *Gateway) describe(w http.ResponseWriter, req *http.Request, service, method string) {
+	ctx, cancel, err := g.context(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer cancel()
+	var sig MyRPC.MethodSignature
+	args := MyRPC.MetaArgs{Service: service, Method: method}
+	if err := g.caller.Call(ctx, MyRPC.MetaServiceName+".MethodSignature", args, &sig, callopt.WithCodec(codec.JsonType)); err != nil {
+		writeCallError(w, ctx, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sig)
+}
+
+// context 根据请求头设置调用的超时时间和元数据，HTTP 请求结束时调用随之取消
+func (g *Gateway) context(req *http.Request) (context.Context, context.CancelFunc, error) {
+	timeout := g.opt.Timeout
+	if v := req.Header.Get(timeoutHeader); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, nil, errors.New("gateway: invalid " + timeoutHeader + ": " + v)
+		}
+		if d < timeout {
+			timeout = d
+		}
+	}
+	md := MyRPC.Metadata{}
+	for key, values := range req.Header {
+		if strings.HasPrefix(key, metaHeaderPrefix) && len(key) > len(metaHeaderPrefix) && len(values) > 0 {
+			md[strings.ToLower(key[len(metaHeaderPrefix):])] = values[0]
+		}
+	}
+	if id := req.Header.Get(requestIDHeader); id != "" {
+		md[MyRPC.MetadataRequestID] = id
+	}
+	ctx := req.Context()
+	if len(md) > 0 {
+		ctx = MyRPC.WithMetadata(ctx, md)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, nil
+}
+
+// statusOf 把调用的错误映射为 HTTP 状态码。先看错误码，没有对应状态码的错误按服务端和客户端错误信息的前缀区分
+func statusOf(ctx context.Context, err error) int {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	switch MyRPC.Code(err) {
+	case MyRPC.CodeInvalidArgument:
+		return http.StatusBadRequest
+	case MyRPC.CodeUnauthenticated:
+		return http.StatusUnauthorized
+	case MyRPC.CodePermissionDenied:
+		return http.StatusForbidden
+	case MyRPC.CodeNotFound:
+		return http.StatusNotFound
+	case MyRPC.CodeResourceExhausted:
+		return http.StatusTooManyRequests
+	case MyRPC.CodeUnimplemented:
+		return http.StatusNotImplemented
+	case MyRPC.CodeUnavailable:
+		return http.StatusServiceUnavailable
+	case MyRPC.CodeDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "no available servers"):
+		return http.StatusServiceUnavailable
+	case strings.HasPrefix(msg, "rpc server:"):
+		return http.StatusInternalServerError
+	case strings.HasPrefix(msg, "rpc client:"), strings.HasPrefix(msg, "dial "), strings.Contains(msg, "connection refused"):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// writeCallError 写出调用的错误，带上错误码的名字
+func writeCallError(w http.ResponseWriter, ctx context.Context, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusOf(ctx, err))
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error(), "code": MyRPC.Code(err).String()})
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,188 @@
+package gateway
+
+import (
+	"MyRPC"
+	"MyRPC/registry"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Foo int
+
+type Args struct {
+	Num1, Num2 int
+}
+
+func (f Foo) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func (f Foo) Fail(args Args, reply *int) error {
+	return errors.New("boom")
+}
+
+func (f Foo) Tenant(ctx context.Context, args Args, reply *string) error {
+	md := MyRPC.MetadataFromContext(ctx)
+	*reply = md["tenant"] + "/" + md[MyRPC.MetadataRequestID]
+	return nil
+}
+
+func (f Foo) Sleep(ctx context.Context, args Args, reply *int) error {
+	select {
+	case <-time.After(time.Second):
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func (f Foo) DescribeMethods() map[string]MyRPC.MethodDoc {
+	return map[string]MyRPC.MethodDoc{
+		"Sum": {Description: "returns Num1+Num2", Example: Args{Num1: 1, Num2: 2}, ExampleReply: 3},
+	}
+}
+
+func startGateway(t *testing.T, opt *Options) *httptest.Server {
+	r := httptest.NewServer(registry.New(time.Minute))
+	t.Cleanup(r.Close)
+	server := MyRPC.NewServer()
+	var foo Foo
+	if err := server.Register(&foo); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go server.Accept(l)
+	server.Heartbeat(r.URL, "tcp@"+l.Addr().String(), time.Minute)
+
+	g := NewWithRegistry(r.URL, opt)
+	t.Cleanup(func() { _ = g.Close() })
+	ts := httptest.NewServer(g)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func do(t *testing.T, method, url, body string, header map[string]string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, strings.TrimSpace(string(b))
+}
+
+func TestGateway(t *testing.T) {
+	ts := startGateway(t, nil)
+	if code, body := do(t, "POST", ts.URL+"/Foo/Sum", `{"Num1":1,"Num2":2}`, nil); code != 200 || body != "3" {
+		t.Fatalf("expect 3, got %d %s", code, body)
+	}
+	header := map[string]string{"X-Myrpc-Meta-Tenant": "acme", "X-Request-Id": "r1"}
+	if code, body := do(t, "POST", ts.URL+"/Foo/Tenant", "", header); code != 200 || body != `"acme/r1"` {
+		t.Fatalf("expect metadata forwarded, got %d %s", code, body)
+	}
+	code, body := do(t, "GET", ts.URL+"/Foo/Sum", "", nil)
+	var sig MyRPC.MethodSignature
+	if code != 200 || json.Unmarshal([]byte(body), &sig) != nil || sig.Args == nil || len(sig.Args.Fields) != 2 {
+		t.Fatalf("expect the signature, got %d %s", code, body)
+	}
+	if code, body := do(t, "POST", ts.URL+"/Foo/Missing", "{}", nil); code != http.StatusNotFound || !strings.Contains(body, `"code":"NotFound"`) {
+		t.Fatalf("expect the error code in the body, got %d %s", code, body)
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		header             map[string]string
+		code               int
+	}{
+		{"POST", "/Foo/Missing", "{}", nil, http.StatusNotFound},
+		{"POST", "/Bar/Sum", "{}", nil, http.StatusNotFound},
+		{"POST", "/Foo", "{}", nil, http.StatusNotFound},
+		{"POST", "/Foo/Sum", "{", nil, http.StatusBadRequest},
+		{"POST", "/Foo/Fail", "{}", nil, http.StatusInternalServerError},
+		{"POST", "/_meta/ListServices", "{}", nil, http.StatusForbidden},
+		{"POST", "/Foo/Sleep", "{}", map[string]string{"X-Myrpc-Timeout": "50ms"}, http.StatusGatewayTimeout},
+		{"POST", "/Foo/Sum", "{}", map[string]string{"X-Myrpc-Timeout": "soon"}, http.StatusBadRequest},
+		{"DELETE", "/Foo/Sum", "", nil, http.StatusMethodNotAllowed},
+	} {
+		code, body := do(t, c.method, ts.URL+c.path, c.body, c.header)
+		if code != c.code || !strings.Contains(body, `"error"`) {
+			t.Fatalf("%s %s: expect %d with an error, got %d %s", c.method, c.path, c.code, code, body)
+		}
+	}
+}
+
+func TestGateway_Services(t *testing.T) {
+	ts := startGateway(t, &Options{Services: []string{"Bar"}, MaxBodySize: 16})
+	if code, _ := do(t, "POST", ts.URL+"/Foo/Sum", "{}", nil); code != http.StatusForbidden {
+		t.Fatalf("expect Foo not exposed, got %d", code)
+	}
+	if code, _ := do(t, "POST", ts.URL+"/Bar/Sum", `{"Num1":1,"Num2":2,"Num3":3}`, nil); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expect the body limit, got %d", code)
+	}
+}
+
+func TestGateway_OpenAPI(t *testing.T) {
+	ts := startGateway(t, nil)
+	code, body := do(t, "GET", ts.URL+OpenAPIPath, "", nil)
+	var doc struct {
+		Paths map[string]struct {
+			Post struct {
+				Summary     string
+				RequestBody struct {
+					Content map[string]struct {
+						Schema  map[string]interface{}
+						Example json.RawMessage
+					}
+				}
+			}
+		}
+		Components struct {
+			Schemas map[string]struct {
+				Type       string
+				Properties map[string]map[string]interface{}
+			}
+		}
+	}
+	if code != 200 || json.Unmarshal([]byte(body), &doc) != nil {
+		t.Fatalf("expect the document, got %d %s", code, body)
+	}
+	if len(doc.Paths) != 4 {
+		t.Fatalf("expect 4 methods of Foo, got %v", doc.Paths)
+	}
+	sum := doc.Paths["/Foo/Sum"].Post
+	content := sum.RequestBody.Content["application/json"]
+	if sum.Summary != "returns Num1+Num2" || string(content.Example) != `{"Num1":1,"Num2":2}` {
+		t.Fatalf("expect the description and example, got %+v", sum)
+	}
+	if content.Schema["$ref"] != "#/components/schemas/gateway.Args" {
+		t.Fatalf("expect a reference to Args, got %v", content.Schema)
+	}
+	args := doc.Components.Schemas["gateway.Args"]
+	if args.Type != "object" || args.Properties["Num1"]["type"] != "integer" {
+		t.Fatalf("unexpected schema of Args %+v", args)
+	}
+
+	ts = startGateway(t, &Options{Services: []string{"Bar"}})
+	if code, body := do(t, "GET", ts.URL+OpenAPIPath, "", nil); code != 200 || strings.Contains(body, "/Foo/") {
+		t.Fatalf("expect Foo left out, got %d %s", code, body)
+	}
+}
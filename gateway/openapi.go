@@ -0,0 +1,172 @@
+package gateway
+
+import (
+	"MyRPC"
+	"MyRPC/callopt"
+	"MyRPC/codec"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+//
+// OpenAPI 文档
+// GET /openapi.json 根据服务端 _meta 服务返回的签名生成 OpenAPI 3.0 文档，每个方法对应一个 POST 接口，
+// 只包含 Options.Services 允许访问的服务。服务实现 MyRPC.Describer 时，说明和示例也会写进文档。
+// 有名字的结构体放在 components.schemas 中，按 TypeInfo.Name 引用
+//
+
+// OpenAPIPath 网关提供 OpenAPI 文档的路径
+const OpenAPIPath = "/openapi.json"
+
+// openAPI 查询服务端所有服务的签名，生成 OpenAPI 文档
+func (g *Gateway) openAPI(ctx context.Context) (map[string]interface{}, error) {
+	var services []string
+	if err := g.meta(ctx, "ListServices", MyRPC.MetaArgs{}, &services); err != nil {
+		return nil, err
+	}
+	schemas := map[string]interface{}{}
+	paths := map[string]interface{}{}
+	sort.Strings(services)
+	for _, service := range services {
+		if g.allowed != nil && !g.allowed[service] {
+			continue
+		}
+		var methods []string
+		if err := g.meta(ctx, "ListMethods", MyRPC.MetaArgs{Service: service}, &methods); err != nil {
+			return nil, err
+		}
+		for _, method := range methods {
+			var sig MyRPC.MethodSignature
+			if err := g.meta(ctx, "MethodSignature", MyRPC.MetaArgs{Service: service, Method: method}, &sig); err != nil {
+				return nil, err
+			}
+			paths["/"+service+"/"+method] = map[string]interface{}{"post": operation(&sig, schemas)}
+		}
+	}
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": "MyRPC gateway", "version": "1.0"},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+		},
+	}
+	return doc, nil
+}
+
+func (g *Gateway) meta(ctx context.Context, method string, args MyRPC.MetaArgs, reply interface{}) error {
+	return g.caller.Call(ctx, MyRPC.MetaServiceName+"."+method, args, reply, callopt.WithCodec(codec.JsonType))
+}
+
+// operation 一个方法对应的 POST 接口
+func operation(sig *MyRPC.MethodSignature, schemas map[string]interface{}) map[string]interface{} {
+	body := map[string]interface{}{"schema": schemaOf(sig.Args, schemas)}
+	if len(sig.Example) > 0 {
+		body["example"] = sig.Example
+	}
+	reply := map[string]interface{}{"schema": schemaOf(sig.Reply, schemas)}
+	if len(sig.ExampleReply) > 0 {
+		reply["example"] = sig.ExampleReply
+	}
+	errorBody := map[string]interface{}{
+		"schema": map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"error": map[string]interface{}{"type": "string"}},
+		},
+	}
+	op := map[string]interface{}{
+		"operationId": sig.Service + "." + sig.Method,
+		"tags":        []string{sig.Service},
+		"requestBody": map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": body},
+		},
+		"responses": map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "OK",
+				"content":     map[string]interface{}{"application/json": reply},
+			},
+			"default": map[string]interface{}{
+				"description": "error",
+				"content":     map[string]interface{}{"application/json": errorBody},
+			},
+		},
+	}
+	if sig.Description != "" {
+		op["summary"] = sig.Description
+	}
+	return op
+}
+
+// schemaOf 把 TypeInfo 转换成 Json Schema，按 Json 编码后的样子描述
+func schemaOf(t *MyRPC.TypeInfo, schemas map[string]interface{}) map[string]interface{} {
+	if t == nil {
+		return map[string]interface{}{}
+	}
+	switch t.Kind {
+	case "ptr":
+		return schemaOf(t.Elem, schemas)
+	case "bool":
+		return map[string]interface{}{"type": "boolean"}
+	case "string":
+		return map[string]interface{}{"type": "string"}
+	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "uintptr":
+		return map[string]interface{}{"type": "integer"}
+	case "float32", "float64":
+		return map[string]interface{}{"type": "number"}
+	case "slice", "array":
+		if t.Elem != nil && t.Elem.Kind == "uint8" { // []byte 编码成 base64 字符串
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		s := map[string]interface{}{"type": "array", "items": schemaOf(t.Elem, schemas)}
+		if t.Kind == "array" {
+			s["minItems"], s["maxItems"] = t.Len, t.Len
+		}
+		return s
+	case "map":
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem, schemas)}
+	case "struct":
+		if t.Name == "time.Time" {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if t.Name == "" {
+			return structSchema(t, schemas)
+		}
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name}
+		// 递归引用自身时 TypeInfo 没有字段，使用第一次展开的结果
+		if _, ok := schemas[t.Name]; !ok {
+			schemas[t.Name] = nil // 占位，避免字段中再次引用时重复展开
+			schemas[t.Name] = structSchema(t, schemas)
+		}
+		return ref
+	}
+	// interface、chan 等无法确定 Json 的结构
+	return map[string]interface{}{}
+}
+
+func structSchema(t *MyRPC.TypeInfo, schemas map[string]interface{}) map[string]interface{} {
+	props := make(map[string]interface{}, len(t.Fields))
+	for _, f := range t.Fields {
+		props[f.Name] = schemaOf(f.Type, schemas)
+	}
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+// serveOpenAPI 处理 GET /openapi.json
+func (g *Gateway) serveOpenAPI(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel, err := g.context(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer cancel()
+	doc, err := g.openAPI(ctx)
+	if err != nil {
+		writeError(w, statusOf(ctx, err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(doc)
+}
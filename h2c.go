@@ -0,0 +1,31 @@
+//go:build go1.24
+
+package MyRPC
+
+import (
+	"net"
+	"net/http"
+)
+
+//
+// 明文 HTTP/2（h2c）
+// 内网里服务端和负载均衡器之间通常不配置 TLS，这时标准库不会协商 HTTP/2。
+// ServeH2C 在监听器上同时接受 HTTP/1.1 和明文的 HTTP/2，client.NewH2CCaller 直接以 HTTP/2 发起连接（prior knowledge），
+// 所有调用都是同一个连接上的流。需要 Go 1.24 的 http.Protocols，更早的版本返回错误，见 h2c_legacy.go
+//
+
+// ServeH2C 在 lis 上以明文 HTTP/2 提供 CallHandler，路径是 /_myrpc_/call，lis 关闭或者 Shutdown 时返回
+func (server *Server) ServeH2C(lis net.Listener) error {
+	if !server.trackListener(lis) {
+		_ = lis.Close()
+		return ErrServerClosed
+	}
+	defer server.untrackListener(lis)
+	mux := http.NewServeMux()
+	mux.Handle(defaultCallPath, server.CallHandler())
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	hs := &http.Server{Handler: mux, Protocols: &protocols}
+	return hs.Serve(lis)
+}
@@ -0,0 +1,17 @@
+//go:build !go1.24
+
+package MyRPC
+
+import (
+	"errors"
+	"net"
+)
+
+// errH2CUnsupported 明文 HTTP/2 需要 Go 1.24 的 http.Protocols
+var errH2CUnsupported = errors.New("rpc: h2c requires Go 1.24 or later")
+
+// ServeH2C 见 h2c.go，这个版本的 Go 不支持，关闭 lis 并返回错误
+func (server *Server) ServeH2C(lis net.Listener) error {
+	_ = lis.Close()
+	return errH2CUnsupported
+}
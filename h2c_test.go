@@ -0,0 +1,50 @@
+//go:build go1.24
+
+package MyRPC
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestServer_ServeH2C(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go func() { _ = server.ServeH2C(l) }()
+
+	url := "http://" + l.Addr().String() + defaultCallPath
+	caller, err := NewH2CCaller(url)
+	_assert(err == nil, "failed to create the caller: %v", err)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply int
+			err := caller.Call(context.Background(), "Foo.Sum", Args{Num1: i, Num2: 1}, &reply)
+			_assert(err == nil && reply == i+1, "failed to call Foo.Sum over h2c: %v", err)
+		}(i)
+	}
+	wg.Wait()
+	// 和 NewH2CCaller 一样以明文 HTTP/2 发起连接
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	h2c := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	resp, err := h2c.Get(url)
+	_assert(err == nil, "failed to send a request over h2c: %v", err)
+	_ = resp.Body.Close()
+	_assert(resp.ProtoMajor == 2, "expect HTTP/2 without TLS, got %s", resp.Proto)
+
+	// HTTP/1.1 的客户端同样可以访问
+	resp, err = http.Post(url, callContentType, strings.NewReader(""))
+	_assert(err == nil && resp.ProtoMajor == 1, "expect HTTP/1.1 still served, got %v", err)
+	_ = resp.Body.Close()
+}
@@ -0,0 +1,202 @@
+package MyRPC
+
+import (
+	"MyRPC/codec"
+	"MyRPC/wire"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+//
+// 二进制握手
+// 原来的握手直接用Json编码Option，服务端的json.Decoder带缓冲，可能把紧跟其后的Gob数据一起读走。
+// 现在握手改为固定长度的二进制头部，后面跟着长度明确的Option，之后的所有消息都使用长度前缀的帧：
+//
+//	| Magic(4) | Version(1) | CodecID(1) | Flags(2) | OptionLength(4) | Option(Json) | Frame | Frame | ...
+//
+// 服务端通过第一个字节区分新老客户端：老客户端以 '{' 开头，新客户端以魔数开头，
+// 所以升级期间两种客户端可以连接同一个服务端。
+//
+// 客户端设置 flagAck 后，服务端校验完握手（TLS升级之前）回复一个确认帧，拒绝时带上原因，
+// 客户端不用等到超时才发现握手失败。老的服务端不认识这个标志位，所以默认不开启：
+//
+//	| Status(1) | Length(uint32) | Reason |
+//
+// 客户端同时设置 flagAckDetail 时，拒绝的 Reason 是 Json 编码的 wire.AckDetail，带有服务端支持的编码方式，
+// 客户端可以换一种编码方式重新连接（Option.RenegotiateCodec）。老的服务端仍然回复文本的原因，客户端两种都能解析。
+// 这里是服务端的一侧，客户端的一侧见 client/handshake.go
+//
+
+// 握手的常量定义在 wire 包中，和 client、lite 共用
+const (
+	handshakeVersion = wire.Version
+	handshakeLen     = wire.HeaderLen
+	maxOptionLen     = wire.MaxOptionLen
+)
+
+// 握手头部的标志位
+const (
+	flagStartTLS     = wire.FlagStartTLS     // 握手之后升级TLS
+	flagCapabilities = wire.FlagCapabilities // 服务端回复自己支持的能力
+	flagAck          = wire.FlagAck          // 服务端回复握手确认
+	flagAckDetail    = wire.FlagAckDetail    // 拒绝握手时用 Json 回复原因和服务端支持的编码方式
+	flagErrorCodes   = wire.FlagErrorCodes   // 客户端能读取 CompactType 头部中的错误码和附加信息，见 errors.go
+	flagTLSToken     = wire.FlagTLSToken     // 令牌在 TLS 握手之后发送，见 tls.go
+)
+
+// 握手确认帧的状态
+const (
+	ackOK     = wire.AckOK
+	ackReject = wire.AckReject
+)
+
+// codecIDs 常用编码方式的编号，其他编码方式编号为0，从Option的CodecType中读取
+var codecIDs = wire.CodecIDs
+
+func codecTypeOf(id uint8) codec.Type {
+	return wire.CodecType(id)
+}
+
+// serverOption 服务端读到的协商信息，加上握手头部中只有服务端关心的标志位
+type serverOption struct {
+	*Option
+	ackDetail  bool // 客户端希望用 Json 回复拒绝握手的原因
+	errorCodes bool // 客户端能读取紧凑头部中的错误码，见 errors.go
+	tlsToken   bool // 令牌在 TLS 握手之后发送，见 tls.go
+}
+
+// readHandshake 服务端读取握手信息，返回协商信息、后续使用的连接以及是否使用帧。
+// 读到握手头部之后才出错时，返回的协商信息只有 HandshakeAck 和 ackDetail 有效，用于决定是否回复拒绝的原因
+func readHandshake(conn io.ReadWriteCloser) (*serverOption, io.ReadWriteCloser, bool, error) {
+	br := bufio.NewReaderSize(conn, handshakeLen)
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	// 老客户端，Json编码的Option
+	if first[0] == '{' {
+		var opt Option
+		dec := json.NewDecoder(br)
+		if err := dec.Decode(&opt); err != nil {
+			return nil, nil, false, err
+		}
+		if opt.MagicNumber != MagicNumber {
+			return nil, nil, false, fmt.Errorf("invalid magic number %x", opt.MagicNumber)
+		}
+		// json.Decoder 和 br 可能多读了之后的数据，拼回连接的前面。
+		// json.Encoder 会在 Option 后面写一个换行符，它不属于之后的报文，需要跳过
+		rest, _ := io.ReadAll(dec.Buffered())
+		more, _ := br.Peek(br.Buffered())
+		rest = append(rest, more...)
+		if len(rest) > 0 && rest[0] == '\n' {
+			rest = rest[1:]
+		} else if len(rest) == 0 {
+			var b [1]byte
+			if _, err := io.ReadFull(conn, b[:]); err != nil {
+				return nil, nil, false, err
+			}
+			if b[0] != '\n' {
+				rest = b[:]
+			}
+		}
+		return &serverOption{Option: &opt}, withPrefix(conn, rest), false, nil
+	}
+
+	head := make([]byte, handshakeLen)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, nil, false, err
+	}
+	// 头部长度固定，魔数不对时也能读到标志位
+	flags := binary.BigEndian.Uint16(head[6:])
+	rejected := &serverOption{Option: &Option{HandshakeAck: flags&flagAck != 0}, ackDetail: flags&flagAckDetail != 0}
+	if magic := binary.BigEndian.Uint32(head[0:]); magic != MagicNumber {
+		return rejected, conn, false, fmt.Errorf("invalid magic number %x", magic)
+	}
+	if head[4] != handshakeVersion {
+		return rejected, conn, false, fmt.Errorf("unsupported handshake version %d", head[4])
+	}
+	n := binary.BigEndian.Uint32(head[8:])
+	if n > maxOptionLen {
+		return rejected, conn, false, errors.New("option too large")
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, false, err
+	}
+	var opt Option
+	if err := json.Unmarshal(body, &opt); err != nil {
+		return rejected, conn, false, err
+	}
+	opt.MagicNumber = MagicNumber
+	if t := codecTypeOf(head[5]); t != "" {
+		opt.CodecType = t
+	}
+	opt.StartTLS = flags&flagStartTLS != 0
+	opt.NegotiateCapabilities = flags&flagCapabilities != 0
+	opt.HandshakeAck = rejected.HandshakeAck
+	// br 可能多读了之后的帧，拼回连接的前面
+	if br.Buffered() > 0 {
+		rest, _ := br.Peek(br.Buffered())
+		conn = withPrefix(conn, append([]byte(nil), rest...))
+	}
+	return &serverOption{
+		Option:     &opt,
+		ackDetail:  rejected.ackDetail,
+		errorCodes: flags&flagErrorCodes != 0,
+		tlsToken:   flags&flagTLSToken != 0,
+	}, conn, true, nil
+}
+
+// writeHandshakeAck 服务端回复握手确认，reason 不为 nil 时表示拒绝，codecs 不为 nil 时用 Json 回复拒绝的原因
+func writeHandshakeAck(w io.Writer, reason error, codecs []string) error {
+	status, msg := ackOK, ""
+	if reason != nil {
+		status, msg = ackReject, reason.Error()
+		if codecs != nil {
+			detail, _ := json.Marshal(wire.AckDetail{Reason: msg, Codecs: codecs})
+			msg = string(detail)
+		}
+	}
+	buf := make([]byte, 5, 5+len(msg))
+	buf[0] = status
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// prefixConn 握手时可能多读了之后的数据，把这部分数据拼回连接的前面
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+type prefixReadWriteCloser struct {
+	io.ReadWriteCloser
+	r io.Reader
+}
+
+func (c *prefixReadWriteCloser) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// withPrefix 返回先读 prefix 再读 conn 的连接，conn 是 net.Conn 时返回值仍然是 net.Conn
+func withPrefix(conn io.ReadWriteCloser, prefix []byte) io.ReadWriteCloser {
+	if len(prefix) == 0 {
+		return conn
+	}
+	r := io.MultiReader(bytes.NewReader(prefix), conn)
+	if nc, ok := conn.(net.Conn); ok {
+		return &prefixConn{Conn: nc, r: r}
+	}
+	return &prefixReadWriteCloser{ReadWriteCloser: conn, r: r}
+}
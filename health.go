@@ -0,0 +1,251 @@
+package MyRPC
+
+import (
+	"MyRPC/logger"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//
+// 错误预算与自动摘除
+// 服务端依赖的下游挂掉时，它自己的心跳仍然正常，注册中心继续把流量分给它，请求却全部失败。
+// SetSLO 让服务端统计最近一段时间的错误率和慢请求比例，SetHealthCheck 让应用定义自己的健康判断（比如数据库是否可用）。
+// 任意一项不满足时，服务端主动从 Heartbeat 注册的注册中心注销并暂停心跳，恢复后重新注册。
+// 健康状态每 healthCheckInterval 检查一次，需要在 Heartbeat 之前配置
+//
+
+// healthCheckInterval 检查健康状态的间隔
+var healthCheckInterval = 5 * time.Second
+
+const (
+	budgetBuckets     = 10 // 统计窗口分成的桶数
+	defaultSLOWindow  = time.Minute
+	defaultSLORequest = 10
+)
+
+// SLO 服务端的错误率和延迟目标，比例为0的项不检查
+type SLO struct {
+	Window        time.Duration // 统计窗口，默认1分钟
+	MaxErrorRate  float64       // 窗口内出错请求的比例上限，0~1
+	SlowThreshold time.Duration // 处理时间超过它的请求是慢请求
+	MaxSlowRate   float64       // 窗口内慢请求的比例上限，0~1
+	MinRequests   uint64        // 窗口内请求数少于它时不判断，避免个别失败的请求就把实例摘除，默认10
+}
+
+// HealthCheck 应用定义的健康判断，返回错误表示不健康，错误信息作为原因
+type HealthCheck func() error
+
+// HealthStatus 健康检查的结果
+type HealthStatus struct {
+	Healthy   bool
+	Reason    string    // 不健康的原因
+	Requests  uint64    // 窗口内的请求数
+	ErrorRate float64   // 窗口内出错请求的比例
+	SlowRate  float64   // 窗口内慢请求的比例
+	Since     time.Time // 当前状态开始的时间
+}
+
+// SetSLO 开启错误预算的统计，超出预算时服务端从注册中心摘除自己
+func (server *Server) SetSLO(slo SLO) {
+	if slo.Window <= 0 {
+		slo.Window = defaultSLOWindow
+	}
+	if slo.MinRequests == 0 {
+		slo.MinRequests = defaultSLORequest
+	}
+	server.budget = &errorBudget{slo: slo, width: slo.Window / budgetBuckets}
+}
+
+// SetHealthCheck 设置应用定义的健康判断，不健康时服务端从注册中心摘除自己
+func (server *Server) SetHealthCheck(check HealthCheck) {
+	server.healthCheck = check
+}
+
+// healthEnabled 是否配置了 SLO 或健康判断
+func (server *Server) healthEnabled() bool {
+	return server.budget != nil || server.healthCheck != nil
+}
+
+// Health 检查当前的健康状态
+func (server *Server) Health() HealthStatus {
+	status := HealthStatus{Healthy: true}
+	if server.budget != nil {
+		status.Requests, status.ErrorRate, status.SlowRate = server.budget.rates()
+		if err := server.budget.check(status.Requests, status.ErrorRate, status.SlowRate); err != nil {
+			status.Healthy, status.Reason = false, err.Error()
+		}
+	}
+	if status.Healthy && server.healthCheck != nil {
+		if err := server.healthCheck(); err != nil {
+			status.Healthy, status.Reason = false, err.Error()
+		}
+	}
+
+	server.healthMu.Lock()
+	defer server.healthMu.Unlock()
+	status.Since = server.health.Since
+	if status.Since.IsZero() || status.Healthy != server.health.Healthy {
+		status.Since = time.Now()
+	}
+	server.health = status
+	return status
+}
+
+// lastHealth 最近一次检查的健康状态，没有检查过时视为健康
+func (server *Server) lastHealth() HealthStatus {
+	server.healthMu.Lock()
+	defer server.healthMu.Unlock()
+	if server.health.Since.IsZero() {
+		return HealthStatus{Healthy: true}
+	}
+	return server.health
+}
+
+// observeBudget 记录一次请求，没有配置 SLO 时什么也不做
+func (server *Server) observeBudget(d time.Duration, err error) {
+	if server.budget != nil {
+		server.budget.observe(d, err)
+	}
+}
+
+// budgetBucket 统计窗口中的一个时间段
+type budgetBucket struct {
+	index  int64 // 时间段的编号，不等于当前编号说明是过期的数据
+	total  uint64
+	errors uint64
+	slow   uint64
+}
+
+// errorBudget 滑动窗口内的请求统计，窗口分成 budgetBuckets 个桶循环使用
+type errorBudget struct {
+	slo     SLO
+	width   time.Duration // 每个桶的时间跨度
+	mu      sync.Mutex
+	buckets [budgetBuckets]budgetBucket
+}
+
+func (b *errorBudget) observe(d time.Duration, err error) {
+	index := time.Now().UnixNano() / int64(b.width)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket := &b.buckets[index%budgetBuckets]
+	if bucket.index != index {
+		*bucket = budgetBucket{index: index}
+	}
+	bucket.total++
+	if err != nil {
+		bucket.errors++
+	}
+	if b.slo.SlowThreshold > 0 && d > b.slo.SlowThreshold {
+		bucket.slow++
+	}
+}
+
+// rates 窗口内的请求数、错误率和慢请求比例
+func (b *errorBudget) rates() (total uint64, errorRate, slowRate float64) {
+	index := time.Now().UnixNano() / int64(b.width)
+	var errors, slow uint64
+	b.mu.Lock()
+	for _, bucket := range b.buckets {
+		if index-bucket.index < budgetBuckets {
+			total += bucket.total
+			errors += bucket.errors
+			slow += bucket.slow
+		}
+	}
+	b.mu.Unlock()
+	if total == 0 {
+		return 0, 0, 0
+	}
+	return total, float64(errors) / float64(total), float64(slow) / float64(total)
+}
+
+// check 判断是否超出错误预算
+func (b *errorBudget) check(total uint64, errorRate, slowRate float64) error {
+	if total < b.slo.MinRequests {
+		return nil
+	}
+	if b.slo.MaxErrorRate > 0 && errorRate > b.slo.MaxErrorRate {
+		return fmt.Errorf("error rate %.3f exceeds %.3f", errorRate, b.slo.MaxErrorRate)
+	}
+	if b.slo.MaxSlowRate > 0 && slowRate > b.slo.MaxSlowRate {
+		return fmt.Errorf("slow request rate %.3f exceeds %.3f", slowRate, b.slo.MaxSlowRate)
+	}
+	return nil
+}
+
+// heartbeatRetryMin 心跳失败后第一次重试的间隔，之后每次翻倍，不超过心跳周期
+const heartbeatRetryMin = time.Second
+
+// heartbeatLoop 定期发送心跳，配置了 SLO 或健康判断时不健康就注销并暂停心跳，恢复后重新注册。
+// err 是上一次心跳的结果，失败时按退避间隔重试，注册中心拒绝时停止
+func (server *Server) heartbeatLoop(ctx context.Context, registry, addr string, duration time.Duration, registered bool, err error) {
+	var backoff time.Duration
+	next := func() time.Duration {
+		if err == nil {
+			backoff = 0
+			return duration
+		}
+		backoff *= 2
+		if backoff < heartbeatRetryMin {
+			backoff = heartbeatRetryMin
+		}
+		if backoff > duration {
+			backoff = duration
+		}
+		logger.Warnf("rpc server: heart beat to %s failed, retry in %v: %v", registry, backoff, err)
+		return backoff
+	}
+	t := time.NewTimer(next())
+	defer t.Stop()
+	var health <-chan time.Time
+	if server.healthEnabled() {
+		ht := time.NewTicker(healthCheckInterval)
+		defer ht.Stop()
+		health = ht.C
+	}
+	for {
+		// 服务端关闭后不再发送心跳，否则注销之后又会被注册回去
+		select {
+		case <-t.C:
+			if !registered {
+				t.Reset(duration)
+				continue
+			}
+		case <-health:
+			status := server.Health()
+			if status.Healthy == registered {
+				continue
+			}
+			if !status.Healthy {
+				logger.Warnf("rpc server: %s unhealthy, deregister from %s: %s", addr, registry, status.Reason)
+				if err := server.deregister(ctx, registry, addr); err != nil {
+					logger.Errorf("rpc server: deregister from %s error: %v", registry, err)
+				}
+				registered = false
+				continue
+			}
+			logger.Infof("rpc server: %s recovered, register to %s again", addr, registry)
+			registered = true
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+		case <-server.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+		err = server.sendHeartbeat(ctx, registry, addr, duration)
+		server.recordHeartbeat(registry, addr, err)
+		if errors.Is(err, errHeartbeatRejected) {
+			return
+		}
+		t.Reset(next())
+	}
+}
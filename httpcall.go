@@ -0,0 +1,96 @@
+package MyRPC
+
+import (
+	"MyRPC/codec"
+	"MyRPC/wire"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//
+// 每个调用一个 HTTP 请求
+// CONNECT 把整个 HTTP 连接劫持成 RPC 连接，负载均衡器只能看到一个长连接，无法按请求分发。
+// 这里的模式把每次调用放在一个 POST 请求里：请求体是编码后的请求头和参数，响应体是编码后的响应头和返回值，
+// 格式和连接上的单条消息相同，编码方式由 X-Myrpc-Codec 指定，默认 Gob。
+// 服务端和客户端之间是 HTTP/2 时，所有调用都是同一个连接上的流，有真正的多路复用和流量控制，
+// 也能放在普通的 HTTP/2 负载均衡器之后。
+//
+// CallHandler 是普通的 http.Handler，使用哪个 HTTP 版本由 http.Server 决定：配置 TLS 时标准库自动协商 HTTP/2；
+// 明文的 HTTP/2（h2c）用 ServeH2C 和 NewH2CCaller，见 h2c.go。
+// 客户端同理，client.HTTPCaller 使用调用方提供的 http.Client。
+// 每次调用是独立的请求，不支持握手中协商的压缩、批量写和流式调用
+//
+
+const (
+	defaultCallPath = wire.CallPath
+	codecHeader     = wire.CodecHeader
+	callContentType = wire.CallContentType
+)
+
+// CallHandler 返回每个调用一个 HTTP 请求的处理程序，HandleHTTP 把它注册在 /_myrpc_/call
+func (server *Server) CallHandler() http.Handler {
+	return callHTTP{server}
+}
+
+type callHTTP struct {
+	*Server
+}
+
+func (server callHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_, _ = io.WriteString(w, "405 must POST\n")
+		return
+	}
+	token := bearerToken(req)
+	if err := server.authenticate(token, req.RemoteAddr); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	opt := &serverOption{Option: &Option{CodecType: codec.Type(req.Header.Get(codecHeader))}}
+	if opt.CodecType == "" {
+		opt.CodecType = codec.GobType
+	}
+	f := opt.NewCodecFunc()
+	if f == nil {
+		http.Error(w, fmt.Sprintf("rpc server: invalid codec type %s", opt.CodecType), http.StatusUnsupportedMediaType)
+		return
+	}
+	// 请求很短，不出现在 Conns 中
+	ci := &connInfo{
+		remoteAddr: req.RemoteAddr,
+		codecType:  opt.CodecType,
+		since:      time.Now(),
+		active:     newSeqSet(),
+		token:      token,
+		ctx:        req.Context(), // 请求体读完时请求还在处理，只在 HTTP 请求结束时取消
+	}
+	w.Header().Set("Content-Type", callContentType)
+	// 请求体只有一条消息，读到 EOF 后 serverCodec 等待处理完成再返回，响应在返回之前写完
+	conn := &httpServerConn{body: req.Body, w: w}
+	server.serverCodec(server.wrapCodec(f, opt, ci)(conn), opt.Option, ci)
+}
+
+// bearerToken 读取 Authorization: Bearer <token> 中的令牌
+func bearerToken(req *http.Request) string {
+	const prefix = "Bearer "
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+	return auth[len(prefix):]
+}
+
+// httpServerConn 从请求体读，向响应写
+type httpServerConn struct {
+	body io.ReadCloser
+	w    io.Writer
+}
+
+func (c *httpServerConn) Read(p []byte) (int, error)  { return c.body.Read(p) }
+func (c *httpServerConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+func (c *httpServerConn) Close() error                { return c.body.Close() }
@@ -0,0 +1,257 @@
+// Package lite 精简的客户端，用于命令行工具、边缘代理这类在意二进制大小和依赖的场景。
+// 它只依赖 codec、wire 包和标准库中的 net，不引入服务端、注册中心、HTTP 和 TLS 的代码：
+//
+//	client, err := lite.Dial("tcp", "127.0.0.1:9999", &lite.Options{CodecType: codec.CompactType})
+//	err = client.Call(ctx, "Foo.Sum", args, &reply)
+//
+// 只支持新的二进制握手和基本的调用：没有压缩、TLS、批量写、心跳和能力协商，需要这些功能时使用 MyRPC.Client。
+// 除了 Gob 和 Json 本身用到的反射，客户端不使用反射
+package lite
+
+import (
+	"MyRPC/codec"
+	"MyRPC/wire"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrShutdown 连接已经关闭
+var ErrShutdown = errors.New("rpc lite: connection is shut down")
+
+// Options 连接的配置
+type Options struct {
+	CodecType      codec.Type    // 默认 Gob
+	ConnectTimeout time.Duration // 默认10s，0表示使用默认值
+	HandshakeAck   bool          // 等待服务端确认握手，服务端需要支持
+	Token          string        // 鉴权令牌，见 MyRPC.Option.Token
+}
+
+const defaultConnectTimeout = 10 * time.Second
+
+// Client 精简的客户端，可以被多个协程同时使用
+type Client struct {
+	cc      codec.Codec
+	sending sync.Mutex // 保证一条请求完整写出
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]*call
+	err     error // 不为 nil 时连接已经关闭
+}
+
+type call struct {
+	reply interface{}
+	done  chan error
+}
+
+// Dial 连接 network 上的 address
+func Dial(network, address string, opt *Options) (*Client, error) {
+	return DialContext(context.Background(), network, address, opt)
+}
+
+// DialContext 和 Dial 相同，连接和握手在 ctx 结束时放弃
+func DialContext(ctx context.Context, network, address string, opt *Options) (*Client, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	timeout := opt.ConnectTimeout
+	if timeout == 0 {
+		timeout = defaultConnectTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	// ctx 被取消时让握手中阻塞的读写立即返回
+	quit, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-quit:
+		}
+	}()
+	client, err := NewClient(conn, opt)
+	close(quit)
+	<-exited
+	// 连接的 deadline 可能比 ctx 的定时器先触发
+	if err != nil && !time.Now().Before(deadline) {
+		<-ctx.Done()
+	}
+	if ctx.Err() != nil {
+		if client != nil {
+			_ = client.Close()
+		}
+		return nil, errors.New("rpc lite: connect failed: " + ctx.Err().Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return client, nil
+}
+
+// NewClient 在 conn 上握手并创建客户端，失败时关闭 conn
+func NewClient(conn io.ReadWriteCloser, opt *Options) (*Client, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	t := opt.CodecType
+	if t == "" {
+		t = codec.GobType
+	}
+	f := codec.NewCodecFuncMap[t]
+	if f == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("rpc lite: invalid codec type %s", t)
+	}
+	if err := handshake(conn, t, opt.Token, opt.HandshakeAck); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	c := &Client{cc: f(codec.NewFrameConn(conn)), pending: make(map[uint64]*call)}
+	go c.receive()
+	return c, nil
+}
+
+// handshake 发送二进制握手：| Magic(4) | Version(1) | CodecID(1) | Flags(2) | OptionLength(4) | Option(Json) |
+func handshake(conn io.ReadWriter, t codec.Type, token string, ack bool) error {
+	body := `{"MagicNumber":` + strconv.Itoa(wire.MagicNumber) + `,"CodecType":` + strconv.Quote(string(t))
+	if token != "" {
+		body += `,"Token":` + strconv.Quote(token)
+	}
+	body += `}`
+	buf := make([]byte, wire.HeaderLen, wire.HeaderLen+len(body))
+	binary.BigEndian.PutUint32(buf[0:], wire.MagicNumber)
+	buf[4] = wire.Version
+	buf[5] = wire.CodecIDs[t]
+	if ack {
+		binary.BigEndian.PutUint16(buf[6:], wire.FlagAck)
+	}
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(body)))
+	if _, err := conn.Write(append(buf, body...)); err != nil {
+		return err
+	}
+	if !ack {
+		return nil
+	}
+	// | Status(1) | Length(uint32) | Reason |
+	var head [5]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(head[1:])
+	if n > wire.MaxOptionLen {
+		return errors.New("rpc lite: handshake ack too large")
+	}
+	reason := make([]byte, n)
+	if _, err := io.ReadFull(conn, reason); err != nil {
+		return err
+	}
+	if head[0] != wire.AckOK {
+		return fmt.Errorf("rpc lite: handshake rejected: %s", reason)
+	}
+	return nil
+}
+
+// Call 调用 serviceMethod 并等待结果，ctx 的截止时间随请求头发给服务端，ctx 结束时不再等待
+func (c *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	cl := &call{reply: reply, done: make(chan error, 1)}
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.seq++
+	seq := c.seq
+	c.pending[seq] = cl
+	c.mu.Unlock()
+
+	h := &codec.Header{ServiceMethod: serviceMethod, Seq: seq}
+	if deadline, ok := ctx.Deadline(); ok {
+		h.Deadline = deadline.UnixNano()
+	}
+	c.sending.Lock()
+	err := c.cc.Write(h, args)
+	c.sending.Unlock()
+	if err != nil {
+		c.remove(seq)
+		return err
+	}
+	select {
+	case err := <-cl.done:
+		return err
+	case <-ctx.Done():
+		c.remove(seq)
+		return errors.New("rpc lite: call failed: " + ctx.Err().Error())
+	}
+}
+
+func (c *Client) remove(seq uint64) *call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cl := c.pending[seq]
+	delete(c.pending, seq)
+	return cl
+}
+
+// receive 读取响应，连接出错后结束所有等待中的调用
+func (c *Client) receive() {
+	var err error
+	for err == nil {
+		var h codec.Header
+		if err = c.cc.ReadHeader(&h); err != nil {
+			break
+		}
+		cl := c.remove(h.Seq)
+		switch {
+		case cl == nil: // 已经取消的调用
+			err = c.cc.ReadBody(nil)
+		case h.Error != "":
+			err = c.cc.ReadBody(nil)
+			cl.done <- errors.New(h.Error)
+		default:
+			if err = c.cc.ReadBody(cl.reply); err != nil {
+				cl.done <- errors.New("rpc lite: reading body " + err.Error())
+			} else {
+				cl.done <- nil
+			}
+		}
+	}
+	if err == io.EOF {
+		err = ErrShutdown
+	}
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	for seq, cl := range c.pending {
+		cl.done <- c.err
+		delete(c.pending, seq)
+	}
+	c.mu.Unlock()
+}
+
+// Close 关闭连接
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return ErrShutdown
+	}
+	c.err = ErrShutdown
+	c.mu.Unlock()
+	return c.cc.Close()
+}
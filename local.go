@@ -0,0 +1,29 @@
+package MyRPC
+
+import (
+	"MyRPC/client"
+	"net"
+)
+
+//
+// 进程内传输
+// 测试服务方法时不需要真实的 socket 和空闲端口：NewLocalPipe 用 net.Pipe 直接把客户端连到服务端；
+// 也可以用 local@name 地址，Listen("local@name") 返回一个内存中的监听器，XDial("local@name") 连接它，
+// 这样 XClient、服务发现等按地址工作的代码也能在测试中使用。local 地址只在同一个进程内可达
+//
+// 内存中的监听器和连接方式见 client/local.go
+//
+
+// NewLocalPipe 通过内存中的管道把客户端直接连到 server，server 为 nil 时连接 DefaultServer
+func NewLocalPipe(server *Server, opts ...*Option) (*Client, error) {
+	if server == nil {
+		server = DefaultServer
+	}
+	opt, err := client.ParseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	c1, c2 := net.Pipe()
+	go server.ServerConn(c2)
+	return NewClient(c1, opt)
+}
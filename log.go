@@ -0,0 +1,146 @@
+package MyRPC
+
+import (
+	"MyRPC/client"
+	"MyRPC/codec"
+	"MyRPC/logger"
+	"context"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+//
+// 日志
+// 所有包的日志都经过 MyRPC/logger，通过 SetLogger 可以接入 zap、logrus 等日志库，
+// SetLogLevel 屏蔽生产环境中的调试日志。访问日志需要单独开启，每个请求处理完后记录一条。
+// 服务方法用 LoggerFromContext(ctx) 打印的日志会带上请求ID、方法、对端地址和租户，和访问日志中的字段相同，
+// 按请求ID就能把业务日志和访问日志对应起来
+//
+
+// Logger 日志接口
+type Logger = logger.Logger
+
+// SetLogger 替换全局的 Logger，传入 nil 恢复默认的标准库 log
+func SetLogger(l Logger) {
+	logger.Set(l)
+}
+
+// SetLogLevel 设置全局的日志级别：debug、info、warn、error、off
+func SetLogLevel(level string) error {
+	l, err := logger.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(l)
+	return nil
+}
+
+// AccessEntry 一条访问日志
+type AccessEntry struct {
+	ServiceMethod string
+	RemoteAddr    string
+	CodecType     codec.Type
+	Start         time.Time
+	Duration      time.Duration
+	Error         string
+	RequestID     string
+	Tenant        string
+}
+
+// AccessLogger 接收访问日志
+type AccessLogger interface {
+	Access(entry *AccessEntry)
+}
+
+// DefaultAccessLogger 以 Info 级别把访问日志写到全局的 Logger
+type DefaultAccessLogger struct{}
+
+func (DefaultAccessLogger) Access(e *AccessEntry) {
+	logger.Infof("rpc access: request_id=%s method=%s remote=%s tenant=%s codec=%s duration=%s error=%q",
+		e.RequestID, e.ServiceMethod, e.RemoteAddr, e.Tenant, e.CodecType, e.Duration, e.Error)
+}
+
+// SetAccessLogger 开启服务端的访问日志，传入 nil 关闭，需要在 Accept 之前调用
+func (server *Server) SetAccessLogger(l AccessLogger) {
+	server.accessLogger = l
+}
+
+// logAccess 记录一次请求的访问日志
+func (server *Server) logAccess(req *request, start time.Time, err error) {
+	if server.accessLogger == nil {
+		return
+	}
+	e := &AccessEntry{
+		ServiceMethod: req.h.ServiceMethod,
+		Start:         start,
+		Duration:      time.Since(start),
+		RequestID:     req.fields.RequestID,
+		Tenant:        req.fields.Tenant,
+	}
+	if req.ci != nil {
+		e.RemoteAddr = req.ci.remoteAddr
+		e.CodecType = req.ci.codecType
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	server.accessLogger.Access(e)
+}
+
+// 日志字段使用的元数据键
+const (
+	MetadataRequestID = client.MetadataRequestID
+	MetadataTenant    = client.MetadataTenant
+)
+
+// LogFields 服务端处理一个请求时的日志字段
+type LogFields = client.LogFields
+
+// LogFieldsFromContext 取出服务端放在 ctx 中的日志字段
+var LogFieldsFromContext = client.LogFieldsFromContext
+
+// LoggerFromContext 返回带上 ctx 中日志字段的 Logger，ctx 中没有字段时只使用全局的 Logger。
+// 全局的 Logger 实现了 logger.FieldLogger 时字段以结构化的方式传给它
+func LoggerFromContext(ctx context.Context) Logger {
+	f, ok := LogFieldsFromContext(ctx)
+	if !ok {
+		return logger.With()
+	}
+	fields := []logger.Field{
+		{Key: "request_id", Value: f.RequestID},
+		{Key: "method", Value: f.ServiceMethod},
+		{Key: "peer", Value: f.RemoteAddr},
+	}
+	if f.Tenant != "" {
+		fields = append(fields, logger.Field{Key: "tenant", Value: f.Tenant})
+	}
+	return logger.With(fields...)
+}
+
+var (
+	requestIDPrefix = fmt.Sprintf("%08x", rand.New(rand.NewSource(time.Now().UnixNano())).Uint32())
+	requestIDSeq    uint64
+)
+
+// newRequestID 生成请求ID，进程内唯一，不同进程之间靠随机前缀区分
+func newRequestID() string {
+	return fmt.Sprintf("%s-%d", requestIDPrefix, atomic.AddUint64(&requestIDSeq, 1))
+}
+
+// withLogFields 把请求的日志字段放到 ctx 中
+func withLogFields(ctx context.Context, req *request) context.Context {
+	req.fields = LogFields{
+		RequestID:     req.h.Metadata[MetadataRequestID],
+		ServiceMethod: req.h.ServiceMethod,
+		Tenant:        req.h.Metadata[MetadataTenant],
+	}
+	if req.ci != nil {
+		req.fields.RemoteAddr = req.ci.remoteAddr
+	}
+	if req.fields.RequestID == "" {
+		req.fields.RequestID = newRequestID()
+	}
+	return client.WithLogFields(ctx, req.fields)
+}
@@ -0,0 +1,185 @@
+// Package logger MyRPC 各个包共用的日志接口。默认输出到标准库的 log，
+// 可以通过 Set 接入 zap、logrus 等日志库，通过 SetLevel 屏蔽低级别的日志
+package logger
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Logger 日志接口，参数与 fmt.Printf 相同
+type Logger interface {
+	Debug(format string, v ...interface{})
+	Info(format string, v ...interface{})
+	Warn(format string, v ...interface{})
+	Error(format string, v ...interface{})
+}
+
+// Level 日志级别
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff // 关闭所有日志
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "off"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelOff {
+		return fmt.Sprintf("level(%d)", l)
+	}
+	return levelNames[l]
+}
+
+// ParseLevel 解析 debug、info、warn、error、off
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("logger: unknown level %q", s)
+}
+
+// stdLogger 默认实现，输出到标准库的 log
+type stdLogger struct{}
+
+func (stdLogger) Debug(format string, v ...interface{}) { log.Printf(format, v...) }
+func (stdLogger) Info(format string, v ...interface{})  { log.Printf(format, v...) }
+func (stdLogger) Warn(format string, v ...interface{})  { log.Printf(format, v...) }
+func (stdLogger) Error(format string, v ...interface{}) { log.Printf(format, v...) }
+
+type holder struct {
+	Logger
+}
+
+var (
+	current atomic.Value // holder
+	level   int32        // Level
+)
+
+func init() {
+	current.Store(holder{stdLogger{}})
+}
+
+// Set 替换全局的 Logger，传入 nil 恢复默认实现
+func Set(l Logger) {
+	if l == nil {
+		l = stdLogger{}
+	}
+	current.Store(holder{l})
+}
+
+// SetLevel 设置全局的日志级别，低于该级别的日志不会交给 Logger
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// GetLevel 返回当前的日志级别
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&level))
+}
+
+func enabled(l Level) bool {
+	return l >= GetLevel()
+}
+
+func get() Logger {
+	return current.Load().(holder).Logger
+}
+
+func Debugf(format string, v ...interface{}) {
+	if enabled(LevelDebug) {
+		get().Debug(format, v...)
+	}
+}
+
+func Infof(format string, v ...interface{}) {
+	if enabled(LevelInfo) {
+		get().Info(format, v...)
+	}
+}
+
+func Warnf(format string, v ...interface{}) {
+	if enabled(LevelWarn) {
+		get().Warn(format, v...)
+	}
+}
+
+func Errorf(format string, v ...interface{}) {
+	if enabled(LevelError) {
+		get().Error(format, v...)
+	}
+}
+
+// Field 结构化日志的一个字段
+type Field struct {
+	Key   string
+	Value string
+}
+
+// FieldLogger 支持结构化字段的 Logger 可以实现该接口，With 返回带上这些字段的 Logger，
+// 没有实现时字段以 key=value 的形式加在每条日志的前面
+type FieldLogger interface {
+	Logger
+	With(fields ...Field) Logger
+}
+
+// With 返回带上 fields 的 Logger，它使用调用时的全局 Logger 和日志级别
+func With(fields ...Field) Logger {
+	return fieldLogger{fields: fields}
+}
+
+type fieldLogger struct {
+	fields []Field
+}
+
+// logger 全局 Logger 实现了 FieldLogger 时交给它处理字段，否则把字段拼接到格式串前面
+func (l fieldLogger) logger() (Logger, string) {
+	base := get()
+	if fl, ok := base.(FieldLogger); ok {
+		return fl.With(l.fields...), ""
+	}
+	var b strings.Builder
+	for _, f := range l.fields {
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		b.WriteString(f.Value)
+		b.WriteByte(' ')
+	}
+	return base, strings.ReplaceAll(b.String(), "%", "%%")
+}
+
+func (l fieldLogger) Debug(format string, v ...interface{}) {
+	if enabled(LevelDebug) {
+		base, prefix := l.logger()
+		base.Debug(prefix+format, v...)
+	}
+}
+
+func (l fieldLogger) Info(format string, v ...interface{}) {
+	if enabled(LevelInfo) {
+		base, prefix := l.logger()
+		base.Info(prefix+format, v...)
+	}
+}
+
+func (l fieldLogger) Warn(format string, v ...interface{}) {
+	if enabled(LevelWarn) {
+		base, prefix := l.logger()
+		base.Warn(prefix+format, v...)
+	}
+}
+
+func (l fieldLogger) Error(format string, v ...interface{}) {
+	if enabled(LevelError) {
+		base, prefix := l.logger()
+		base.Error(prefix+format, v...)
+	}
+}
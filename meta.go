@@ -0,0 +1,163 @@
+package MyRPC
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//
+// 元数据服务
+// 每个 Server 都内置 _meta 服务，命令行工具、网关、测试这类通用的调用方可以在运行时查询服务端有哪些服务和方法，
+// 以及参数和返回值的结构，然后用 Json 编码构造请求，不需要编译时知道服务的类型：
+//
+//	_meta.ListServices      MetaArgs{}                         -> []string
+//	_meta.ListMethods       MetaArgs{Service}                  -> []string
+//	_meta.MethodSignature   MetaArgs{Service, Method}          -> MethodSignature
+//
+// _meta 不出现在 Services() 中，不会上报给注册中心，也不能被注册或注销
+//
+
+// MetaServiceName 内置的元数据服务的服务名
+const MetaServiceName = "_meta"
+
+// MetaArgs 元数据服务的参数，不同的方法使用其中不同的字段
+type MetaArgs struct {
+	Service string
+	Method  string
+}
+
+// MethodSignature 一个方法的签名
+type MethodSignature struct {
+	Service     string
+	Method      string
+	WithContext bool      // 方法是否接收 context.Context
+	Args        *TypeInfo // 参数的类型
+	Reply       *TypeInfo // 返回值的类型，方法声明中的指针已经去掉
+
+	// 服务实现 Describer 时提供的说明和示例，见 describe.go
+	Description  string          `json:",omitempty"`
+	Example      json.RawMessage `json:",omitempty"`
+	ExampleReply json.RawMessage `json:",omitempty"`
+}
+
+// TypeInfo 描述一个 Go 类型的结构，字段名按 Json 编码时的名字
+type TypeInfo struct {
+	Name   string      `json:",omitempty"` // 类型名，比如 main.Args，匿名类型为空
+	Kind   string      // reflect.Kind 的名字，比如 struct、slice、map、ptr、int
+	Fields []FieldInfo `json:",omitempty"` // struct 的导出字段，递归引用自身时为空
+	Key    *TypeInfo   `json:",omitempty"` // map 的键
+	Elem   *TypeInfo   `json:",omitempty"` // ptr、slice、array、map 的元素
+	Len    int         `json:",omitempty"` // array 的长度
+}
+
+// FieldInfo 结构体的一个字段
+type FieldInfo struct {
+	Name   string
+	GoName string `json:",omitempty"` // Go 的字段名，Gob 按它匹配字段，与 Name 相同时为空
+	Type   *TypeInfo
+}
+
+// MetaService 内置的元数据服务
+type MetaService struct {
+	server *Server
+}
+
+// ListServices 返回已注册的服务名，不包括 _meta
+func (m *MetaService) ListServices(args MetaArgs, reply *[]string) error {
+	*reply = m.server.Services()
+	return nil
+}
+
+// ListMethods 返回服务的方法名，按字典序排列
+func (m *MetaService) ListMethods(args MetaArgs, reply *[]string) error {
+	svc, err := m.service(args.Service)
+	if err != nil {
+		return err
+	}
+	methods := make([]string, 0, len(svc.method))
+	for name := range svc.method {
+		methods = append(methods, name)
+	}
+	sort.Strings(methods)
+	*reply = methods
+	return nil
+}
+
+// MethodSignature 返回方法的签名
+func (m *MetaService) MethodSignature(args MetaArgs, reply *MethodSignature) error {
+	svc, err := m.service(args.Service)
+	if err != nil {
+		return err
+	}
+	mtype := svc.method[args.Method]
+	if mtype == nil {
+		return Errorf(CodeNotFound, "rpc server: can't find method %s", args.Method)
+	}
+	*reply = MethodSignature{
+		Service:     svc.name,
+		Method:      args.Method,
+		WithContext: mtype.withCtx,
+		Args:        describeType(mtype.ArgType, map[reflect.Type]bool{}),
+		Reply:       describeType(mtype.ReplyType.Elem(), map[reflect.Type]bool{}),
+
+		Description:  mtype.doc.description,
+		Example:      mtype.doc.example,
+		ExampleReply: mtype.doc.exampleReply,
+	}
+	return nil
+}
+
+func (m *MetaService) service(name string) (*service, error) {
+	if name == MetaServiceName {
+		return m.server.meta, nil
+	}
+	svci, ok := m.server.serviceMap.Load(name)
+	if !ok {
+		return nil, Errorf(CodeNotFound, "rpc server: can't find service %s", name)
+	}
+	return svci.(*service), nil
+}
+
+// describeType 描述类型的结构，visiting 记录正在展开的结构体，递归引用时不再展开
+func describeType(t reflect.Type, visiting map[reflect.Type]bool) *TypeInfo {
+	info := &TypeInfo{Kind: t.Kind().String()}
+	if t.Name() != "" {
+		info.Name = t.String()
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		info.Elem = describeType(t.Elem(), visiting)
+	case reflect.Array:
+		info.Elem = describeType(t.Elem(), visiting)
+		info.Len = t.Len()
+	case reflect.Map:
+		info.Key = describeType(t.Key(), visiting)
+		info.Elem = describeType(t.Elem(), visiting)
+	case reflect.Struct:
+		if visiting[t] {
+			return info
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" { // 不导出的字段不会被编码
+				continue
+			}
+			field := FieldInfo{Name: f.Name}
+			if tag := f.Tag.Get("json"); tag != "" {
+				if tag == "-" {
+					continue
+				}
+				if n := strings.Split(tag, ",")[0]; n != "" && n != f.Name {
+					field.Name, field.GoName = n, f.Name
+				}
+			}
+			field.Type = describeType(f.Type, visiting)
+			info.Fields = append(info.Fields, field)
+		}
+	}
+	return info
+}
@@ -0,0 +1,50 @@
+package MyRPC
+
+import (
+	"MyRPC/codec"
+	"context"
+	"time"
+)
+
+//
+// 元数据与截止时间的传递
+// 客户端把 ctx 中的截止时间和元数据放到请求头中发给服务端（见 client/metadata.go），服务端据此构造处理请求的 ctx，
+// 接受 ctx 的服务方法（func (t *T) Method(ctx context.Context, args T1, reply *T2) error）就能拿到它们。
+//
+
+// requestContext 服务端根据请求头构造处理请求的 ctx
+func requestContext(parent context.Context, deadline int64, md map[string]string) (context.Context, context.CancelFunc) {
+	ctx := parent
+	if len(md) > 0 {
+		ctx = WithMetadata(ctx, md)
+	}
+	if deadline > 0 {
+		return context.WithDeadline(ctx, time.Unix(0, deadline))
+	}
+	return context.WithCancel(ctx)
+}
+
+// SetMetadataLimits 限制请求元数据的键值对个数和总字节数，超过限制的请求返回 codec.ErrMetadataTooLarge，
+// CompactType 在解码时就检查，超过限制时直接关闭连接。需要在 Accept 之前调用
+func (server *Server) SetMetadataLimits(l codec.MetadataLimits) {
+	server.mdLimits = l
+}
+
+type callerKey struct{}
+
+// SetCaller 为服务端配置调用下游服务的客户端，服务方法通过 CallerFromContext 取出使用。
+// 整条调用链共用同一个客户端，调用时传入服务方法收到的 ctx，截止时间和元数据就会继续向下传递
+func (server *Server) SetCaller(c Caller) {
+	server.caller = c
+}
+
+// WithCaller 返回带有下游客户端的 ctx
+func WithCaller(ctx context.Context, c Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+// CallerFromContext 取出 ctx 中的下游客户端，没有配置时返回 nil
+func CallerFromContext(ctx context.Context) Caller {
+	c, _ := ctx.Value(callerKey{}).(Caller)
+	return c
+}
@@ -0,0 +1,102 @@
+package MyRPC
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// 方法统计
+// 每个注册的方法自己统计调用次数、错误数、正在执行的调用数，并保存最近 latencyWindow 次调用的耗时用来计算分位数。
+// 和 metrics.go 的直方图不同，这里不受 MetricsConfig 的限制，所有方法都有，Server.Stats 返回它们，
+// 调试页面和 /debug/myrpc/metrics 也会展示
+//
+
+// latencyWindow 计算耗时分位数使用的最近调用次数
+const latencyWindow = 1024
+
+// MethodStats 一个方法的调用统计
+type MethodStats struct {
+	Method   string        // 服务名.方法名
+	Calls    uint64        // 注册以来的调用次数
+	Errors   uint64        // 返回错误的调用次数，包括 panic
+	Inflight int64         // 正在执行的调用数
+	P50      time.Duration // 最近调用耗时的分位数，还没有调用时为0
+	P90      time.Duration
+	P99      time.Duration
+}
+
+// methodStats methodType 中除调用次数以外的统计
+type methodStats struct {
+	errors   uint64
+	inflight int64
+
+	mu      sync.Mutex
+	samples []time.Duration // 最近的耗时，写满后循环覆盖
+	next    int
+}
+
+// begin 开始一次调用
+func (m *methodType) begin() {
+	atomic.AddInt64(&m.stats.inflight, 1)
+}
+
+// end 结束一次调用，记录耗时和结果
+func (m *methodType) end(d time.Duration, err error) {
+	s := &m.stats
+	atomic.AddInt64(&s.inflight, -1)
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.samples) < latencyWindow {
+		s.samples = append(s.samples, d)
+		return
+	}
+	s.samples[s.next] = d
+	s.next = (s.next + 1) % latencyWindow
+}
+
+// snapshot 返回方法当前的统计
+func (m *methodType) snapshot(serviceMethod string) MethodStats {
+	st := MethodStats{
+		Method:   serviceMethod,
+		Calls:    m.NumCalls(),
+		Errors:   atomic.LoadUint64(&m.stats.errors),
+		Inflight: atomic.LoadInt64(&m.stats.inflight),
+	}
+	m.stats.mu.Lock()
+	samples := append([]time.Duration(nil), m.stats.samples...)
+	m.stats.mu.Unlock()
+	if len(samples) == 0 {
+		return st
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	st.P50, st.P90, st.P99 = percentile(samples, 0.5), percentile(samples, 0.9), percentile(samples, 0.99)
+	return st
+}
+
+// percentile 有序的 samples 中的 q 分位数
+func percentile(samples []time.Duration, q float64) time.Duration {
+	i := int(q*float64(len(samples))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	return samples[i]
+}
+
+// methodStats 返回所有注册的方法的统计，按 服务名.方法名 排序
+func (server *Server) methodStats() []MethodStats {
+	var stats []MethodStats
+	server.serviceMap.Range(func(name, svci interface{}) bool {
+		for methodName, mtype := range svci.(*service).method {
+			stats = append(stats, mtype.snapshot(name.(string)+"."+methodName))
+		}
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Method < stats[j].Method })
+	return stats
+}
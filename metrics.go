@@ -0,0 +1,223 @@
+package MyRPC
+
+import (
+	"MyRPC/logger"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// 指标
+// 服务端按 服务名.方法名 记录请求数、错误数和耗时直方图，连同当前连接数、接受连接的统计、向注册中心发送的心跳数，
+// 以 Prometheus 文本格式导出，HandleHTTP 会把它挂在 /debug/myrpc/metrics 上。
+// 注册了成千上万个方法的服务端如果全部导出，指标的基数会爆炸，所以可以用 MetricsConfig 控制：
+// 只导出允许列表中的方法、排除拒绝列表中的方法、限制方法的数量，并且为每个方法单独配置分桶
+//
+
+const defaultMetricsPath = "/debug/myrpc/metrics"
+
+// DefaultBuckets 默认的耗时分桶，单位秒
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// otherMethod 超过 MaxMethods 之后的方法都记在这里
+const otherMethod = "other"
+
+// MetricsConfig 指标的导出配置，Allow 和 Deny 使用 path.Match 的模式匹配 服务名.方法名
+type MetricsConfig struct {
+	Allow      []string             // 只导出匹配的方法，为空表示全部
+	Deny       []string             // 不导出匹配的方法，优先于 Allow
+	Buckets    map[string][]float64 // 按方法配置的分桶
+	MaxMethods int                  // 最多导出多少个方法，超出的合并到 other，0 表示不限制
+}
+
+// histogram 耗时直方图
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // 与 buckets 一一对应，不是累积值
+	count   uint64
+	sum     float64
+	errors  uint64 // 返回错误的请求数
+}
+
+func (h *histogram) observe(v float64, failed bool) {
+	if failed {
+		h.errors++
+	}
+	h.count++
+	h.sum += v
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+type serverMetrics struct {
+	mu      sync.Mutex
+	config  MetricsConfig
+	latency map[string]*histogram
+
+	heartbeats      uint64 // 发送的心跳数
+	heartbeatErrors uint64 // 发送失败的心跳数
+	accept          acceptStats
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{latency: make(map[string]*histogram)}
+}
+
+// SetMetricsConfig 设置指标的导出配置，已经记录的指标会被清空
+func (server *Server) SetMetricsConfig(config MetricsConfig) {
+	server.metrics.mu.Lock()
+	defer server.metrics.mu.Unlock()
+	server.metrics.config = config
+	server.metrics.latency = make(map[string]*histogram)
+}
+
+// allowed 判断方法是否需要导出
+func (c *MetricsConfig) allowed(serviceMethod string) bool {
+	for _, p := range c.Deny {
+		if ok, _ := path.Match(p, serviceMethod); ok {
+			return false
+		}
+	}
+	if len(c.Allow) == 0 {
+		return true
+	}
+	for _, p := range c.Allow {
+		if ok, _ := path.Match(p, serviceMethod); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// observe 记录一次请求的耗时和结果
+func (m *serverMetrics) observe(serviceMethod string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.config.allowed(serviceMethod) {
+		return
+	}
+	h := m.latency[serviceMethod]
+	if h == nil {
+		if m.config.MaxMethods > 0 && len(m.latency) >= m.config.MaxMethods {
+			serviceMethod = otherMethod
+			h = m.latency[serviceMethod]
+		}
+		if h == nil {
+			buckets := m.config.Buckets[serviceMethod]
+			if buckets == nil {
+				buckets = DefaultBuckets
+			}
+			h = &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+			m.latency[serviceMethod] = h
+		}
+	}
+	h.observe(d.Seconds(), err != nil)
+}
+
+// observeHeartbeat 记录一次心跳的结果
+func (m *serverMetrics) observeHeartbeat(err error) {
+	atomic.AddUint64(&m.heartbeats, 1)
+	if err != nil {
+		atomic.AddUint64(&m.heartbeatErrors, 1)
+	}
+}
+
+// WriteMetrics 以 Prometheus 文本格式写出指标
+func (server *Server) WriteMetrics(w io.Writer) error {
+	m := server.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	methods := make([]string, 0, len(m.latency))
+	for method := range m.latency {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	fmt.Fprintln(w, "# HELP myrpc_server_requests_total Total number of handled requests.\n# TYPE myrpc_server_requests_total counter")
+	for _, method := range methods {
+		fmt.Fprintf(w, "myrpc_server_requests_total{method=%q} %d\n", method, m.latency[method].count)
+	}
+	fmt.Fprintln(w, "# HELP myrpc_server_errors_total Total number of requests that returned an error.\n# TYPE myrpc_server_errors_total counter")
+	for _, method := range methods {
+		fmt.Fprintf(w, "myrpc_server_errors_total{method=%q} %d\n", method, m.latency[method].errors)
+	}
+	fmt.Fprintln(w, "# HELP myrpc_server_handle_seconds Time spent handling requests.\n# TYPE myrpc_server_handle_seconds histogram")
+	for _, method := range methods {
+		h := m.latency[method]
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "myrpc_server_handle_seconds_bucket{method=%q,le=\"%g\"} %d\n", method, b, cumulative)
+		}
+		fmt.Fprintf(w, "myrpc_server_handle_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", method, h.count)
+		fmt.Fprintf(w, "myrpc_server_handle_seconds_sum{method=%q} %g\n", method, h.sum)
+		fmt.Fprintf(w, "myrpc_server_handle_seconds_count{method=%q} %d\n", method, h.count)
+	}
+
+	// methodType 自己的统计，包括注册以来的所有调用，见 methodstats.go
+	var stats []MethodStats
+	for _, st := range server.methodStats() {
+		if m.config.allowed(st.Method) {
+			stats = append(stats, st)
+		}
+	}
+	fmt.Fprintln(w, "# HELP myrpc_service_method_calls_total Total number of calls per registered method.\n# TYPE myrpc_service_method_calls_total counter")
+	for _, st := range stats {
+		fmt.Fprintf(w, "myrpc_service_method_calls_total{method=%q} %d\n", st.Method, st.Calls)
+	}
+	fmt.Fprintln(w, "# HELP myrpc_service_method_errors_total Total number of calls per registered method that returned an error or panicked.\n# TYPE myrpc_service_method_errors_total counter")
+	for _, st := range stats {
+		fmt.Fprintf(w, "myrpc_service_method_errors_total{method=%q} %d\n", st.Method, st.Errors)
+	}
+	fmt.Fprintln(w, "# HELP myrpc_service_method_inflight Number of calls per registered method being executed.\n# TYPE myrpc_service_method_inflight gauge")
+	for _, st := range stats {
+		fmt.Fprintf(w, "myrpc_service_method_inflight{method=%q} %d\n", st.Method, st.Inflight)
+	}
+	fmt.Fprintln(w, "# HELP myrpc_service_method_latency_seconds Latency quantiles of the recent calls per registered method.\n# TYPE myrpc_service_method_latency_seconds gauge")
+	for _, st := range stats {
+		fmt.Fprintf(w, "myrpc_service_method_latency_seconds{method=%q,quantile=\"0.5\"} %g\n", st.Method, st.P50.Seconds())
+		fmt.Fprintf(w, "myrpc_service_method_latency_seconds{method=%q,quantile=\"0.9\"} %g\n", st.Method, st.P90.Seconds())
+		fmt.Fprintf(w, "myrpc_service_method_latency_seconds{method=%q,quantile=\"0.99\"} %g\n", st.Method, st.P99.Seconds())
+	}
+
+	var conns int
+	server.conns.Range(func(_, _ interface{}) bool {
+		conns++
+		return true
+	})
+	fmt.Fprintf(w, "# HELP myrpc_server_open_connections Number of open connections.\n# TYPE myrpc_server_open_connections gauge\nmyrpc_server_open_connections %d\n", conns)
+	fmt.Fprintf(w, "# HELP myrpc_server_accepted_connections_total Total number of accepted connections.\n# TYPE myrpc_server_accepted_connections_total counter\nmyrpc_server_accepted_connections_total %d\n", atomic.LoadUint64(&m.accept.accepted))
+	fmt.Fprintf(w, "# HELP myrpc_server_accept_errors_total Total number of errors returned by Accept.\n# TYPE myrpc_server_accept_errors_total counter\nmyrpc_server_accept_errors_total %d\n", atomic.LoadUint64(&m.accept.errors))
+	fmt.Fprintf(w, "# HELP myrpc_server_handshaking_connections Number of accepted connections that have not finished the handshake.\n# TYPE myrpc_server_handshaking_connections gauge\nmyrpc_server_handshaking_connections %d\n", atomic.LoadInt64(&m.accept.handshaking))
+	fmt.Fprintf(w, "# HELP myrpc_server_accept_workers Number of goroutines accepting connections per listener.\n# TYPE myrpc_server_accept_workers gauge\nmyrpc_server_accept_workers %d\n", server.acceptWorkers)
+	healthy := 0
+	if server.lastHealth().Healthy {
+		healthy = 1
+	}
+	fmt.Fprintf(w, "# HELP myrpc_server_healthy Whether the server is within its SLO and passes its health check.\n# TYPE myrpc_server_healthy gauge\nmyrpc_server_healthy %d\n", healthy)
+	fmt.Fprintf(w, "# HELP myrpc_registry_heartbeats_total Total number of heartbeats sent to the registry.\n# TYPE myrpc_registry_heartbeats_total counter\nmyrpc_registry_heartbeats_total %d\n", atomic.LoadUint64(&m.heartbeats))
+	_, err := fmt.Fprintf(w, "# HELP myrpc_registry_heartbeat_errors_total Total number of heartbeats that failed.\n# TYPE myrpc_registry_heartbeat_errors_total counter\nmyrpc_registry_heartbeat_errors_total %d\n", atomic.LoadUint64(&m.heartbeatErrors))
+	return err
+}
+
+// metricsHTTP 以 Prometheus 文本格式提供指标
+type metricsHTTP struct {
+	*Server
+}
+
+func (server metricsHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := server.WriteMetrics(w); err != nil {
+		logger.Errorf("rpc server: write metrics error: %v", err)
+	}
+}
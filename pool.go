@@ -0,0 +1,98 @@
+package MyRPC
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+//
+// 并发控制
+// serverCodec 为每个请求开一个协程，突发流量可能耗尽内存。设置最大并发数后，
+// 同时处理的请求不超过 workers 个，多出来的请求最多排队 queue 个，队列也满了就直接返回 ErrServerBusy。
+// 昂贵的方法可以用 SetMethodConcurrency 单独限制，它的请求在自己的池子里排队，不占用全局的并发数，
+// 慢查询堆积时其他方法不受影响；它的队列满了返回 ErrMethodBusy
+//
+
+// ErrMethodBusy 方法的并发数和队列都已经用满时返回给客户端的错误
+var ErrMethodBusy error = Errorf(CodeResourceExhausted, "rpc server: method busy")
+
+type workerPool struct {
+	slots  chan struct{} // 容量等于最大并发数
+	queue  int64         // 队列的长度
+	queued int64         // 正在排队的请求数
+	busy   error         // 队列满了时返回的错误
+}
+
+// SetMaxConcurrency 设置同时处理的最大请求数 workers 和排队的请求数 queue，workers 为 0 表示不限制，需要在 Accept 之前调用。
+// 处理超时的请求在服务方法返回之前仍然占用名额
+func (server *Server) SetMaxConcurrency(workers, queue int) {
+	if workers <= 0 {
+		server.pool = nil
+		return
+	}
+	server.pool = &workerPool{
+		slots: make(chan struct{}, workers),
+		queue: int64(queue),
+		busy:  ErrServerBusy,
+	}
+}
+
+// SetMethodConcurrency 限制 serviceMethod（Service.Method）同时处理的请求数为 workers，
+// 可选的 queue 是排队的请求数，默认为0，超出并发数的请求直接返回 ErrMethodBusy。
+// workers 为 0 表示取消单独的限制，方法的请求回到全局的池子。可以在运行时调用，只影响之后收到的请求
+func (server *Server) SetMethodConcurrency(serviceMethod string, workers int, queue ...int) error {
+	if dot := strings.LastIndex(serviceMethod, "."); dot <= 0 || dot == len(serviceMethod)-1 {
+		return fmt.Errorf("rpc server: method concurrency: service/method %s ill-formed", serviceMethod)
+	}
+	if len(queue) > 1 {
+		return fmt.Errorf("rpc server: method concurrency: expect at most one queue size, got %d", len(queue))
+	}
+	if workers <= 0 {
+		server.methodPools.Delete(serviceMethod)
+		return nil
+	}
+	p := &workerPool{slots: make(chan struct{}, workers), busy: ErrMethodBusy}
+	if len(queue) == 1 {
+		p.queue = int64(queue[0])
+	}
+	server.methodPools.Store(serviceMethod, p)
+	return nil
+}
+
+// poolFor 返回处理 serviceMethod 的池子，有单独限制的方法使用自己的池子
+func (server *Server) poolFor(serviceMethod string) *workerPool {
+	if p, ok := server.methodPools.Load(serviceMethod); ok {
+		return p.(*workerPool)
+	}
+	return server.pool
+}
+
+// submit 提交一个任务，超出并发数时排队，队列满了返回 ErrServerBusy 或者方法的 ErrMethodBusy
+func (p *workerPool) submit(task func()) error {
+	if p == nil {
+		go task()
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		go p.run(task)
+		return nil
+	default:
+	}
+	if atomic.AddInt64(&p.queued, 1) > p.queue {
+		atomic.AddInt64(&p.queued, -1)
+		return p.busy
+	}
+	go func() {
+		p.slots <- struct{}{}
+		atomic.AddInt64(&p.queued, -1)
+		p.run(task)
+	}()
+	return nil
+}
+
+func (p *workerPool) run(task func()) {
+	defer func() { <-p.slots }()
+	task()
+}
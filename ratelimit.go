@@ -0,0 +1,145 @@
+package MyRPC
+
+import (
+	"MyRPC/logger"
+	"MyRPC/registry/regclient"
+	"context"
+	"sync"
+	"time"
+)
+
+//
+// 集群限流
+// 服务端按请求的元数据算出限流键（比如租户），通过注册中心的 /quota 接口共享令牌桶。
+// 为了不让每个请求都访问注册中心，每次按批租用令牌，在本地消耗完再去申请；同一个键同时只有一个申请，
+// 注册中心没有令牌时在 quotaDenyWindow 内直接拒绝，不再重复申请。
+// 申请在连接的读循环中进行，有超时时间，注册中心不可用或者超时时放行请求，限流不能成为新的单点故障
+//
+
+// ErrRateLimited 超过集群限流配额时返回给客户端的错误
+var ErrRateLimited error = Errorf(CodeResourceExhausted, "rpc server: rate limit exceeded")
+
+// 默认值
+const (
+	defaultQuotaBatch   = 10
+	defaultQuotaTimeout = 200 * time.Millisecond
+	quotaDenyWindow     = 100 * time.Millisecond // 注册中心没有令牌时，这段时间内直接拒绝
+)
+
+// Quota 一个限流键在整个集群的配额
+type Quota struct {
+	Rate  float64 // 集群合计的 QPS
+	Burst float64 // 突发容量，为0时等于 Rate
+}
+
+// DistributedLimit 集群限流的配置
+type DistributedLimit struct {
+	Registry string                                         // 注册中心地址
+	Quotas   map[string]Quota                               // 限流键对应的配额，没有配额的键不限流
+	Key      func(serviceMethod string, md Metadata) string // 计算限流键，默认取元数据中的 tenant
+	Batch    int                                            // 每次从注册中心租用的令牌数，默认10
+	Timeout  time.Duration                                  // 向注册中心申请令牌的超时时间，默认200ms
+}
+
+// distributedLimiter 本地缓存从注册中心租来的令牌
+type distributedLimiter struct {
+	server   *Server // 申请令牌时带上 SetRegistryToken 设置的令牌
+	config   DistributedLimit
+	mu       sync.Mutex
+	tokens   map[string]int
+	denied   map[string]time.Time     // 注册中心没有令牌的键，到期之前直接拒绝
+	inflight map[string]*quotaAcquire // 正在向注册中心申请令牌的键
+}
+
+// quotaAcquire 一次正在进行的申请，同一个键的其他请求等待它完成
+type quotaAcquire struct {
+	done chan struct{}
+	err  error
+}
+
+// SetDistributedLimit 开启集群限流，传入 nil 关闭，需要在 Accept 之前调用
+func (server *Server) SetDistributedLimit(l *DistributedLimit) {
+	if l == nil {
+		server.limiter = nil
+		return
+	}
+	config := *l
+	if config.Key == nil {
+		config.Key = func(_ string, md Metadata) string { return md[MetadataTenant] }
+	}
+	if config.Batch <= 0 {
+		config.Batch = defaultQuotaBatch
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultQuotaTimeout
+	}
+	server.limiter = &distributedLimiter{
+		server:   server,
+		config:   config,
+		tokens:   make(map[string]int),
+		denied:   make(map[string]time.Time),
+		inflight: make(map[string]*quotaAcquire),
+	}
+}
+
+// allow 消耗一个令牌，本地的令牌用完时向注册中心申请
+func (l *distributedLimiter) allow(serviceMethod string, md Metadata) bool {
+	key := l.config.Key(serviceMethod, md)
+	quota, ok := l.config.Quotas[key]
+	if key == "" || !ok {
+		return true
+	}
+	l.mu.Lock()
+	for {
+		if l.tokens[key] > 0 {
+			l.tokens[key]--
+			l.mu.Unlock()
+			return true
+		}
+		if time.Now().Before(l.denied[key]) {
+			l.mu.Unlock()
+			return false
+		}
+		a, ok := l.inflight[key]
+		if !ok {
+			a = &quotaAcquire{done: make(chan struct{})}
+			l.inflight[key] = a
+			l.mu.Unlock()
+			a.err = l.acquire(key, quota)
+			l.mu.Lock()
+			delete(l.inflight, key)
+			close(a.done)
+		} else {
+			l.mu.Unlock()
+			<-a.done
+			l.mu.Lock()
+		}
+		if a.err != nil {
+			l.mu.Unlock()
+			return true
+		}
+	}
+}
+
+// acquire 向注册中心申请一批令牌，调用方不持有锁
+func (l *distributedLimiter) acquire(key string, quota Quota) error {
+	ctx, cancel := context.WithTimeout(regclient.WithToken(context.Background(), l.server.registryToken), l.config.Timeout)
+	defer cancel()
+	granted, err := regclient.AcquireQuotaContext(ctx, l.config.Registry, regclient.QuotaRequest{
+		Key:    key,
+		Rate:   quota.Rate,
+		Burst:  quota.Burst,
+		Tokens: l.config.Batch,
+	})
+	if err != nil {
+		logger.Warnf("rpc server: acquire quota for %s error: %v", key, err)
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens[key] += granted
+	if granted == 0 {
+		l.denied[key] = time.Now().Add(quotaDenyWindow)
+	}
+	return nil
+}
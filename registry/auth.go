@@ -0,0 +1,113 @@
+package registry
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//
+// 注册鉴权和准入
+// 默认任何能访问注册中心的人都可以注册一个地址，把客户端的流量引到自己那里。
+// SetToken 设置共享的令牌后，注册、心跳、注销、申请限流令牌以及写入和删除 KV 都需要带上
+// Authorization: Bearer <token>，否则返回 401。服务端通过 MyRPC.Server.SetRegistryToken 配置，
+// 直接使用 regclient 时用 regclient.WithToken 把令牌放进 ctx，对等节点之间转发时使用同一个令牌。
+// SetAdmission 在接受一个实例之前检查它，比如只允许内网地址，拒绝时返回 403。
+// 查询服务列表、事件流和读取 KV 不受影响
+//
+
+// AdmitFunc 检查是否接受实例的注册或心跳，remoteAddr 是请求的来源地址，对等节点转发时是对等节点的地址。
+// 返回错误时拒绝
+type AdmitFunc func(item ServerItem, remoteAddr string) error
+
+// SetToken 设置修改注册中心的请求使用的令牌，为空时不鉴权，需要在 HandleHTTP 之前调用
+func (r *MyRegistry) SetToken(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.token = token
+}
+
+// SetAdmission 设置实例的准入检查，为 nil 时接受所有实例，需要在 HandleHTTP 之前调用
+func (r *MyRegistry) SetAdmission(admit AdmitFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.admit = admit
+}
+
+// authorized 检查修改注册中心的请求是否带有正确的令牌，失败时写出 401
+func (r *MyRegistry) authorized(w http.ResponseWriter, req *http.Request) bool {
+	r.mu.Lock()
+	token := r.token
+	r.mu.Unlock()
+	if token == "" {
+		return true
+	}
+	got := []byte(req.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(got, []byte("Bearer "+token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "rpc registry: invalid token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// admitted 执行准入检查，拒绝时写出 403
+func (r *MyRegistry) admitted(w http.ResponseWriter, req *http.Request, item ServerItem) bool {
+	r.mu.Lock()
+	admit := r.admit
+	r.mu.Unlock()
+	if admit == nil {
+		return true
+	}
+	if err := admit(item, req.RemoteAddr); err != nil {
+		http.Error(w, fmt.Sprintf("rpc registry: %s rejected: %v", item.Addr, err), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// setToken 给转发给对等节点的请求带上令牌
+func (r *MyRegistry) setToken(req *http.Request) {
+	r.mu.Lock()
+	token := r.token
+	r.mu.Unlock()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// AllowNetworks 返回只接受 cidrs 网段中地址的 AdmitFunc，检查的是实例注册的地址（protocol@host:port），
+// 不是请求的来源，所以对等节点的转发同样适用。主机名和 unix socket 地址会被拒绝
+func AllowNetworks(cidrs ...string) (AdmitFunc, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return func(item ServerItem, remoteAddr string) error {
+		addr := item.Addr
+		if i := strings.Index(addr, "@"); i >= 0 {
+			addr = addr[i+1:]
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return errors.New("host must be an IP address")
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return nil
+			}
+		}
+		return errors.New("address not in allowed networks")
+	}, nil
+}
@@ -0,0 +1,85 @@
+package registry
+
+import (
+	"MyRPC/logger"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//
+// 集群
+// 单个注册中心是单点，可以部署多个注册中心互为对等节点：任意一个节点收到服务端的注册、心跳或注销，
+// 都会异步转发给其他节点，转发的请求带上 X-Myrpc-Replicated，收到的节点不再继续转发。
+// 客户端配置多个注册中心地址，一个不可用时切换到下一个
+//
+
+const replicatedHeader = "X-Myrpc-Replicated"
+
+// SetPeers 设置对等的注册中心地址（完整的注册中心路径），需要在 HandleHTTP 之前调用
+func (r *MyRegistry) SetPeers(peers []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers = peers
+}
+
+// replicated 判断请求是否来自其他注册中心的转发
+func replicated(req *http.Request) bool {
+	return req.Header.Get(replicatedHeader) != ""
+}
+
+// replicatePut 把注册或心跳转发给所有对等节点
+func (r *MyRegistry) replicatePut(addr string) {
+	r.mu.Lock()
+	peers := r.peers
+	s := r.servers[addr]
+	var item ServerItem
+	if s != nil {
+		item = *s
+	}
+	r.mu.Unlock()
+	if len(peers) == 0 || s == nil {
+		return
+	}
+	body, err := json.Marshal(item)
+	if err != nil {
+		return
+	}
+	for _, peer := range peers {
+		req, _ := http.NewRequest("POST", strings.TrimSuffix(peer, "/")+registerPath, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.setToken(req)
+		go forward(peer, req)
+	}
+}
+
+// replicateRemove 把注销转发给所有对等节点
+func (r *MyRegistry) replicateRemove(addr string) {
+	r.mu.Lock()
+	peers := r.peers
+	r.mu.Unlock()
+	for _, peer := range peers {
+		req, _ := http.NewRequest("DELETE", peer, nil)
+		req.Header.Set("X-Myrpc-Server", addr)
+		r.setToken(req)
+		go forward(peer, req)
+	}
+}
+
+// forwardClient 转发给对等节点使用的客户端，对等节点没有响应时不会让转发协程一直阻塞
+var forwardClient = &http.Client{Timeout: 5 * time.Second}
+
+func forward(peer string, req *http.Request) {
+	req.Header.Set(replicatedHeader, "1")
+	resp, err := forwardClient.Do(req)
+	if err != nil {
+		logger.Warnf("rpc registry: replicate to %s error: %v", peer, err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logger.Warnf("rpc registry: replicate to %s failed: %s", peer, resp.Status)
+	}
+}
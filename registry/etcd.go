@@ -0,0 +1,346 @@
+package registry
+
+import (
+	"MyRPC/logger"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// etcd
+// 已经部署了 etcd 的环境不需要再单独部署注册中心。这里通过 etcd v3 的 Json 网关（/v3/...）访问 etcd，
+// 不引入 etcd 的客户端依赖：
+//
+// 1.服务端申请一个租约，把 prefix+addr => addr 写入 etcd 并绑定租约，之后定期续约。
+// 2.服务端停止续约或者主动撤销租约后，etcd 删除对应的 key。
+// 3.客户端按 prefix 读取所有 key，得到可用的服务列表。
+//
+
+// DefaultEtcdPrefix 默认的服务列表前缀
+const DefaultEtcdPrefix = "/myrpc/servers/"
+
+const defaultEtcdTTL = 10 * time.Second
+
+// EtcdClient etcd v3 Json 网关的客户端，只实现服务注册和发现需要的接口。
+// 配置多个地址时，当前地址不可用则依次尝试后面的地址
+type EtcdClient struct {
+	mu        sync.Mutex
+	endpoints []string
+	current   int
+	client    *http.Client
+}
+
+// NewEtcdClient 创建 etcd 客户端，endpoints 形如 http://127.0.0.1:2379
+func NewEtcdClient(endpoints []string) *EtcdClient {
+	return &EtcdClient{
+		endpoints: endpoints,
+		client:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// etcdInt Json 网关把 int64 编码成字符串，这里两种都接受
+type etcdInt int64
+
+func (n *etcdInt) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return err
+	}
+	*n = etcdInt(v)
+	return nil
+}
+
+type etcdKeyValue struct {
+	Key   []byte `json:"key"` // []byte 在 Json 中是 base64，和网关一致
+	Value []byte `json:"value"`
+}
+
+// call 向 etcd 发送请求，失败时切换到下一个地址
+func (c *EtcdClient) call(ctx context.Context, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	endpoints, current := c.endpoints, c.current
+	c.mu.Unlock()
+	err = errors.New("rpc registry: no etcd endpoint configured")
+	for i := 0; i < len(endpoints); i++ {
+		idx := (current + i) % len(endpoints)
+		if err = c.post(ctx, endpoints[idx]+path, body, out); err == nil {
+			c.mu.Lock()
+			c.current = idx
+			c.mu.Unlock()
+			return nil
+		}
+		logger.Warnf("rpc registry: etcd %s unavailable: %v", endpoints[idx], err)
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *EtcdClient) post(ctx context.Context, url string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("rpc registry: etcd unexpected status " + resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// prefixEnd 返回前缀查询的 range_end，即前缀最后一个不是 0xff 的字节加一
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+// Range 返回以 prefix 开头的所有 key 的值
+func (c *EtcdClient) Range(prefix string) ([]string, error) {
+	return c.RangeContext(context.Background(), prefix)
+}
+
+// RangeContext 和 Range 相同，ctx 结束时放弃请求
+func (c *EtcdClient) RangeContext(ctx context.Context, prefix string) ([]string, error) {
+	var out struct {
+		Kvs []etcdKeyValue `json:"kvs"`
+	}
+	in := map[string][]byte{"key": []byte(prefix), "range_end": prefixEnd(prefix)}
+	if err := c.call(ctx, "/v3/kv/range", in, &out); err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, len(out.Kvs))
+	for _, kv := range out.Kvs {
+		values = append(values, string(kv.Value))
+	}
+	return values, nil
+}
+
+// Grant 申请一个 ttl 的租约，返回租约 ID
+func (c *EtcdClient) Grant(ttl time.Duration) (int64, error) {
+	return c.GrantContext(context.Background(), ttl)
+}
+
+// GrantContext 和 Grant 相同，ctx 结束时放弃请求
+func (c *EtcdClient) GrantContext(ctx context.Context, ttl time.Duration) (int64, error) {
+	var out struct {
+		ID etcdInt `json:"ID"`
+	}
+	in := map[string]int64{"TTL": int64(ttl / time.Second)}
+	if err := c.call(ctx, "/v3/lease/grant", in, &out); err != nil {
+		return 0, err
+	}
+	return int64(out.ID), nil
+}
+
+// Put 写入 key，lease 不为 0 时绑定租约
+func (c *EtcdClient) Put(key, value string, lease int64) error {
+	return c.PutContext(context.Background(), key, value, lease)
+}
+
+// PutContext 和 Put 相同，ctx 结束时放弃请求
+func (c *EtcdClient) PutContext(ctx context.Context, key, value string, lease int64) error {
+	in := map[string]interface{}{
+		"key":   []byte(key),
+		"value": []byte(value),
+	}
+	if lease != 0 {
+		in["lease"] = strconv.FormatInt(lease, 10)
+	}
+	return c.call(ctx, "/v3/kv/put", in, nil)
+}
+
+// ErrLeaseExpired 续约时租约已经过期
+var ErrLeaseExpired = errors.New("rpc registry: etcd lease expired")
+
+// KeepAlive 续约一次，租约已经过期时返回 ErrLeaseExpired
+func (c *EtcdClient) KeepAlive(lease int64) error {
+	return c.KeepAliveContext(context.Background(), lease)
+}
+
+// KeepAliveContext 和 KeepAlive 相同，ctx 结束时放弃请求
+func (c *EtcdClient) KeepAliveContext(ctx context.Context, lease int64) error {
+	var out struct {
+		Result struct {
+			TTL etcdInt `json:"TTL"`
+		} `json:"result"`
+	}
+	in := map[string]string{"ID": strconv.FormatInt(lease, 10)}
+	if err := c.call(ctx, "/v3/lease/keepalive", in, &out); err != nil {
+		return err
+	}
+	if out.Result.TTL <= 0 {
+		return ErrLeaseExpired
+	}
+	return nil
+}
+
+// Revoke 撤销租约，绑定的 key 会被删除
+func (c *EtcdClient) Revoke(lease int64) error {
+	return c.RevokeContext(context.Background(), lease)
+}
+
+// RevokeContext 和 Revoke 相同，ctx 结束时放弃请求
+func (c *EtcdClient) RevokeContext(ctx context.Context, lease int64) error {
+	in := map[string]string{"ID": strconv.FormatInt(lease, 10)}
+	return c.call(ctx, "/v3/lease/revoke", in, nil)
+}
+
+// EtcdRegistrar 服务端向 etcd 注册自己，用租约代替心跳
+type EtcdRegistrar struct {
+	client *EtcdClient
+	prefix string
+	ttl    time.Duration
+
+	mu     sync.Mutex
+	leases map[string]*etcdLease // addr => 租约
+}
+
+type etcdLease struct {
+	id   int64
+	stop chan struct{}
+}
+
+// NewEtcdRegistrar 创建 etcd 注册器，prefix 为空时使用 DefaultEtcdPrefix，ttl 为 0 时使用 10s
+func NewEtcdRegistrar(endpoints []string, prefix string, ttl time.Duration) *EtcdRegistrar {
+	if prefix == "" {
+		prefix = DefaultEtcdPrefix
+	}
+	if ttl < time.Second {
+		ttl = defaultEtcdTTL
+	}
+	return &EtcdRegistrar{
+		client: NewEtcdClient(endpoints),
+		prefix: prefix,
+		ttl:    ttl,
+		leases: make(map[string]*etcdLease),
+	}
+}
+
+// grant 申请租约并写入 addr
+func (r *EtcdRegistrar) grant(ctx context.Context, addr string) (int64, error) {
+	id, err := r.client.GrantContext(ctx, r.ttl)
+	if err != nil {
+		return 0, err
+	}
+	if err := r.client.PutContext(ctx, r.prefix+addr, addr, id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Register 注册 addr 并在后台每 ttl/3 续约一次，租约过期时（比如和 etcd 断开太久）重新注册
+func (r *EtcdRegistrar) Register(addr string) error {
+	return r.RegisterContext(context.Background(), addr)
+}
+
+// RegisterContext 和 Register 相同，ctx 结束时放弃注册，ctx 不影响之后的续约
+func (r *EtcdRegistrar) RegisterContext(ctx context.Context, addr string) error {
+	id, err := r.grant(ctx, addr)
+	if err != nil {
+		return err
+	}
+	lease := &etcdLease{id: id, stop: make(chan struct{})}
+	r.mu.Lock()
+	if old := r.leases[addr]; old != nil {
+		close(old.stop)
+	}
+	r.leases[addr] = lease
+	r.mu.Unlock()
+	logger.Infof("rpc registry: %s registered to etcd with lease %d", addr, id)
+	go r.keepAlive(addr, lease)
+	return nil
+}
+
+func (r *EtcdRegistrar) keepAlive(addr string, lease *etcdLease) {
+	t := time.NewTicker(r.ttl / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-lease.stop:
+			return
+		}
+		r.mu.Lock()
+		id := lease.id
+		r.mu.Unlock()
+		// 每次续约最多等一个周期，etcd 没有响应时不会卡住之后的续约
+		ctx, cancel := context.WithTimeout(context.Background(), r.ttl/3)
+		err := r.client.KeepAliveContext(ctx, id)
+		if errors.Is(err, ErrLeaseExpired) {
+			logger.Warnf("rpc registry: etcd lease of %s expired, register again", addr)
+			if id, err = r.grant(ctx, addr); err == nil {
+				r.mu.Lock()
+				lease.id = id
+				r.mu.Unlock()
+			}
+		}
+		cancel()
+		if err != nil {
+			logger.Errorf("rpc registry: etcd keepalive of %s error: %v", addr, err)
+		}
+	}
+}
+
+// Deregister 停止续约并撤销租约，客户端下一次刷新时就看不到 addr
+func (r *EtcdRegistrar) Deregister(addr string) error {
+	return r.DeregisterContext(context.Background(), addr)
+}
+
+// DeregisterContext 和 Deregister 相同，ctx 结束时放弃撤销租约，addr 在租约过期后消失
+func (r *EtcdRegistrar) DeregisterContext(ctx context.Context, addr string) error {
+	r.mu.Lock()
+	lease := r.leases[addr]
+	delete(r.leases, addr)
+	r.mu.Unlock()
+	if lease == nil {
+		return nil
+	}
+	close(lease.stop)
+	r.mu.Lock()
+	id := lease.id
+	r.mu.Unlock()
+	return r.client.RevokeContext(ctx, id)
+}
+
+// Close 注销所有注册过的地址
+func (r *EtcdRegistrar) Close() error {
+	r.mu.Lock()
+	addrs := make([]string, 0, len(r.leases))
+	for addr := range r.leases {
+		addrs = append(addrs, addr)
+	}
+	r.mu.Unlock()
+	var err error
+	for _, addr := range addrs {
+		if e := r.Deregister(addr); e != nil {
+			err = e
+		}
+	}
+	return err
+}
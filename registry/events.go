@@ -0,0 +1,179 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//
+// 事件流
+// 监控面板和告警需要实时知道服务实例的上线、下线和过期，而不是定期轮询 /servers 再自己对比。
+// GET /events 以 SSE（text/event-stream）推送事件，连接建立时先以 add/snapshot 推送当前所有实例：
+//
+//	event: add
+//	data: {"type":"add","reason":"register","time":"...","server":{...}}
+//
+// 事件只推送给已经连接的订阅者，消费太慢的订阅者会丢弃事件，不会阻塞注册中心
+//
+
+// 事件类型
+const (
+	EventAdd    = "add"    // 新的服务实例
+	EventUpdate = "update" // 服务实例的元数据发生变化
+	EventRemove = "remove" // 服务实例主动注销
+	EventExpire = "expire" // 服务实例超过 timeout 没有心跳
+)
+
+// 事件原因
+const (
+	ReasonSnapshot   = "snapshot"   // 订阅时已经存在的实例
+	ReasonRegister   = "register"   // 服务端注册或心跳
+	ReasonReplicated = "replicated" // 对等注册中心转发
+	ReasonDeregister = "deregister" // 服务端注销
+	ReasonTimeout    = "timeout"    // 心跳超时
+	ReasonRestart    = "restart"    // 同一地址的服务端重启，实例ID发生变化
+)
+
+// Event 服务列表的一次变化
+type Event struct {
+	Type   string     `json:"type"`
+	Reason string     `json:"reason"`
+	Time   time.Time  `json:"time"`
+	Server ServerItem `json:"server"`
+}
+
+const (
+	eventsPath        = "/events"
+	eventBuffer       = 64               // 每个订阅者缓冲的事件数
+	eventPingInterval = 15 * time.Second // 没有事件时发送注释，防止代理断开空闲连接
+)
+
+// events 事件的订阅者。每次变化 version 加一并关闭 changed，长轮询的请求据此等待变化
+type events struct {
+	mu      sync.Mutex
+	subs    map[chan Event]struct{}
+	version uint64
+	changed chan struct{}
+}
+
+// current 返回当前的版本号，以及下一次变化时会被关闭的 channel
+func (e *events) current() (uint64, <-chan struct{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.changed == nil {
+		e.changed = make(chan struct{})
+	}
+	return e.version, e.changed
+}
+
+func (e *events) subscribe() chan Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.subs == nil {
+		e.subs = make(map[chan Event]struct{})
+	}
+	ch := make(chan Event, eventBuffer)
+	e.subs[ch] = struct{}{}
+	return ch
+}
+
+func (e *events) unsubscribe(ch chan Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.subs, ch)
+}
+
+// publish 发送事件，订阅者的缓冲满了就丢弃
+func (e *events) publish(typ, reason string, s ServerItem) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.version++
+	if e.changed != nil {
+		close(e.changed)
+		e.changed = nil
+	}
+	ev := Event{Type: typ, Reason: reason, Time: time.Now(), Server: s}
+	for ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// registerReason 注册请求对应的事件原因
+func registerReason(req *http.Request) string {
+	if replicated(req) {
+		return ReasonReplicated
+	}
+	return ReasonRegister
+}
+
+// serveEvents GET /events 以 SSE 推送服务列表的变化
+func (r *MyRegistry) serveEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "rpc registry: streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := r.events.subscribe()
+	defer r.events.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for _, s := range r.aliveServers() {
+		if writeEvent(w, Event{Type: EventAdd, Reason: ReasonSnapshot, Time: time.Now(), Server: s}) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	// 过期只在访问服务列表时检查，这里定期检查，保证没有客户端访问时也能推送过期事件
+	sweep := time.NewTicker(r.sweepInterval())
+	defer sweep.Stop()
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case <-req.Context().Done():
+			return
+		case ev := <-ch:
+			err = writeEvent(w, ev)
+		case <-sweep.C:
+			r.aliveServers()
+			continue
+		case <-ping.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// sweepInterval 检查过期的间隔，不超过 timeout 的十分之一
+func (r *MyRegistry) sweepInterval() time.Duration {
+	interval := time.Second
+	if r.timeout > 0 && r.timeout/10 < interval {
+		interval = r.timeout / 10
+	}
+	return interval
+}
+
+func writeEvent(w http.ResponseWriter, ev Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+	return err
+}
@@ -0,0 +1,119 @@
+package registry
+
+import (
+	"MyRPC/registry/regclient"
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+)
+
+//
+// 键值存储
+// 注册中心提供一个简单的键值存储，用来分发客户端和服务端都需要的共享数据，比如压缩使用的预置字典。
+// GET/PUT/DELETE /kv?key= 读取、写入、删除一个键，值是原样保存的请求体。
+// 写入和删除和注册一样转发给对等节点；键值不持久化，注册中心重启后需要重新写入
+//
+
+const (
+	kvPath     = regclient.KVPath
+	maxKVValue = regclient.MaxValueSize
+)
+
+// ErrKeyNotFound 见 regclient.ErrKeyNotFound
+var ErrKeyNotFound = regclient.ErrKeyNotFound
+
+type kvStore struct {
+	mu     sync.RWMutex
+	values map[string][]byte
+}
+
+func (kv *kvStore) get(key string) ([]byte, bool) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	v, ok := kv.values[key]
+	return v, ok
+}
+
+func (kv *kvStore) put(key string, value []byte) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.values == nil {
+		kv.values = make(map[string][]byte)
+	}
+	kv.values[key] = value
+}
+
+func (kv *kvStore) remove(key string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	delete(kv.values, key)
+}
+
+// serveKV GET/PUT/DELETE /kv?key= 读写键值，写入和删除需要令牌
+func (r *MyRegistry) serveKV(w http.ResponseWriter, req *http.Request) {
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "rpc registry: key is required", http.StatusBadRequest)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		v, ok := r.kv.get(key)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(v)
+	case "PUT":
+		if !r.authorized(w, req) {
+			return
+		}
+		v, err := io.ReadAll(io.LimitReader(req.Body, maxKVValue+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(v) > maxKVValue {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.kv.put(key, v)
+		if !replicated(req) {
+			r.replicateKV("PUT", key, v)
+		}
+	case "DELETE":
+		if !r.authorized(w, req) {
+			return
+		}
+		r.kv.remove(key)
+		if !replicated(req) {
+			r.replicateKV("DELETE", key, nil)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// replicateKV 把键值的写入或删除转发给所有对等节点
+func (r *MyRegistry) replicateKV(method, key string, value []byte) {
+	r.mu.Lock()
+	peers := r.peers
+	r.mu.Unlock()
+	for _, peer := range peers {
+		req, _ := http.NewRequest(method, regclient.KVURL(peer, key), bytes.NewReader(value))
+		r.setToken(req)
+		go forward(peer, req)
+	}
+}
+
+// PutValue 见 regclient.PutValue
+func PutValue(registry, key string, value []byte) error {
+	return regclient.PutValue(registry, key, value)
+}
+
+// GetValue 见 regclient.GetValue
+func GetValue(registry, key string) ([]byte, error) {
+	return regclient.GetValue(registry, key)
+}
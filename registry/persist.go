@@ -0,0 +1,116 @@
+package registry
+
+import (
+	"MyRPC/logger"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//
+// 持久化
+// 注册中心只在内存中保存服务列表，重启之后所有客户端都拿到空列表，直到服务端下一次发送心跳。
+// 开启持久化后定期把服务列表写到文件，启动时读回来，已经超过过期时间的服务实例直接丢弃
+//
+
+const defaultSnapshotInterval = 10 * time.Second
+
+// EnablePersistence 从 path 恢复服务列表，并且每隔 interval 把服务列表写回 path，interval 为0时默认10s。
+// 文件不存在时视为空列表
+func (r *MyRegistry) EnablePersistence(path string, interval time.Duration) error {
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	if err := r.load(path); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.snapshotPath = path
+	r.stop = make(chan struct{})
+	stop := r.stop
+	r.mu.Unlock()
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := r.Snapshot(); err != nil {
+					logger.Errorf("rpc registry: snapshot error: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// load 读取快照，丢弃过期的服务实例
+func (r *MyRegistry) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var items []ServerItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range items {
+		item := items[i]
+		if r.timeout != 0 && item.LastHeartbeat.Add(r.timeout).Before(time.Now()) {
+			continue
+		}
+		if _, ok := r.servers[item.Addr]; !ok {
+			r.servers[item.Addr] = &item
+		}
+	}
+	logger.Infof("rpc registry: restored %d servers from %s", len(r.servers), path)
+	return nil
+}
+
+// Snapshot 立即把当前的服务列表写到持久化文件，先写临时文件再重命名，避免写到一半时崩溃留下损坏的文件
+func (r *MyRegistry) Snapshot() error {
+	r.mu.Lock()
+	path := r.snapshotPath
+	r.mu.Unlock()
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(r.aliveServers())
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Close 停止定期持久化，并写入最后一次快照
+func (r *MyRegistry) Close() error {
+	r.mu.Lock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	r.mu.Unlock()
+	return r.Snapshot()
+}
@@ -0,0 +1,88 @@
+package registry
+
+import (
+	"MyRPC/registry/regclient"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//
+// 集群限流
+// 注册中心为每个限流键维护一个令牌桶，服务端按批从注册中心租用令牌，在本地消耗完再来取，
+// 这样整个集群共享同一个配额，比如租户X在所有实例上合计不超过1000 QPS，不需要额外部署Redis
+//
+
+const quotaPath = regclient.QuotaPath
+
+// QuotaRequest 见 regclient.QuotaRequest
+type QuotaRequest = regclient.QuotaRequest
+
+// QuotaResponse 见 regclient.QuotaResponse
+type QuotaResponse = regclient.QuotaResponse
+
+type quotaBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type quotas struct {
+	mu      sync.Mutex
+	buckets map[string]*quotaBucket
+}
+
+// take 从 key 对应的令牌桶中最多取出 n 个令牌
+func (q *quotas) take(req QuotaRequest) int {
+	burst := req.Burst
+	if burst <= 0 {
+		burst = req.Rate
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.buckets == nil {
+		q.buckets = make(map[string]*quotaBucket)
+	}
+	now := time.Now()
+	b := q.buckets[req.Key]
+	if b == nil {
+		b = &quotaBucket{tokens: burst, last: now}
+		q.buckets[req.Key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*req.Rate)
+	b.last = now
+	granted := int(math.Min(float64(req.Tokens), math.Floor(b.tokens)))
+	if granted < 0 {
+		granted = 0
+	}
+	b.tokens -= float64(granted)
+	return granted
+}
+
+// serveQuota POST /quota 发放令牌，需要注册中心的令牌，否则任何人都能耗尽配额
+func (r *MyRegistry) serveQuota(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.authorized(w, req) {
+		return
+	}
+	var q QuotaRequest
+	if err := json.NewDecoder(req.Body).Decode(&q); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Key == "" || q.Rate <= 0 || q.Tokens <= 0 {
+		http.Error(w, "rpc registry: key, rate and tokens are required", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(QuotaResponse{Granted: r.quotas.take(q)})
+}
+
+// AcquireQuota 见 regclient.AcquireQuota
+func AcquireQuota(registry string, q QuotaRequest) (int, error) {
+	return regclient.AcquireQuota(registry, q)
+}
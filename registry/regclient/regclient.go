@@ -0,0 +1,175 @@
+// Package regclient 注册中心的客户端部分：服务实例的描述、集群限流和键值存储的 HTTP 调用。
+// 只依赖标准库，客户端和服务端通过它访问注册中心，不会引入注册中心本身（持久化、事件流、etcd 等）的代码。
+// registry 包保留了同名的类型别名和函数，原来的导入路径继续可用
+package regclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 注册中心路径下的 Json 接口
+const (
+	ServersPath  = "/servers"
+	RegisterPath = "/register"
+	QuotaPath    = "/quota"
+	KVPath       = "/kv"
+)
+
+// MaxValueSize 键值存储中单个值的最大长度
+const MaxValueSize = 1 << 20
+
+// httpClient 访问注册中心使用的客户端，ctx 没有截止时间时请求最多等待 Timeout，注册中心没有响应也不会一直阻塞
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// ServerItem 一个服务实例，除了地址还带有注册时上报的元数据
+type ServerItem struct {
+	Addr          string            `json:"addr"`
+	Registered    time.Time         `json:"registered"`     // 第一次注册的时间
+	LastHeartbeat time.Time         `json:"last_heartbeat"` // 最近一次心跳的时间
+	Weight        int               `json:"weight,omitempty"`
+	Protocol      string            `json:"protocol,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Services      []string          `json:"services,omitempty"` // 服务端注册的服务名，为空表示未知
+	Instance      string            `json:"instance,omitempty"` // 服务端进程的实例ID，每次启动都不同，同一地址的实例ID变化说明服务端重启过
+	Host          string            `json:"host,omitempty"`     // 服务端的主机名，unix@ 这类只在本机可达的地址只有同一主机的客户端能使用
+	Version       string            `json:"version,omitempty"`  // 服务端部署的版本，比如 v2，XClient 据此按版本分流
+}
+
+// HasService 判断服务实例是否提供 service，没有上报服务名的实例视为提供所有服务
+func (s *ServerItem) HasService(service string) bool {
+	if len(s.Services) == 0 {
+		return true
+	}
+	for _, name := range s.Services {
+		if name == service {
+			return true
+		}
+	}
+	return false
+}
+
+// QuotaRequest 向注册中心申请令牌
+type QuotaRequest struct {
+	Key    string  `json:"key"`
+	Rate   float64 `json:"rate"`  // 每秒产生的令牌数，即集群的总 QPS
+	Burst  float64 `json:"burst"` // 桶的容量，为0时等于 Rate
+	Tokens int     `json:"tokens"`
+}
+
+// QuotaResponse 注册中心实际发放的令牌数，可能少于申请的数量
+type QuotaResponse struct {
+	Granted int `json:"granted"`
+}
+
+// tokenKey ctx 中注册中心令牌的键
+type tokenKey struct{}
+
+// WithToken 返回带有注册中心令牌的 ctx，注册中心设置了 SetToken 时，申请令牌和修改键值需要带上它
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// setToken 把 ctx 中的令牌写入请求头
+func setToken(ctx context.Context, req *http.Request) {
+	if token, _ := ctx.Value(tokenKey{}).(string); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// AcquireQuota 向地址为 registry 的注册中心申请令牌，返回实际获得的数量
+func AcquireQuota(registry string, q QuotaRequest) (int, error) {
+	return AcquireQuotaContext(context.Background(), registry, q)
+}
+
+// AcquireQuotaContext 和 AcquireQuota 相同，ctx 结束时放弃请求，ctx 中的令牌见 WithToken
+func AcquireQuotaContext(ctx context.Context, registry string, q QuotaRequest) (int, error) {
+	body, err := json.Marshal(q)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(registry, "/")+QuotaPath, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setToken(ctx, req)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New("rpc registry: acquire quota failed: " + resp.Status)
+	}
+	var qr QuotaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&qr); err != nil {
+		return 0, err
+	}
+	return qr.Granted, nil
+}
+
+// ErrKeyNotFound 注册中心中没有这个键
+var ErrKeyNotFound = errors.New("rpc registry: key not found")
+
+// KVURL 注册中心键值存储中 key 的地址
+func KVURL(registry, key string) string {
+	return strings.TrimSuffix(registry, "/") + KVPath + "?key=" + url.QueryEscape(key)
+}
+
+// PutValue 在地址为 registry 的注册中心写入一个键
+func PutValue(registry, key string, value []byte) error {
+	return PutValueContext(context.Background(), registry, key, value)
+}
+
+// PutValueContext 和 PutValue 相同，ctx 结束时放弃请求，ctx 中的令牌见 WithToken
+func PutValueContext(ctx context.Context, registry, key string, value []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", KVURL(registry, key), bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	setToken(ctx, req)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("rpc registry: put value failed: " + resp.Status)
+	}
+	return nil
+}
+
+// GetValue 从地址为 registry 的注册中心读取一个键，键不存在时返回 ErrKeyNotFound
+func GetValue(registry, key string) ([]byte, error) {
+	return GetValueContext(context.Background(), registry, key)
+}
+
+// GetValueContext 和 GetValue 相同，ctx 结束时放弃请求
+func GetValueContext(ctx context.Context, registry, key string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", KVURL(registry, key), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(io.LimitReader(resp.Body, MaxValueSize))
+	case http.StatusNotFound:
+		return nil, ErrKeyNotFound
+	default:
+		return nil, errors.New("rpc registry: get value failed: " + resp.Status)
+	}
+}
@@ -1,9 +1,13 @@
 package registry
 
 import (
-	"log"
+	"MyRPC/logger"
+	"MyRPC/registry/regclient"
+	"encoding/json"
 	"net/http"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,84 +25,306 @@ type MyRegistry struct {
 	timeout time.Duration //默认5分钟，任何注册的服务超过5分钟，都视为不可用
 	mu      sync.Mutex
 	servers map[string]*ServerItem
-}
 
-type ServerItem struct {
-	Addr  string
-	start time.Time
+	snapshotPath string        // 持久化文件，为空时不持久化
+	stop         chan struct{} // 停止定期持久化
+	quotas       quotas        // 集群限流的令牌桶
+	peers        []string      // 对等的注册中心
+	events       events        // 服务列表变化的订阅者
+	kv           kvStore       // 共享数据，见 kv.go
+	token        string        // 注册、心跳和注销的令牌，见 auth.go
+	admit        AdmitFunc     // 实例的准入检查
 }
 
+// ServerItem 一个服务实例，定义在 regclient，这里保留别名
+type ServerItem = regclient.ServerItem
+
 const (
 	defaultPath    = "/_geerpc_/registry"
 	defaultTimeout = time.Minute * 5
 )
 
+// Json 接口挂在注册中心路径下
+const (
+	serversPath  = regclient.ServersPath
+	registerPath = regclient.RegisterPath
+)
+
 func New(timeout time.Duration) *MyRegistry {
-	return &MyRegistry{
+	r := &MyRegistry{
 		timeout: timeout,
 		servers: make(map[string]*ServerItem),
 	}
+	// 版本号从启动时间开始，注册中心重启后客户端手里旧的版本号不会恰好等于新的版本号
+	r.events.version = uint64(time.Now().UnixNano())
+	return r
 }
 
 var DefaultMyRegister = New(defaultTimeout)
 
-// putServer 添加服务实例，如果服务已经存在，则更新start
-func (r *MyRegistry) putServer(addr string) {
+// putServer 添加服务实例，如果服务已经存在，则更新心跳时间，item 不为 nil 时同时更新元数据
+func (r *MyRegistry) putServer(addr string, item *ServerItem, reason string) {
+	r.updateServer(addr, reason, func(s *ServerItem) {
+		if item != nil {
+			s.Weight, s.Protocol, s.Tags, s.Metadata = item.Weight, item.Protocol, item.Tags, item.Metadata
+			s.Services, s.Instance, s.Host, s.Version = item.Services, item.Instance, item.Host, item.Version
+		}
+	})
+}
+
+// updateServer 添加服务实例或更新心跳时间，然后用 update 修改元数据，新增或元数据变化时发送事件。
+// 实例ID变化说明服务端在过期之前重启了，当作新注册的实例，事件原因为 ReasonRestart
+func (r *MyRegistry) updateServer(addr, reason string, update func(s *ServerItem)) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	now := time.Now()
 	s := r.servers[addr]
 	if s == nil {
-		r.servers[addr] = &ServerItem{
-			Addr:  addr,
-			start: time.Now(),
-		}
-	} else {
-		s.start = time.Now() // 更新时间，心跳信息
+		s = &ServerItem{Addr: addr, Registered: now, LastHeartbeat: now}
+		update(s)
+		r.servers[addr] = s
+		r.events.publish(EventAdd, reason, *s)
+		return
+	}
+	before := *s
+	s.LastHeartbeat = now // 更新时间，心跳信息
+	update(s)
+	if before.Instance != "" && s.Instance != before.Instance {
+		s.Registered = now
+		reason = ReasonRestart
+	}
+	if !sameMetadata(&before, s) {
+		r.events.publish(EventUpdate, reason, *s)
+	}
+}
+
+// sameMetadata 判断两个实例的元数据是否相同，不比较时间
+func sameMetadata(a, b *ServerItem) bool {
+	x, y := *a, *b
+	x.Registered, x.LastHeartbeat = time.Time{}, time.Time{}
+	y.Registered, y.LastHeartbeat = time.Time{}, time.Time{}
+	return reflect.DeepEqual(x, y)
+}
+
+// removeServer 删除服务实例
+func (r *MyRegistry) removeServer(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.servers[addr]; s != nil {
+		delete(r.servers, addr)
+		r.events.publish(EventRemove, ReasonDeregister, *s)
 	}
 }
 
 // 给客户端返回可用的服务列表，如果存在超时的服务，则删除
-func (r *MyRegistry) aliveServers() []string {
+func (r *MyRegistry) aliveServers() []ServerItem {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	var alive []string
+	var alive []ServerItem
 	for addr, s := range r.servers {
-		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
-			alive = append(alive, addr)
+		if r.timeout == 0 || s.LastHeartbeat.Add(r.timeout).After(time.Now()) {
+			alive = append(alive, *s)
 		} else {
 			delete(r.servers, addr)
+			r.events.publish(EventExpire, ReasonTimeout, *s)
 		}
 	}
-	sort.Strings(alive)
+	sort.Slice(alive, func(i, j int) bool { return alive[i].Addr < alive[j].Addr })
 	return alive
 }
 
 // MyRegistry 采用HTTP协议
+// 注册中心路径本身是基于请求头的老接口，路径下的 /servers、/register 和 /quota 是 Json 接口，/events 是事件流，
+// /kv 是键值存储
 func (r *MyRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case strings.HasSuffix(req.URL.Path, serversPath):
+		r.serveServers(w, req)
+	case strings.HasSuffix(req.URL.Path, registerPath):
+		r.serveRegister(w, req)
+	case strings.HasSuffix(req.URL.Path, quotaPath):
+		r.serveQuota(w, req)
+	case strings.HasSuffix(req.URL.Path, eventsPath):
+		r.serveEvents(w, req)
+	case strings.HasSuffix(req.URL.Path, kvPath):
+		r.serveKV(w, req)
+	default:
+		r.serveLegacy(w, req)
+	}
+}
+
+// serveLegacy 通过请求头交换信息
+func (r *MyRegistry) serveLegacy(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET": // 返回所有可用的服务列表
-		w.Header().Set("X-Myrpc-Servers", strings.Join(r.aliveServers(), ","))
+		alive := r.aliveServers()
+		addrs := make([]string, len(alive))
+		for i, s := range alive {
+			addrs[i] = s.Addr
+		}
+		w.Header().Set("X-Myrpc-Servers", strings.Join(addrs, ","))
 	case "POST": // 添加服务实例或发送心跳
+		if !r.authorized(w, req) {
+			return
+		}
 		addr := req.Header.Get("X-Myrpc-Server")
 		if addr == "" {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		r.putServer(addr)
+		item := ServerItem{Addr: addr, Instance: req.Header.Get(instanceHeader), Host: req.Header.Get(hostHeader),
+			Version: req.Header.Get(serverVersionHeader)}
+		if services := req.Header.Get("X-Myrpc-Services"); services != "" {
+			item.Services = strings.Split(services, ",")
+		}
+		if !r.admitted(w, req, item) {
+			return
+		}
+		r.updateServer(addr, registerReason(req), func(s *ServerItem) {
+			if item.Services != nil {
+				s.Services = item.Services
+			}
+			if item.Instance != "" {
+				s.Instance = item.Instance
+			}
+			if item.Host != "" {
+				s.Host = item.Host
+			}
+			if item.Version != "" {
+				s.Version = item.Version
+			}
+		})
+		if !replicated(req) {
+			r.replicatePut(addr)
+		}
+	case "DELETE": // 服务端关闭时注销
+		if !r.authorized(w, req) {
+			return
+		}
+		addr := req.Header.Get("X-Myrpc-Server")
+		if addr == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.removeServer(addr)
+		if !replicated(req) {
+			r.replicateRemove(addr)
+		}
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
-func (r *MyRegistry) HandleHTTP(registryPath string) {
-	http.Handle(registryPath, r)
-	log.Println("rpc registry path:", registryPath)
+// serveServers GET /servers 以 Json 返回所有可用的服务实例，可以用 ?service= 按服务名筛选。
+// 响应头 X-Myrpc-Version 是服务列表的版本号，带上 ?version= 时是长轮询：
+// 版本号没有变化就等到服务列表变化或者 ?wait=（默认30s，最长5分钟）超时再返回
+func (r *MyRegistry) serveServers(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	version, changed := r.events.current()
+	if v := query.Get("version"); v != "" && v == strconv.FormatUint(version, 10) {
+		version = r.waitChange(req, version, changed, longPollWait(query.Get("wait")))
+	}
+	// ?service= 只返回提供该服务的实例
+	service := query.Get("service")
+	alive := []ServerItem{}
+	for _, s := range r.aliveServers() {
+		if service == "" || s.HasService(service) {
+			alive = append(alive, s)
+		}
+	}
+	// 返回之前的检查可能刚刚删除了过期的实例
+	if v, _ := r.events.current(); v > version {
+		version = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(versionHeader, strconv.FormatUint(version, 10))
+	if err := json.NewEncoder(w).Encode(alive); err != nil {
+		logger.Errorf("rpc registry: encode servers error: %v", err)
+	}
 }
 
-func HandleHTTP() {
-	DefaultMyRegister.HandleHTTP(defaultPath)
+const (
+	versionHeader       = "X-Myrpc-Version"
+	instanceHeader      = "X-Myrpc-Instance"
+	hostHeader          = "X-Myrpc-Host"
+	serverVersionHeader = "X-Myrpc-Server-Version" // 服务端部署的版本，不要和服务列表的版本号 versionHeader 混淆
+	defaultLongPollWait = 30 * time.Second
+	maxLongPollWait     = 5 * time.Minute
+)
+
+func longPollWait(v string) time.Duration {
+	wait, err := time.ParseDuration(v)
+	if err != nil || wait <= 0 {
+		return defaultLongPollWait
+	}
+	if wait > maxLongPollWait {
+		wait = maxLongPollWait
+	}
+	return wait
 }
 
+// waitChange 等待服务列表从 version 发生变化，期间定期检查过期的实例，返回最新的版本号
+func (r *MyRegistry) waitChange(req *http.Request, version uint64, changed <-chan struct{}, wait time.Duration) uint64 {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	sweep := time.NewTicker(r.sweepInterval())
+	defer sweep.Stop()
+	for {
+		select {
+		case <-changed:
+			v, _ := r.events.current()
+			return v
+		case <-sweep.C:
+			r.aliveServers()
+		case <-timer.C:
+			return version
+		case <-req.Context().Done():
+			return version
+		}
+	}
+}
 
+// serveRegister POST /register 注册服务实例或发送心跳，请求体是 Json 编码的 ServerItem
+func (r *MyRegistry) serveRegister(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.authorized(w, req) {
+		return
+	}
+	var item ServerItem
+	if err := json.NewDecoder(req.Body).Decode(&item); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if item.Addr == "" {
+		http.Error(w, "rpc registry: addr is required", http.StatusBadRequest)
+		return
+	}
+	if !r.admitted(w, req, item) {
+		return
+	}
+	r.putServer(item.Addr, &item, registerReason(req))
+	if !replicated(req) {
+		r.replicatePut(item.Addr)
+	}
+}
 
+func (r *MyRegistry) HandleHTTP(registryPath string) {
+	http.Handle(registryPath, r)
+	http.Handle(registryPath+serversPath, r)
+	http.Handle(registryPath+registerPath, r)
+	http.Handle(registryPath+quotaPath, r)
+	http.Handle(registryPath+eventsPath, r)
+	http.Handle(registryPath+kvPath, r)
+	logger.Infof("rpc registry path: %s", registryPath)
+}
 
+func HandleHTTP() {
+	DefaultMyRegister.HandleHTTP(defaultPath)
+}
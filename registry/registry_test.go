@@ -0,0 +1,297 @@
+package registry
+
+import (
+	"MyRPC/registry/regclient"
+	"MyRPC/registry/registrytest"
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMyRegistry_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.json")
+	r := New(time.Minute)
+	if err := r.EnablePersistence(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	r.putServer("tcp@a", &ServerItem{Weight: 2}, ReasonRegister)
+	r.putServer("tcp@stale", nil, ReasonRegister)
+	r.servers["tcp@stale"].LastHeartbeat = time.Now().Add(-time.Hour)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := New(time.Minute)
+	if err := restarted.EnablePersistence(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	alive := restarted.aliveServers()
+	if len(alive) != 1 || alive[0].Addr != "tcp@a" || alive[0].Weight != 2 {
+		t.Fatalf("expect tcp@a to be restored, got %+v", alive)
+	}
+}
+
+func TestMyRegistry_Replication(t *testing.T) {
+	r1, r2 := New(time.Minute), New(time.Minute)
+	ts1, ts2 := httptest.NewServer(r1), httptest.NewServer(r2)
+	defer ts1.Close()
+	defer ts2.Close()
+	r1.SetPeers([]string{ts2.URL})
+	r2.SetPeers([]string{ts1.URL})
+
+	send := func(method string) {
+		req, _ := http.NewRequest(method, ts1.URL, nil)
+		req.Header.Set("X-Myrpc-Server", "tcp@a")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+	waitFor := func(n int) {
+		for i := 0; i < 100 && len(r2.aliveServers()) != n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := len(r2.aliveServers()); got != n {
+			t.Fatalf("expect %d servers on the peer, got %d", n, got)
+		}
+	}
+	send("POST")
+	waitFor(1)
+	send("DELETE")
+	waitFor(0)
+}
+
+func TestEtcdRegistrar(t *testing.T) {
+	etcd, ts := registrytest.StartEtcd()
+	defer ts.Close()
+	r := NewEtcdRegistrar([]string{"http://127.0.0.1:1", ts.URL}, "", time.Second)
+	if err := r.Register("tcp@a"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := etcd.Keys(); len(keys) != 1 || keys[0] != DefaultEtcdPrefix+"tcp@a" {
+		t.Fatalf("expect tcp@a registered, got %v", keys)
+	}
+
+	// 租约过期后续约失败，重新注册
+	etcd.Expire(etcd.Leases()[0])
+	deadline := time.Now().Add(2 * time.Second)
+	for len(etcd.Keys()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if keys := etcd.Keys(); len(keys) != 1 {
+		t.Fatalf("expect tcp@a registered again after lease expired, got %v", keys)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := etcd.Keys(); len(keys) != 0 {
+		t.Fatalf("expect no keys after close, got %v", keys)
+	}
+
+	// etcd 没有响应时注册和注销随 ctx 结束
+	hang := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-hang:
+		case <-req.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(hang)
+	r = NewEtcdRegistrar([]string{slow.URL}, "", time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := r.RegisterContext(ctx, "tcp@b"); err == nil || time.Since(start) > time.Second {
+		t.Fatalf("expect the registration to give up with ctx, got %v after %v", err, time.Since(start))
+	}
+	if err := r.client.RevokeContext(ctx, 1); err == nil {
+		t.Fatal("expect revoke to fail with a done ctx")
+	}
+}
+
+func TestMyRegistry_Events(t *testing.T) {
+	r := New(300 * time.Millisecond)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	post := func(path, body string) {
+		resp, err := http.Post(ts.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+	post(registerPath, `{"addr":"tcp@a"}`)
+
+	resp, err := http.Get(ts.URL + eventsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	sc := bufio.NewScanner(resp.Body)
+	next := func() Event {
+		for sc.Scan() {
+			if line := sc.Text(); strings.HasPrefix(line, "data: ") {
+				var ev Event
+				if err := json.Unmarshal([]byte(line[len("data: "):]), &ev); err != nil {
+					t.Fatal(err)
+				}
+				return ev
+			}
+		}
+		t.Fatalf("event stream closed: %v", sc.Err())
+		return Event{}
+	}
+
+	expect := func(typ, reason, addr string) {
+		if ev := next(); ev.Type != typ || ev.Reason != reason || ev.Server.Addr != addr {
+			t.Fatalf("expect %s/%s of %s, got %+v", typ, reason, addr, ev)
+		}
+	}
+	expect(EventAdd, ReasonSnapshot, "tcp@a")
+	post(registerPath, `{"addr":"tcp@b"}`)
+	expect(EventAdd, ReasonRegister, "tcp@b")
+	post(registerPath, `{"addr":"tcp@b"}`) // 只是心跳，没有事件
+	post(registerPath, `{"addr":"tcp@b","metadata":{"zone":"z1"}}`)
+	if ev := next(); ev.Type != EventUpdate || ev.Server.Metadata["zone"] != "z1" {
+		t.Fatalf("expect update with metadata, got %+v", ev)
+	}
+	heartbeat := func(instance string) {
+		req, _ := http.NewRequest("POST", ts.URL, nil)
+		req.Header.Set("X-Myrpc-Server", "tcp@b")
+		req.Header.Set(instanceHeader, instance)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			_ = resp.Body.Close()
+		}
+	}
+	heartbeat("i1")
+	expect(EventUpdate, ReasonRegister, "tcp@b")
+	heartbeat("i1") // 同一个实例的心跳，没有事件
+	heartbeat("i2")
+	if ev := next(); ev.Type != EventUpdate || ev.Reason != ReasonRestart || ev.Server.Instance != "i2" {
+		t.Fatalf("expect restart with the new instance, got %+v", ev)
+	}
+	req, _ := http.NewRequest("DELETE", ts.URL, nil)
+	req.Header.Set("X-Myrpc-Server", "tcp@b")
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		_ = resp.Body.Close()
+	}
+	expect(EventRemove, ReasonDeregister, "tcp@b")
+	// 没有任何请求访问服务列表，tcp@a 也会因为心跳超时推送过期事件
+	expect(EventExpire, ReasonTimeout, "tcp@a")
+}
+
+func TestMyRegistry_KV(t *testing.T) {
+	r1, r2 := New(time.Minute), New(time.Minute)
+	ts1, ts2 := httptest.NewServer(r1), httptest.NewServer(r2)
+	defer ts1.Close()
+	defer ts2.Close()
+	r1.SetPeers([]string{ts2.URL})
+
+	if _, err := GetValue(ts1.URL, "a/b"); err != ErrKeyNotFound {
+		t.Fatalf("expect ErrKeyNotFound, got %v", err)
+	}
+	if err := PutValue(ts1.URL, "a/b", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := GetValue(ts1.URL, "a/b"); err != nil || string(v) != "value" {
+		t.Fatalf("expect value, got %q: %v", v, err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := r2.kv.get("a/b"); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expect the value to be replicated to the peer")
+}
+
+func TestMyRegistry_Auth(t *testing.T) {
+	admit, err := AllowNetworks("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1, r2 := New(time.Minute), New(time.Minute)
+	for _, r := range []*MyRegistry{r1, r2} {
+		r.SetToken("secret")
+		r.SetAdmission(admit)
+	}
+	ts1, ts2 := httptest.NewServer(r1), httptest.NewServer(r2)
+	defer ts1.Close()
+	defer ts2.Close()
+	r1.SetPeers([]string{ts2.URL})
+
+	send := func(method, url, addr, token, body string) int {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		if addr != "" {
+			req.Header.Set("X-Myrpc-Server", addr)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, c := range []struct {
+		method, path, addr, token, body string
+		code                            int
+	}{
+		{"POST", "", "tcp@127.0.0.1:1", "", "", http.StatusUnauthorized},
+		{"POST", "", "tcp@127.0.0.1:1", "guess", "", http.StatusUnauthorized},
+		{"POST", "", "tcp@10.0.0.1:1", "secret", "", http.StatusForbidden},
+		{"POST", "", "tcp@localhost:1", "secret", "", http.StatusForbidden},
+		{"POST", registerPath, "", "", `{"Addr":"tcp@127.0.0.1:2"}`, http.StatusUnauthorized},
+		{"POST", registerPath, "", "secret", `{"Addr":"tcp@10.0.0.1:2"}`, http.StatusForbidden},
+		{"POST", "", "tcp@127.0.0.1:1", "secret", "", http.StatusOK},
+		{"DELETE", "", "tcp@127.0.0.1:1", "", "", http.StatusUnauthorized},
+		{"PUT", regclient.KVURL("", "k"), "", "", "v", http.StatusUnauthorized},
+		{"DELETE", regclient.KVURL("", "k"), "", "", "", http.StatusUnauthorized},
+		{"POST", regclient.QuotaPath, "", "", `{"key":"k","rate":1,"tokens":1}`, http.StatusUnauthorized},
+	} {
+		if code := send(c.method, ts1.URL+c.path, c.addr, c.token, c.body); code != c.code {
+			t.Fatalf("%s %s %s with token %q: expect %d, got %d", c.method, c.path, c.addr+c.body, c.token, c.code, code)
+		}
+	}
+	if alive := r1.aliveServers(); len(alive) != 1 || alive[0].Addr != "tcp@127.0.0.1:1" {
+		t.Fatalf("expect only the admitted server, got %+v", alive)
+	}
+	// 转发给对等节点时带上令牌
+	for i := 0; i < 100 && len(r2.aliveServers()) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := len(r2.aliveServers()); got != 1 {
+		t.Fatalf("expect the registration replicated with the token, got %d servers", got)
+	}
+
+	// 修改 KV 和申请限流令牌同样需要令牌
+	if err := PutValue(ts1.URL, "k", []byte("v")); err == nil {
+		t.Fatal("expect the anonymous write rejected")
+	}
+	ctx := regclient.WithToken(context.Background(), "secret")
+	if err := regclient.PutValueContext(ctx, ts1.URL, "k", []byte("v")); err != nil {
+		t.Fatalf("failed to write with the token: %v", err)
+	}
+	if granted, err := regclient.AcquireQuotaContext(ctx, ts1.URL, QuotaRequest{Key: "k", Rate: 1, Tokens: 1}); err != nil || granted != 1 {
+		t.Fatalf("expect a token granted with the token, got %d: %v", granted, err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := r2.kv.get("k"); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expect the value replicated with the token")
+}
@@ -0,0 +1,170 @@
+package registrytest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeEtcd 内存中的假 etcd，实现 etcd v3 Json 网关中服务注册和发现用到的接口：
+// /v3/kv/range、/v3/kv/put、/v3/lease/grant、/v3/lease/keepalive、/v3/lease/revoke。
+// 租约到期的 key 会被删除，所有方法都是并发安全的
+type FakeEtcd struct {
+	mu     sync.Mutex
+	kvs    map[string]fakeKV
+	leases map[int64]time.Time // 租约 ID => 过期时间
+	ttls   map[int64]time.Duration
+	nextID int64
+}
+
+type fakeKV struct {
+	value string
+	lease int64
+}
+
+// NewEtcd 创建假 etcd
+func NewEtcd() *FakeEtcd {
+	return &FakeEtcd{
+		kvs:    make(map[string]fakeKV),
+		leases: make(map[int64]time.Time),
+		ttls:   make(map[int64]time.Duration),
+	}
+}
+
+// StartEtcd 创建假 etcd 并启动一个 HTTP 服务，返回的 URL 可以直接作为 etcd 地址使用，用完需要 Close
+func StartEtcd() (*FakeEtcd, *httptest.Server) {
+	e := NewEtcd()
+	return e, httptest.NewServer(e)
+}
+
+// Keys 返回当前所有没有过期的 key
+func (e *FakeEtcd) Keys() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expire()
+	keys := make([]string, 0, len(e.kvs))
+	for k := range e.kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Expire 让租约立即过期，模拟服务端和 etcd 断开太久
+func (e *FakeEtcd) Expire(lease int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.leases[lease] = time.Time{}
+	e.expire()
+}
+
+// Leases 返回当前有效的租约
+func (e *FakeEtcd) Leases() []int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expire()
+	ids := make([]int64, 0, len(e.leases))
+	for id := range e.leases {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// expire 删除过期的租约和绑定的 key，调用时需要持有锁
+func (e *FakeEtcd) expire() {
+	now := time.Now()
+	for id, deadline := range e.leases {
+		if deadline.Before(now) {
+			e.revoke(id)
+		}
+	}
+}
+
+func (e *FakeEtcd) revoke(id int64) {
+	delete(e.leases, id)
+	delete(e.ttls, id)
+	for k, kv := range e.kvs {
+		if kv.lease == id {
+			delete(e.kvs, k)
+		}
+	}
+}
+
+// fakeInt 和网关一样把 int64 编码成字符串，解码时两种都接受
+type fakeInt int64
+
+func (n fakeInt) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + strconv.FormatInt(int64(n), 10) + `"`), nil
+}
+
+func (n *fakeInt) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	*n = fakeInt(v)
+	return err
+}
+
+func (e *FakeEtcd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var in struct {
+		Key      []byte  `json:"key"`
+		RangeEnd []byte  `json:"range_end"`
+		Value    []byte  `json:"value"`
+		Lease    fakeInt `json:"lease"`
+		ID       fakeInt `json:"ID"`
+		TTL      fakeInt `json:"TTL"`
+	}
+	if req.Method != "POST" || json.NewDecoder(req.Body).Decode(&in) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expire()
+	var out interface{} = struct{}{}
+	switch req.URL.Path {
+	case "/v3/kv/range":
+		type kv struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		}
+		var kvs []kv
+		for k, v := range e.kvs {
+			if k == string(in.Key) || (len(in.RangeEnd) > 0 && k >= string(in.Key) && k < string(in.RangeEnd)) {
+				kvs = append(kvs, kv{Key: []byte(k), Value: []byte(v.value)})
+			}
+		}
+		sort.Slice(kvs, func(i, j int) bool { return string(kvs[i].Key) < string(kvs[j].Key) })
+		out = map[string]interface{}{"kvs": kvs, "count": fakeInt(len(kvs))}
+	case "/v3/kv/put":
+		if _, ok := e.leases[int64(in.Lease)]; in.Lease != 0 && !ok {
+			http.Error(w, "etcdserver: requested lease not found", http.StatusBadRequest)
+			return
+		}
+		e.kvs[string(in.Key)] = fakeKV{value: string(in.Value), lease: int64(in.Lease)}
+	case "/v3/lease/grant":
+		e.nextID++
+		ttl := time.Duration(in.TTL) * time.Second
+		e.leases[e.nextID] = time.Now().Add(ttl)
+		e.ttls[e.nextID] = ttl
+		out = map[string]fakeInt{"ID": fakeInt(e.nextID), "TTL": in.TTL}
+	case "/v3/lease/keepalive":
+		// 租约不存在时网关返回的 TTL 为 0（省略）
+		result := map[string]fakeInt{"ID": in.ID}
+		if ttl, ok := e.ttls[int64(in.ID)]; ok {
+			e.leases[int64(in.ID)] = time.Now().Add(ttl)
+			result["TTL"] = fakeInt(ttl / time.Second)
+		}
+		out = map[string]interface{}{"result": result}
+	case "/v3/lease/revoke":
+		e.revoke(int64(in.ID))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,148 @@
+// Package registrytest 提供一个内存中的假注册中心，用于在没有真实服务端的情况下
+// 确定性地测试服务发现和负载均衡。它与 registry.MyRegistry 使用相同的 HTTP 协议：
+// GET 通过 X-Myrpc-Servers 返回服务列表，POST 通过 X-Myrpc-Server 发送心跳，DELETE 注销。
+package registrytest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Step 脚本中的一步，每次 GET 请求消耗一步，脚本执行完后使用 SetServers 设置的列表
+type Step struct {
+	Servers []string      // 本次返回的服务列表
+	Delay   time.Duration // 返回前的延迟
+	Fail    bool          // 为true时返回 500
+}
+
+// FakeRegistry 假注册中心，所有方法都是并发安全的
+type FakeRegistry struct {
+	mu         sync.Mutex
+	servers    []string       // 默认返回的服务列表
+	delay      time.Duration  // 每次请求的默认延迟
+	failNext   int            // 接下来失败的 GET 请求数
+	script     []Step         // 按顺序消耗的脚本
+	gets       int            // 收到的 GET 请求数
+	heartbeats map[string]int // 每个服务端发送的心跳次数
+	deregister map[string]int // 每个服务端的注销次数
+}
+
+// New 创建一个返回servers的假注册中心
+func New(servers ...string) *FakeRegistry {
+	return &FakeRegistry{
+		servers:    servers,
+		heartbeats: make(map[string]int),
+		deregister: make(map[string]int),
+	}
+}
+
+// Start 创建假注册中心并启动一个 HTTP 服务，返回的 URL 可以直接作为注册中心地址使用，用完需要 Close
+func Start(servers ...string) (*FakeRegistry, *httptest.Server) {
+	r := New(servers...)
+	return r, httptest.NewServer(r)
+}
+
+// SetServers 修改默认返回的服务列表
+func (r *FakeRegistry) SetServers(servers ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.servers = servers
+}
+
+// SetDelay 设置每次请求的延迟，用于模拟慢注册中心
+func (r *FakeRegistry) SetDelay(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delay = d
+}
+
+// FailNext 让接下来的 n 次 GET 请求返回 500
+func (r *FakeRegistry) FailNext(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failNext = n
+}
+
+// Script 追加脚本，之后的每次 GET 请求按顺序消耗一步
+func (r *FakeRegistry) Script(steps ...Step) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.script = append(r.script, steps...)
+}
+
+// Gets 返回收到的 GET 请求数
+func (r *FakeRegistry) Gets() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.gets
+}
+
+// Heartbeats 返回 addr 发送的心跳次数
+func (r *FakeRegistry) Heartbeats(addr string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.heartbeats[addr]
+}
+
+// Deregisters 返回 addr 的注销次数
+func (r *FakeRegistry) Deregisters(addr string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deregister[addr]
+}
+
+// next 决定本次 GET 请求的结果
+func (r *FakeRegistry) next() Step {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gets++
+	if len(r.script) > 0 {
+		step := r.script[0]
+		r.script = r.script[1:]
+		return step
+	}
+	step := Step{Servers: r.servers, Delay: r.delay}
+	if r.failNext > 0 {
+		r.failNext--
+		step.Fail = true
+	}
+	return step
+}
+
+func (r *FakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		step := r.next()
+		if step.Delay > 0 {
+			time.Sleep(step.Delay)
+		}
+		if step.Fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Myrpc-Servers", strings.Join(step.Servers, ","))
+	case "POST":
+		addr := req.Header.Get("X-Myrpc-Server")
+		if addr == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		r.mu.Lock()
+		r.heartbeats[addr]++
+		r.mu.Unlock()
+	case "DELETE":
+		addr := req.Header.Get("X-Myrpc-Server")
+		if addr == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		r.deregister[addr]++
+		r.mu.Unlock()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
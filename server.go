@@ -1,41 +1,31 @@
 package MyRPC
 
 import (
+	"MyRPC/client"
 	"MyRPC/codec"
+	"MyRPC/logger"
+	"MyRPC/wire"
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"reflect"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// 客户端和服务端通信需要协商一些内容，服务端通过解析header就能够知道如何从body中读取需要的信息
-// 对于本项目来说，唯一需要协商的就是消息的编解码方式
-// 一般来说，涉及协议协商的这部分信息，需要固定的字节来传输。为了实现的方便，本项目采用Json编码Option
-// 后续的header和body的编码方式由Option中的CodeType指定。所以服务端需要先Json解码Option，如何通过Option的CodecType解码剩余内容
+// 协商信息 Option 和握手的格式见 client/option.go 和 handshake.go
 
-/*
-	| Option(Json) | Requese(Codec) |  --> | Option(Json) | Header(Codec) | Body(Codec) |
-*/
-
-const MagicNumber = 0x79779200
 const defaultTimeout = time.Minute * 5 // 注册中心心跳超时时间
 
-// Option 协商信息
-type Option struct {
-	MagicNumber    int           // 标记这是MyRPC的请求
-	CodecType      codec.Type    // 客户端选择什么方式进行编码
-	ConnectTimeout time.Duration // 连接超时 默认10s
-	HandleTimeout  time.Duration // 处理超时 默认不设限 0s
-}
-
 // request 一个完整的请求，请求头，请求参数，响应
 // 有服务注册以后，就得带上，哪个服务什么方法
 type request struct {
@@ -43,28 +33,94 @@ type request struct {
 	argv, replyv reflect.Value
 	mtype        *methodType
 	svc          *service
+	span         *Span     // 追踪信息，未采样时为nil
+	ci           *connInfo // 请求所在的连接
+	received     time.Time // 读完请求的时间
+	fields       LogFields // 日志字段，开始处理时生成
 }
 
 type Server struct {
-	serviceMap sync.Map
+	serviceMap    sync.Map
+	meta          *service    // 内置的元数据服务，见 meta.go
+	conns         sync.Map    // 当前的所有连接 *connInfo
+	strict        StrictMode  // 处理协议异常的方式
+	tlsConfig     *tls.Config // StartTLS 使用的配置
+	tracer        Tracer      // 请求追踪，为nil时不追踪
+	sampler       *Sampler    // 追踪的采样配置
+	metrics       *serverMetrics
+	admission     admission            // 限流和过载保护
+	adminToken    string               // 调参接口的鉴权令牌
+	authenticator Authenticator        // 连接鉴权，为nil时不鉴权
+	authorizer    Authorizer           // 方法级的访问控制，为nil时不检查
+	registryToken string               // 心跳和注销时发给注册中心的令牌
+	pool          *workerPool          // 并发控制，为nil时不限制
+	methodPools   sync.Map             // 单独限制并发数的方法 Service.Method -> *workerPool
+	acceptWorkers int                  // 每个监听器同时 Accept 的协程数
+	caller        Caller               // 服务方法调用下游服务使用的客户端
+	mdLimits      codec.MetadataLimits // 请求元数据的限制
+
+	accessLogger AccessLogger // 访问日志，为nil时不记录
+	slowLog      *slowLog     // 慢调用日志，为nil时不记录
+	heartbeat    atomic.Value // HeartbeatStatus
+	encryption   *codec.Encryption
+	capture      *codec.Capture      // 抓包，为nil时不记录
+	limiter      *distributedLimiter // 集群限流，为nil时不限制
+	unregistered uint64              // 注销服务的次数，连接上缓存的方法查找结果据此失效
+	instanceID   string              // 实例ID，每次创建 Server 都不同
+	version      string              // 部署的版本，随心跳上报给注册中心
+	budget       *errorBudget        // 错误预算，为nil时不统计
+	healthCheck  HealthCheck         // 应用定义的健康判断
+	healthMu     sync.Mutex
+	health       HealthStatus // 最近一次健康检查的结果
+
+	mu            sync.Mutex
+	listeners     map[net.Listener]struct{}       // Accept 中的监听器，关闭时停止接受新连接
+	registrations map[registration]*HeartbeatTask // 发送过心跳的注册中心，关闭时停止心跳并注销
+	registrars    []registrarEntry                // 通过 Registrar 注册的地址，关闭时注销
+	done          chan struct{}                   // 关闭时关闭，停止发送心跳
+	shutdownOnce  sync.Once
 }
 
 func NewServer() *Server {
-	return &Server{}
+	server := &Server{
+		metrics:       newServerMetrics(),
+		acceptWorkers: 1,
+		instanceID:    newInstanceID(),
+		listeners:     make(map[net.Listener]struct{}),
+		registrations: make(map[registration]*HeartbeatTask),
+		done:          make(chan struct{}),
+	}
+	server.meta, _ = newNamedService(MetaServiceName, &MetaService{server: server})
+	return server
 }
 
 var DefaultServer = NewServer()
 
+// newInstanceID 生成实例ID，由启动时间和随机数组成
+func newInstanceID() string {
+	return fmt.Sprintf("%x-%08x", time.Now().UnixNano(), rand.Uint32())
+}
+
+// InstanceID 返回服务端的实例ID。服务端重启后地址不变但实例ID会变，心跳和能力协商都会带上它，
+// 注册中心和 XClient 据此发现重启，丢弃连到旧进程的连接
+func (server *Server) InstanceID() string {
+	return server.instanceID
+}
+
+// SetVersion 设置服务端部署的版本，比如 v2，随心跳上报给注册中心，XClient 的 SetTrafficSplit 据此按版本分流。
+// 需要在开始发送心跳之前调用
+func (server *Server) SetVersion(version string) {
+	server.version = version
+}
+
 // Accept 监听输入请求并提供服务，传入连接
 func (server *Server) Accept(lis net.Listener) {
-	for { // 循环等待socket连接建立 并开启子线程处理 处理过程交给ServerConn
-		conn, err := lis.Accept()
-		if err != nil {
-			log.Println("rpc server: accept error :", err)
-			return
-		}
-		go server.ServerConn(conn)
+	if !server.trackListener(lis) {
+		_ = lis.Close()
+		return
 	}
+	defer server.untrackListener(lis)
+	server.acceptLoop(lis) // 处理过程交给ServerConn
 }
 
 func Accept(lis net.Listener) {
@@ -76,59 +132,240 @@ func (server *Server) ServerConn(conn io.ReadWriteCloser) {
 	defer func() {
 		_ = conn.Close()
 	}()
+	handshook := server.handshaking()
+	defer handshook()
 	// 协议协商
-	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
-		log.Println("rpc server: options error: ", err)
-		return
+	opt, rw, framed, err := readHandshake(conn)
+	if rw != nil {
+		conn = rw
+	}
+	if err == nil {
+		err = server.checkHandshake(opt)
 	}
-	// 判断是不是发给本RPC的
-	if opt.MagicNumber != MagicNumber {
-		log.Printf("rpc server : invalid magic number %x", opt.MagicNumber)
+	if err == nil && opt.tlsToken && !opt.StartTLS {
+		err = errors.New("rpc server: token after TLS requested without StartTLS")
+	}
+	if err == nil && !opt.tlsToken {
+		err = server.authenticate(opt.Token, client.RemoteAddr(conn))
+	}
+	if opt != nil && opt.HandshakeAck {
+		var codecs []string
+		if opt.ackDetail {
+			codecs = server.capabilities().Codecs
+		}
+		if werr := writeHandshakeAck(conn, err, codecs); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	if err != nil {
+		logger.Warnf("rpc server: options error: %v", err)
 		return
 	}
+	if opt.StartTLS {
+		tc, err := server.startTLS(conn)
+		if err != nil {
+			logger.Warnf("rpc server: start tls error: %v", err)
+			return
+		}
+		conn = tc
+		if opt.tlsToken && !server.authenticateTLS(conn, opt.Option) {
+			return
+		}
+	}
+	if opt.NegotiateCapabilities {
+		if err := writeCapabilities(conn, server.capabilities()); err != nil {
+			logger.Warnf("rpc server: write capabilities error: %v", err)
+			return
+		}
+	}
+	handshook()
 	// 获取对应的编解码格式 返回的是构造函数
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
-		log.Printf("rpc server: invalid codec type %s", opt.CodecType)
+	f := opt.NewCodecFunc()
+	ci, untrack := server.trackConn(conn, opt.Option)
+	defer untrack()
+	wrapped, err := opt.WrapConn(conn, framed)
+	if err != nil {
+		logger.Warnf("rpc server: options error: %v", err)
 		return
 	}
-	server.serverCodec(f(conn), &opt)
+	server.serverCodec(server.wrapCodec(f, opt, ci)(wrapped), opt.Option, ci)
 }
 
+// wrapCodec 按服务端的配置包装编解码器：元数据限制、统计、抓包和消息体加密
+func (server *Server) wrapCodec(f codec.NewCodecFunc, opt *serverOption, ci *connInfo) codec.NewCodecFunc {
+	if server.mdLimits != (codec.MetadataLimits{}) {
+		f = codec.WithMetadataLimits(f, server.mdLimits)
+	}
+	if opt.errorCodes {
+		f = codec.WithErrorCodes(f)
+	}
+	f = codec.NewStatsCodec(f, &ci.stats)
+	if server.capture != nil {
+		f = codec.NewCaptureCodec(f, server.capture, ci.remoteAddr)
+	}
+	if server.encryption != nil {
+		f = codec.NewEncryptCodec(f, opt.CodecType, server.encryption)
+	}
+	return f
+}
+
+// checkHandshake 在回复握手确认之前检查服务端能否处理这个连接
+func (server *Server) checkHandshake(opt *serverOption) error {
+	if opt.NewCodecFunc() == nil {
+		return fmt.Errorf("rpc server: invalid codec type %s", opt.CodecType)
+	}
+	if opt.StartTLS && server.tlsConfig == nil {
+		return errors.New("rpc server: StartTLS requested but TLS is not configured")
+	}
+	return codec.CheckCompress(opt.CompressType, opt.CompressDict)
+}
+
+// SetCapture 把所有连接上解码后的消息写入抓包文件，见 codec.NewCapture，需要在 Accept 之前调用
+func (server *Server) SetCapture(c *codec.Capture) {
+	server.capture = c
+}
+
+// SetEncryption 设置需要加密消息体的方法，客户端需要在 Option.Encryption 中配置相同的方法，
+// 需要在 Accept 之前调用
+func (server *Server) SetEncryption(e *codec.Encryption) {
+	server.encryption = e
+}
+
+// errProtocol 协议异常，严格模式下会被计数
+var errProtocol error = Errorf(CodeInvalidArgument, "rpc: protocol violation")
+
 // invalidRequest 是发生错误时 argv 的占位符
 var invalidRequest = struct{}{}
 
 // serverCodec 三个阶段 明确了编解码的格式 开始具体的处理
 // 1. 读取请求 readRequest  2. 处理请求 handleRequest  3. 回复请求 sendResponse
-func (server *Server) serverCodec(cc codec.Codec, opt *Option) {
+func (server *Server) serverCodec(cc codec.Codec, opt *Option, ci *connInfo) {
 	sending := new(sync.Mutex) // 处理请求是并发的，但是发送的时候得按顺序，不然可能会混淆数据
 	wg := new(sync.WaitGroup)
+	active := ci.active // 正在处理的请求的seq
+	methods := new(methodCache)
 	// 为什么这里是无限制循环 因为一次连接中允许接受多个请求，尽力而为，只有在header解析失败（可能所有请求结束了），才终止循环
 	for {
-		req, err := server.readRequest(cc)
+		req, err := server.readRequest(cc, methods)
 		if err != nil {
 			if req == nil {
 				break
 			}
-			req.h.Error = err.Error()
+			if errors.Is(err, errProtocol) && protocolViolation(server.strict, ci, "server", ci.remoteAddr, "%v", err) {
+				break
+			}
+			setError(req.h, err)
 			server.sendResponse(cc, req.h, invalidRequest, sending) // 出错向客户端返回错误信息
 			continue
 		}
+		if req.h.ServiceMethod == pingMethod {
+			server.sendResponse(cc, req.h, true, sending)
+			continue
+		}
+		if req.h.ServiceMethod == cancelMethod {
+			active.cancel(req.h.Seq)
+			continue
+		}
+		// 同一个连接上正在处理的请求不能复用seq，否则响应会交错，客户端无法区分
+		if !active.acquire(req.h.Seq) {
+			err = fmt.Errorf("%w: duplicate seq %d", errProtocol, req.h.Seq)
+			if protocolViolation(server.strict, ci, "server", ci.remoteAddr, "%v", err) {
+				break
+			}
+			setError(req.h, err)
+			server.sendResponse(cc, req.h, invalidRequest, sending)
+			continue
+		}
+		if err = server.admission.admit(); err != nil {
+			active.release(req.h.Seq)
+			setError(req.h, err)
+			server.sendResponse(cc, req.h, invalidRequest, sending)
+			continue
+		}
+		if server.limiter != nil && !server.limiter.allow(req.h.ServiceMethod, req.h.Metadata) {
+			server.admission.done()
+			active.release(req.h.Seq)
+			setError(req.h, ErrRateLimited)
+			server.sendResponse(cc, req.h, invalidRequest, sending)
+			continue
+		}
+		req.span = server.startSpan(req.h, ci.remoteAddr)
+		req.ci = ci
+		req.received = time.Now()
+		timeout := opt.HandleTimeout
+		if t := server.admission.load().HandleTimeout; t > 0 {
+			timeout = t
+		}
 		wg.Add(1)
-		// 把请求信息传入，处理请求 这里的这个timeout要注意，这里我们写死了，以后来改
-		go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
+		err = server.poolFor(req.h.ServiceMethod).submit(func() {
+			// 超时或连接断开后服务方法可能还在执行，等它返回才释放并发名额和seq，
+			// 否则不理会 ctx 的服务方法会让实际执行的数量超过限制
+			<-server.handleRequest(cc, req, sending, wg, timeout)
+			server.admission.done()
+			active.release(req.h.Seq)
+		})
+		if err != nil {
+			wg.Done()
+			server.admission.done()
+			active.release(req.h.Seq)
+			server.finishSpan(req.span, err)
+			setError(req.h, err)
+			server.sendResponse(cc, req.h, invalidRequest, sending)
+		}
+	}
+	// 连接已经断开，通知还在处理的请求，不再等待它们的服务方法返回
+	if ci.cancel != nil {
+		ci.cancel()
 	}
 	wg.Wait()
 	_ = cc.Close()
 }
 
+// seqSet 一个连接上正在处理的请求的seq集合，同时记录取消处理每个请求的 ctx 的函数
+type seqSet struct {
+	mu   sync.Mutex
+	seqs map[uint64]*activeRequest
+}
+
+// activeRequest 一个正在处理的请求
+type activeRequest struct {
+	cancel   context.CancelFunc // 开始处理后才有
+	canceled bool               // 客户端已经取消
+}
+
+func newSeqSet() *seqSet {
+	return &seqSet{seqs: make(map[uint64]*activeRequest)}
+}
+
+// acquire 记录seq，seq已经在处理中时返回false
+func (s *seqSet) acquire(seq uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seqs[seq]; ok {
+		return false
+	}
+	s.seqs[seq] = &activeRequest{}
+	return true
+}
+
+func (s *seqSet) release(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.seqs, seq)
+}
+
+func (s *seqSet) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.seqs)
+}
+
 // readRequestHeader 读取请求头
 func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 	var h codec.Header
 	if err := cc.ReadHeader(&h); err != nil {
 		if err != io.EOF && err != io.ErrUnexpectedEOF {
-			log.Println("rpc server: read header error: ", err)
+			logger.Warnf("rpc server: read header error: %v", err)
 		}
 		return nil, err
 	}
@@ -136,14 +373,29 @@ func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 }
 
 // readRequest 读取请求，先读取请求头，再读取请求体
-func (server *Server) readRequest(cc codec.Codec) (*request, error) {
+func (server *Server) readRequest(cc codec.Codec, methods *methodCache) (*request, error) {
 	h, err := server.readRequestHeader(cc)
 	if err != nil {
 		return nil, err
 	}
 	req := &request{h: h}
-	req.svc, req.mtype, err = server.findService(h.ServiceMethod)
+	if h.ServiceMethod == pingMethod || h.ServiceMethod == cancelMethod {
+		var ping bool
+		return req, cc.ReadBody(&ping)
+	}
+	// 客户端的请求中Error必须为空，seq从1开始
+	if server.strict != StrictOff && (h.Error != "" || h.Seq == 0) {
+		_ = cc.ReadBody(nil)
+		return req, fmt.Errorf("%w: unexpected request frame seq=%d error=%q", errProtocol, h.Seq, h.Error)
+	}
+	if err = server.mdLimits.Check(h.Metadata); err != nil {
+		_ = cc.ReadBody(nil)
+		return req, err
+	}
+	req.svc, req.mtype, err = server.findMethod(h, methods)
 	if err != nil {
+		// 丢弃请求体，否则会被当成下一个请求的头部
+		_ = cc.ReadBody(nil)
 		return req, err
 	}
 	// reflect.TypeOf 获取对应的Type
@@ -158,8 +410,8 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 		argvi = req.argv.Addr().Interface()
 	}
 	if err = cc.ReadBody(argvi); err != nil {
-		log.Println("rpc server: read argv err: ", err)
-		return req, err
+		logger.Warnf("rpc server: read argv err: %v", err)
+		return req, &Error{Code: CodeInvalidArgument, Message: err.Error()}
 	}
 
 	return req, nil
@@ -173,46 +425,126 @@ func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interfa
 	// 回复信息，Write方法调用了gob包中的encode方法，
 	// encode方法用到了一个我们在gob结构体中定义的bufio.Writer缓冲区，所以需要自己上锁
 	if err := cc.Write(h, body); err != nil {
-		log.Println("rpc server: write response error: ", err)
+		logger.Errorf("rpc server: write response error: %v", err)
 	}
 }
 
-// handleRequest 处理请求，带有超时处理 解决send超时和协程泄露问题
-func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
+// handleRequest 处理请求，带有超时处理 解决send超时和协程泄露问题。
+// 服务方法在单独的协程中执行，和超时的分支竞争回复，respond 保证每个请求只回复一次。
+// 返回的通道在服务方法返回后关闭，没有调用服务方法时已经关闭
+func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) <-chan struct{} {
 	defer wg.Done()
 
-	var ctx context.Context
-	var cancel context.CancelFunc
-	if timeout == 0 {
-		ctx, cancel = context.WithCancel(context.TODO())
-	} else {
-		ctx, cancel = context.WithTimeout(context.TODO(), timeout)
+	var once sync.Once
+	respond := func(h *codec.Header, body interface{}) {
+		once.Do(func() { server.sendResponse(cc, h, body, sending) })
+	}
+	// fail 在调用服务方法之前结束请求
+	fail := func(err error) {
+		server.metrics.observe(req.h.ServiceMethod, 0, err)
+		server.logAccess(req, time.Now(), err)
+		server.finishSpan(req.span, err)
+		h := *req.h
+		setError(&h, err)
+		respond(&h, invalidRequest)
+	}
+
+	// 处理请求的 ctx 继承客户端传来的截止时间和元数据
+	ctx, cancel := requestContext(req.ci.ctx, req.h.Deadline, req.h.Metadata)
+	defer cancel()
+	ctx = withLogFields(ctx, req)
+	ctx = withPeer(ctx, req.ci)
+	if server.caller != nil {
+		ctx = WithCaller(ctx, server.caller)
+	}
+	if err := server.authorize(ctx, req.h.ServiceMethod); err != nil {
+		fail(err)
+		return closedChan
+	}
+	if timeout != 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
 		defer cancel()
 	}
+	// 在排队期间已经被客户端取消的请求不再处理
+	if !req.ci.active.bind(req.h.Seq, cancel) {
+		fail(errRequestCanceled)
+		return closedChan
+	}
 
-	go func(context context.Context) {
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
+	called := make(chan struct{})
+	go func() {
+		defer close(called)
+		start := time.Now()
+		err := server.callService(ctx, req)
+		server.metrics.observe(req.h.ServiceMethod, time.Since(start), err)
+		server.observeBudget(time.Since(start), err)
+		server.logAccess(req, start, err)
+		server.observeSlow(req, start, err)
+		server.finishSpan(req.span, err)
+		// 超时的分支也会读请求头，各自复制一份，避免同时修改 req.h
+		h := *req.h
+		h.Trailer = server.responseTrailer(req, start)
 		if err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
+			setError(&h, err)
+			respond(&h, errorBody(&h, err))
 			return
 		}
-		server.sendResponse(cc, req.h, req.replyv.Interface(), sending)
-		cancel()
-	}(ctx)
+		respond(&h, req.replyv.Interface())
+	}()
 
+	// 没有处理超时的时候等待服务方法返回，客户端的截止时间和取消只通过 ctx 通知服务方法；
+	// 连接断开时响应已经发不出去，不再等待不理会 ctx 的服务方法
+	if timeout == 0 {
+		select {
+		case <-called:
+		case <-req.ci.ctx.Done():
+		}
+		return called
+	}
 	select {
+	case <-called:
 	case <-ctx.Done():
-		if timeout != 0 {
-			req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-			//fmt.Println(req.h.Error)
-			server.sendResponse(cc, req.h, invalidRequest, sending)
+		if req.ci.ctx.Err() != nil {
+			return called
+		}
+		h := *req.h
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			setError(&h, Errorf(CodeDeadlineExceeded, "rpc server: request handle timeout: expect within %s", timeout))
+		} else {
+			setError(&h, errRequestCanceled)
 		}
+		respond(&h, invalidRequest)
 	}
+	return called
+}
+
+// closedChan 没有调用服务方法的请求返回的已关闭的通道
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// callService 调用服务方法，服务方法 panic 时返回错误，不影响其他请求
+func (server *Server) callService(ctx context.Context, req *request) (err error) {
+	start := time.Now()
+	req.mtype.begin()
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 64<<10)
+			logger.Errorf("rpc server: %s panic: %v\n%s", req.h.ServiceMethod, r, buf[:runtime.Stack(buf, false)])
+			err = Errorf(CodeInternal, "rpc server: %s panic: %v", req.h.ServiceMethod, r)
+		}
+		req.mtype.end(time.Since(start), err)
+	}()
+	return req.svc.call(ctx, req.mtype, req.argv, req.replyv)
 }
 
 func (server *Server) Register(rcvr interface{}) error {
-	s := newService(rcvr)
+	s, err := newService(rcvr)
+	if err != nil {
+		return err
+	}
 	// dup是true表示loaded
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
 		return errors.New("rpc: service already defined: " + s.name)
@@ -224,28 +556,176 @@ func Register(rcvr interface{}) error {
 	return DefaultServer.Register(rcvr)
 }
 
+// RegisterName 与Register类似，但使用name作为服务名而不是结构体的名称，
+// 这样同一个结构体的多个实例可以以不同的服务名暴露，例如 "UserV1" 和 "UserV2"
+func (server *Server) RegisterName(name string, rcvr interface{}) error {
+	if name == "" || strings.Contains(name, ".") || name == MetaServiceName {
+		return errors.New("rpc: invalid service name: " + name)
+	}
+	s, err := newNamedService(name, rcvr)
+	if err != nil {
+		return err
+	}
+	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
+		return errors.New("rpc: service already defined: " + s.name)
+	}
+	return nil
+}
+
+func RegisterName(name string, rcvr interface{}) error {
+	return DefaultServer.RegisterName(name, rcvr)
+}
+
+// RegisterReport 返回已注册服务的注册报告，列出注册成功的方法和被跳过的方法及原因，
+// 用来排查调用时 can't find method 的问题
+func (server *Server) RegisterReport(serviceName string) (*RegisterReport, error) {
+	svci, ok := server.serviceMap.Load(serviceName)
+	if !ok {
+		return nil, errors.New("rpc: service not defined: " + serviceName)
+	}
+	return svci.(*service).report(), nil
+}
+
+// ServiceProvider 由依赖注入容器实现，一次性提供一组以名字为键的服务
+type ServiceProvider interface {
+	ProvideServices() map[string]interface{}
+}
+
+// RegisterErrors 批量注册时收集到的所有错误
+type RegisterErrors []error
+
+func (errs RegisterErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// RegisterAll 按名字批量注册服务，某个服务注册失败不影响其它服务，
+// 所有的错误合并成 RegisterErrors 返回
+func (server *Server) RegisterAll(services map[string]interface{}) error {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	// 按名字排序，保证错误的顺序稳定
+	sort.Strings(names)
+	var errs RegisterErrors
+	for _, name := range names {
+		if err := server.RegisterName(name, services[name]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// RegisterProvider 注册 ServiceProvider 提供的所有服务
+func (server *Server) RegisterProvider(p ServiceProvider) error {
+	return server.RegisterAll(p.ProvideServices())
+}
+
+func RegisterAll(services map[string]interface{}) error {
+	return DefaultServer.RegisterAll(services)
+}
+
+func RegisterProvider(p ServiceProvider) error {
+	return DefaultServer.RegisterProvider(p)
+}
+
+// Unregister 注销服务，便于长期运行的进程热替换服务实现。已经在处理中的请求不受影响
+func (server *Server) Unregister(serviceName string) error {
+	if _, ok := server.serviceMap.LoadAndDelete(serviceName); !ok {
+		return errors.New("rpc: service not defined: " + serviceName)
+	}
+	atomic.AddUint64(&server.unregistered, 1)
+	return nil
+}
+
+func Unregister(serviceName string) error {
+	return DefaultServer.Unregister(serviceName)
+}
+
+// Services 返回当前已注册的所有服务名，按字典序排列
+func (server *Server) Services() []string {
+	var names []string
+	server.serviceMap.Range(func(namei, _ interface{}) bool {
+		names = append(names, namei.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
 // findService ServiceMethod 的构成是 “Service.Method”
 // 先在serviceMap 中找到对应的 service 实例，再从 service 实例的 method 中，找到对应的 methodType。
 func (server *Server) findService(serviceMethod string) (svc *service, mtype *methodType, err error) {
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
-		err = errors.New("rpc server: server/method request ill-formed: " + serviceMethod)
+		err = Errorf(CodeInvalidArgument, "rpc server: server/method request ill-formed: %s", serviceMethod)
 		return
 	}
 	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
-	svci, ok := server.serviceMap.Load(serviceName)
-	if !ok {
-		err = errors.New("rpc server: can't find service " + serviceName)
-		return
+	if serviceName == MetaServiceName {
+		svc = server.meta
+	} else {
+		svci, ok := server.serviceMap.Load(serviceName)
+		if !ok {
+			err = Errorf(CodeNotFound, "rpc server: can't find service %s", serviceName)
+			return
+		}
+		svc = svci.(*service)
 	}
-	svc = svci.(*service)
 	mtype = svc.method[methodName]
 	if mtype == nil {
-		err = errors.New("rpc server: can't find method " + methodName)
+		err = Errorf(CodeNotFound, "rpc server: can't find method %s", methodName)
 	}
 	return
 }
 
+// methodCache 一个连接上缓存的方法查找结果，只在读请求的协程中使用。
+// 同一个连接上的请求通常只调用少数几个方法，按方法名（以及编码方式分配的方法编号）缓存后，
+// 不需要每个请求都切分 服务名.方法名 再查两次 map
+type methodCache struct {
+	unregistered uint64 // 建立缓存时服务端注销服务的次数，变化后缓存失效
+	byID         map[uint64]cachedMethod
+	byName       map[string]cachedMethod
+}
+
+type cachedMethod struct {
+	svc   *service
+	mtype *methodType
+}
+
+// findMethod 查找请求的服务和方法，只缓存查找成功的结果
+func (server *Server) findMethod(h *codec.Header, cache *methodCache) (*service, *methodType, error) {
+	if n := atomic.LoadUint64(&server.unregistered); cache.byName == nil || cache.unregistered != n {
+		cache.unregistered = n
+		cache.byID = make(map[uint64]cachedMethod)
+		cache.byName = make(map[string]cachedMethod)
+	}
+	id := h.MethodID()
+	if m, ok := cache.byID[id]; ok && id != 0 {
+		return m.svc, m.mtype, nil
+	}
+	m, ok := cache.byName[h.ServiceMethod]
+	if !ok {
+		svc, mtype, err := server.findService(h.ServiceMethod)
+		if err != nil {
+			return nil, nil, err
+		}
+		m = cachedMethod{svc, mtype}
+		cache.byName[h.ServiceMethod] = m
+	}
+	if id != 0 {
+		cache.byID[id] = m
+	}
+	return m.svc, m.mtype, nil
+}
+
 //
 // 支持HTTP协议。
 // 先看将 HTTP 协议转换为 HTTPS 协议的过程：
@@ -266,8 +746,8 @@ func (server *Server) findService(serviceMethod string) (svc *service, mtype *me
 */
 
 const (
-	connected        = "200 Connected to MyRPC"
-	defaultRPCPath   = "/_myrpc_"
+	connected        = wire.Connected
+	defaultRPCPath   = wire.RPCPath
 	defaultDebugPath = "/debug/myrpc"
 )
 
@@ -282,7 +762,7 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// Hijack()可以将HTTP对应的TCP连接取出，连接在Hijack()之后，HTTP的相关操作就会受到影响，调用方需要负责去关闭连接。
 	conn, _, err := w.(http.Hijacker).Hijack()
 	if err != nil {
-		log.Print("rpc hijacking", req.RemoteAddr, ": ", err.Error())
+		logger.Errorf("rpc hijacking %s: %v", req.RemoteAddr, err)
 		return
 	}
 	_, _ = io.WriteString(conn, "HTTP/1.0 "+connected+"\n\n")
@@ -294,8 +774,11 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 func (server *Server) HandleHTTP() {
 	// 第一个参数是访问路径  第二个参数是Handler类型 一个接口 需要实现ServerHTTP
 	http.Handle(defaultRPCPath, server)
+	http.Handle(defaultCallPath, server.CallHandler())
 	http.Handle(defaultDebugPath, debugHTTP{server})
-	log.Println("rpc server debug path:", defaultDebugPath)
+	http.Handle(defaultTunePath, tuneHTTP{server})
+	http.Handle(defaultMetricsPath, metricsHTTP{server})
+	logger.Infof("rpc server debug path: %s", defaultDebugPath)
 }
 
 // HandleHTTP 默认服务器注册HTTP处理程序
@@ -308,33 +791,159 @@ func HandleHTTP() {
 //
 
 // Heartbeat 方法，便于服务启动时定时向注册中心发送心跳，默认周期比注册中心设置的过期时间少 1 min。
-func (server *Server) Heartbeat(registry, addr string, duration time.Duration) {
+// 第一次心跳在返回之前发送。心跳失败后按退避间隔重试，注册中心拒绝（4xx）时停止。
+// 配置了 SetSLO 或 SetHealthCheck 时，不健康期间注销并暂停心跳，见 health.go
+func (server *Server) Heartbeat(registry, addr string, duration time.Duration) *HeartbeatTask {
+	return server.HeartbeatContext(context.Background(), registry, addr, duration)
+}
+
+// HeartbeatContext 和 Heartbeat 相同，ctx 结束时停止心跳，正在发送的心跳请求也随之取消
+func (server *Server) HeartbeatContext(ctx context.Context, registry, addr string, duration time.Duration) *HeartbeatTask {
 	if duration == 0 {
 		duration = defaultTimeout - time.Duration(1)*time.Minute
 	}
+	ctx, cancel := context.WithCancel(ctx)
+	reg := registration{registry, addr}
+	task := &HeartbeatTask{server: server, reg: reg, cancel: cancel, done: make(chan struct{})}
+	server.mu.Lock()
+	prev := server.registrations[reg]
+	server.registrations[reg] = task
+	server.mu.Unlock()
+	// 同一个地址重复调用时只保留最新的心跳
+	if prev != nil {
+		prev.Stop()
+	}
+	// 启动时就不健康的实例先不注册，恢复后再注册
+	registered := true
+	if server.healthEnabled() {
+		if status := server.Health(); !status.Healthy {
+			logger.Warnf("rpc server: %s unhealthy, skip registering to %s: %s", addr, registry, status.Reason)
+			registered = false
+		}
+	}
 	var err error
-	err = sendHeartbeat(registry, addr)
+	if registered {
+		err = server.sendHeartbeat(ctx, registry, addr, duration)
+		server.recordHeartbeat(registry, addr, err)
+	}
 	go func() {
-		// time.NewTicker 创建周期性定时器
-		t := time.NewTicker(duration)
-		for err == nil {
-			// 从定时器中获取数据
-			<-t.C
-			err = sendHeartbeat(registry, addr)
+		defer close(task.done)
+		if errors.Is(err, errHeartbeatRejected) {
+			return
 		}
+		server.heartbeatLoop(ctx, registry, addr, duration, registered, err)
 	}()
+	return task
 }
 
-// sendHeartbeat 发送心跳信息
-func sendHeartbeat(registry, addr string) error {
-	log.Println(addr, "send heart beat to registry", registry)
+// HeartbeatTask 一个地址向一个注册中心的心跳
+type HeartbeatTask struct {
+	server *Server
+	reg    registration
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Stop 停止发送心跳并等待心跳协程退出，不注销，地址在注册中心过期后消失。
+// 停止后 Shutdown 也不再注销这个地址。Deregister 和 Shutdown 会停止对应的心跳
+func (t *HeartbeatTask) Stop() {
+	t.cancel()
+	<-t.done
+	t.server.mu.Lock()
+	// 同一个地址可能已经换成了新的心跳，只删除自己
+	if t.server.registrations[t.reg] == t {
+		delete(t.server.registrations, t.reg)
+	}
+	t.server.mu.Unlock()
+}
+
+// Done 返回心跳停止时关闭的 channel：调用了 Stop、ctx 结束、服务端关闭或者被注册中心拒绝
+func (t *HeartbeatTask) Done() <-chan struct{} {
+	return t.done
+}
+
+// HeartbeatStatus 最近一次向注册中心发送心跳的状态
+type HeartbeatStatus struct {
+	Registry  string
+	Addr      string
+	Last      time.Time // 最近一次发送的时间，从未发送时为零值
+	LastError string    // 最近一次发送的错误，成功时为空
+}
+
+// recordHeartbeat 记录一次心跳的结果
+func (server *Server) recordHeartbeat(registry, addr string, err error) {
+	server.metrics.observeHeartbeat(err)
+	status := HeartbeatStatus{Registry: registry, Addr: addr, Last: time.Now()}
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	server.heartbeat.Store(status)
+}
+
+// LastHeartbeat 返回最近一次心跳的状态
+func (server *Server) LastHeartbeat() HeartbeatStatus {
+	status, _ := server.heartbeat.Load().(HeartbeatStatus)
+	return status
+}
+
+// maxHeartbeatTimeout 一次心跳请求的最长等待时间，心跳周期更短时以周期为准
+const maxHeartbeatTimeout = 10 * time.Second
+
+// sendHeartbeat 发送心跳信息，同时上报注册的服务名，客户端据此只选择提供对应服务的实例。
+// 每次发送最多等待 min(duration, maxHeartbeatTimeout)，注册中心没有响应时按失败处理，之后退避重试
+func (server *Server) sendHeartbeat(ctx context.Context, registry, addr string, duration time.Duration) error {
+	logger.Debugf("%s send heart beat to registry %s", addr, registry)
+	timeout := maxHeartbeatTimeout
+	if duration > 0 && duration < timeout {
+		timeout = duration
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 	httpClient := &http.Client{}
-	req, _ := http.NewRequest("POST", registry, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", registry, nil)
+	if err != nil {
+		return err
+	}
 	req.Header.Set("X-Myrpc-Server", addr)
+	req.Header.Set("X-Myrpc-Instance", server.instanceID)
+	server.setRegistryToken(req)
+	if host := Hostname(); host != "" {
+		req.Header.Set("X-Myrpc-Host", host)
+	}
+	if server.version != "" {
+		req.Header.Set("X-Myrpc-Server-Version", server.version)
+	}
+	if services := server.Services(); len(services) > 0 {
+		req.Header.Set("X-Myrpc-Services", strings.Join(services, ","))
+	}
 	// httpClient.Do 发送HTTP请求用的
-	if _, err := httpClient.Do(req); err != nil {
-		log.Println("rpc server: heart beat err:", err)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logger.Errorf("rpc server: heart beat err: %v", err)
 		return err
 	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		logger.Errorf("rpc server: heart beat to %s rejected: %s", registry, resp.Status)
+		return fmt.Errorf("%w: %s", errHeartbeatRejected, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		logger.Errorf("rpc server: heart beat to %s failed: %s", registry, resp.Status)
+		return errors.New("rpc server: heart beat failed: " + resp.Status)
+	}
 	return nil
 }
+
+// errHeartbeatRejected 注册中心拒绝了心跳，比如令牌错误或者没有通过准入检查，重试没有意义
+var errHeartbeatRejected = errors.New("rpc server: heart beat rejected")
+
+// SetRegistryToken 设置向注册中心发送心跳和注销时使用的令牌，对应注册中心的 SetToken
+func (server *Server) SetRegistryToken(token string) {
+	server.registryToken = token
+}
+
+func (server *Server) setRegistryToken(req *http.Request) {
+	if server.registryToken != "" {
+		req.Header.Set("Authorization", "Bearer "+server.registryToken)
+	}
+}
@@ -1,9 +1,13 @@
 package MyRPC
 
 import (
+	"MyRPC/logger"
+	"context"
+	"errors"
+	"fmt"
 	"go/ast"
-	"log"
 	"reflect"
+	"sort"
 	"sync/atomic"
 )
 
@@ -25,13 +29,32 @@ type methodType struct {
 	ArgType   reflect.Type   // 第一个参数的类型
 	ReplyType reflect.Type   // 第二个参数的类型
 	numCalls  uint64         // 统计方法调用次数
+	stats     methodStats    // 错误数、正在执行的调用数和最近的耗时，见 methodstats.go
+	withCtx   bool           // 方法的第一个参数是否是 context.Context
+	doc       methodDoc      // 服务实现 Describer 时提供的说明和示例，见 describe.go
 }
 
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 type service struct {
-	name   string                 // 映射的结构体的名称
-	typ    reflect.Type           // 结构体的类型
-	rcvr   reflect.Value          // 结构体的实例本身
-	method map[string]*methodType // 存储映射的结构体的所有符合条件的方法
+	name    string                 // 映射的结构体的名称
+	typ     reflect.Type           // 结构体的类型
+	rcvr    reflect.Value          // 结构体的实例本身
+	method  map[string]*methodType // 存储映射的结构体的所有符合条件的方法
+	skipped []SkippedMethod        // 不符合条件被跳过的方法
+}
+
+// SkippedMethod 注册时被跳过的方法以及违反的规则
+type SkippedMethod struct {
+	Name   string
+	Reason string
+}
+
+// RegisterReport 服务的注册报告
+type RegisterReport struct {
+	Service string
+	Methods []string        // 成功注册的方法
+	Skipped []SkippedMethod // 被跳过的方法
 }
 
 func (m *methodType) NumCalls() uint64 {
@@ -69,19 +92,36 @@ func (m *methodType) newReplyv() reflect.Value {
 	return replyv
 }
 
-func newService(rcvr interface{}) *service {
+func newService(rcvr interface{}) (*service, error) {
+	return newNamedService("", rcvr)
+}
+
+// newNamedService 以指定的名称创建服务，name为空时使用结构体的名称
+func newNamedService(name string, rcvr interface{}) (*service, error) {
+	if rcvr == nil {
+		return nil, errors.New("rpc server: service receiver is nil")
+	}
 	s := new(service)
 	// 获得值的反射值对象,包含有rcvr的值信息
 	s.rcvr = reflect.ValueOf(rcvr)
+	// 指向nil的指针没法调用方法，Indirect 之后也拿不到类型
+	if s.rcvr.Kind() == reflect.Ptr && s.rcvr.IsNil() {
+		return nil, fmt.Errorf("rpc server: service receiver is a nil %s", s.rcvr.Type())
+	}
 	// Indirect返回v指向的值，如果v是个nil指针，Indirect返回0值，如果v不是指针，Indirect返回v本身
-	s.name = reflect.Indirect(s.rcvr).Type().Name()
+	typeName := reflect.Indirect(s.rcvr).Type().Name()
 	s.typ = reflect.TypeOf(rcvr)
 	// 通过检查抽象语法树，看对应名称的结构体是否是导出的（方法的类型是外部可见的）
-	if !ast.IsExported(s.name) {
-		log.Fatalf("rpc server: %s is not a valid service name", s.name)
+	if !ast.IsExported(typeName) {
+		return nil, fmt.Errorf("rpc server: %q is not a valid service name", typeName)
+	}
+	s.name = typeName
+	if name != "" {
+		s.name = name
 	}
 	s.registerMethods()
-	return s
+	s.describeMethods(rcvr)
+	return s, nil
 }
 
 // 注册方法，实现结构体和服务的映射
@@ -89,29 +129,65 @@ func (s *service) registerMethods() {
 	s.method = make(map[string]*methodType)
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
-		mType := method.Type
-		// 符合条件的方法需要满足
-		// 两个导出或内置类型的入参（反射时为 3 个，第 0 个是自身，类似于 python 的 self，java 中的 this）
-		// 返回值有且只有 1 个，类型为 error
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		if method.Name == "DescribeMethods" && s.typ.Implements(typeOfDescriber) {
 			continue
 		}
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		mType, reason := checkMethod(method)
+		if mType == nil {
+			s.skipped = append(s.skipped, SkippedMethod{Name: method.Name, Reason: reason})
+			logger.Debugf("rpc server: skip %s.%s: %s", s.name, method.Name, reason)
 			continue
 		}
-		argType, replyType := mType.In(1), mType.In(2)
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
-			continue
-		}
-		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
-		}
-		log.Printf("rpc server: register %s.%s", s.name, method.Name)
+		s.method[method.Name] = mType
+		logger.Debugf("rpc server: register %s.%s", s.name, method.Name)
 	}
 }
 
+// checkMethod 检查方法是否符合条件，不符合时返回违反的规则
+func checkMethod(method reflect.Method) (*methodType, string) {
+	mType := method.Type
+	// 符合条件的方法需要满足
+	// 两个导出或内置类型的入参（反射时为 3 个，第 0 个是自身，类似于 python 的 self，java 中的 this）
+	// 返回值有且只有 1 个，类型为 error
+	// 也可以在两个参数前面加一个 context.Context，用来接收请求的截止时间和元数据
+	withCtx := mType.NumIn() == 4 && mType.In(1) == typeOfContext
+	if mType.NumIn() != 3 && !withCtx {
+		return nil, fmt.Sprintf("has %d arguments, want (args, reply) or (ctx, args, reply)", mType.NumIn()-1)
+	}
+	if mType.NumOut() != 1 {
+		return nil, fmt.Sprintf("has %d return values, want exactly 1", mType.NumOut())
+	}
+	if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		return nil, fmt.Sprintf("returns %s, want error", mType.Out(0))
+	}
+	argType, replyType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
+	if !isExportedOrBuiltinType(argType) {
+		return nil, fmt.Sprintf("argument type %s is not exported", argType)
+	}
+	if replyType.Kind() != reflect.Ptr {
+		return nil, fmt.Sprintf("reply type %s is not a pointer", replyType)
+	}
+	if !isExportedOrBuiltinType(replyType) {
+		return nil, fmt.Sprintf("reply type %s is not exported", replyType)
+	}
+	return &methodType{
+		method:    method,
+		ArgType:   argType,
+		ReplyType: replyType,
+		withCtx:   withCtx,
+	}, ""
+}
+
+// report 生成服务的注册报告
+func (s *service) report() *RegisterReport {
+	r := &RegisterReport{Service: s.name, Skipped: s.skipped}
+	for name := range s.method {
+		r.Methods = append(r.Methods, name)
+	}
+	sort.Strings(r.Methods)
+	return r
+}
+
 // isExportedOrBuiltinType 判断是否导出或者内置类型
 func isExportedOrBuiltinType(t reflect.Type) bool {
 	// PkgPath返回包名，代表这个包的唯一标识符，所以可能是单一的包名  包名为空 内置类型
@@ -119,11 +195,15 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 }
 
 // call 实现通过反射值调用方法
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+func (s *service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
 	f := m.method.Func
 	// 传入参数，第一个是本身 类似Java的this，第二个是形参，第三个是响应值 最后返回函数运行结果error
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	in := []reflect.Value{s.rcvr, argv, replyv}
+	if m.withCtx {
+		in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv}
+	}
+	returnValues := f.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
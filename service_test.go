@@ -1,9 +1,25 @@
 package MyRPC
 
 import (
+	"MyRPC/codec"
+	"MyRPC/lite"
+	"MyRPC/registry"
+	"MyRPC/registry/registrytest"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type Foo int
@@ -31,20 +47,1445 @@ func _assert(condition bool, msg string, v ...interface{}) {
 
 func TestNewService(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s, err := newService(&foo)
+	_assert(err == nil, "failed to create service: %v", err)
 	_assert(len(s.method) == 1, "wrong service Method, expect 1, but got %d", len(s.method))
 	mType := s.method["Sum"]
 	_assert(mType != nil, "wrong Method, Sum shouldn't nil")
 }
 
+type unexported int
+
+func (u unexported) Sum(args Args, reply *int) error { return nil }
+
+func TestNewService_Invalid(t *testing.T) {
+	var nilFoo *Foo
+	var u unexported
+	for _, rcvr := range []interface{}{nil, nilFoo, &u} {
+		_, err := newService(rcvr)
+		_assert(err != nil, "expect an error for receiver %#v", rcvr)
+	}
+	server := NewServer()
+	_assert(server.Register(nilFoo) != nil, "expect Register to return an error instead of exiting")
+}
+
 func TestMethodType_Call(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s, _ := newService(&foo)
 	mType := s.method["Sum"]
 
 	argv := mType.newArgv()
 	replyv := mType.newReplyv()
 	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 3}))
-	err := s.call(mType, argv, replyv)
+	err := s.call(context.Background(), mType, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 4 && mType.NumCalls() == 1, "failed to call Foo.Sum")
 }
+
+func TestServer_Unregister(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_assert(server.Register(&foo) == nil, "failed to register Foo")
+	_assert(len(server.Services()) == 1 && server.Services()[0] == "Foo", "expect services [Foo], but got %v", server.Services())
+	_assert(server.Unregister("Foo") == nil, "failed to unregister Foo")
+	_assert(server.Unregister("Foo") != nil, "expect an error when unregister twice")
+	_assert(len(server.Services()) == 0, "expect no services, but got %v", server.Services())
+	_assert(server.Register(&foo) == nil, "expect Foo can be registered again")
+}
+
+func TestServer_RegisterName(t *testing.T) {
+	server := NewServer()
+	var v1, v2 Foo
+	_assert(server.RegisterName("FooV1", &v1) == nil, "failed to register FooV1")
+	_assert(server.RegisterName("FooV2", &v2) == nil, "failed to register FooV2")
+	_assert(server.RegisterName("FooV2", &v2) != nil, "expect an error when name is duplicated")
+	_assert(server.RegisterName("Foo.V3", &v2) != nil, "expect an error when name contains '.'")
+	_, mtype, err := server.findService("FooV2.Sum")
+	_assert(err == nil && mtype != nil, "failed to find FooV2.Sum")
+}
+
+func TestServer_RegisterAll(t *testing.T) {
+	server := NewServer()
+	var v1, v2 Foo
+	_assert(server.RegisterName("FooV1", &v1) == nil, "failed to register FooV1")
+	err := server.RegisterAll(map[string]interface{}{"FooV1": &v1, "FooV2": &v2, "Foo.V3": &v2})
+	errs, ok := err.(RegisterErrors)
+	_assert(ok && len(errs) == 2, "expect 2 aggregated errors, got %v", err)
+	_, _, err = server.findService("FooV2.Sum")
+	_assert(err == nil, "expect FooV2 is registered despite other failures")
+}
+
+type Bad int
+
+func (b Bad) Sum(args Args, reply *int) error { return nil }
+func (b Bad) NoReply(args Args) error         { return nil }
+func (b Bad) ValueReply(args Args, reply int) error {
+	return nil
+}
+func (b Bad) NoError(args Args, reply *int) {}
+
+func TestServer_RegisterReport(t *testing.T) {
+	server := NewServer()
+	var b Bad
+	_assert(server.Register(&b) == nil, "failed to register Bad")
+	r, err := server.RegisterReport("Bad")
+	_assert(err == nil, "failed to get report: %v", err)
+	_assert(len(r.Methods) == 1 && r.Methods[0] == "Sum", "wrong registered methods: %v", r.Methods)
+	_assert(len(r.Skipped) == 3, "expect 3 skipped methods, got %v", r.Skipped)
+	for _, m := range r.Skipped {
+		_assert(m.Reason != "", "expect a reason for %s", m.Name)
+	}
+	_, err = server.RegisterReport("Unknown")
+	_assert(err != nil, "expect an error for unknown service")
+}
+
+func TestSeqSet(t *testing.T) {
+	s := newSeqSet()
+	_assert(s.acquire(1), "expect seq 1 can be acquired")
+	_assert(!s.acquire(1), "expect duplicate seq 1 is rejected")
+	s.release(1)
+	_assert(s.acquire(1), "expect seq 1 can be reused after release")
+
+	// 开始处理之前被取消的请求 bind 返回 false，处理中被取消的请求 ctx 被取消
+	s.cancel(1)
+	_assert(!s.bind(1, func() {}), "expect seq 1 canceled before bind")
+	_assert(s.acquire(2), "expect seq 2 can be acquired")
+	ctx, cancel := context.WithCancel(context.Background())
+	_assert(s.bind(2, cancel), "expect seq 2 is bound")
+	s.cancel(2)
+	_assert(ctx.Err() != nil, "expect the ctx of seq 2 canceled")
+}
+
+func TestMetricsConfig(t *testing.T) {
+	m := newServerMetrics()
+	m.config = MetricsConfig{Deny: []string{"Foo.Debug*"}, Buckets: map[string][]float64{"Foo.Sum": {1}}, MaxMethods: 2}
+	for _, method := range []string{"Foo.Sum", "Foo.DebugDump", "Foo.Mul", "Foo.Div", "Foo.Sub"} {
+		m.observe(method, time.Millisecond, nil)
+	}
+	_assert(m.latency["Foo.DebugDump"] == nil, "expect denied method is not recorded")
+	_assert(len(m.latency["Foo.Sum"].buckets) == 1, "expect custom buckets for Foo.Sum")
+	_assert(len(m.latency) == 3 && m.latency[otherMethod].count == 2, "expect methods beyond MaxMethods are merged into other")
+}
+
+func TestWriteMetrics(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_assert(server.Register(&foo) == nil, "failed to register Foo")
+	server.metrics.observe("Foo.Sum", time.Millisecond, nil)
+	server.metrics.observe("Foo.Sum", time.Millisecond, errors.New("failed"))
+	server.metrics.observeHeartbeat(nil)
+	var buf bytes.Buffer
+	_assert(server.WriteMetrics(&buf) == nil, "failed to write metrics")
+	out := buf.String()
+	for _, line := range []string{
+		`myrpc_server_requests_total{method="Foo.Sum"} 2`,
+		`myrpc_server_errors_total{method="Foo.Sum"} 1`,
+		`myrpc_service_method_calls_total{method="Foo.Sum"} 0`,
+		`myrpc_server_open_connections 0`,
+		`myrpc_registry_heartbeats_total 1`,
+	} {
+		_assert(strings.Contains(out, line), "expect %q in metrics", line)
+	}
+}
+
+func TestServer_AcceptWorkers(t *testing.T) {
+	server := NewServer()
+	server.SetAcceptWorkers(4)
+	var foo Foo
+	_assert(server.Register(&foo) == nil, "failed to register Foo")
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	accepting := make(chan struct{})
+	go func() {
+		server.Accept(l)
+		close(accepting)
+	}()
+
+	for i := 0; i < 8; i++ {
+		client, err := Dial("tcp", l.Addr().String())
+		_assert(err == nil, "failed to dial: %v", err)
+		var reply int
+		_assert(client.Call(context.Background(), "Foo.Sum", Args{i, i}, &reply) == nil && reply == 2*i, "failed to call Foo.Sum")
+		_ = client.Close()
+	}
+	raw, err := net.Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = raw.Close() }()
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&server.metrics.accept.handshaking) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var buf bytes.Buffer
+	_assert(server.WriteMetrics(&buf) == nil, "failed to write metrics")
+	for _, line := range []string{
+		`myrpc_server_accepted_connections_total 9`,
+		`myrpc_server_accept_errors_total 0`,
+		`myrpc_server_handshaking_connections 1`,
+		`myrpc_server_accept_workers 4`,
+	} {
+		_assert(strings.Contains(buf.String(), line), "expect %q in metrics", line)
+	}
+
+	_ = l.Close()
+	select {
+	case <-accepting:
+	case <-time.After(time.Second):
+		t.Fatal("expect Accept to return after the listener is closed")
+	}
+}
+
+func TestServer_MethodCache(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_assert(server.Register(&foo) == nil, "failed to register Foo")
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	for _, ct := range []codec.Type{codec.GobType, codec.CompactType} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: ct})
+		_assert(err == nil, "failed to dial: %v", err)
+		call := func() error {
+			var reply int
+			return client.Call(context.Background(), "Foo.Sum", Args{1, 2}, &reply)
+		}
+		_assert(call() == nil && call() == nil, "failed to call Foo.Sum with %s", ct)
+		_assert(server.Unregister("Foo") == nil, "failed to unregister Foo")
+		err = call()
+		_assert(err != nil && strings.Contains(err.Error(), "can't find service"), "expect cached method dropped after unregister with %s, got %v", ct, err)
+		_assert(server.Register(&foo) == nil, "failed to register Foo again")
+		_assert(call() == nil, "failed to call Foo.Sum after registering again with %s", ct)
+		_ = client.Close()
+	}
+}
+
+func TestServer_MetadataLimits(t *testing.T) {
+	server := NewServer()
+	server.SetMetadataLimits(codec.MetadataLimits{MaxPairs: 2, MaxBytes: 16})
+	var e Echo
+	_assert(server.Register(&e) == nil, "failed to register Echo")
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	small := WithMetadata(ctx, Metadata{"trace": "abc"})
+	for _, md := range []Metadata{{"a": "1", "b": "2", "c": "3"}, {"trace": strings.Repeat("x", 16)}} {
+		large := WithMetadata(ctx, md)
+		client, err := Dial("tcp", l.Addr().String())
+		_assert(err == nil, "failed to dial: %v", err)
+		var reply string
+		err = client.Call(large, "Echo.Metadata", "trace", &reply)
+		_assert(err != nil && strings.Contains(err.Error(), codec.ErrMetadataTooLarge.Error()), "expect metadata too large, got %v", err)
+		err = client.Call(small, "Echo.Metadata", "trace", &reply)
+		_assert(err == nil && reply == "abc", "expect the connection usable after a rejected request, got %q, %v", reply, err)
+		_ = client.Close()
+
+		// CompactType 在解码时拒绝，连接被关闭
+		client, err = Dial("tcp", l.Addr().String(), &Option{CodecType: codec.CompactType})
+		_assert(err == nil, "failed to dial: %v", err)
+		_assert(client.Call(large, "Echo.Metadata", "trace", &reply) != nil, "expect compact request with large metadata rejected")
+		_ = client.Close()
+	}
+}
+
+func BenchmarkServer_FindService(b *testing.B) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	h := &codec.Header{ServiceMethod: "Foo.Sum"}
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _, _ = server.findService(h.ServiceMethod)
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		cache := new(methodCache)
+		for i := 0; i < b.N; i++ {
+			_, _, _ = server.findMethod(h, cache)
+		}
+	})
+}
+
+func TestWorkerPool(t *testing.T) {
+	server := NewServer()
+	server.SetMaxConcurrency(1, 1)
+	block := make(chan struct{})
+	_assert(server.pool.submit(func() { <-block }) == nil, "expect the first task runs")
+	_assert(server.pool.submit(func() {}) == nil, "expect the second task is queued")
+	_assert(server.pool.submit(func() {}) == ErrServerBusy, "expect the third task is rejected")
+	close(block)
+}
+
+func TestServer_MethodConcurrency(t *testing.T) {
+	server := NewServer()
+	h := &Hold{release: make(chan struct{})}
+	var foo Foo
+	_ = server.Register(h)
+	_ = server.Register(&foo)
+	_assert(server.SetMethodConcurrency("Hold", 1) != nil, "expect an ill-formed method rejected")
+	_assert(server.SetMethodConcurrency("Hold.Wait", 1) == nil, "failed to limit Hold.Wait")
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	first := client.Go("Hold.Wait", 0, new(int), nil)
+	for atomic.LoadInt32(&h.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	var reply int
+	err = client.Call(context.Background(), "Hold.Wait", 0, &reply)
+	_assert(errors.Is(err, ErrMethodBusy) && Code(err) == CodeResourceExhausted, "expect ErrMethodBusy, got %v", err)
+	// 其他方法不受影响
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect Foo.Sum served, got %d, %v", reply, err)
+
+	close(h.release)
+	_assert((<-first.Done).Error == nil, "expect the first call to succeed")
+	err = client.Call(context.Background(), "Hold.Wait", 0, &reply)
+	_assert(err == nil, "expect Hold.Wait served after the slot is freed, got %v", err)
+}
+
+func TestServer_ConcurrencyAfterTimeout(t *testing.T) {
+	server := NewServer()
+	h := &Hold{release: make(chan struct{})}
+	_ = server.Register(h)
+	_assert(server.SetMethodConcurrency("Hold.Wait", 1) == nil, "failed to limit Hold.Wait")
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String(), &Option{HandleTimeout: 50 * time.Millisecond})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Hold.Wait", 0, &reply)
+	_assert(Code(err) == CodeDeadlineExceeded, "expect the first call to time out, got %v", err)
+	// 超时的服务方法还在执行，仍然占着名额
+	err = client.Call(context.Background(), "Hold.Wait", 0, &reply)
+	_assert(errors.Is(err, ErrMethodBusy), "expect ErrMethodBusy while the timed-out handler runs, got %v", err)
+
+	close(h.release)
+	for i := 0; ; i++ {
+		err = client.Call(context.Background(), "Hold.Wait", 0, &reply)
+		if err == nil || i == 100 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_assert(err == nil, "expect Hold.Wait served after the handler returns, got %v", err)
+}
+
+func TestDebugHTTP_JSON(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_assert(server.Register(&foo) == nil, "failed to register Foo")
+	w := httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath+"?format=json", nil))
+	var data debugData
+	_assert(json.NewDecoder(w.Body).Decode(&data) == nil, "failed to decode debug json")
+	_assert(len(data.Services) == 1 && data.Services[0].Name == "Foo", "wrong services: %v", data.Services)
+	_assert(len(data.Services[0].Methods) == 1 && data.Services[0].Methods[0].Name == "Sum", "wrong methods: %v", data.Services[0].Methods)
+	_assert(data.Heartbeat.Last.IsZero(), "expect no heartbeat sent")
+
+	w = httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath, nil))
+	_assert(strings.Contains(w.Body.String(), "Service Foo"), "expect html page lists Foo")
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	r := registry.New(time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	server := NewServer()
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	addr := "tcp@" + l.Addr().String()
+	server.Heartbeat(ts.URL, addr, time.Hour)
+	resp, err := http.Get(ts.URL)
+	_assert(err == nil && resp.Header.Get("X-Myrpc-Servers") == addr, "expect %s to be registered", addr)
+	etcd, ets := registrytest.StartEtcd()
+	defer ets.Close()
+	_assert(server.RegisterTo(registry.NewEtcdRegistrar([]string{ets.URL}, "", time.Minute), addr) == nil, "failed to register to etcd")
+	_assert(len(etcd.Keys()) == 1, "expect %s to be registered to etcd", addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_assert(server.Shutdown(ctx) == nil, "failed to shutdown")
+	resp, err = http.Get(ts.URL)
+	_assert(err == nil && resp.Header.Get("X-Myrpc-Servers") == "", "expect %s to be deregistered", addr)
+	_assert(len(etcd.Keys()) == 0, "expect %s to be deregistered from etcd", addr)
+	_, err = net.Dial("tcp", l.Addr().String())
+	_assert(err != nil, "expect listener to be closed")
+	_assert(server.Shutdown(ctx) == ErrServerClosed, "expect ErrServerClosed on second shutdown")
+}
+
+func TestServer_HeartbeatContext(t *testing.T) {
+	t.Parallel()
+	hang := make(chan struct{})
+	var beats int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&beats, 1) == 1 {
+			select { // 第一次心跳一直不响应
+			case <-hang:
+			case <-req.Context().Done():
+			}
+		}
+	}))
+	defer ts.Close()
+	defer close(hang)
+
+	server := NewServer()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	start := time.Now()
+	server.HeartbeatContext(ctx, ts.URL, "tcp@127.0.0.1:1", time.Hour)
+	cancel()
+	_assert(time.Since(start) < time.Second, "expect the heartbeat to give up with ctx, took %v", time.Since(start))
+	_assert(strings.Contains(server.LastHeartbeat().LastError, "deadline exceeded"), "expect the ctx error, got %+v", server.LastHeartbeat())
+
+	// ctx 结束后不再发送心跳
+	ctx, cancel = context.WithCancel(context.Background())
+	server.HeartbeatContext(ctx, ts.URL, "tcp@127.0.0.1:1", 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	n := atomic.LoadInt32(&beats)
+	_assert(n > 2, "expect periodic heartbeats, got %d", n)
+	time.Sleep(50 * time.Millisecond)
+	_assert(atomic.LoadInt32(&beats) == n, "expect heartbeats stopped after ctx is done")
+}
+
+func TestServer_ErrorBudget(t *testing.T) {
+	server := NewServer()
+	server.SetSLO(SLO{MaxErrorRate: 0.5, SlowThreshold: 100 * time.Millisecond, MaxSlowRate: 0.5, MinRequests: 4})
+	for i := 0; i < 3; i++ {
+		server.observeBudget(time.Millisecond, errors.New("failed"))
+	}
+	_assert(server.Health().Healthy, "expect healthy below MinRequests")
+	server.observeBudget(time.Millisecond, nil)
+	status := server.Health()
+	_assert(!status.Healthy && status.Requests == 4 && status.ErrorRate == 0.75 && strings.Contains(status.Reason, "error rate"), "expect error budget exceeded, got %+v", status)
+
+	server = NewServer()
+	server.SetSLO(SLO{SlowThreshold: 10 * time.Millisecond, MaxSlowRate: 0.2, MinRequests: 2})
+	server.observeBudget(time.Second, nil)
+	server.observeBudget(time.Millisecond, nil)
+	status = server.Health()
+	_assert(!status.Healthy && status.SlowRate == 0.5 && strings.Contains(status.Reason, "slow"), "expect slow request budget exceeded, got %+v", status)
+}
+
+func TestServer_SelfDeregister(t *testing.T) {
+	interval := healthCheckInterval
+	healthCheckInterval = 10 * time.Millisecond
+	defer func() { healthCheckInterval = interval }()
+	r := registry.New(time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	var down int32
+	server := NewServer()
+	server.SetHealthCheck(func() error {
+		if atomic.LoadInt32(&down) == 1 {
+			return errors.New("database is down")
+		}
+		return nil
+	})
+	defer func() { _ = server.Shutdown(context.Background()) }()
+	addr := "tcp@127.0.0.1:1"
+	server.Heartbeat(ts.URL, addr, time.Hour)
+	registered := func(want bool) {
+		deadline := time.Now().Add(time.Second)
+		for {
+			resp, err := http.Get(ts.URL)
+			_assert(err == nil, "failed to get servers: %v", err)
+			if (resp.Header.Get("X-Myrpc-Servers") == addr) == want {
+				return
+			}
+			_assert(time.Now().Before(deadline), "expect registered=%v", want)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	registered(true)
+	atomic.StoreInt32(&down, 1)
+	registered(false)
+	_assert(!server.lastHealth().Healthy && server.lastHealth().Reason == "database is down", "wrong health %+v", server.lastHealth())
+	atomic.StoreInt32(&down, 0)
+	registered(true)
+}
+
+func TestDistributedLimit(t *testing.T) {
+	reg := registry.New(time.Minute)
+	var acquires int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&acquires, 1)
+		reg.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+	var limiters []*distributedLimiter
+	for i := 0; i < 2; i++ {
+		server := NewServer()
+		server.SetDistributedLimit(&DistributedLimit{
+			Registry: ts.URL,
+			Quotas:   map[string]Quota{"x": {Rate: 0.001, Burst: 5}},
+			Batch:    2,
+		})
+		limiters = append(limiters, server.limiter)
+	}
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if limiters[i%2].allow("Foo.Sum", Metadata{"tenant": "x"}) {
+			allowed++
+		}
+	}
+	_assert(allowed == 5, "expect 5 requests allowed across the cluster, got %d", allowed)
+	_assert(limiters[0].allow("Foo.Sum", Metadata{"tenant": "y"}), "expect tenant without quota to be allowed")
+	// 注册中心没有令牌后，短时间内直接拒绝，不再每个请求都去申请
+	n := atomic.LoadInt32(&acquires)
+	for i := 0; i < 10; i++ {
+		_assert(!limiters[0].allow("Foo.Sum", Metadata{"tenant": "x"}), "expect the quota exhausted")
+	}
+	_assert(atomic.LoadInt32(&acquires) == n, "expect the denial cached, got %d more acquires", atomic.LoadInt32(&acquires)-n)
+
+	// 注册中心没有响应时，超时后放行，不阻塞其他请求
+	hung := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { <-hung }))
+	defer slow.Close()
+	defer close(hung)
+	server := NewServer()
+	server.SetDistributedLimit(&DistributedLimit{
+		Registry: slow.URL,
+		Quotas:   map[string]Quota{"x": {Rate: 1}},
+		Timeout:  50 * time.Millisecond,
+	})
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_assert(server.limiter.allow("Foo.Sum", Metadata{"tenant": "x"}), "expect requests allowed when the registry hangs")
+		}()
+	}
+	wg.Wait()
+	_assert(time.Since(start) < time.Second, "expect the acquire to time out, took %v", time.Since(start))
+}
+
+func TestClient_CompressDictionary(t *testing.T) {
+	t.Parallel()
+	reg := registry.New(time.Minute)
+	ts := httptest.NewServer(reg)
+	defer ts.Close()
+	dict := []byte(`{"Num1":,"Num2":}`)
+	_assert(PublishDictionary(ts.URL, 9001, dict) == nil, "failed to publish the dictionary")
+	_assert(LoadDictionary(ts.URL, 9001) == nil, "failed to load the dictionary")
+	_assert(errors.Is(LoadDictionary(ts.URL, 9002), registry.ErrKeyNotFound), "expect an unpublished dictionary to be missing")
+
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	opt := &Option{CodecType: codec.JsonType, CompressType: codec.CompressDeflate, CompressDict: 9001, NegotiateCapabilities: true}
+	client, err := Dial("tcp", l.Addr().String(), opt)
+	_assert(err == nil, "failed to dial with a dictionary: %v", err)
+	defer func() { _ = client.Close() }()
+	caps, _ := client.Capabilities()
+	found := false
+	for _, id := range caps.Dictionaries {
+		found = found || id == 9001
+	}
+	_assert(found, "expect the server to advertise dictionary 9001, got %v", caps.Dictionaries)
+	for i := 0; i < 3; i++ {
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", Args{Num1: i, Num2: 1}, &reply)
+		_assert(err == nil && reply == i+1, "failed to call Foo.Sum with a dictionary: %v", err)
+	}
+
+	_, err = Dial("tcp", l.Addr().String(), &Option{CompressType: codec.CompressDeflate, CompressDict: 9003, HandshakeAck: true})
+	_assert(err != nil, "expect an unknown dictionary to be rejected")
+}
+
+func TestHTTPCaller_HTTP2(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	var protos sync.Map
+	handler := server.CallHandler()
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		protos.Store(req.Proto, true)
+		handler.ServeHTTP(w, req)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	for _, ct := range []codec.Type{codec.GobType, codec.JsonType} {
+		caller, err := NewHTTPCaller(ts.URL+defaultCallPath, ts.Client(), &Option{CodecType: ct})
+		_assert(err == nil, "failed to create the caller: %v", err)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var reply int
+				err := caller.Call(context.Background(), "Foo.Sum", Args{Num1: i, Num2: 1}, &reply)
+				_assert(err == nil && reply == i+1, "failed to call Foo.Sum with %s: %v", ct, err)
+			}(i)
+		}
+		wg.Wait()
+		var reply int
+		err = caller.Call(context.Background(), "Foo.Missing", Args{}, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect the server error, got %v", err)
+	}
+	_, h2 := protos.Load("HTTP/2.0")
+	_assert(h2, "expect the calls to use HTTP/2")
+}
+
+func TestServer_Authenticator(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	var remote atomic.Value
+	check := TokenAuthenticator("secret", "rotated")
+	server.SetAuthenticator(func(token, remoteAddr string) error {
+		remote.Store(remoteAddr)
+		return check(token, remoteAddr)
+	})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	for _, token := range []string{"secret", "rotated"} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{Token: token})
+		_assert(err == nil, "failed to dial: %v", err)
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "failed to call Foo.Sum with token %s: %v", token, err)
+		_ = client.Close()
+	}
+	lc, err := lite.Dial("tcp", l.Addr().String(), &lite.Options{Token: "secret", HandshakeAck: true})
+	_assert(err == nil, "failed to dial with the lite client: %v", err)
+	_ = lc.Close()
+	addr, _ := remote.Load().(string)
+	_assert(strings.HasPrefix(addr, "127.0.0.1:"), "expect the remote address, got %q", addr)
+
+	_, err = Dial("tcp", l.Addr().String(), &Option{Token: "guess", HandshakeAck: true})
+	_assert(errors.Is(err, ErrHandshakeRejected) && strings.Contains(err.Error(), "authentication failed"),
+		"expect the handshake rejected, got %v", err)
+	// 不等待确认时连接在处理请求之前被关闭
+	client, err := Dial("tcp", l.Addr().String(), &Option{})
+	_assert(err == nil, "failed to dial: %v", err)
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err != nil, "expect the call without a token to fail")
+	_ = client.Close()
+
+	ts := httptest.NewServer(server.CallHandler())
+	defer ts.Close()
+	caller, _ := NewHTTPCaller(ts.URL, nil, &Option{Token: "secret"})
+	err = caller.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call through CallHandler: %v", err)
+	caller, _ = NewHTTPCaller(ts.URL, nil)
+	err = caller.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "401"), "expect 401 without a token, got %v", err)
+}
+
+func TestServer_Authorizer(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	server.SetAuthorizer(func(ctx context.Context, serviceMethod string) error {
+		peer, ok := PeerFromContext(ctx)
+		if !ok || peer.RemoteAddr == "" {
+			return errors.New("unknown peer")
+		}
+		if serviceMethod == "Foo.Sum" && peer.Token != "admin" {
+			return errors.New("admin only")
+		}
+		return nil
+	})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	for token, allowed := range map[string]bool{"admin": true, "guest": false} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{Token: token})
+		_assert(err == nil, "failed to dial: %v", err)
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		if allowed {
+			_assert(err == nil && reply == 3, "expect %s allowed, got %v", token, err)
+		} else {
+			_assert(err != nil && strings.Contains(err.Error(), "permission denied") && strings.Contains(err.Error(), "admin only"),
+				"expect %s denied, got %v", token, err)
+		}
+		// 拒绝之后连接仍然可用
+		var names []string
+		err = client.Call(context.Background(), "_meta.ListServices", MetaArgs{}, &names)
+		_assert(err == nil && len(names) == 1, "expect _meta allowed for %s, got %v", token, err)
+		_ = client.Close()
+	}
+}
+
+func TestServer_RegistryToken(t *testing.T) {
+	t.Parallel()
+	r := registry.New(time.Minute)
+	r.SetToken("secret")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	server := NewServer()
+	server.Heartbeat(ts.URL, "tcp@127.0.0.1:1", time.Minute)
+	_assert(strings.Contains(server.LastHeartbeat().LastError, "401"), "expect the heartbeat rejected, got %+v", server.LastHeartbeat())
+
+	server = NewServer()
+	server.SetRegistryToken("secret")
+	server.Heartbeat(ts.URL, "tcp@127.0.0.1:1", time.Minute)
+	_assert(server.LastHeartbeat().LastError == "", "expect the heartbeat accepted, got %+v", server.LastHeartbeat())
+	err := server.Deregister(ts.URL, "tcp@127.0.0.1:1")
+	_assert(err == nil, "failed to deregister with the token: %v", err)
+}
+
+func TestServer_HeartbeatTask(t *testing.T) {
+	t.Parallel()
+	var hits, fail, deletes int32
+	atomic.StoreInt32(&fail, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "DELETE" {
+			atomic.AddInt32(&deletes, 1)
+			return
+		}
+		atomic.AddInt32(&hits, 1)
+		switch {
+		case req.Header.Get("Authorization") == "Bearer bad":
+			w.WriteHeader(http.StatusUnauthorized)
+		case atomic.AddInt32(&fail, -1) >= 0:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	// 暂时失败时重试，恢复后按周期发送
+	server := NewServer()
+	task := server.Heartbeat(ts.URL, "tcp@127.0.0.1:1", 50*time.Millisecond)
+	for i := 0; i < 100 && (atomic.LoadInt32(&hits) < 4 || server.LastHeartbeat().LastError != ""); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_assert(server.LastHeartbeat().LastError == "", "expect the heartbeat to recover, got %+v", server.LastHeartbeat())
+	task.Stop()
+	stopped := atomic.LoadInt32(&hits)
+	time.Sleep(150 * time.Millisecond)
+	_assert(atomic.LoadInt32(&hits) == stopped, "expect no heartbeat after Stop")
+	// 停止的地址在 Shutdown 时不再注销
+	_ = server.Shutdown(context.Background())
+	_assert(atomic.LoadInt32(&deletes) == 0, "expect no deregister after Stop, got %d", atomic.LoadInt32(&deletes))
+
+	// 注册中心拒绝时停止
+	server = NewServer()
+	server.SetRegistryToken("bad")
+	task = server.Heartbeat(ts.URL, "tcp@127.0.0.1:1", 50*time.Millisecond)
+	select {
+	case <-task.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expect the heartbeat to stop after being rejected")
+	}
+
+	// Shutdown 停止心跳并注销
+	server = NewServer()
+	task = server.Heartbeat(ts.URL, "tcp@127.0.0.1:1", 50*time.Millisecond)
+	_ = server.Shutdown(context.Background())
+	select {
+	case <-task.Done():
+	default:
+		t.Fatal("expect Shutdown to stop the heartbeat")
+	}
+	_assert(atomic.LoadInt32(&deletes) == 1, "expect Shutdown to deregister, got %d", atomic.LoadInt32(&deletes))
+
+	// 注册中心不响应时每次心跳按周期超时，之后继续重试
+	hang := make(chan struct{})
+	var hung int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hung, 1)
+		select {
+		case <-hang:
+		case <-req.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(hang)
+	server = NewServer()
+	start := time.Now()
+	task = server.Heartbeat(slow.URL, "tcp@127.0.0.1:1", 50*time.Millisecond)
+	_assert(time.Since(start) < time.Second, "expect the heartbeat to time out, took %v", time.Since(start))
+	_assert(strings.Contains(server.LastHeartbeat().LastError, "deadline exceeded"), "expect a timeout, got %+v", server.LastHeartbeat())
+	for i := 0; i < 100 && atomic.LoadInt32(&hung) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_assert(atomic.LoadInt32(&hung) >= 2, "expect the heartbeat to retry after a timeout")
+	task.Stop()
+}
+
+func TestServer_MetaService(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	_assert(server.RegisterName(MetaServiceName, &foo) != nil, "expect the meta service name to be reserved")
+	_assert(len(server.Services()) == 1, "expect _meta hidden from Services, got %v", server.Services())
+
+	client, err := NewLocalPipe(server, &Option{CodecType: codec.JsonType})
+	_assert(err == nil, "failed to create the local pipe: %v", err)
+	defer func() { _ = client.Close() }()
+	ctx := context.Background()
+
+	var names []string
+	err = client.Call(ctx, "_meta.ListServices", MetaArgs{}, &names)
+	_assert(err == nil && reflect.DeepEqual(names, []string{"Foo"}), "wrong services %v: %v", names, err)
+	err = client.Call(ctx, "_meta.ListMethods", MetaArgs{Service: "Foo"}, &names)
+	_assert(err == nil && reflect.DeepEqual(names, []string{"Sum"}), "wrong methods %v: %v", names, err)
+	err = client.Call(ctx, "_meta.ListMethods", MetaArgs{Service: "Bar"}, &names)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find service"), "expect unknown service, got %v", err)
+
+	var sig MethodSignature
+	err = client.Call(ctx, "_meta.MethodSignature", MetaArgs{Service: "Foo", Method: "Sum"}, &sig)
+	_assert(err == nil, "failed to get the signature: %v", err)
+	_assert(sig.Args.Kind == "struct" && sig.Args.Name == "MyRPC.Args" && len(sig.Args.Fields) == 2 &&
+		sig.Args.Fields[0].Name == "Num1" && sig.Args.Fields[1].Type.Kind == "int", "wrong args %+v", sig.Args)
+	_assert(sig.Reply.Kind == "int", "wrong reply %+v", sig.Reply)
+	err = client.Call(ctx, "_meta.MethodSignature", MetaArgs{Service: "Foo", Method: "sum"}, &sig)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect unknown method, got %v", err)
+
+	// 元数据服务描述自己
+	err = client.Call(ctx, "_meta.MethodSignature", MetaArgs{Service: MetaServiceName, Method: "MethodSignature"}, &sig)
+	_assert(err == nil && sig.Reply.Name == "MyRPC.MethodSignature", "failed to describe _meta: %+v %v", sig.Reply, err)
+}
+
+type metaNode struct {
+	Value    int
+	Children []*metaNode `json:"children,omitempty"`
+	skipped  int
+}
+
+func TestDescribeType_Recursive(t *testing.T) {
+	info := describeType(reflect.TypeOf(metaNode{}), map[reflect.Type]bool{})
+	_assert(len(info.Fields) == 2 && info.Fields[1].Name == "children", "wrong fields %+v", info.Fields)
+	inner := info.Fields[1].Type.Elem.Elem
+	_assert(inner.Kind == "struct" && inner.Fields == nil, "expect the recursive reference not expanded, got %+v", inner)
+}
+
+type DescribedFoo struct{ Foo }
+
+func (f *DescribedFoo) DescribeMethods() map[string]MethodDoc {
+	return map[string]MethodDoc{
+		"Sum":     {Description: "adds two numbers", Example: Args{Num1: 1, Num2: 2}, ExampleReply: 3},
+		"Missing": {Description: "dropped"},
+	}
+}
+
+func TestServer_Describer(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	err := server.RegisterName("Described", &DescribedFoo{})
+	_assert(err == nil, "failed to register: %v", err)
+	report, _ := server.RegisterReport("Described")
+	_assert(len(report.Skipped) == 0, "expect DescribeMethods not reported as skipped, got %v", report.Skipped)
+
+	var sig MethodSignature
+	err = (&MetaService{server}).MethodSignature(MetaArgs{Service: "Described", Method: "Sum"}, &sig)
+	_assert(err == nil, "failed to get the signature: %v", err)
+	_assert(sig.Description == "adds two numbers" && string(sig.Example) == `{"Num1":1,"Num2":2}` &&
+		string(sig.ExampleReply) == "3", "wrong doc %+v", sig)
+
+	rec := httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/myrpc?format=json", nil))
+	_assert(strings.Contains(rec.Body.String(), `"Description":"adds two numbers"`), "expect the doc on the debug page, got %s", rec.Body)
+}
+
+// Timing 用于检查服务端在各种结束方式下的回复
+type Timing int
+
+func (t Timing) Fast(args int, reply *int) error {
+	*reply = args
+	return nil
+}
+
+func (t Timing) Fail(args int, reply *int) error {
+	return errors.New("fail")
+}
+
+func (t Timing) Panic(args int, reply *int) error {
+	panic("boom")
+}
+
+// Sleep 睡眠 args 毫秒
+func (t Timing) Sleep(args int, reply *int) error {
+	time.Sleep(time.Duration(args) * time.Millisecond)
+	return nil
+}
+
+// scriptedCodec 依次返回预先准备的请求，之后返回 io.EOF，并记录服务端写出的响应头
+type scriptedCodec struct {
+	mu    sync.Mutex
+	reqs  []*codec.Header
+	args  []int
+	arg   int
+	resps []codec.Header
+}
+
+func (c *scriptedCodec) ReadHeader(h *codec.Header) error {
+	if len(c.reqs) == 0 {
+		return io.EOF
+	}
+	*h, c.arg = *c.reqs[0], c.args[0]
+	c.reqs, c.args = c.reqs[1:], c.args[1:]
+	return nil
+}
+
+func (c *scriptedCodec) ReadBody(body interface{}) error {
+	if body != nil {
+		reflect.ValueOf(body).Elem().Set(reflect.ValueOf(c.arg))
+	}
+	return nil
+}
+
+func (c *scriptedCodec) Write(h *codec.Header, body interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resps = append(c.resps, *h)
+	return nil
+}
+
+func (c *scriptedCodec) Close() error { return nil }
+
+// responses 返回每个seq收到的响应头
+func (c *scriptedCodec) responses() map[uint64][]codec.Header {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[uint64][]codec.Header)
+	for _, h := range c.resps {
+		m[h.Seq] = append(m[h.Seq], h)
+	}
+	return m
+}
+
+func TestServer_StrictMode(t *testing.T) {
+	t.Parallel()
+	for _, mode := range []StrictMode{StrictOff, StrictLog, StrictClose} {
+		server := NewServer()
+		server.SetStrictMode(mode)
+		var foo Foo
+		_ = server.Register(&foo)
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		go server.Accept(l)
+		conn, err := net.Dial("tcp", l.Addr().String())
+		_assert(err == nil, "failed to dial: %v", err)
+		// 老的 Json 握手之后直接收发消息，seq 为0的请求是协议异常，正常的客户端不会发出
+		_ = json.NewEncoder(conn).Encode(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType})
+		cc := codec.NewGobCodec(conn)
+		err = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 0}, Args{Num1: 1, Num2: 2})
+		_assert(err == nil, "failed to write the bad frame: %v", err)
+
+		var reply int
+		err = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, Args{Num1: 1, Num2: 2})
+		// 跳过 seq 为0的请求的响应
+		for h := (codec.Header{}); err == nil && h.Seq != 1; {
+			if err = cc.ReadHeader(&h); err == nil && h.Seq == 1 {
+				err = cc.ReadBody(&reply)
+			} else if err == nil {
+				err = cc.ReadBody(nil)
+			}
+		}
+		switch mode {
+		case StrictClose:
+			_assert(err != nil, "expect the connection closed by the server")
+			for i := 0; i < 100 && len(server.Conns()) > 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			_assert(len(server.Conns()) == 0, "expect the connection dropped, got %+v", server.Conns())
+		default:
+			_assert(err == nil && reply == 3, "mode %d: expect the connection kept, got %v", mode, err)
+			conns := server.Conns()
+			want := map[StrictMode]uint64{StrictOff: 0, StrictLog: 1}[mode]
+			_assert(len(conns) == 1 && conns[0].Stats.ProtocolErrors == want, "mode %d: expect %d protocol errors, got %+v", mode, want, conns)
+		}
+		_ = cc.Close()
+		_ = l.Close()
+	}
+}
+
+func TestServer_HandleRequestRespondsOnce(t *testing.T) {
+	server := NewServer()
+	var timing Timing
+	_ = server.Register(&timing)
+	serve := func(timeout time.Duration, methods []string, args []int) *scriptedCodec {
+		cc := &scriptedCodec{args: args}
+		for i, m := range methods {
+			cc.reqs = append(cc.reqs, &codec.Header{ServiceMethod: "Timing." + m, Seq: uint64(i + 1)})
+		}
+		done := make(chan struct{})
+		go func() {
+			server.serverCodec(cc, &Option{HandleTimeout: timeout}, &connInfo{active: newSeqSet(), ctx: context.Background()})
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("serverCodec doesn't return with HandleTimeout %v", timeout)
+		}
+		return cc
+	}
+
+	// 不论是否设置处理超时，成功和失败的请求都只回复一次，失败的请求不会让连接卡住
+	for _, timeout := range []time.Duration{0, time.Second} {
+		cc := serve(timeout, []string{"Fast", "Fail"}, []int{1, 0})
+		resps := cc.responses()
+		_assert(len(resps[1]) == 1 && resps[1][0].Error == "", "expect one reply for Fast, got %+v", resps[1])
+		_assert(len(resps[2]) == 1 && resps[2][0].Error == "fail", "expect one error for Fail, got %+v", resps[2])
+	}
+
+	// 服务方法 panic 时返回错误
+	cc := serve(0, []string{"Panic", "Fast"}, []int{0, 2})
+	resps := cc.responses()
+	_assert(len(resps[1]) == 1 && strings.Contains(resps[1][0].Error, "panic: boom"), "expect a panic error, got %+v", resps[1])
+	_assert(len(resps[2]) == 1 && resps[2][0].Error == "", "expect the next request served, got %+v", resps[2])
+
+	// 超时之后服务方法的结果被丢弃
+	cc = serve(20*time.Millisecond, []string{"Sleep"}, []int{100})
+	time.Sleep(150 * time.Millisecond)
+	resps = cc.responses()
+	_assert(len(resps[1]) == 1 && strings.Contains(resps[1][0].Error, "handle timeout"), "expect one timeout reply, got %+v", resps[1])
+}
+
+func TestServer_ConnClosedReapsHandlers(t *testing.T) {
+	server := NewServer()
+	b := &Blocker{started: make(chan struct{}, 1), canceled: make(chan error, 1)}
+	_ = server.Register(b)
+	var timing Timing
+	_ = server.Register(&timing)
+	// 读完请求就返回 io.EOF，相当于客户端断开了连接
+	cc := &scriptedCodec{
+		reqs: []*codec.Header{{ServiceMethod: "Blocker.Block", Seq: 1}, {ServiceMethod: "Timing.Sleep", Seq: 2}},
+		args: []int{0, 5000},
+	}
+	ci := &connInfo{active: newSeqSet()}
+	ci.ctx, ci.cancel = context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.serverCodec(cc, &Option{}, ci)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expect serverCodec to return after the connection is closed")
+	}
+	select {
+	case err := <-b.canceled:
+		_assert(errors.Is(err, context.Canceled), "expect the handler ctx canceled, got %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expect the handler ctx canceled after the connection is closed")
+	}
+}
+
+// Coded 返回带错误码的错误
+type Coded int
+
+func (c Coded) Find(args int, reply *int) error {
+	return Errorf(CodeNotFound, "user %d not found", args).WithDetails(map[string]string{"user": fmt.Sprint(args)})
+}
+
+func (c Coded) Plain(args int, reply *int) error {
+	return errors.New("plain")
+}
+
+func (c Coded) Busy(args int, reply *int) error {
+	return ErrServerBusy
+}
+
+func TestErrorCodes(t *testing.T) {
+	server := NewServer()
+	var c Coded
+	_ = server.Register(&c)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	for _, ct := range []codec.Type{codec.GobType, codec.JsonType, codec.CompactType} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: ct})
+		_assert(err == nil, "failed to dial with %s: %v", ct, err)
+		ctx := context.Background()
+		err = client.Call(ctx, "Coded.Find", 7, new(int))
+		var e *Error
+		_assert(Code(err) == CodeNotFound && err.Error() == "user 7 not found", "%s: expect NotFound, got %v %v", ct, Code(err), err)
+		_assert(errors.As(err, &e) && e.Details["user"] == "7", "%s: expect details, got %+v", ct, e)
+		err = client.Call(ctx, "Coded.Plain", 0, new(int))
+		_assert(Code(err) == CodeUnknown && err.Error() == "plain", "%s: expect Unknown, got %v %v", ct, Code(err), err)
+		err = client.Call(ctx, "Coded.Missing", 0, new(int))
+		_assert(Code(err) == CodeNotFound, "%s: expect NotFound for a missing method, got %v", ct, Code(err))
+		_ = client.Close()
+	}
+
+	// 老的握手没有 flagErrorCodes，紧凑头部不带错误码，连接上之后的响应仍然能正确解析
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.CompactType, LegacyHandshake: true})
+	_assert(err == nil, "failed to dial: %v", err)
+	err = client.Call(context.Background(), "Coded.Find", 7, new(int))
+	_assert(Code(err) == CodeUnknown && err.Error() == "user 7 not found", "expect no code for a legacy client, got %v %v", Code(err), err)
+	err = client.Call(context.Background(), "Coded.Plain", 0, new(int))
+	_assert(err != nil && err.Error() == "plain", "expect the stream in sync, got %v", err)
+	_ = client.Close()
+
+	// 客户端收到的错误可以和服务端的哨兵错误比较，本地错误也有错误码
+	client, err = Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	err = client.Call(context.Background(), "Coded.Busy", 0, new(int))
+	_assert(errors.Is(err, ErrServerBusy) && Code(err) == CodeUnavailable, "expect ErrServerBusy to survive the wire, got %v", err)
+	_ = client.Close()
+	var h codec.Header
+	setError(&h, fmt.Errorf("%w: duplicate seq 1", errProtocol))
+	_assert(h.Code == uint32(CodeInvalidArgument) && h.Error == "rpc: protocol violation: duplicate seq 1", "unexpected header %+v", h)
+	_assert(Code(nil) == CodeOK && Code(ErrShutdown) == CodeUnavailable, "unexpected local codes")
+	_assert(Code(fmt.Errorf("rpc client: call failed: %w", context.DeadlineExceeded)) == CodeDeadlineExceeded, "expect DeadlineExceeded")
+	_assert(CodeNotFound.String() == "NotFound" && ErrorCode(99).String() == "Code(99)", "unexpected code names")
+}
+
+// BalanceError 注册过的业务错误
+type BalanceError struct {
+	Balance int
+}
+
+func (e *BalanceError) Error() string     { return fmt.Sprintf("insufficient balance %d", e.Balance) }
+func (e *BalanceError) ErrorType() string { return "test.BalanceError" }
+
+// LimitError 值类型的业务错误
+type LimitError struct {
+	Limit int
+}
+
+func (e LimitError) Error() string     { return fmt.Sprintf("over limit %d", e.Limit) }
+func (e LimitError) ErrorType() string { return "test.LimitError" }
+
+// unknownError 没有注册的业务错误
+type unknownError struct {
+	N int
+}
+
+func (e *unknownError) Error() string     { return "unknown" }
+func (e *unknownError) ErrorType() string { return "test.unknownError" }
+
+func init() {
+	RegisterErrorType(&BalanceError{})
+	RegisterErrorType(LimitError{})
+}
+
+type Bank int
+
+func (b Bank) Pay(args int, reply *int) error {
+	switch args {
+	case 1:
+		return fmt.Errorf("pay failed: %w", &BalanceError{Balance: 42})
+	case 2:
+		return LimitError{Limit: 100}
+	}
+	return &unknownError{N: 1}
+}
+
+func TestTypedErrors(t *testing.T) {
+	server := NewServer()
+	var b Bank
+	_ = server.Register(&b)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	for _, ct := range []codec.Type{codec.GobType, codec.JsonType, codec.CompactType} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: ct})
+		_assert(err == nil, "failed to dial with %s: %v", ct, err)
+		ctx := context.Background()
+		err = client.Call(ctx, "Bank.Pay", 1, new(int))
+		var be *BalanceError
+		_assert(errors.As(err, &be) && be.Balance == 42, "%s: expect *BalanceError, got %#v", ct, err)
+		_assert(err.Error() == "pay failed: insufficient balance 42" && Code(err) == CodeUnknown, "%s: unexpected error %v", ct, err)
+		var e *Error
+		_assert(errors.As(err, &e) && e.Details == nil, "%s: expect the type name removed from details, got %v", ct, e.Details)
+
+		err = client.Call(ctx, "Bank.Pay", 2, new(int))
+		var le LimitError
+		_assert(errors.As(err, &le) && le.Limit == 100, "%s: expect LimitError, got %#v", ct, err)
+
+		// 没有注册的类型只有错误信息，连接仍然可用
+		err = client.Call(ctx, "Bank.Pay", 3, new(int))
+		var ue *unknownError
+		_assert(err != nil && err.Error() == "unknown" && !errors.As(err, &ue), "%s: expect a plain error, got %#v", ct, err)
+		err = client.Call(ctx, "Bank.Pay", 1, new(int))
+		_assert(errors.As(err, &be), "%s: expect the connection still works, got %v", ct, err)
+		_ = client.Close()
+	}
+}
+
+func TestServer_SlowLog(t *testing.T) {
+	server := NewServer()
+	var timing Timing
+	_ = server.Register(&timing)
+	server.SetSlowLog(&SlowLogOptions{Threshold: 20 * time.Millisecond, Keep: 2})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	for _, ms := range []int{30, 0, 40, 50} {
+		_ = client.Call(context.Background(), "Timing.Sleep", ms, &reply)
+	}
+	calls := server.SlowCalls()
+	_assert(len(calls) == 2, "expect the latest 2 slow calls, got %+v", calls)
+	_assert(calls[0].Args == "50" && calls[1].Args == "40", "expect the newest first, got %+v", calls)
+	_assert(calls[0].ServiceMethod == "Timing.Sleep" && calls[0].Duration >= 50*time.Millisecond, "wrong slow call %+v", calls[0])
+	_assert(calls[0].RemoteAddr != "", "expect the peer address recorded")
+
+	w := httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath+"?format=json", nil))
+	var data debugData
+	_assert(json.NewDecoder(w.Body).Decode(&data) == nil, "failed to decode debug json")
+	_assert(len(data.SlowCalls) == 2, "expect slow calls on the debug page, got %+v", data.SlowCalls)
+
+	// 参数摘要超过上限时截断
+	req := &request{argv: reflect.ValueOf(strings.Repeat("x", 100))}
+	s := summarizeArgs(req, 10)
+	_assert(s == `"xxxxxxxxx...(102 bytes)`, "expect a truncated summary, got %s", s)
+}
+
+// spanRecorder 记录上报的 Span
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *spanRecorder) Report(span *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+// take 取出已经上报的 Span 并清空
+func (r *spanRecorder) take() []*Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spans := r.spans
+	r.spans = nil
+	return spans
+}
+
+func TestServer_Tracer(t *testing.T) {
+	server := NewServer()
+	var timing Timing
+	_ = server.Register(&timing)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	call := func(serviceMethod string, n int) {
+		for i := 0; i < n; i++ {
+			var reply int
+			_ = client.Call(context.Background(), serviceMethod, i, &reply)
+		}
+	}
+
+	tracer := new(spanRecorder)
+	// 服务端在回复之前上报，调用返回时 Span 已经记录下来
+	server.SetTracer(tracer, nil)
+	call("Timing.Fast", 3)
+	spans := tracer.take()
+	_assert(len(spans) == 3, "expect every request traced without a sampler, got %d", len(spans))
+	_assert(spans[0].ServiceMethod == "Timing.Fast" && spans[0].Sampled && spans[0].RemoteAddr != "", "wrong span %+v", spans[0])
+
+	server.SetTracer(tracer, &Sampler{Ratio: 0})
+	call("Timing.Fast", 3)
+	call("Timing.Fail", 3)
+	_assert(len(tracer.take()) == 0, "expect nothing traced with ratio 0")
+
+	server.SetTracer(tracer, &Sampler{Ratio: 1})
+	call("Timing.Fast", 3)
+	_assert(len(tracer.take()) == 3, "expect every request traced with ratio 1")
+
+	// 按方法配置的采样率优先于默认采样率
+	server.SetTracer(tracer, &Sampler{Ratio: 0, Methods: map[string]float64{"Timing.Fail": 1}})
+	call("Timing.Fast", 3)
+	call("Timing.Fail", 2)
+	spans = tracer.take()
+	_assert(len(spans) == 2 && spans[0].ServiceMethod == "Timing.Fail" && spans[0].Error == "fail", "expect only Timing.Fail traced, got %+v", spans)
+	server.SetTracer(tracer, &Sampler{Ratio: 1, Methods: map[string]float64{"Timing.Fast": 0}})
+	call("Timing.Fast", 3)
+	_assert(len(tracer.take()) == 0, "expect the method ratio to turn tracing off")
+
+	// 未被采样的请求只有出错时才上报
+	server.SetTracer(tracer, &Sampler{Ratio: 0, AlwaysOnError: true})
+	call("Timing.Fast", 3)
+	call("Timing.Fail", 2)
+	spans = tracer.take()
+	_assert(len(spans) == 2, "expect only the failed requests traced, got %d", len(spans))
+	for _, span := range spans {
+		_assert(span.ServiceMethod == "Timing.Fail" && !span.Sampled && span.Error == "fail", "expect an unsampled error span, got %+v", span)
+	}
+}
+
+func TestServer_MethodStats(t *testing.T) {
+	server := NewServer()
+	var timing Timing
+	_ = server.Register(&timing)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	for _, call := range []struct {
+		method string
+		args   int
+	}{{"Fast", 1}, {"Fast", 2}, {"Fail", 0}, {"Panic", 0}, {"Sleep", 20}} {
+		_ = client.Call(context.Background(), "Timing."+call.method, call.args, &reply)
+	}
+	stats := make(map[string]MethodStats)
+	for _, st := range server.Stats().Methods {
+		stats[st.Method] = st
+	}
+	_assert(stats["Timing.Fast"].Calls == 2 && stats["Timing.Fast"].Errors == 0, "wrong Fast stats %+v", stats["Timing.Fast"])
+	_assert(stats["Timing.Fail"].Errors == 1, "expect Fail counted as an error, got %+v", stats["Timing.Fail"])
+	_assert(stats["Timing.Panic"].Errors == 1 && stats["Timing.Panic"].Inflight == 0, "expect a panic counted and finished, got %+v", stats["Timing.Panic"])
+	_assert(stats["Timing.Sleep"].P99 >= 20*time.Millisecond, "expect the Sleep latency recorded, got %+v", stats["Timing.Sleep"])
+
+	var buf bytes.Buffer
+	_assert(server.WriteMetrics(&buf) == nil, "failed to write metrics")
+	_assert(strings.Contains(buf.String(), `myrpc_service_method_errors_total{method="Timing.Fail"} 1`), "expect method errors exported:\n%s", buf.String())
+
+	// 分位数按最近的耗时计算
+	samples := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	_assert(percentile(samples, 0.5) == 5 && percentile(samples, 0.9) == 9 && percentile(samples, 0.99) == 10, "wrong percentiles")
+}
+
+func TestServer_Conns(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	client, err := NewClient(conn, &Option{MagicNumber: MagicNumber, CodecType: codec.JsonType})
+	_assert(err == nil, "failed to create the client: %v", err)
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum: %v", err)
+
+	conns := server.Conns()
+	_assert(len(conns) == 1, "expect one connection, got %+v", conns)
+	ci := conns[0]
+	_assert(ci.RemoteAddr == conn.LocalAddr().String(), "expect remote addr %s, got %s", conn.LocalAddr(), ci.RemoteAddr)
+	_assert(ci.CodecType == codec.JsonType && !ci.Since.IsZero() && ci.Pending == 0, "wrong connection info %+v", ci)
+	_assert(ci.Stats.FramesRead >= 2 && ci.Stats.FramesWritten >= 1 && ci.Stats.BytesRead > 0, "expect the server codec stats, got %+v", ci.Stats)
+	stats := client.Stats()
+	_assert(stats.FramesWritten >= 1 && stats.FramesRead >= 2 && stats.BytesWritten > 0, "expect the client codec stats, got %+v", stats)
+
+	_ = client.Close()
+	for i := 0; i < 100 && len(server.Conns()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_assert(len(server.Conns()) == 0, "expect the closed connection removed, got %+v", server.Conns())
+}
+
+func TestServer_Tune(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	var s Slow
+	_ = server.Register(&foo)
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	tune := func(method, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, defaultTunePath, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		tuneHTTP{server}.ServeHTTP(w, req)
+		return w
+	}
+
+	// 没有设置令牌时接口不可用，令牌不对时拒绝
+	_assert(tune("GET", "", "").Code == http.StatusForbidden, "expect forbidden without an admin token")
+	server.SetAdminToken("secret")
+	_assert(tune("GET", "", "").Code == http.StatusForbidden, "expect forbidden without Authorization")
+	_assert(tune("GET", "wrong", "").Code == http.StatusForbidden, "expect forbidden with a wrong token")
+	_assert(tune("PUT", "secret", "").Code == http.StatusMethodNotAllowed, "expect PUT not allowed")
+	_assert(tune("POST", "secret", "{").Code == http.StatusBadRequest, "expect bad request for an invalid body")
+	_assert(tune("POST", "secret", `{"LogLevel":"nope"}`).Code == http.StatusBadRequest, "expect bad request for an unknown log level")
+
+	w := tune("GET", "secret", "")
+	var stats ServerStats
+	_assert(w.Code == http.StatusOK && json.NewDecoder(w.Body).Decode(&stats) == nil, "failed to get stats: %d %s", w.Code, w.Body)
+	_assert(stats.Tuning == Tuning{}, "expect no tuning, got %+v", stats.Tuning)
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	// 运行时修改 HandleTimeout，不需要重新连接
+	w = tune("POST", "secret", fmt.Sprintf(`{"HandleTimeout":%d}`, 50*time.Millisecond))
+	_assert(w.Code == http.StatusOK && json.NewDecoder(w.Body).Decode(&stats) == nil, "failed to tune: %d %s", w.Code, w.Body)
+	_assert(stats.Tuning.HandleTimeout == 50*time.Millisecond, "expect HandleTimeout tuned, got %+v", stats.Tuning)
+	var reply int
+	err = client.Call(context.Background(), "Slow.Wait", 500*time.Millisecond, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect handle timeout, got %v", err)
+	// 超时的服务方法返回后才不再计入 Inflight
+	for i := 0; i < 200 && server.Stats().Inflight != 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	_assert(server.Stats().Inflight == 0, "expect the timed-out handler finished, got %+v", server.Stats())
+
+	// POST 只覆盖请求体中的字段，其余保持当前值
+	w = tune("POST", "secret", `{"MaxInflight":1}`)
+	_assert(w.Code == http.StatusOK && json.NewDecoder(w.Body).Decode(&stats) == nil, "failed to tune: %d %s", w.Code, w.Body)
+	_assert(stats.Tuning.MaxInflight == 1 && stats.Tuning.HandleTimeout == 50*time.Millisecond, "expect MaxInflight merged, got %+v", stats.Tuning)
+	w = tune("POST", "secret", `{"HandleTimeout":0}`)
+	_assert(w.Code == http.StatusOK, "failed to clear HandleTimeout: %d %s", w.Code, w.Body)
+
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- client.Call(context.Background(), "Slow.Wait", 200*time.Millisecond, &reply)
+	}()
+	for i := 0; i < 100 && server.Stats().Inflight == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(errors.Is(err, ErrServerBusy), "expect server busy over MaxInflight, got %v", err)
+	_assert(<-done == nil, "expect the in-flight call finished")
+	_assert(server.Stats().Rejected == 1, "expect one rejected request, got %+v", server.Stats())
+
+	// 恢复后重新接受请求
+	_assert(server.Tune(Tuning{}) == nil, "failed to reset tuning")
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum after reset: %v", err)
+}
@@ -0,0 +1,173 @@
+package MyRPC
+
+import (
+	"MyRPC/logger"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+//
+// 优雅关闭
+// 服务端停止时先向注册中心注销，客户端下一次刷新服务列表时就不会再选到它，
+// 而不是等注册中心的过期时间（默认5分钟）到了才消失；然后停止接受新连接，等正在处理的请求完成
+//
+
+// ErrServerClosed 服务端已经关闭
+var ErrServerClosed = errors.New("rpc server: server closed")
+
+// registration 一次向注册中心的注册
+type registration struct {
+	registry string
+	addr     string
+}
+
+// Registrar 注册中心之外的服务注册方式，比如 registry.EtcdRegistrar，注册之后由实现自己维持（续约、心跳）
+type Registrar interface {
+	Register(addr string) error
+	Deregister(addr string) error
+}
+
+// contextRegistrar 注销时支持 ctx 的 Registrar，Shutdown 用它把 ctx 传给注销请求
+type contextRegistrar interface {
+	DeregisterContext(ctx context.Context, addr string) error
+}
+
+type registrarEntry struct {
+	r    Registrar
+	addr string
+}
+
+// RegisterTo 通过 r 注册 addr，服务端关闭时自动注销
+func (server *Server) RegisterTo(r Registrar, addr string) error {
+	if err := r.Register(addr); err != nil {
+		return err
+	}
+	server.mu.Lock()
+	server.registrars = append(server.registrars, registrarEntry{r, addr})
+	server.mu.Unlock()
+	return nil
+}
+
+// shutdownPollInterval 等待请求处理完成时的检查间隔
+const shutdownPollInterval = 10 * time.Millisecond
+
+func (server *Server) trackListener(lis net.Listener) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	select {
+	case <-server.done:
+		return false
+	default:
+	}
+	server.listeners[lis] = struct{}{}
+	return true
+}
+
+func (server *Server) untrackListener(lis net.Listener) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	delete(server.listeners, lis)
+}
+
+// Deregister 从注册中心注销 addr，之后不再向该注册中心发送 addr 的心跳
+func (server *Server) Deregister(registry, addr string) error {
+	return server.DeregisterContext(context.Background(), registry, addr)
+}
+
+// DeregisterContext 和 Deregister 相同，ctx 结束时放弃注销请求
+func (server *Server) DeregisterContext(ctx context.Context, registry, addr string) error {
+	server.mu.Lock()
+	task := server.registrations[registration{registry, addr}]
+	delete(server.registrations, registration{registry, addr})
+	server.mu.Unlock()
+	// 先停止心跳，避免正在发送的心跳在注销之后又把地址注册回去
+	if task != nil {
+		task.cancel()
+		select {
+		case <-task.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return server.deregister(ctx, registry, addr)
+}
+
+// deregister 向注册中心发送注销请求，和心跳一样最多等待 maxHeartbeatTimeout
+func (server *Server) deregister(ctx context.Context, registry, addr string) error {
+	logger.Debugf("%s deregister from registry %s", addr, registry)
+	ctx, cancel := context.WithTimeout(ctx, maxHeartbeatTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "DELETE", registry, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Myrpc-Server", addr)
+	server.setRegistryToken(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("rpc server: deregister failed: " + resp.Status)
+	}
+	return nil
+}
+
+// Shutdown 优雅关闭服务端：停止心跳并从所有注册中心注销，关闭所有监听器，
+// 然后等待正在处理的请求完成，ctx 结束时返回 ctx 的错误
+func (server *Server) Shutdown(ctx context.Context) error {
+	first := false
+	server.shutdownOnce.Do(func() {
+		first = true
+		server.mu.Lock()
+		close(server.done)
+		server.mu.Unlock()
+	})
+	if !first {
+		return ErrServerClosed
+	}
+
+	server.mu.Lock()
+	regs := make([]registration, 0, len(server.registrations))
+	for r := range server.registrations {
+		regs = append(regs, r)
+	}
+	registrars := server.registrars
+	server.registrars = nil
+	for lis := range server.listeners {
+		_ = lis.Close()
+	}
+	server.mu.Unlock()
+	for _, r := range regs {
+		if err := server.DeregisterContext(ctx, r.registry, r.addr); err != nil {
+			logger.Warnf("rpc server: deregister %s from %s error: %v", r.addr, r.registry, err)
+		}
+	}
+	for _, e := range registrars {
+		var err error
+		if cr, ok := e.r.(contextRegistrar); ok {
+			err = cr.DeregisterContext(ctx, e.addr)
+		} else {
+			err = e.r.Deregister(e.addr)
+		}
+		if err != nil {
+			logger.Warnf("rpc server: deregister %s error: %v", e.addr, err)
+		}
+	}
+
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+	for atomic.LoadInt64(&server.admission.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package MyRPC
+
+import (
+	"MyRPC/logger"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//
+// 慢调用日志
+// 服务变慢时首先要知道慢在哪些请求上。开启后处理时间超过阈值的请求以 Warn 级别记一条日志，
+// 带上方法、参数摘要、耗时和对端地址，最近的若干条保存在内存中，可以在 /debug/myrpc 上查看：
+//
+//	server.SetSlowLog(&MyRPC.SlowLogOptions{Threshold: 500 * time.Millisecond})
+//
+// 参数摘要是参数的 Json，超过 MaxArgsSize 的部分被截断，只有慢调用才会编码参数
+//
+
+// 默认值
+const (
+	defaultSlowArgsSize = 256
+	defaultSlowKeep     = 100
+)
+
+// SlowLogOptions 慢调用日志的配置
+type SlowLogOptions struct {
+	Threshold   time.Duration // 处理时间超过它的请求是慢调用，必须大于0
+	MaxArgsSize int           // 参数摘要的最大字节数，默认256
+	Keep        int           // 内存中保存的最近的慢调用条数，默认100
+}
+
+// SlowCall 一次慢调用
+type SlowCall struct {
+	ServiceMethod string
+	RemoteAddr    string
+	RequestID     string
+	Start         time.Time
+	Duration      time.Duration
+	Args          string // 参数摘要
+	Error         string
+}
+
+// slowLog 最近的慢调用，环形缓冲区
+type slowLog struct {
+	opt   SlowLogOptions
+	mu    sync.Mutex
+	calls []SlowCall
+	next  int // 下一条写入的位置
+}
+
+// SetSlowLog 开启慢调用日志，传入 nil 关闭，需要在 Accept 之前调用
+func (server *Server) SetSlowLog(opt *SlowLogOptions) {
+	if opt == nil || opt.Threshold <= 0 {
+		server.slowLog = nil
+		return
+	}
+	l := &slowLog{opt: *opt}
+	if l.opt.MaxArgsSize <= 0 {
+		l.opt.MaxArgsSize = defaultSlowArgsSize
+	}
+	if l.opt.Keep <= 0 {
+		l.opt.Keep = defaultSlowKeep
+	}
+	server.slowLog = l
+}
+
+// SlowCalls 返回最近的慢调用，最新的在前面，没有开启慢调用日志时返回 nil
+func (server *Server) SlowCalls() []SlowCall {
+	l := server.slowLog
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	calls := make([]SlowCall, 0, len(l.calls))
+	for i := 1; i <= len(l.calls); i++ {
+		calls = append(calls, l.calls[(l.next-i+len(l.calls))%len(l.calls)])
+	}
+	return calls
+}
+
+// observeSlow 请求处理完后检查是否是慢调用
+func (server *Server) observeSlow(req *request, start time.Time, err error) {
+	l := server.slowLog
+	if l == nil {
+		return
+	}
+	d := time.Since(start)
+	if d < l.opt.Threshold {
+		return
+	}
+	c := SlowCall{
+		ServiceMethod: req.h.ServiceMethod,
+		RequestID:     req.fields.RequestID,
+		Start:         start,
+		Duration:      d,
+		Args:          summarizeArgs(req, l.opt.MaxArgsSize),
+	}
+	if req.ci != nil {
+		c.RemoteAddr = req.ci.remoteAddr
+	}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	logger.Warnf("rpc server: slow call: request_id=%s method=%s remote=%s duration=%s args=%s error=%q",
+		c.RequestID, c.ServiceMethod, c.RemoteAddr, c.Duration, c.Args, c.Error)
+	l.add(c)
+}
+
+func (l *slowLog) add(c SlowCall) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.calls) < l.opt.Keep {
+		l.calls = append(l.calls, c)
+		l.next = len(l.calls) % l.opt.Keep
+		return
+	}
+	l.calls[l.next] = c
+	l.next = (l.next + 1) % l.opt.Keep
+}
+
+// summarizeArgs 参数的 Json，不能编码时使用 %+v，超过 max 字节时截断
+func summarizeArgs(req *request, max int) string {
+	if !req.argv.IsValid() {
+		return ""
+	}
+	var s string
+	if b, err := json.Marshal(req.argv.Interface()); err == nil {
+		s = string(b)
+	} else {
+		s = fmt.Sprintf("%+v", req.argv.Interface())
+	}
+	if len(s) > max {
+		n := max
+		for n > 0 && !utf8.RuneStart(s[n]) { // 不截断多字节的字符
+			n--
+		}
+		s = fmt.Sprintf("%s...(%d bytes)", s[:n], len(s))
+	}
+	return s
+}
@@ -0,0 +1,27 @@
+package MyRPC
+
+import (
+	"MyRPC/logger"
+	"sync/atomic"
+)
+
+// 严格模式见 client/strict.go，服务端用 SetStrictMode 设置
+
+// protocolViolation 根据严格模式处理一次协议异常，返回true表示需要断开连接
+func protocolViolation(mode StrictMode, stats interface{ addProtocolError() }, side, peer, format string, v ...interface{}) bool {
+	if mode == StrictOff {
+		return false
+	}
+	stats.addProtocolError()
+	logger.Warnf("rpc "+side+": protocol violation from %s: "+format, append([]interface{}{peer}, v...)...)
+	return mode == StrictClose
+}
+
+func (ci *connInfo) addProtocolError() {
+	atomic.AddUint64(&ci.stats.ProtocolErrors, 1)
+}
+
+// SetStrictMode 设置服务端处理协议异常的方式，需要在Accept之前调用
+func (server *Server) SetStrictMode(mode StrictMode) {
+	server.strict = mode
+}
@@ -0,0 +1,26 @@
+package MyRPC
+
+import (
+	"MyRPC/wire"
+	"strconv"
+	"time"
+)
+
+// 调用时间线见 client/timeline.go，服务端在响应头的 Trailer 中带回自己的耗时
+
+// 响应头 Trailer 中服务端的耗时，单位纳秒
+const (
+	trailerServerQueue = wire.TrailerServerQueue
+	trailerHandler     = wire.TrailerHandler
+)
+
+// timelineTrailer 服务端生成带有耗时的 Trailer，请求没有要求时返回 nil
+func timelineTrailer(req *request, start time.Time) map[string]string {
+	if req.h.Metadata[TimelineMetadataKey] == "" {
+		return nil
+	}
+	return map[string]string{
+		trailerServerQueue: strconv.FormatInt(int64(start.Sub(req.received)), 10),
+		trailerHandler:     strconv.FormatInt(int64(time.Since(start)), 10),
+	}
+}
@@ -0,0 +1,62 @@
+package MyRPC
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+//
+// 连接升级（STARTTLS）
+// 迁移期间同一个端口既要服务老的明文客户端，又要服务新的加密客户端。
+// 客户端在 Option 中设置 StartTLS，发送完 Option 后双方立即在原连接上完成 TLS 握手，之后的 RPC 报文都经过加密。
+//
+//	| Option(Json, StartTLS) | TLS Handshake | Header(Codec) | Body(Codec) | ...
+//
+// 客户端有鉴权令牌时，令牌不能随明文的 Option 发送。握手头部设置 flagTLSToken，TLS 握手之后先发送令牌，
+// 服务端读到令牌后才校验；客户端设置 HandshakeAck 时，服务端再回复一个确认帧告诉客户端校验的结果：
+//
+//	| Option(Json, StartTLS) | [Ack] | TLS Handshake | Length(uint32) | Token | [Ack] | Header(Codec) | ...
+//
+// 老的 Json 握手没有标志位，不能同时使用 StartTLS 和令牌
+//
+
+// SetTLSConfig 设置服务端的 TLS 配置，设置后才能接受 StartTLS 的连接
+func (server *Server) SetTLSConfig(config *tls.Config) {
+	server.tlsConfig = config
+}
+
+// readTLSToken 服务端在 TLS 握手之后读取令牌
+func readTLSToken(r io.Reader) (string, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", err
+	}
+	n := binary.BigEndian.Uint32(head[:])
+	if n > maxOptionLen {
+		return "", errors.New("rpc server: token too large")
+	}
+	token := make([]byte, n)
+	if _, err := io.ReadFull(r, token); err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// startTLS 服务端把连接升级为 TLS
+func (server *Server) startTLS(conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	if server.tlsConfig == nil {
+		return nil, errors.New("rpc server: StartTLS requested but TLS is not configured")
+	}
+	nc, ok := conn.(net.Conn)
+	if !ok {
+		return nil, errors.New("rpc server: StartTLS requires a net.Conn")
+	}
+	tc := tls.Server(nc, server.tlsConfig)
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
@@ -0,0 +1,125 @@
+package MyRPC
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// selfSignedConfig 生成一个自签名证书的服务端配置
+func selfSignedConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestStartTLS(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	server.SetTLSConfig(selfSignedConfig(t))
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+
+	// 同一个端口同时服务明文和加密的客户端
+	for _, startTLS := range []bool{false, true} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{
+			StartTLS:  startTLS,
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		})
+		_assert(err == nil, "failed to dial with StartTLS=%v: %v", startTLS, err)
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "failed to call Foo.Sum with StartTLS=%v: %v", startTLS, err)
+		_ = client.Close()
+	}
+}
+
+// sniffListener 记录服务端从连接上读到的所有字节
+type sniffListener struct {
+	net.Listener
+	mu   sync.Mutex
+	seen bytes.Buffer
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &sniffConn{Conn: conn, l: l}, nil
+}
+
+type sniffConn struct {
+	net.Conn
+	l *sniffListener
+}
+
+func (c *sniffConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.l.mu.Lock()
+	c.l.seen.Write(p[:n])
+	c.l.mu.Unlock()
+	return n, err
+}
+
+func TestStartTLS_Token(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	server.SetTLSConfig(selfSignedConfig(t))
+	server.SetAuthenticator(TokenAuthenticator("secret-token"))
+	inner, _ := net.Listen("tcp", "127.0.0.1:0")
+	l := &sniffListener{Listener: inner}
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	dial := func(token string) (*Client, error) {
+		return Dial("tcp", l.Addr().String(), &Option{
+			StartTLS:     true,
+			TLSConfig:    &tls.Config{InsecureSkipVerify: true},
+			Token:        token,
+			HandshakeAck: true,
+		})
+	}
+	client, err := dial("secret-token")
+	_assert(err == nil, "failed to dial with a token over StartTLS: %v", err)
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum: %v", err)
+	_ = client.Close()
+
+	_, err = dial("guess-token")
+	_assert(errors.Is(err, ErrHandshakeRejected), "expect the wrong token rejected after TLS, got %v", err)
+
+	// 令牌只在 TLS 之后发送，连接上看不到明文
+	l.mu.Lock()
+	leaked := bytes.Contains(l.seen.Bytes(), []byte("-token"))
+	l.mu.Unlock()
+	_assert(!leaked, "expect no token in cleartext")
+
+	_, err = Dial("tcp", l.Addr().String(), &Option{StartTLS: true, Token: "secret-token", LegacyHandshake: true})
+	_assert(err != nil, "expect a token with StartTLS rejected over the legacy handshake")
+}
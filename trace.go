@@ -0,0 +1,100 @@
+package MyRPC
+
+import (
+	"MyRPC/codec"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//
+// 请求追踪
+// 服务端为每个请求生成一个Span交给Tracer上报。QPS很高的方法全部上报会压垮追踪后端，
+// 所以在请求开始时由Sampler决定是否采样（head-based），罕见的方法可以单独配置为全量采样。
+//
+
+// Span 一次请求的追踪信息
+type Span struct {
+	ServiceMethod string
+	Seq           uint64
+	RemoteAddr    string
+	Start         time.Time
+	Duration      time.Duration
+	Error         string
+	Sampled       bool // 是否被采样命中，为false说明是因为出错才上报的
+}
+
+// Tracer 接收被采样的Span，由使用方对接具体的追踪系统
+type Tracer interface {
+	Report(span *Span)
+}
+
+// Sampler 采样配置
+type Sampler struct {
+	Ratio         float64            // 默认采样率，0~1
+	Methods       map[string]float64 // 按 服务名.方法名 单独配置的采样率，优先于Ratio
+	AlwaysOnError bool               // 未被采样的请求出错时也上报
+}
+
+var (
+	samplerMu   sync.Mutex
+	samplerRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// sample 请求开始时决定是否采样
+func (s *Sampler) sample(serviceMethod string) bool {
+	ratio := s.Ratio
+	if r, ok := s.Methods[serviceMethod]; ok {
+		ratio = r
+	}
+	if ratio <= 0 {
+		return false
+	}
+	if ratio >= 1 {
+		return true
+	}
+	samplerMu.Lock()
+	defer samplerMu.Unlock()
+	return samplerRand.Float64() < ratio
+}
+
+// SetTracer 设置服务端的Tracer和采样配置，sampler为nil时全量采样，需要在Accept之前调用
+func (server *Server) SetTracer(tracer Tracer, sampler *Sampler) {
+	if sampler == nil {
+		sampler = &Sampler{Ratio: 1}
+	}
+	server.tracer = tracer
+	server.sampler = sampler
+}
+
+// startSpan 开始追踪一个请求，没有设置Tracer时返回nil
+func (server *Server) startSpan(h *codec.Header, remoteAddr string) *Span {
+	if server.tracer == nil {
+		return nil
+	}
+	sampled := server.sampler.sample(h.ServiceMethod)
+	if !sampled && !server.sampler.AlwaysOnError {
+		return nil
+	}
+	return &Span{
+		ServiceMethod: h.ServiceMethod,
+		Seq:           h.Seq,
+		RemoteAddr:    remoteAddr,
+		Start:         time.Now(),
+		Sampled:       sampled,
+	}
+}
+
+// finishSpan 结束追踪，未被采样且没有出错的请求不上报
+func (server *Server) finishSpan(span *Span, err error) {
+	if span == nil {
+		return
+	}
+	span.Duration = time.Since(span.Start)
+	if err != nil {
+		span.Error = err.Error()
+	}
+	if span.Sampled || err != nil {
+		server.tracer.Report(span)
+	}
+}
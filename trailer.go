@@ -0,0 +1,17 @@
+package MyRPC
+
+import "time"
+
+// 响应 Trailer 和读己之写见 client/trailer.go
+
+// responseTrailer 服务端生成响应的 Trailer，没有需要返回的信息时为 nil
+func (server *Server) responseTrailer(req *request, start time.Time) map[string]string {
+	trailer := timelineTrailer(req, start)
+	if _, ok := req.h.Metadata[ReadYourWritesMetadataKey]; ok {
+		if trailer == nil {
+			trailer = make(map[string]string, 1)
+		}
+		trailer[TrailerInstance] = server.instanceID
+	}
+	return trailer
+}
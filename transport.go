@@ -0,0 +1,40 @@
+package MyRPC
+
+import (
+	"MyRPC/client"
+	"net"
+	"os"
+)
+
+//
+// 传输方式
+// Listen 和 XDial 使用同样的 protocol@addr 格式，地址的格式、Addr 和 LocalOnly 见 client/transport.go
+//
+
+// Listen 按 rpcAddr 监听。unix 地址的 socket 文件已经存在但没有进程在监听时（上一次没有正常退出），先删除它
+func Listen(rpcAddr string) (net.Listener, error) {
+	protocol, addr, err := client.SplitAddr(rpcAddr)
+	if err != nil {
+		return nil, err
+	}
+	switch protocol {
+	case "local":
+		return client.ListenLocal(addr)
+	case "unix":
+		removeStaleSocket(addr)
+	}
+	return net.Listen(protocol, addr)
+}
+
+// removeStaleSocket 删除没有进程监听的 socket 文件，其他类型的文件保持不动，交给 net.Listen 报错
+func removeStaleSocket(path string) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return
+	}
+	_ = os.Remove(path)
+}
@@ -0,0 +1,153 @@
+package MyRPC
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// 运行时调参
+// 一些参数需要在不重启进程的情况下调整，比如限流、处理超时和过载保护的阈值。
+// 这些参数放在 Tuning 中整体原子替换，通过 debug 路径下带鉴权的 /debug/myrpc/tune 查看和修改。
+//
+
+const defaultTunePath = "/debug/myrpc/tune"
+
+// ErrServerBusy 超过限流或者过载保护阈值时返回给客户端的错误
+var ErrServerBusy error = Errorf(CodeUnavailable, "rpc server: server busy")
+
+// Tuning 可以在运行时调整的参数，零值表示不限制
+type Tuning struct {
+	RateLimit     float64       // 每秒最多接受的请求数
+	HandleTimeout time.Duration // 大于0时覆盖客户端 Option 中的 HandleTimeout
+	MaxInflight   int64         // 同时处理的请求数超过该值时直接拒绝
+	LogLevel      string        // 全局的日志级别，为空时不修改
+}
+
+// ServerStats 服务端的运行状态
+type ServerStats struct {
+	Tuning   Tuning // 当前生效的参数
+	Inflight int64  // 正在处理的请求数
+	Rejected uint64 // 因为限流或过载被拒绝的请求数
+	Conns    int    // 当前的连接数
+
+	Methods []MethodStats `json:",omitempty"` // 每个注册的方法的调用统计
+}
+
+// admission 根据 Tuning 决定是否接受请求
+type admission struct {
+	tuning   atomic.Value // Tuning
+	inflight int64
+	rejected uint64
+
+	mu     sync.Mutex // 保护令牌桶
+	tokens float64
+	last   time.Time
+}
+
+func (a *admission) load() Tuning {
+	t, _ := a.tuning.Load().(Tuning)
+	return t
+}
+
+// admit 接受一个请求，返回 ErrServerBusy 表示拒绝，接受后需要调用 done
+func (a *admission) admit() error {
+	t := a.load()
+	if t.MaxInflight > 0 && atomic.LoadInt64(&a.inflight) >= t.MaxInflight {
+		atomic.AddUint64(&a.rejected, 1)
+		return ErrServerBusy
+	}
+	if t.RateLimit > 0 && !a.take(t.RateLimit) {
+		atomic.AddUint64(&a.rejected, 1)
+		return ErrServerBusy
+	}
+	atomic.AddInt64(&a.inflight, 1)
+	return nil
+}
+
+func (a *admission) done() {
+	atomic.AddInt64(&a.inflight, -1)
+}
+
+// take 令牌桶，桶的容量等于每秒的速率
+func (a *admission) take(rate float64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if a.last.IsZero() {
+		a.tokens = rate
+	} else {
+		a.tokens += now.Sub(a.last).Seconds() * rate
+		if a.tokens > rate {
+			a.tokens = rate
+		}
+	}
+	a.last = now
+	if a.tokens < 1 {
+		return false
+	}
+	a.tokens--
+	return true
+}
+
+// Tune 原子地替换运行时参数
+func (server *Server) Tune(t Tuning) error {
+	if t.LogLevel != "" {
+		if err := SetLogLevel(t.LogLevel); err != nil {
+			return err
+		}
+	}
+	server.admission.tuning.Store(t)
+	return nil
+}
+
+// Stats 返回服务端当前的运行状态
+func (server *Server) Stats() ServerStats {
+	return ServerStats{
+		Tuning:   server.admission.load(),
+		Inflight: atomic.LoadInt64(&server.admission.inflight),
+		Rejected: atomic.LoadUint64(&server.admission.rejected),
+		Conns:    len(server.Conns()),
+		Methods:  server.methodStats(),
+	}
+}
+
+// SetAdminToken 设置调参接口的鉴权令牌，请求需要带上 Authorization: Bearer <token>，令牌为空时接口不可用
+func (server *Server) SetAdminToken(token string) {
+	server.adminToken = token
+}
+
+// tuneHTTP 运行时调参接口，GET 返回 Stats，POST 使用请求体中的 Json 替换 Tuning
+type tuneHTTP struct {
+	*Server
+}
+
+func (server tuneHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	token := []byte("Bearer " + server.adminToken)
+	if server.adminToken == "" || subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), token) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch req.Method {
+	case "GET":
+	case "POST":
+		t := server.admission.load()
+		if err := json.NewDecoder(req.Body).Decode(&t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := server.Tune(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(server.Stats())
+}
@@ -0,0 +1,31 @@
+package MyRPC
+
+import (
+	"MyRPC/client"
+	"MyRPC/codec"
+	"MyRPC/wire"
+	"errors"
+)
+
+// 业务错误见 client/typederror.go
+
+// errorTypeKey 响应头 Details 中错误类型的名字
+const errorTypeKey = wire.ErrorTypeKey
+
+// errorBody 服务方法出错时响应的消息体，注册过的业务错误是错误值本身，同时在响应头中写入类型的名字
+func errorBody(h *codec.Header, err error) interface{} {
+	var te TypedError
+	if !errors.As(err, &te) {
+		return invalidRequest
+	}
+	if !client.ErrorTypeRegistered(te) {
+		return invalidRequest
+	}
+	details := make(map[string]string, len(h.Details)+1)
+	for k, v := range h.Details {
+		details[k] = v
+	}
+	details[errorTypeKey] = te.ErrorType()
+	h.Details = details
+	return te
+}
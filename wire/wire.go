@@ -0,0 +1,73 @@
+// Package wire 线上协议的常量：握手头部的魔数、版本、标志位和编码方式的编号，以及控制消息、Trailer 等约定的名字。
+// 服务端 MyRPC、客户端 MyRPC/client 和 lite 都从这里取，各方不会各自修改而对不上，握手的格式见 MyRPC 的 handshake.go
+package wire
+
+import "MyRPC/codec"
+
+const (
+	MagicNumber  = 0x79779200 // 握手头部和 Option 中的魔数
+	Version      = 1          // 握手头部的版本
+	HeaderLen    = 12         // | Magic(4) | Version(1) | CodecID(1) | Flags(2) | OptionLength(4) |
+	MaxOptionLen = 64 << 10   // Option、握手确认帧等变长部分的最大长度
+)
+
+// 握手头部的标志位
+const (
+	FlagStartTLS     uint16 = 1 << iota // 握手之后升级TLS
+	FlagCapabilities                    // 服务端回复自己支持的能力
+	FlagAck                             // 服务端回复握手确认
+	FlagAckDetail                       // 拒绝握手时用 Json 回复原因和服务端支持的编码方式
+	FlagErrorCodes                      // 客户端能读取 CompactType 头部中的错误码和附加信息
+	FlagTLSToken                        // 令牌在 TLS 握手之后发送
+)
+
+// 握手确认帧的状态
+const (
+	AckOK     uint8 = 0
+	AckReject uint8 = 1
+)
+
+// AckDetail 客户端设置 FlagAckDetail 时，服务端拒绝握手的原因，Json 编码
+type AckDetail struct {
+	Reason string
+	Codecs []string `json:",omitempty"` // 服务端支持的编码方式
+}
+
+// 控制消息使用的 ServiceMethod，服务名不是合法的导出标识符，不会和用户的服务冲突
+const (
+	PingMethod   = "_myrpc.Ping"   // 心跳
+	CancelMethod = "_myrpc.Cancel" // 取消 Seq 对应的请求，服务端不回复
+)
+
+// 响应头 Trailer 和 Details 中框架使用的键
+const (
+	TrailerServerQueue = "myrpc-server-queue" // 服务端读完请求到开始执行服务方法的耗时，单位纳秒
+	TrailerHandler     = "myrpc-handler"      // 服务方法的执行时间，单位纳秒
+	ErrorTypeKey       = "myrpc-error-type"   // Details 中业务错误类型的名字
+)
+
+// HTTP 上的传输
+const (
+	RPCPath         = "/_myrpc_"               // CONNECT 劫持连接的路径
+	Connected       = "200 Connected to MyRPC" // CONNECT 成功时的状态行
+	CallPath        = "/_myrpc_/call"          // 每个调用一个 HTTP 请求的路径
+	CodecHeader     = "X-Myrpc-Codec"          // 每个调用一个 HTTP 请求时的编码方式
+	CallContentType = "application/x-myrpc"
+)
+
+// CodecIDs 常用编码方式在握手头部中的编号，其他编码方式编号为0，从 Option 的 CodecType 中读取
+var CodecIDs = map[codec.Type]uint8{
+	codec.GobType:     1,
+	codec.JsonType:    2,
+	codec.CompactType: 3,
+}
+
+// CodecType 编号对应的编码方式，不认识的编号返回空字符串
+func CodecType(id uint8) codec.Type {
+	for t, i := range CodecIDs {
+		if i == id {
+			return t
+		}
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+package MyRPC
+
+import (
+	"MyRPC/codec"
+	"reflect"
+	"strings"
+	"time"
+)
+
+//
+// 协议描述
+// 其他语言的客户端需要和 Go 的实现保持一致，手写的文档很容易落后于代码，
+// 所以这里直接从 Go 的定义生成一份机器可读的协议描述，cmd/wirespec 把它以 Json 输出
+//
+
+// WireSpec 线上协议的描述
+type WireSpec struct {
+	MagicNumber      int
+	HandshakeVersion int
+	Handshake        []WireField // 握手头部，按顺序排列，所有整数都是大端
+	MaxOptionLength  int
+	Option           []WireField // 握手头部之后的 Option，Json 编码
+	CodecIDs         map[string]int
+	HandshakeFlags   map[string]int
+	HandshakeAck     []WireField // 设置 Ack 标志位时，服务端校验握手之后、TLS升级之前回复的确认帧
+	Capabilities     []WireField // 设置 Capabilities 标志位时，服务端在握手之后回复 | Length(uint32) | Capabilities(Json) |
+	TLSToken         []WireField // 设置 TLSToken 标志位时，客户端在 TLS 握手之后发送的令牌，设置 Ack 时服务端再回复一个确认帧
+	Frame            []WireField // 握手之后每条消息的帧格式
+	MaxFrameSize     int
+	Layers           []string    // 从连接往上的各层，写的时候从后往前经过
+	Header           []WireField // 每条消息的头部，由协商的编码方式编码
+	CompactHeader    []WireField // CompactType 的头部，见 codec/compact.go，后面跟着 Gob 编码的消息体
+	Envelope         []WireField // 需要加密的方法的消息体，Ciphertext 是 AES-GCM 加密后的明文消息体
+	Compressors      []string
+	PingMethod       string
+	CancelMethod     string         // 取消请求的控制消息，Seq 是要取消的请求，服务端不回复
+	Errors           []string       // 服务端在响应头 Error 中可能返回的错误前缀
+	ErrorCodes       map[string]int // 响应头 Code 的取值，见 ErrorCode
+}
+
+// WireField 一个字段
+type WireField struct {
+	Name string
+	Type string
+	Size int    `json:",omitempty"` // 固定长度字段的字节数
+	Doc  string `json:",omitempty"`
+}
+
+// ProtocolSpec 生成当前版本的协议描述
+func ProtocolSpec() WireSpec {
+	spec := WireSpec{
+		MagicNumber:      MagicNumber,
+		HandshakeVersion: handshakeVersion,
+		Handshake: []WireField{
+			{Name: "Magic", Type: "uint32", Size: 4, Doc: "MagicNumber"},
+			{Name: "Version", Type: "uint8", Size: 1, Doc: "HandshakeVersion"},
+			{Name: "CodecID", Type: "uint8", Size: 1, Doc: "see CodecIDs, 0 means read CodecType from Option"},
+			{Name: "Flags", Type: "uint16", Size: 2, Doc: "see HandshakeFlags"},
+			{Name: "OptionLength", Type: "uint32", Size: 4, Doc: "length of the Json encoded Option that follows"},
+		},
+		MaxOptionLength: maxOptionLen,
+		Option:          structFields(reflect.TypeOf(Option{})),
+		CodecIDs:        make(map[string]int),
+		HandshakeFlags:  map[string]int{"StartTLS": int(flagStartTLS), "Capabilities": int(flagCapabilities), "Ack": int(flagAck), "AckDetail": int(flagAckDetail), "ErrorCodes": int(flagErrorCodes), "TLSToken": int(flagTLSToken)},
+		HandshakeAck: []WireField{
+			{Name: "Status", Type: "uint8", Size: 1, Doc: "0 accepted, 1 rejected"},
+			{Name: "Length", Type: "uint32", Size: 4},
+			{Name: "Reason", Type: "string", Doc: "Length bytes, why the server rejected the handshake; with AckDetail a Json object {Reason, Codecs}"},
+		},
+		Capabilities: structFields(reflect.TypeOf(Capabilities{})),
+		TLSToken: []WireField{
+			{Name: "Length", Type: "uint32", Size: 4},
+			{Name: "Token", Type: "string", Doc: "Length bytes, Option.Token which is left out of the cleartext Option"},
+		},
+		Frame: []WireField{
+			{Name: "Length", Type: "uint32", Size: 4},
+			{Name: "Payload", Type: "bytes", Doc: "Length bytes"},
+		},
+		MaxFrameSize: codec.MaxFrameSize,
+		Layers:       []string{"frame", "batch (optional, write side only)", "compress (optional)", "codec"},
+		Header:       structFields(reflect.TypeOf(codec.Header{})),
+		CompactHeader: []WireField{
+			{Name: "Flags", Type: "uint8", Size: 1, Doc: "1 Error, 2 Deadline, 4 Metadata, 8 Trailer, 16 Code, 32 Details; Code and Details only when the client set the ErrorCodes handshake flag"},
+			{Name: "Seq", Type: "uvarint"},
+			{Name: "Method", Type: "uvarint", Doc: "0 followed by the method name (uvarint length + bytes), which is appended to the per-direction method table, or the 1-based index in that table"},
+			{Name: "Error", Type: "string", Doc: "uvarint length + bytes, only with flag 1"},
+			{Name: "Deadline", Type: "varint", Doc: "only with flag 2"},
+			{Name: "Metadata", Type: "map<string,string>", Doc: "uvarint count + key/value pairs, only with flag 4; each key is a uvarint id in the per-direction key table, or 0 followed by the key string which is appended to that table; values are strings"},
+			{Name: "Trailer", Type: "map<string,string>", Doc: "same encoding as Metadata and shares its key table, only with flag 8"},
+			{Name: "Code", Type: "uvarint", Doc: "error code, see ErrorCodes, only with flag 16"},
+			{Name: "Details", Type: "map<string,string>", Doc: "same encoding as Metadata and shares its key table, only with flag 32"},
+		},
+		Envelope:     structFields(reflect.TypeOf(codec.Envelope{})),
+		Compressors:  codec.Compressors(),
+		PingMethod:   pingMethod,
+		CancelMethod: cancelMethod,
+		Errors: []string{
+			errProtocol.Error(),
+			ErrServerBusy.Error(),
+			ErrMethodBusy.Error(),
+			"rpc server: request handle timeout",
+			"rpc server: server/method request ill-formed",
+			"rpc server: can't find service",
+			"rpc server: can't find method",
+			errRequestCanceled.Error(),
+			codec.ErrMetadataTooLarge.Error(),
+		},
+	}
+	spec.ErrorCodes = make(map[string]int, int(CodeUnauthenticated)+1)
+	for c := CodeOK; c <= CodeUnauthenticated; c++ {
+		spec.ErrorCodes[c.String()] = int(c)
+	}
+	for t, id := range codecIDs {
+		spec.CodecIDs[string(t)] = int(id)
+	}
+	return spec
+}
+
+// structFields 列出结构体中会被 Json 编码的字段
+func structFields(t reflect.Type) []WireField {
+	var fields []WireField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // 不导出的字段不会被编码
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			}
+		}
+		fields = append(fields, WireField{Name: name, Type: wireType(f.Type)})
+	}
+	return fields
+}
+
+var typeOfDuration = reflect.TypeOf(time.Duration(0))
+
+// wireType 用与语言无关的名字描述 Json 中的类型
+func wireType(t reflect.Type) string {
+	if t == typeOfDuration {
+		return "int64 (nanoseconds)"
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return wireType(t.Elem()) + " (nullable)"
+	case reflect.Map:
+		return "map<" + wireType(t.Key()) + "," + wireType(t.Elem()) + ">"
+	case reflect.Slice:
+		return "list<" + wireType(t.Elem()) + ">"
+	case reflect.Struct:
+		return "object"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int64"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "uint64"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	}
+	return t.Kind().String()
+}
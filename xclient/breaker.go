@@ -0,0 +1,106 @@
+package xclient
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//
+// 熔断器
+// 服务发现在注册中心感知到实例下线之前，仍然会返回已经挂掉的实例。为每个实例维护一个熔断器：
+// 连续失败 threshold 次后熔断 cooldown 时间，期间负载均衡会跳过该实例；冷却结束后放行一次试探调用，
+// 成功则恢复，失败则重新熔断。
+//
+
+// ErrAllBreakersOpen 所有实例都处于熔断状态
+var ErrAllBreakersOpen = errors.New("rpc xclient: all servers are unavailable (circuit breaker open)")
+
+// breaker 单个实例的熔断状态
+type breaker struct {
+	failures  int       // 连续失败次数
+	openUntil time.Time // 熔断结束的时间
+}
+
+type circuitBreakers struct {
+	mu        sync.Mutex
+	threshold int                 // 连续失败多少次后熔断
+	cooldown  time.Duration       // 熔断持续时间
+	breakers  map[string]*breaker // 键是 rpcAddr
+	r         *rand.Rand          // 随机策略重新选择实例时使用
+	next      int                 // 轮询策略重新选择实例时的位置
+}
+
+// WithCircuitBreaker 为每个实例开启熔断，连续失败 threshold 次后在 cooldown 时间内不再选择该实例
+func WithCircuitBreaker(threshold int, cooldown time.Duration) XOption {
+	return func(xc *XClient) {
+		xc.breakers = &circuitBreakers{
+			threshold: threshold,
+			cooldown:  cooldown,
+			breakers:  make(map[string]*breaker),
+			r:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		}
+	}
+}
+
+// isOpen 判断实例是否处于熔断状态，只用于过滤，不改变熔断器的状态
+func (cb *circuitBreakers) isOpen(rpcAddr string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	b := cb.breakers[rpcAddr]
+	return b != nil && b.failures >= cb.threshold && time.Now().Before(b.openUntil)
+}
+
+// reserveProbe 在真正向实例发起调用前调用。冷却已经结束的实例，这次调用就是试探调用，
+// 在结果返回之前重新进入熔断，避免大量请求同时涌入
+func (cb *circuitBreakers) reserveProbe(rpcAddr string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	b := cb.breakers[rpcAddr]
+	if b != nil && b.failures >= cb.threshold && !time.Now().Before(b.openUntil) {
+		b.openUntil = time.Now().Add(cb.cooldown)
+	}
+}
+
+// record 记录一次调用的结果
+func (cb *circuitBreakers) record(rpcAddr string, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if err == nil {
+		delete(cb.breakers, rpcAddr)
+		return
+	}
+	b := cb.breakers[rpcAddr]
+	if b == nil {
+		b = new(breaker)
+		cb.breakers[rpcAddr] = b
+	}
+	b.failures++
+	if b.failures >= cb.threshold {
+		b.openUntil = time.Now().Add(cb.cooldown)
+	}
+}
+
+// available 过滤掉处于熔断状态的实例
+func (cb *circuitBreakers) available(servers []string) []string {
+	alive := make([]string, 0, len(servers))
+	for _, s := range servers {
+		if !cb.isOpen(s) {
+			alive = append(alive, s)
+		}
+	}
+	return alive
+}
+
+// pick 在没有熔断的实例中随机或者轮询选择一个
+func (cb *circuitBreakers) pick(alive []string, mode SelectMode) string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if mode == RoundRobinSelect {
+		s := alive[cb.next%len(alive)]
+		cb.next = (cb.next + 1) % len(alive)
+		return s
+	}
+	return alive[cb.r.Intn(len(alive))]
+}
@@ -0,0 +1,275 @@
+package xclient
+
+import (
+	"MyRPC/callopt"
+	"MyRPC/client"
+	"MyRPC/codec"
+	"bytes"
+	"container/list"
+	"context"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// 响应缓存
+// 幂等的读操作重复调用时不需要每次都访问服务端。开启响应缓存后，XClient 以 (serviceMethod, 参数的类型和编码) 为键
+// 缓存调用成功的结果，过期之前相同的调用直接从缓存返回：
+//
+//	xc := NewXClient(d, RandomSelect, nil, WithResponseCache(nil, 0))
+//	err := xc.Call(ctx, "Foo.Get", args, &reply, callopt.WithCache(time.Minute))
+//
+// WithResponseCache 的 ttl 大于0时所有调用都使用缓存，否则只有带 callopt.WithCache 的调用使用。
+// 缓存的是 Gob 编码的结果，命中时解码到 reply，所以不同的调用方拿到的是各自的副本。
+// 参数按调用实际使用的编码方式编码，和发给服务端的内容一致。参数中有未导出的字段时编码不能区分不同的参数，
+// 这样的调用和参数无法编码（比如包含 chan）、结果无法编码的调用一样跳过缓存，调用照常进行。
+// 租户、鉴权这类元数据会改变结果，所以键中还包括调用的元数据（ctx 中的和 callopt.WithMetadata 的）、
+// 指定的实例和编码方式，一个调用方的结果不会返回给另一个调用方；请求ID这类只用于追踪的元数据不计入键
+//
+
+// Cache 响应缓存的存储，可以替换成 Redis 这类共享的存储，需要能被多个协程同时使用
+type Cache interface {
+	// Get 返回 key 对应的值，不存在或者已经过期时返回 false
+	Get(key string) ([]byte, bool)
+	// Set 保存 key 对应的值 ttl 时间
+	Set(key string, value []byte, ttl time.Duration)
+}
+
+// 默认值
+const defaultCacheEntries = 1024
+
+// cacheIgnoredMetadata 每个请求都不同、不影响结果的元数据，不计入缓存的键
+var cacheIgnoredMetadata = map[string]bool{
+	client.MetadataRequestID:   true,
+	client.TimelineMetadataKey: true,
+}
+
+// WithResponseCache 开启响应缓存，cache 为 nil 时使用最多1024个条目的 LRUCache。
+// ttl 大于0时所有调用的结果都缓存 ttl 时间，为0时只缓存带 callopt.WithCache 的调用
+func WithResponseCache(cache Cache, ttl time.Duration) XOption {
+	return func(xc *XClient) {
+		if cache == nil {
+			cache = NewLRUCache(defaultCacheEntries)
+		}
+		xc.cache = &replyCache{backend: cache, ttl: ttl}
+	}
+}
+
+// replyCache XClient 的响应缓存
+type replyCache struct {
+	backend Cache
+	ttl     time.Duration // 默认的缓存时间，为0时只缓存带 callopt.WithCache 的调用
+	hits    uint64
+	misses  uint64
+}
+
+// cachedCall 一次使用缓存的调用，为 nil 时不使用缓存
+type cachedCall struct {
+	rc  *replyCache
+	key string
+	ttl time.Duration
+}
+
+// lookup 确定本次调用是否使用缓存，ct 是本次调用使用的编码方式
+func (rc *replyCache) lookup(ctx context.Context, o *callopt.Options, serviceMethod string, args interface{}, ct codec.Type) *cachedCall {
+	if rc == nil {
+		return nil
+	}
+	ttl := rc.ttl
+	if o.Cache != 0 {
+		ttl = o.Cache
+	}
+	if ttl <= 0 {
+		return nil
+	}
+	body, ok := encodeArgs(ct, args)
+	if !ok {
+		return nil
+	}
+	md := make(map[string]string)
+	for k, v := range client.MetadataFromContext(ctx) {
+		md[k] = v
+	}
+	for k, v := range o.Metadata {
+		md[k] = v
+	}
+	for k := range cacheIgnoredMetadata {
+		delete(md, k)
+	}
+	// 除了最后的参数编码，每一项都加引号，不同的调用不会拼出相同的键
+	parts := []string{serviceMethod, o.Target, string(ct), fmt.Sprintf("%T", args)}
+	for k, v := range md {
+		parts = append(parts, k+"="+strconv.Quote(v))
+	}
+	sort.Strings(parts[4:])
+	var key strings.Builder
+	for _, part := range parts {
+		key.WriteString(strconv.Quote(part))
+	}
+	key.Write(body)
+	return &cachedCall{rc: rc, key: key.String(), ttl: ttl}
+}
+
+// bufferConn 把编码器的输出写到内存中
+type bufferConn struct{ bytes.Buffer }
+
+func (*bufferConn) Close() error { return nil }
+
+// encodeArgs 用编码方式 ct 编码参数，参数的编码不能区分不同的值或者无法编码时返回 false
+func encodeArgs(ct codec.Type, args interface{}) ([]byte, bool) {
+	newCodec := codec.NewCodecFuncMap[ct]
+	if newCodec == nil || !exactEncoding(reflect.TypeOf(args), make(map[reflect.Type]bool)) {
+		return nil, false
+	}
+	var conn bufferConn
+	if err := newCodec(&conn).Write(&codec.Header{}, args); err != nil {
+		return nil, false
+	}
+	return conn.Bytes(), true
+}
+
+var (
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	gobEncoderType      = reflect.TypeOf((*gob.GobEncoder)(nil)).Elem()
+	binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// exactEncoding 类型为 t 的值编码后能否区分不同的值。自己实现编码的类型由编码结果决定，
+// 不需要检查；有未导出字段的结构体、chan、func 和 interface 不能确定
+func exactEncoding(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if t == nil {
+		return true
+	}
+	if seen[t] {
+		return true
+	}
+	seen[t] = true
+	for _, m := range []reflect.Type{jsonMarshalerType, gobEncoderType, binaryMarshalerType, textMarshalerType} {
+		if t.Implements(m) || reflect.PtrTo(t).Implements(m) {
+			return true
+		}
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return exactEncoding(t.Elem(), seen)
+	case reflect.Map:
+		return exactEncoding(t.Key(), seen) && exactEncoding(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || !exactEncoding(f.Type, seen) {
+				return false
+			}
+		}
+		return true
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.UnsafePointer:
+		return false
+	}
+	return true
+}
+
+// load 缓存命中时把结果解码到 reply
+func (c *cachedCall) load(reply interface{}) bool {
+	if c == nil {
+		return false
+	}
+	value, ok := c.rc.backend.Get(c.key)
+	if ok {
+		resetReply(reply)
+		ok = gob.NewDecoder(bytes.NewReader(value)).Decode(reply) == nil
+	}
+	if ok {
+		atomic.AddUint64(&c.rc.hits, 1)
+	} else {
+		atomic.AddUint64(&c.rc.misses, 1)
+	}
+	return ok
+}
+
+// store 调用成功时缓存结果，原样返回 err
+func (c *cachedCall) store(err error, reply interface{}) error {
+	if c == nil || err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if gob.NewEncoder(&buf).Encode(reply) == nil {
+		c.rc.backend.Set(c.key, buf.Bytes(), c.ttl)
+	}
+	return nil
+}
+
+// LRUCache 内存中的 Cache，条目数超过上限时淘汰最久没有访问的条目
+type LRUCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List // 最近访问的在前
+	items      map[string]*list.Element
+}
+
+type lruEntry struct {
+	key      string
+	value    []byte
+	expireAt time.Time
+}
+
+var _ Cache = (*LRUCache)(nil)
+
+// NewLRUCache 创建最多保存 maxEntries 个条目的缓存，maxEntries 不大于0时使用1024
+func NewLRUCache(maxEntries int) *LRUCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheEntries
+	}
+	return &LRUCache{maxEntries: maxEntries, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *LRUCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*lruEntry)
+	if time.Now().After(entry.expireAt) {
+		c.ll.Remove(e)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return entry.value, true
+}
+
+func (c *LRUCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expireAt := time.Now().Add(ttl)
+	if e, ok := c.items[key]; ok {
+		entry := e.Value.(*lruEntry)
+		entry.value, entry.expireAt = value, expireAt
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value, expireAt: expireAt})
+	for c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Len 返回缓存的条目数，包括已经过期但还没有被淘汰的
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
@@ -1,6 +1,7 @@
 package xclient
 
 import (
+	"context"
 	"errors"
 	"math"
 	"math/rand"
@@ -16,6 +17,8 @@ import (
 //	  高性能的机器赋予更高的权重，也可以根据服务实例的当前的负载情况做动态的调整，例如考虑最近5分钟部署服务器的 CPU、内存消耗情况。
 // 4. 哈希/一致性哈希策略 - 依据请求的某些特征，计算一个 hash 值，根据 hash 值将请求发送到对应的机器。
 //	  一致性 hash 还可以解决服务实例动态添加情况下，调度抖动的问题。一致性哈希的一个典型应用场景是分布式缓存服务。
+// 5. 最小负载策略 - 客户端统计每个实例正在进行的调用数和最近的延迟，把新的调用发给负载最低的实例，见 load.go。
+// 6. P2C(Power of Two Choices) - 随机选两个实例，取负载较低的一个，不需要比较所有实例，也不会让所有客户端同时涌向同一个实例。
 
 // 服务发现
 // 负载均衡的前提是有多个服务实例，那我们首先实现一个最基础的服务发现模块 Discovery。
@@ -26,9 +29,11 @@ type SelectMode int // 代表不同负载均衡策略
 const replicateCount = 5
 
 const (
-	RandomSelect     SelectMode = iota // 随机选择策略
-	RoundRobinSelect                   // 轮询算法
-	HashRingSelect                     // 一致性哈希算法
+	RandomSelect      SelectMode = iota // 随机选择策略
+	RoundRobinSelect                    // 轮询算法
+	HashRingSelect                      // 一致性哈希算法
+	LeastActiveSelect                   // 最小负载，只有 XClient 支持，根据客户端统计的正在进行的调用数和延迟选择
+	P2CSelect                           // 随机选两个实例取负载较低的一个，只有 XClient 支持
 )
 
 // Discovery 包含服务发现所需要的最基本的接口
@@ -39,20 +44,66 @@ type Discovery interface {
 	GetAll() ([]string, error)           // 返回所有的服务实例
 }
 
+// ContextRefresher 刷新服务列表时支持 ctx 的服务发现，ctx 结束时放弃对注册中心的请求。
+// XClient 在选择实例之前用调用的 ctx 刷新服务列表，注册中心不可用时调用不会超过自己的截止时间
+type ContextRefresher interface {
+	RefreshContext(ctx context.Context) error
+}
+
+// RefreshContext 用 ctx 刷新 d 的服务列表，d 没有实现 ContextRefresher 时调用 Refresh
+func RefreshContext(ctx context.Context, d Discovery) error {
+	if cr, ok := d.(ContextRefresher); ok {
+		return cr.RefreshContext(ctx)
+	}
+	return d.Refresh()
+}
+
+// KeyedDiscovery 支持根据key选择服务实例的服务发现，一致性哈希策略需要它，
+// 相同的key总是落到同一个服务实例上（服务列表不变的情况下）
+type KeyedDiscovery interface {
+	Discovery
+	GetFor(key string) (string, error) // 根据key在哈希环上选择一个服务实例
+}
+
+// ServiceDiscovery 支持按服务名筛选服务实例的服务发现，注册中心记录了每个实例提供的服务，
+// XClient 调用时只会选择提供对应服务的实例
+type ServiceDiscovery interface {
+	KeyedDiscovery
+	GetService(service string, mode SelectMode) (string, error) // 在提供 service 的实例中选择一个
+	GetServiceFor(service, key string) (string, error)          // 在提供 service 的实例中根据key选择一个
+	GetAllService(service string) ([]string, error)             // 返回提供 service 的所有实例
+}
+
+// WatchableDiscovery 服务列表变化时可以主动通知的服务发现。
+// Watch 返回的 channel 只保留最新的服务列表，消费慢时中间的变化会被合并；cancel 之后不再通知
+type WatchableDiscovery interface {
+	Discovery
+	Watch() (updates <-chan []string, cancel func())
+}
+
 // MultiServersDiscovery 实现一个不需要注册中心，服务列表由手工维护的服务发现的结构体
 type MultiServersDiscovery struct {
 	r       *rand.Rand   // 生成随机数
 	mu      sync.RWMutex // 互斥访问控制
 	servers []string     // 服务列表
 	index   int          // 记录轮询算法已经选择的索引
+	ring    *HashRing    // 一致性哈希环，随服务列表一起更新
+	watches map[chan []string]struct{}
+
+	penalties *penaltyBox // 惩罚期内的实例不会被 Get 和 GetAll 返回，见 penalty.go
 }
 
+var _ KeyedDiscovery = (*MultiServersDiscovery)(nil)
+var _ WatchableDiscovery = (*MultiServersDiscovery)(nil)
+
 func NewMultiServerDiscovery(servers []string) *MultiServersDiscovery {
 	d := &MultiServersDiscovery{
 		// r 是一个产生随机数的实例，初始化时使用时间戳设定随机数种子，避免每次产生相同的随机数序列。
-		r:       rand.New(rand.NewSource(time.Now().UnixNano())),
-		servers: servers,
+		r: rand.New(rand.NewSource(time.Now().UnixNano())),
+
+		penalties: newPenaltyBox(),
 	}
+	d.setServers(servers)
 	// index 记录 Round Robin 算法已经轮询到的位置，为了避免每次从 0 开始，初始化时随机设定一个值。
 	d.index = d.r.Intn(math.MaxInt32 - 1)
 	return d
@@ -67,30 +118,109 @@ func (d *MultiServersDiscovery) Refresh() error {
 func (d *MultiServersDiscovery) Update(servers []string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.servers = servers
+	d.setServers(servers)
 	return nil
 }
 
+// setServers 更新服务列表并重建哈希环，服务列表变化时通知 Watch，调用方需要持有锁
+func (d *MultiServersDiscovery) setServers(servers []string) {
+	changed := !sameServers(d.servers, servers)
+	d.servers = servers
+	d.ring = New(servers, replicateCount)
+	if !changed {
+		return
+	}
+	for ch := range d.watches {
+		// 丢掉还没有被消费的旧列表，只保留最新的
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- append([]string(nil), servers...)
+	}
+}
+
+// sameServers 判断两个服务列表是否包含相同的实例，不考虑顺序
+func sameServers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]int, len(a))
+	for _, s := range a {
+		set[s]++
+	}
+	for _, s := range b {
+		if set[s] == 0 {
+			return false
+		}
+		set[s]--
+	}
+	return true
+}
+
+// Watch 订阅服务列表的变化，注册中心的服务发现在 Refresh 拿到不同的列表时通知
+func (d *MultiServersDiscovery) Watch() (<-chan []string, func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.watches == nil {
+		d.watches = make(map[chan []string]struct{})
+	}
+	ch := make(chan []string, 1)
+	d.watches[ch] = struct{}{}
+	return ch, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.watches, ch)
+	}
+}
+
 func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	n := len(d.servers)
+	servers := d.penalties.filter(d.servers)
+	n := len(servers)
 	if n == 0 {
 		return "", errors.New("rpc discovery: no available servers")
 	}
 	switch mode {
 	case RandomSelect:
-		return d.servers[d.r.Intn(n)], nil
+		return servers[d.r.Intn(n)], nil
 	case RoundRobinSelect:
-		s := d.servers[d.index%n]
+		s := servers[d.index%n]
 		d.index = (d.index + 1) % n
 		return s, nil
+	case HashRingSelect:
+		return "", errors.New("rpc discovery: hash ring select mode requires a key, use GetFor")
+	case LeastActiveSelect, P2CSelect:
+		return "", errors.New("rpc discovery: load aware select mode requires load statistics, use XClient")
 	default:
 		return "", errors.New("rpc discovery: not supported select mode")
 	}
 }
 
+// GetFor 一致性哈希策略，根据key在哈希环上选择服务实例
+func (d *MultiServersDiscovery) GetFor(key string) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.servers) == 0 {
+		return "", errors.New("rpc discovery: no available servers")
+	}
+	return d.ring.GetNode(key), nil
+}
+
+// GetAll 返回可以调用的服务实例：设置了 SetFailurePenalty 时不包括惩罚期内的实例，
+// 所有实例都在惩罚期内时返回全部实例。广播和多数派调用使用它；需要服务列表中全部实例的健康检查、预热和订阅使用 Members
 func (d *MultiServersDiscovery) GetAll() ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	kept := d.penalties.filter(d.servers)
+	servers := make([]string, len(kept), len(kept))
+	copy(servers, kept)
+	return servers, nil
+}
+
+// Members 返回所有的服务实例，包括惩罚期内的实例
+func (d *MultiServersDiscovery) Members() ([]string, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 	servers := make([]string, len(d.servers), len(d.servers))
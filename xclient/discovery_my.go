@@ -1,9 +1,17 @@
 package xclient
 
 import (
-	"log"
+	"MyRPC/client"
+	"MyRPC/logger"
+	"MyRPC/registry/regclient"
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,59 +19,356 @@ import (
 
 type MyRegistryDiscovery struct {
 	*MultiServersDiscovery
-	registry   string        // 注册中心地址
-	timeout    time.Duration // 服务列表的过期时间
-	lastUpdate time.Time     // 代表最后从注册中心更新服务列表的时间，默认 10s 过期，即 10s 之后，需要从注册中心更新新的列表
+	registries []string                          // 注册中心地址，第一个不可用时依次尝试后面的
+	current    int64                             // 当前使用的注册中心，长轮询时不持有锁，原子访问
+	timeout    time.Duration                     // 服务列表的过期时间
+	lastUpdate time.Time                         // 代表最后从注册中心更新服务列表的时间，默认 10s 过期，即 10s 之后，需要从注册中心更新新的列表
+	seeds      []string                          // 静态的种子列表，注册中心不可用时单独使用，注册中心返回后和它的列表合并
+	items      map[string]regclient.ServerItem   // 注册中心返回的服务实例信息
+	byService  map[string]*MultiServersDiscovery // 按服务名划分的服务列表，没有出现的服务名使用全部实例
+	version    string                            // 注册中心返回的服务列表版本号，长轮询时使用
+	stop       chan struct{}                     // 停止长轮询
+	watching   bool                              // 长轮询正常工作，此时 Refresh 不需要再拉取
 }
 
-const defaultUpdateTimeout = time.Second * 10
+var _ ServiceDiscovery = (*MyRegistryDiscovery)(nil)
+
+// DefaultUpdateTimeout 服务列表默认的过期时间
+const DefaultUpdateTimeout = time.Second * 10
 
 func NewMyRegistryDiscovery(registerAddr string, timeout time.Duration) *MyRegistryDiscovery {
 	if timeout == 0 {
-		timeout = defaultUpdateTimeout
+		timeout = DefaultUpdateTimeout
 	}
 	d := &MyRegistryDiscovery{
 		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
-		registry:              registerAddr,
+		registries:            []string{registerAddr},
 		timeout:               timeout,
 	}
 	return d
 }
 
+// NewMyRegistryDiscoveryWithSeeds 带有种子列表的服务发现，改善冷启动：
+// 启动时注册中心还不可用的话先使用种子列表；注册中心返回后使用注册中心的列表和种子列表合并的结果，
+// 种子没有上报服务名，属于所有服务；之后注册中心暂时不可用时继续使用上一次的列表，而不是让调用失败，
+// 并且等到 timeout 过期后再重试，不会每次调用都访问注册中心
+func NewMyRegistryDiscoveryWithSeeds(registerAddr string, timeout time.Duration, seeds []string) *MyRegistryDiscovery {
+	d := NewMyRegistryDiscovery(registerAddr, timeout)
+	d.seeds = seeds
+	d.setServers(seeds)
+	return d
+}
+
+// NewMyRegistryDiscoveryWithEndpoints 使用多个注册中心的服务发现，当前的注册中心不可用时切换到下一个
+func NewMyRegistryDiscoveryWithEndpoints(registries []string, timeout time.Duration) *MyRegistryDiscovery {
+	d := NewMyRegistryDiscovery("", timeout)
+	d.registries = registries
+	return d
+}
+
 // Update 更新服务中心的服务列表
 func (d *MyRegistryDiscovery) Update(servers []string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.servers = servers
+	d.setServers(servers)
+	d.byService = nil
 	d.lastUpdate = time.Now()
 	return nil
 }
 
 // Refresh 刷新本地的服务列表
 func (d *MyRegistryDiscovery) Refresh() error {
+	return d.RefreshContext(context.Background())
+}
+
+// RefreshContext 和 Refresh 相同，ctx 结束时放弃向注册中心的请求
+func (d *MyRegistryDiscovery) RefreshContext(ctx context.Context) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	// 没超时
-	if d.lastUpdate.Add(d.timeout).After(time.Now()) {
+	// 没超时，或者长轮询正在推送变化
+	if d.watching || d.lastUpdate.Add(d.timeout).After(time.Now()) {
 		return nil
 	}
-	log.Println("rpc registry: refresh servers from registry", d.registry)
-	resp, err := http.Get(d.registry)
+	items, version, err := d.fetch(ctx, "", 0)
 	if err != nil {
-		log.Println("rpc registry refresh err:", err)
+		logger.Warnf("rpc registry refresh err: %v", err)
+		// 有种子列表时继续使用当前的列表，过期后再重试
+		if len(d.seeds) > 0 {
+			d.lastUpdate = time.Now()
+			return nil
+		}
 		return err
 	}
-	servers := strings.Split(resp.Header.Get("X-Myrpc-Servers"), ",")
-	d.servers = make([]string, 0, len(servers))
-	for _, server := range servers {
-		if strings.TrimSpace(server) != "" {
-			d.servers = append(d.servers, strings.TrimSpace(server))
+	d.apply(items, version)
+	return nil
+}
+
+// apply 使用注册中心返回的服务列表，调用方需要持有锁
+func (d *MyRegistryDiscovery) apply(items []regclient.ServerItem, version string) {
+	items = reachable(items)
+	d.items = make(map[string]regclient.ServerItem, len(items))
+	for _, item := range items {
+		d.items[item.Addr] = item
+	}
+	// 合并种子列表，注册中心已经返回的地址以注册中心的信息为准
+	for _, seed := range d.seeds {
+		if _, ok := d.items[seed]; !ok {
+			items = append(items, regclient.ServerItem{Addr: seed})
 		}
 	}
+	alive := make([]string, 0, len(items))
+	for _, item := range items {
+		alive = append(alive, item.Addr)
+	}
+	d.byService = groupByService(items)
+	for _, sd := range d.byService {
+		sd.penalties = d.penalties
+	}
+	d.setServers(alive)
+	d.version = version
 	d.lastUpdate = time.Now()
+}
+
+// reachable 去掉其他主机上只在本机可达的实例，比如 unix@ 地址
+func reachable(items []regclient.ServerItem) []regclient.ServerItem {
+	kept := items[:0:0]
+	for _, item := range items {
+		if client.LocalOnly(item.Addr) && item.Host != "" && item.Host != client.Hostname() {
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return kept
+}
+
+// StartWatching 在后台对注册中心长轮询，服务列表一变化就更新，而不是等 timeout 过期后再拉取。
+// wait 是每次长轮询的最长等待时间，为0时使用注册中心的默认值。注册中心不支持长轮询时退回到每 timeout 拉取一次，
+// 调用 Close 停止
+func (d *MyRegistryDiscovery) StartWatching(wait time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stop != nil {
+		return
+	}
+	d.stop = make(chan struct{})
+	go d.watchLoop(d.stop, wait)
+}
+
+// Close 停止长轮询
+func (d *MyRegistryDiscovery) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+		d.watching = false
+	}
 	return nil
 }
 
+func (d *MyRegistryDiscovery) watchLoop(stop chan struct{}, wait time.Duration) {
+	// Close 时取消正在进行的长轮询
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		d.mu.RLock()
+		version := d.version
+		d.mu.RUnlock()
+		// 长轮询期间不持有锁，Get 仍然可以使用当前的列表
+		items, newVersion, err := d.fetch(ctx, version, wait)
+		var pause time.Duration
+		switch {
+		case err != nil:
+			logger.Warnf("rpc registry watch err: %v", err)
+			pause = watchRetryInterval
+		case newVersion == "":
+			// 老的注册中心没有版本号，会立即返回，退回到定期拉取
+			pause = d.timeout
+			if pause < watchRetryInterval {
+				pause = watchRetryInterval
+			}
+		}
+		d.mu.Lock()
+		if d.stop != stop { // 已经 Close
+			d.mu.Unlock()
+			return
+		}
+		if err == nil {
+			d.apply(items, newVersion)
+		}
+		d.watching = err == nil && pause == 0
+		d.mu.Unlock()
+		if pause > 0 {
+			select {
+			case <-time.After(pause):
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+// watchRetryInterval 长轮询失败后重试的间隔
+const watchRetryInterval = time.Second
+
+// groupByService 按服务名划分服务实例，没有上报服务名的实例属于所有服务
+func groupByService(items []regclient.ServerItem) map[string]*MultiServersDiscovery {
+	names := make(map[string]bool)
+	for _, item := range items {
+		for _, name := range item.Services {
+			names[name] = true
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	byService := make(map[string]*MultiServersDiscovery, len(names))
+	for name := range names {
+		var servers []string
+		for i := range items {
+			if items[i].HasService(name) {
+				servers = append(servers, items[i].Addr)
+			}
+		}
+		byService[name] = NewMultiServerDiscovery(servers)
+	}
+	return byService
+}
+
+// service 返回提供 service 的服务列表，注册中心没有上报服务名时返回全部实例
+func (d *MyRegistryDiscovery) service(service string) *MultiServersDiscovery {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if sd := d.byService[service]; sd != nil {
+		return sd
+	}
+	return d.MultiServersDiscovery
+}
+
+func (d *MyRegistryDiscovery) GetService(service string, mode SelectMode) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.service(service).Get(mode)
+}
+
+func (d *MyRegistryDiscovery) GetServiceFor(service, key string) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.service(service).GetFor(key)
+}
+
+func (d *MyRegistryDiscovery) GetAllService(service string) ([]string, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.service(service).GetAll()
+}
+
+// fetch 从当前的注册中心获取服务列表，失败时依次尝试其他注册中心，成功的注册中心作为之后的当前注册中心。
+// version 不为空时是长轮询，注册中心等到服务列表的版本号变化或者 wait 超时再返回
+func (d *MyRegistryDiscovery) fetch(ctx context.Context, version string, wait time.Duration) ([]regclient.ServerItem, string, error) {
+	var err error
+	current := int(atomic.LoadInt64(&d.current))
+	for i := 0; i < len(d.registries); i++ {
+		idx := (current + i) % len(d.registries)
+		addr := d.registries[idx]
+		logger.Debugf("rpc registry: refresh servers from registry %s", addr)
+		var items []regclient.ServerItem
+		var newVersion string
+		if items, newVersion, err = fetchServers(ctx, addr, version, wait); err == nil {
+			atomic.StoreInt64(&d.current, int64(idx))
+			return items, newVersion, nil
+		}
+		logger.Warnf("rpc registry: registry %s unavailable: %v", addr, err)
+		if ctx.Err() != nil { // ctx 已经结束，不再尝试其他注册中心
+			return nil, "", err
+		}
+	}
+	if err == nil {
+		err = errors.New("rpc registry: no registry configured")
+	}
+	return nil, "", err
+}
+
+// fetchServers 优先使用注册中心的 Json 接口，老版本的注册中心没有这个接口时回退到请求头
+func fetchServers(ctx context.Context, registryAddr, version string, wait time.Duration) ([]regclient.ServerItem, string, error) {
+	q := url.Values{}
+	if version != "" {
+		q.Set("version", version)
+		if wait > 0 {
+			q.Set("wait", wait.String())
+		}
+	}
+	serversURL := strings.TrimSuffix(registryAddr, "/") + "/servers"
+	if len(q) > 0 {
+		serversURL += "?" + q.Encode()
+	}
+	hc := registryClient
+	if version != "" {
+		// 长轮询要等到服务列表变化，超时时间加上等待的时间
+		if wait <= 0 {
+			wait = defaultLongPollWait
+		}
+		hc = &http.Client{Timeout: registryClient.Timeout + wait}
+	}
+	resp, err := get(ctx, hc, serversURL)
+	if err == nil && resp.StatusCode == http.StatusNotFound {
+		_ = resp.Body.Close()
+		resp, err = get(ctx, hc, registryAddr)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errors.New("rpc registry: unexpected status " + resp.Status)
+	}
+	var items []regclient.ServerItem
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+			return nil, "", err
+		}
+		return items, resp.Header.Get("X-Myrpc-Version"), nil
+	}
+	for _, server := range strings.Split(resp.Header.Get("X-Myrpc-Servers"), ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			items = append(items, regclient.ServerItem{Addr: server})
+		}
+	}
+	return items, "", nil
+}
+
+// registryClient 访问注册中心使用的客户端，注册中心没有响应时请求最多等待 Timeout，不会一直持有 d.mu
+var registryClient = &http.Client{Timeout: 10 * time.Second}
+
+// defaultLongPollWait 注册中心默认的长轮询等待时间
+const defaultLongPollWait = 30 * time.Second
+
+func get(ctx context.Context, hc *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return hc.Do(req)
+}
+
+// ServerItem 返回注册中心上报的服务实例信息，使用老接口的注册中心只有地址
+func (d *MyRegistryDiscovery) ServerItem(addr string) (regclient.ServerItem, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	item, ok := d.items[addr]
+	return item, ok
+}
+
 func (d *MyRegistryDiscovery) Get(mode SelectMode) (string, error) {
 	// 先确保服务列表没有过期
 	if err := d.Refresh(); err != nil {
@@ -72,9 +377,39 @@ func (d *MyRegistryDiscovery) Get(mode SelectMode) (string, error) {
 	return d.MultiServersDiscovery.Get(mode)
 }
 
+func (d *MyRegistryDiscovery) GetFor(key string) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServersDiscovery.GetFor(key)
+}
+
 func (d *MyRegistryDiscovery) GetAll() ([]string, error) {
 	if err := d.Refresh(); err != nil {
 		return nil, err
 	}
 	return d.MultiServersDiscovery.GetAll()
 }
+
+func (d *MyRegistryDiscovery) Members() ([]string, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.MultiServersDiscovery.Members()
+}
+
+// LoadSeedFile 从文件中读取种子列表，每行一个 protocol@addr，忽略空行和 # 开头的注释
+func LoadSeedFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var seeds []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			seeds = append(seeds, line)
+		}
+	}
+	return seeds, nil
+}
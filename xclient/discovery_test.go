@@ -0,0 +1,381 @@
+package xclient
+
+import (
+	"MyRPC"
+	"MyRPC/registry"
+	"MyRPC/registry/registrytest"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMyRegistryDiscovery_Refresh(t *testing.T) {
+	r, ts := registrytest.Start("tcp@a", "tcp@b")
+	defer ts.Close()
+	r.Script(registrytest.Step{Fail: true})
+
+	// 设置一个很小的过期时间，保证每次 Get 都会访问注册中心
+	d := NewMyRegistryDiscovery(ts.URL, time.Nanosecond)
+	if _, err := d.GetAll(); err == nil {
+		t.Fatal("expect an error when registry fails")
+	}
+	servers, err := d.GetAll()
+	if err != nil || len(servers) != 2 {
+		t.Fatalf("expect 2 servers, but got %v, err: %v", servers, err)
+	}
+
+	r.SetServers("tcp@c")
+	if s, err := d.Get(RoundRobinSelect); err != nil || s != "tcp@c" {
+		t.Fatalf("expect tcp@c, but got %s, err: %v", s, err)
+	}
+	if r.Gets() != 3 {
+		t.Fatalf("expect 3 requests to registry, but got %d", r.Gets())
+	}
+}
+
+func TestMultiServersDiscovery_GetFor(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"tcp@a", "tcp@b", "tcp@c"})
+	if _, err := d.Get(HashRingSelect); err == nil {
+		t.Fatal("expect an error when hash ring select without key")
+	}
+	s1, _ := d.GetFor("Foo.Sum:{1 2}")
+	s2, _ := d.GetFor("Foo.Sum:{1 2}")
+	if s1 == "" || s1 != s2 {
+		t.Fatalf("expect the same server for the same key, but got %s and %s", s1, s2)
+	}
+	_ = d.Update([]string{s1})
+	if s, _ := d.GetFor("Foo.Sum:{3 4}"); s != s1 {
+		t.Fatalf("expect %s after update, but got %s", s1, s)
+	}
+}
+
+func TestMyRegistryDiscovery_Seeds(t *testing.T) {
+	r, ts := registrytest.Start()
+	defer ts.Close()
+	r.Script(registrytest.Step{Fail: true})
+
+	d := NewMyRegistryDiscoveryWithSeeds(ts.URL, time.Nanosecond, []string{"tcp@seed"})
+	if servers, err := d.GetAll(); err != nil || len(servers) != 1 || servers[0] != "tcp@seed" {
+		t.Fatalf("expect seeds when registry fails, but got %v, err: %v", servers, err)
+	}
+	// 注册中心返回后和种子列表合并
+	r.SetServers("tcp@a", "tcp@seed")
+	if servers, err := d.GetAll(); err != nil || len(servers) != 2 {
+		t.Fatalf("expect registry servers merged with seeds, but got %v, err: %v", servers, err)
+	}
+	r.SetServers("tcp@a")
+	if servers, err := d.GetAll(); err != nil || len(servers) != 2 || servers[0] != "tcp@a" || servers[1] != "tcp@seed" {
+		t.Fatalf("expect seeds kept after the registry responds, but got %v, err: %v", servers, err)
+	}
+}
+
+func TestMyRegistryDiscovery_SeedsBackoff(t *testing.T) {
+	r, ts := registrytest.Start()
+	defer ts.Close()
+	r.FailNext(100)
+
+	// 注册中心不可用时使用种子列表，过期之前不再访问注册中心
+	d := NewMyRegistryDiscoveryWithSeeds(ts.URL, time.Minute, []string{"tcp@seed"})
+	for i := 0; i < 5; i++ {
+		if _, err := d.Get(RandomSelect); err != nil {
+			t.Fatalf("expect the seed, got %v", err)
+		}
+	}
+	if n := r.Gets(); n != 1 {
+		t.Fatalf("expect one fetch before the list expires, got %d", n)
+	}
+}
+
+func TestMyRegistryDiscovery_JSON(t *testing.T) {
+	r := registry.New(time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	body := `{"addr":"tcp@a","weight":3,"protocol":"tcp","tags":["blue"]}`
+	resp, err := http.Post(ts.URL+"/register", "application/json", strings.NewReader(body))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to register: %v", err)
+	}
+	_ = resp.Body.Close()
+	req, _ := http.NewRequest("POST", ts.URL, nil)
+	req.Header.Set("X-Myrpc-Server", "tcp@b")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	d := NewMyRegistryDiscovery(ts.URL, time.Nanosecond)
+	servers, err := d.GetAll()
+	if err != nil || len(servers) != 2 {
+		t.Fatalf("expect 2 servers, got %v, %v", servers, err)
+	}
+	item, ok := d.ServerItem("tcp@a")
+	if !ok || item.Weight != 3 || len(item.Tags) != 1 || item.LastHeartbeat.IsZero() {
+		t.Fatalf("wrong server item %+v", item)
+	}
+}
+
+func TestMyRegistryDiscovery_Unix(t *testing.T) {
+	r := registry.New(time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	register := func(addr, host string) {
+		req, _ := http.NewRequest("POST", ts.URL, nil)
+		req.Header.Set("X-Myrpc-Server", addr)
+		req.Header.Set("X-Myrpc-Host", host)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+	register("unix@/tmp/local.sock", MyRPC.Hostname())
+	register("unix@/tmp/remote.sock", "some-other-host")
+	register("tcp@10.0.0.1:9999", "some-other-host")
+
+	d := NewMyRegistryDiscovery(ts.URL, time.Nanosecond)
+	servers, err := d.GetAll()
+	if err != nil || len(servers) != 2 || servers[0] != "tcp@10.0.0.1:9999" || servers[1] != "unix@/tmp/local.sock" {
+		t.Fatalf("expect unix sockets of other hosts skipped, got %v, %v", servers, err)
+	}
+	if item, _ := d.ServerItem("unix@/tmp/local.sock"); item.Host != MyRPC.Hostname() {
+		t.Fatalf("expect host reported, got %+v", item)
+	}
+}
+
+func TestMyRegistryDiscovery_Failover(t *testing.T) {
+	down, ts1 := registrytest.Start()
+	defer ts1.Close()
+	down.FailNext(100)
+	_, ts2 := registrytest.Start("tcp@a")
+	defer ts2.Close()
+
+	d := NewMyRegistryDiscoveryWithEndpoints([]string{ts1.URL, ts2.URL}, time.Nanosecond)
+	servers, err := d.GetAll()
+	if err != nil || len(servers) != 1 {
+		t.Fatalf("expect to fail over to the second registry, got %v, %v", servers, err)
+	}
+	gets := down.Gets()
+	if _, err = d.GetAll(); err != nil || down.Gets() != gets {
+		t.Fatalf("expect the healthy registry to be used afterwards, err %v", err)
+	}
+}
+
+func TestMyRegistryDiscovery_GetService(t *testing.T) {
+	ts := httptest.NewServer(registry.New(time.Minute))
+	defer ts.Close()
+	for addr, services := range map[string]string{"tcp@a": "Foo", "tcp@b": "Bar", "tcp@c": ""} {
+		req, _ := http.NewRequest("POST", ts.URL, nil)
+		req.Header.Set("X-Myrpc-Server", addr)
+		if services != "" {
+			req.Header.Set("X-Myrpc-Services", services)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+
+	d := NewMyRegistryDiscovery(ts.URL, time.Nanosecond)
+	if servers, err := d.GetAllService("Foo"); err != nil || strings.Join(servers, ",") != "tcp@a,tcp@c" {
+		t.Fatalf("expect servers providing Foo, got %v, %v", servers, err)
+	}
+	if servers, err := d.GetAllService("Baz"); err != nil || len(servers) != 3 {
+		t.Fatalf("expect all servers for unknown service, got %v, %v", servers, err)
+	}
+	for i := 0; i < 10; i++ {
+		if s, err := d.GetService("Bar", RandomSelect); err != nil || s == "tcp@a" {
+			t.Fatalf("expect tcp@a never selected for Bar, got %s, %v", s, err)
+		}
+	}
+}
+
+func TestMultiServersDiscovery_Watch(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"tcp@a"})
+	updates, cancel := d.Watch()
+	_ = d.Update([]string{"tcp@a"}) // 列表没有变化，不通知
+	_ = d.Update([]string{"tcp@a", "tcp@b"})
+	_ = d.Update([]string{"tcp@b"})
+	if servers := <-updates; strings.Join(servers, ",") != "tcp@b" {
+		t.Fatalf("expect only the latest servers, got %v", servers)
+	}
+	select {
+	case servers := <-updates:
+		t.Fatalf("expect no more updates, got %v", servers)
+	default:
+	}
+	cancel()
+	_ = d.Update([]string{"tcp@c"})
+	select {
+	case servers := <-updates:
+		t.Fatalf("expect no updates after cancel, got %v", servers)
+	default:
+	}
+}
+
+func TestMultiServersDiscovery_Subscribe(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"tcp@a"})
+	events := make(chan string, 4)
+	cancel := d.Subscribe(func(added, removed []string) {
+		events <- strings.Join(added, ",") + "/" + strings.Join(removed, ",")
+	})
+	expect := func(want string) {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("expect added/removed %s, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect %s within 1s", want)
+		}
+	}
+	expect("tcp@a/")
+	_ = d.Update([]string{"tcp@a", "tcp@b"})
+	expect("tcp@b/")
+	_ = d.Update([]string{"tcp@c"})
+	expect("tcp@c/tcp@a,tcp@b")
+
+	cancel()
+	_ = d.Update([]string{"tcp@d"})
+	select {
+	case got := <-events:
+		t.Fatalf("expect no callbacks after cancel, got %s", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMultiServersDiscovery_FailurePenalty(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"tcp@a", "tcp@b"})
+	d.ReportFailure("tcp@a") // 没有开启时不惩罚
+	if servers, _ := d.GetAll(); len(servers) != 2 {
+		t.Fatalf("expect no penalty by default, got %v", servers)
+	}
+	d.SetFailurePenalty(50*time.Millisecond, time.Second)
+	d.ReportFailure("tcp@a")
+	for i := 0; i < 5; i++ {
+		if s, _ := d.Get(RandomSelect); s != "tcp@b" {
+			t.Fatalf("expect tcp@a excluded, got %s", s)
+		}
+	}
+	if servers, _ := d.GetAll(); strings.Join(servers, ",") != "tcp@b" {
+		t.Fatalf("expect GetAll to exclude tcp@a, got %v", servers)
+	}
+	if servers, _ := d.Members(); len(servers) != 2 {
+		t.Fatalf("expect Members to keep penalized servers, got %v", servers)
+	}
+	// 都在惩罚期内时返回全部实例
+	d.ReportFailure("tcp@b")
+	if servers, _ := d.GetAll(); len(servers) != 2 {
+		t.Fatalf("expect all servers when all are penalized, got %v", servers)
+	}
+	d.ReportSuccess("tcp@b")
+	if servers, _ := d.GetAll(); strings.Join(servers, ",") != "tcp@b" {
+		t.Fatalf("expect tcp@b back after a success, got %v", servers)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if servers, _ := d.GetAll(); len(servers) != 2 {
+		t.Fatalf("expect tcp@a back after the penalty, got %v", servers)
+	}
+	// 连续失败时惩罚期翻倍
+	d.ReportFailure("tcp@a")
+	time.Sleep(60 * time.Millisecond)
+	if servers, _ := d.GetAll(); strings.Join(servers, ",") != "tcp@b" {
+		t.Fatalf("expect a doubled penalty for tcp@a, got %v", servers)
+	}
+}
+
+func TestRegisterDiscoveryProvider(t *testing.T) {
+	if _, err := NewDiscovery("consul://127.0.0.1:8500/Foo"); err == nil {
+		t.Fatal("expect an error for unknown provider")
+	}
+	RegisterDiscoveryProvider("consul", func(target *url.URL) (Discovery, error) {
+		return NewMultiServerDiscovery([]string{"tcp@" + target.Host}), nil
+	})
+	d, err := NewDiscovery("consul://127.0.0.1:8500/Foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := d.Get(RandomSelect); err != nil || s != "tcp@127.0.0.1:8500" {
+		t.Fatalf("expect discovery from registered provider, got %s, %v", s, err)
+	}
+	if d, err := NewDiscovery("static:///tcp@a,tcp@b"); err != nil {
+		t.Fatal(err)
+	} else if servers, _ := d.GetAll(); len(servers) != 2 {
+		t.Fatalf("expect 2 static servers, got %v", servers)
+	}
+}
+
+func TestMyRegistryDiscovery_Watch(t *testing.T) {
+	ts := httptest.NewServer(registry.New(time.Minute))
+	defer ts.Close()
+	register := func(method, addr string) {
+		req, _ := http.NewRequest(method, ts.URL, nil)
+		req.Header.Set("X-Myrpc-Server", addr)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+	register("POST", "tcp@a")
+
+	// 过期时间很长，只有推送才能让列表及时更新
+	d := NewMyRegistryDiscovery(ts.URL, time.Hour)
+	d.StartWatching(time.Second)
+	defer func() { _ = d.Close() }()
+	updates, cancel := d.Watch()
+	defer cancel()
+	expect := func(want string) {
+		select {
+		case servers := <-updates:
+			if strings.Join(servers, ",") != want {
+				t.Fatalf("expect %s, got %v", want, servers)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect %s pushed within 1s", want)
+		}
+	}
+	expect("tcp@a")
+	register("POST", "tcp@b")
+	expect("tcp@a,tcp@b")
+	register("DELETE", "tcp@a")
+	expect("tcp@b")
+	if servers, err := d.GetAll(); err != nil || strings.Join(servers, ",") != "tcp@b" {
+		t.Fatalf("expect tcp@b, got %v, %v", servers, err)
+	}
+}
+
+func TestMyRegistryDiscovery_RefreshContext(t *testing.T) {
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-hang:
+		case <-req.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(hang)
+
+	// 注册中心不响应时，调用在自己的截止时间内返回，而不是等待 Refresh 的请求
+	xc := NewXClient(NewMyRegistryDiscovery(ts.URL, time.Nanosecond), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var reply int
+	err := xc.Call(ctx, "Foo.Sum", [2]int{1, 2}, &reply)
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Fatalf("expect the ctx error, got %v", err)
+	}
+	if _, err := xc.BroadcastAll(ctx, "Foo.Sum", [2]int{1, 2}, &reply); err == nil {
+		t.Fatal("expect broadcast to fail with the ctx")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expect to give up when ctx is done, took %v", elapsed)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package xclient
+
+func fdUsage() (used, limit int, ok bool) {
+	return 0, 0, false
+}
+
+func isTooManyFiles(err error) bool {
+	return false
+}
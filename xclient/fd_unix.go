@@ -0,0 +1,33 @@
+//go:build linux || darwin || freebsd
+
+package xclient
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// fdUsage 返回进程当前打开的文件描述符数量和上限，无法获取时ok为false
+func fdUsage() (used, limit int, ok bool) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, 0, false
+	}
+	dir := "/dev/fd"
+	if runtime.GOOS == "linux" {
+		dir = "/proc/self/fd"
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0, false
+	}
+	return len(entries), int(rl.Cur), true
+}
+
+// isTooManyFiles 判断是否是文件描述符耗尽的错误
+func isTooManyFiles(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && (errno == syscall.EMFILE || errno == syscall.ENFILE)
+}
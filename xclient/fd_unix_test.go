@@ -0,0 +1,110 @@
+//go:build linux || darwin || freebsd
+
+package xclient
+
+import (
+	"MyRPC"
+	"MyRPC/callopt"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+func TestIsTooManyFiles(t *testing.T) {
+	for _, err := range []error{
+		syscall.EMFILE,
+		syscall.ENFILE,
+		&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("socket", syscall.EMFILE)},
+		fmt.Errorf("rpc client: %w", os.NewSyscallError("socket", syscall.ENFILE)),
+	} {
+		if !isTooManyFiles(err) {
+			t.Fatalf("expect %v to be too many open files", err)
+		}
+	}
+	for _, err := range []error{nil, errors.New("too many open files"), syscall.ECONNREFUSED} {
+		if isTooManyFiles(err) {
+			t.Fatalf("expect %v not to be too many open files", err)
+		}
+	}
+}
+
+// 阈值极低时每次新建连接前都会淘汰缓存的连接，最久没有使用的先被淘汰，连带它的实例ID
+func TestXClient_FDPressure(t *testing.T) {
+	if _, _, ok := fdUsage(); !ok {
+		t.Skip("file descriptor usage is not available")
+	}
+	a, b := startServer(t), startServer(t)
+	xc := NewXClient(NewMultiServerDiscovery([]string{a, b}), RandomSelect, nil, WithFDPressure(1e-9))
+	defer func() { _ = xc.Close() }()
+
+	var reply int
+	if err := xc.Call(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply, callopt.WithTarget(a)); err != nil {
+		t.Fatal(err)
+	}
+	old := xc.cached()[a]
+	if err := xc.Call(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply, callopt.WithTarget(b)); err != nil {
+		t.Fatal(err)
+	}
+	if xc.Evicted() != 1 || xc.Stats().FDEvicted != 1 {
+		t.Fatalf("expect one client evicted, got %d", xc.Evicted())
+	}
+	if xc.cached()[a] != nil || old.IsAvailable() {
+		t.Fatalf("expect the least recently used client of %s closed", a)
+	}
+	xc.mu.Lock()
+	_, ok := xc.instances[a]
+	xc.mu.Unlock()
+	if ok {
+		t.Fatalf("expect the instance of the evicted client of %s forgotten", a)
+	}
+
+	// 阈值为0时不检查
+	xc.fdThreshold = 0
+	xc.mu.Lock()
+	xc.relieveFDPressure()
+	xc.mu.Unlock()
+	if xc.cached()[b] == nil {
+		t.Fatal("expect no eviction without a threshold")
+	}
+}
+
+// Dial 因为文件描述符耗尽失败时，淘汰一半缓存连接后重试一次
+func TestXClient_DialTooManyFiles(t *testing.T) {
+	a, b := startServer(t), startServer(t)
+	var failures int32
+	MyRPC.RegisterSchemeContext("emfile", func(ctx context.Context, addr string, opts ...*MyRPC.Option) (*MyRPC.Client, error) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("socket", syscall.EMFILE)}
+		}
+		return MyRPC.DialContext(ctx, "tcp", addr, opts...)
+	})
+	target := "emfile@" + strings.TrimPrefix(b, "tcp@")
+	xc := NewXClient(NewMultiServerDiscovery([]string{a, target}), RandomSelect, nil, WithFDPressure(1))
+	defer func() { _ = xc.Close() }()
+
+	var reply int
+	if err := xc.Call(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply, callopt.WithTarget(a)); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&failures, 1)
+	if err := xc.Call(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply, callopt.WithTarget(target)); err != nil {
+		t.Fatalf("expect the dial retried after eviction, got %v", err)
+	}
+	if xc.Evicted() != 1 || xc.cached()[a] != nil || xc.cached()[target] == nil {
+		t.Fatalf("expect the client of %s evicted to make room, evicted %d", a, xc.Evicted())
+	}
+
+	// 没有缓存连接可以淘汰时不重试
+	_ = xc.Close()
+	xc = NewXClient(NewMultiServerDiscovery([]string{target}), RandomSelect, nil, WithFDPressure(1))
+	atomic.StoreInt32(&failures, 1)
+	if err := xc.Call(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply); !isTooManyFiles(err) {
+		t.Fatalf("expect too many open files, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package xclient
+
+import (
+	"MyRPC/client"
+	"MyRPC/logger"
+	"context"
+	"sort"
+	"time"
+)
+
+//
+// 文件描述符压力
+// XClient 为每个实例缓存一个连接，实例很多时进程可能接近文件描述符上限，之后的 Dial 会在随机的调用点上报 EMFILE。
+// 开启后，每次新建连接前检查文件描述符的使用率，超过阈值时主动关闭最久没有使用的缓存连接并打印警告；
+// Dial 仍然因为 EMFILE 失败时，再淘汰一半缓存连接后重试一次
+//
+
+// WithFDPressure 文件描述符使用率超过 threshold（0~1）时淘汰最久没有使用的缓存连接
+func WithFDPressure(threshold float64) XOption {
+	return func(xc *XClient) {
+		xc.fdThreshold = threshold
+	}
+}
+
+// relieveFDPressure 根据文件描述符使用率淘汰缓存连接，调用方需要持有锁
+func (xc *XClient) relieveFDPressure() {
+	if xc.fdThreshold <= 0 {
+		return
+	}
+	used, limit, ok := fdUsage()
+	if !ok || limit <= 0 || float64(used) < float64(limit)*xc.fdThreshold {
+		return
+	}
+	// 至少关闭一个，最多关闭到使用率低于阈值
+	n := used - int(float64(limit)*xc.fdThreshold) + 1
+	logger.Warnf("rpc xclient: file descriptors near limit (%d/%d), closing %d idle clients", used, limit, n)
+	xc.evictLRU(n)
+}
+
+// evictLRU 关闭最久没有使用的n个缓存连接，调用方需要持有锁
+func (xc *XClient) evictLRU(n int) int {
+	keys := make([]string, 0, len(xc.clients))
+	for key := range xc.clients {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return xc.lastUsed[keys[i]].Before(xc.lastUsed[keys[j]])
+	})
+	if n > len(keys) {
+		n = len(keys)
+	}
+	for _, key := range keys[:n] {
+		_ = xc.clients[key].Close()
+		delete(xc.clients, key)
+		delete(xc.lastUsed, key)
+		delete(xc.instances, key)
+		if xc.health != nil {
+			delete(xc.health.pings, key)
+		}
+	}
+	xc.evicted += uint64(n)
+	return n
+}
+
+// dialWithEviction 新建连接，因为文件描述符耗尽失败时淘汰一半缓存连接后重试一次，调用方需要持有锁
+func (xc *XClient) dialWithEviction(ctx context.Context, rpcAddr string, opt *client.Option) (*client.Client, error) {
+	xc.relieveFDPressure()
+	c, err := client.XDialContext(ctx, rpcAddr, opt)
+	if err != nil && xc.fdThreshold > 0 && isTooManyFiles(err) {
+		if n := xc.evictLRU((len(xc.clients) + 1) / 2); n > 0 {
+			logger.Warnf("rpc xclient: too many open files, closed %d idle clients and retry", n)
+			c, err = client.XDialContext(ctx, rpcAddr, opt)
+		}
+	}
+	return c, err
+}
+
+// touch 记录实例最近一次使用的时间，调用方需要持有锁
+func (xc *XClient) touch(rpcAddr string) {
+	xc.lastUsed[rpcAddr] = time.Now()
+}
+
+// Evicted 返回因为文件描述符压力被关闭的缓存连接数
+func (xc *XClient) Evicted() uint64 {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	return xc.evicted
+}
@@ -0,0 +1,154 @@
+package xclient
+
+import (
+	"MyRPC/client"
+	"MyRPC/logger"
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// 后台健康检查
+// 缓存的连接只有在调用时才会发现已经断开，这次调用就失败了。开启健康检查后，XClient 定期 ping 所有缓存的连接，
+// 没有按时回复的连接被关闭并移出缓存，下一次调用重新建立连接；同时从服务发现获取服务列表，
+// 关闭已经下线的实例的连接，为新实例提前建立连接。服务发现支持 Watch 时变化会立即同步，见 watch.go
+//
+
+// WithHealthCheck 每隔 interval 检查一次缓存的连接，ping 超过 timeout 没有回复的连接被关闭，timeout 为0时等于 interval
+func WithHealthCheck(interval, timeout time.Duration) XOption {
+	return func(xc *XClient) {
+		if timeout <= 0 {
+			timeout = interval
+		}
+		xc.health = &healthCheck{interval: interval, timeout: timeout, pings: make(map[string]pingResult)}
+	}
+}
+
+type healthCheck struct {
+	interval time.Duration
+	timeout  time.Duration
+	pings    map[string]pingResult // 每个缓存连接最近一次 ping 的结果，由 XClient.mu 保护
+	rounds   uint64                // 完成的检查轮数
+	evicted  uint64                // 因为 ping 失败关闭的连接数
+}
+
+type pingResult struct {
+	at  time.Time
+	rtt time.Duration
+}
+
+// healthLoop 定期检查，XClient 关闭后退出
+func (xc *XClient) healthLoop() {
+	t := time.NewTicker(xc.health.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			xc.checkHealth()
+		case <-xc.done:
+			return
+		}
+	}
+}
+
+// checkHealth 并发 ping 所有缓存的连接，然后和服务列表同步
+func (xc *XClient) checkHealth() {
+	xc.mu.Lock()
+	clients := make(map[string]*client.Client, len(xc.clients))
+	for key, c := range xc.clients {
+		clients[key] = c
+	}
+	xc.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for key, c := range clients {
+		wg.Add(1)
+		go func(key string, c *client.Client) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), xc.health.timeout)
+			defer cancel()
+			start := time.Now()
+			err := c.Ping(ctx)
+			xc.mu.Lock()
+			defer xc.mu.Unlock()
+			// 检查期间连接可能已经被替换
+			if xc.clients[key] != c {
+				return
+			}
+			if err == nil {
+				xc.health.pings[key] = pingResult{at: start, rtt: time.Since(start)}
+				return
+			}
+			logger.Warnf("rpc xclient: health check of %s failed, close the client: %v", key, err)
+			_ = c.Close()
+			delete(xc.clients, key)
+			delete(xc.lastUsed, key)
+			delete(xc.instances, key)
+			delete(xc.health.pings, key)
+			atomic.AddUint64(&xc.health.evicted, 1)
+		}(key, c)
+	}
+	wg.Wait()
+
+	if servers, err := members(xc.d); err == nil {
+		xc.sync(servers)
+	} else {
+		logger.Warnf("rpc xclient: health check get servers error: %v", err)
+	}
+	atomic.AddUint64(&xc.health.rounds, 1)
+}
+
+// ConnStats 一个缓存连接的状态
+type ConnStats struct {
+	Key       string        // 缓存键，非默认编码方式的连接带有 #codec 后缀
+	Addr      string        // 实例地址
+	Available bool          // 连接是否可用
+	Pending   int           // 等待响应的调用数
+	LastUsed  time.Time     // 最近一次被调用选中的时间
+	LastPing  time.Time     // 最近一次健康检查成功的时间，没有开启健康检查时为零值
+	PingRTT   time.Duration // 最近一次健康检查的往返时间
+}
+
+// Stats XClient 的连接缓存、健康检查和响应缓存的统计
+type Stats struct {
+	Conns         []ConnStats // 缓存的连接，按 Key 排序
+	HealthChecks  uint64      // 完成的健康检查轮数
+	HealthEvicted uint64      // 因为健康检查失败关闭的连接数
+	FDEvicted     uint64      // 因为文件描述符压力关闭的连接数，同 Evicted
+	CacheHits     uint64      // 响应缓存命中的次数，见 cache.go
+	CacheMisses   uint64      // 使用响应缓存但没有命中的次数
+}
+
+// Stats 返回连接缓存、健康检查和响应缓存的统计
+func (xc *XClient) Stats() Stats {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	s := Stats{FDEvicted: xc.evicted, Conns: make([]ConnStats, 0, len(xc.clients))}
+	for key, client := range xc.clients {
+		c := ConnStats{
+			Key:       key,
+			Addr:      keyAddr(key),
+			Available: client.IsAvailable(),
+			Pending:   client.Pending(),
+			LastUsed:  xc.lastUsed[key],
+		}
+		if xc.health != nil {
+			p := xc.health.pings[key]
+			c.LastPing, c.PingRTT = p.at, p.rtt
+		}
+		s.Conns = append(s.Conns, c)
+	}
+	sort.Slice(s.Conns, func(i, j int) bool { return s.Conns[i].Key < s.Conns[j].Key })
+	if xc.health != nil {
+		s.HealthChecks = atomic.LoadUint64(&xc.health.rounds)
+		s.HealthEvicted = atomic.LoadUint64(&xc.health.evicted)
+	}
+	if xc.cache != nil {
+		s.CacheHits = atomic.LoadUint64(&xc.cache.hits)
+		s.CacheMisses = atomic.LoadUint64(&xc.cache.misses)
+	}
+	return s
+}
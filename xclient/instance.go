@@ -0,0 +1,50 @@
+package xclient
+
+import (
+	"MyRPC/client"
+	"MyRPC/logger"
+	"MyRPC/registry/regclient"
+)
+
+//
+// 服务端重启
+// 服务端在注册中心的过期时间之内用同一个地址重启时，注册中心把它的心跳当成续约，服务列表没有变化，
+// 客户端缓存的连接却还连着已经退出的进程，要等到调用失败才会发现。
+// 服务端的心跳和能力协商中都带有实例ID（见 MyRPC.Server.InstanceID），服务发现能提供实例信息时（比如 MyRegistryDiscovery），
+// XClient 记录每个连接建立时对端的实例ID，取连接时发现同一地址的实例ID变了，就关闭旧连接重新建立
+//
+
+// instanceDiscovery 能提供服务实例信息的服务发现
+type instanceDiscovery interface {
+	ServerItem(addr string) (regclient.ServerItem, bool)
+}
+
+// instanceOf 服务发现中 rpcAddr 当前的实例ID，不知道时返回空字符串
+func (xc *XClient) instanceOf(rpcAddr string) string {
+	d, ok := xc.d.(instanceDiscovery)
+	if !ok {
+		return ""
+	}
+	item, _ := d.ServerItem(rpcAddr)
+	return item.Instance
+}
+
+// restarted 判断缓存的连接是否连着 rpcAddr 重启之前的进程，调用方需要持有锁
+func (xc *XClient) restarted(key, rpcAddr string) bool {
+	want := xc.instanceOf(rpcAddr)
+	have := xc.instances[key]
+	if want == "" || have == "" || want == have {
+		return false
+	}
+	logger.Infof("rpc xclient: %s restarted (instance %s -> %s), reconnecting", rpcAddr, have, want)
+	return true
+}
+
+// recordInstance 记录新连接对端的实例ID，握手时服务端声明了实例ID就以它为准，调用方需要持有锁
+func (xc *XClient) recordInstance(key, rpcAddr string, client *client.Client) {
+	id := client.InstanceID()
+	if id == "" {
+		id = xc.instanceOf(rpcAddr)
+	}
+	xc.instances[key] = id
+}
@@ -0,0 +1,177 @@
+package xclient
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// 客户端负载统计
+// XClient 记录每个实例正在进行的调用数和最近的延迟（指数加权移动平均）。
+// LeastActiveSelect 按 (正在进行的调用数+1) × 平均延迟 选择负载最低的实例，
+// 处理得慢或者积压了请求的实例会自动少分到调用；还没有完成过调用的实例空闲时优先被选中用来探测，
+// 有调用正在进行时按候选实例延迟的中位数计算，第一个响应返回之前不会把所有调用都分给一个新的或者卡住的实例。
+// P2CSelect 随机选两个实例比较同样的负载，实例很多时开销更小，并且多个客户端的统计不同步时不会同时涌向同一个实例
+//
+
+// latencyDecay 新样本在平均延迟中的权重
+const latencyDecay = 0.3
+
+// BackendLoad 一个实例的负载统计
+type BackendLoad struct {
+	Addr    string
+	Active  int           // 正在进行的调用数
+	Latency time.Duration // 最近的平均延迟
+	Calls   uint64        // 累计调用数
+}
+
+type backendLoad struct {
+	active  int
+	latency float64 // 纳秒
+	calls   uint64
+}
+
+// loadStats 每个实例的负载统计，所有方法都是并发安全的
+type loadStats struct {
+	mu       sync.Mutex
+	backends map[string]*backendLoad
+	r        *rand.Rand
+}
+
+func newLoadStats() *loadStats {
+	return &loadStats{
+		backends: make(map[string]*backendLoad),
+		r:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *loadStats) get(addr string) *backendLoad {
+	b := s.backends[addr]
+	if b == nil {
+		b = new(backendLoad)
+		s.backends[addr] = b
+	}
+	return b
+}
+
+// begin 开始一次调用
+func (s *loadStats) begin(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(addr).active++
+}
+
+// end 结束一次调用，更新平均延迟
+func (s *loadStats) end(addr string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.get(addr)
+	b.active--
+	b.calls++
+	if b.calls == 1 {
+		b.latency = float64(d)
+	} else {
+		b.latency = b.latency*(1-latencyDecay) + float64(d)*latencyDecay
+	}
+}
+
+// leastLoaded 从 servers 中选择负载最低的实例，负载相同时随机选择
+func (s *loadStats) leastLoaded(servers []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var best []string
+	var bestScore float64
+	fallback := s.medianLatency(servers)
+	for _, addr := range servers {
+		score := s.score(addr, fallback)
+		switch {
+		case len(best) == 0 || score < bestScore:
+			best, bestScore = append(best[:0], addr), score
+		case score == bestScore:
+			best = append(best, addr)
+		}
+	}
+	if len(best) == 0 {
+		return ""
+	}
+	return best[s.r.Intn(len(best))]
+}
+
+// p2c 从 servers 中随机选两个，返回负载较低的一个
+func (s *loadStats) p2c(servers []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch len(servers) {
+	case 0:
+		return ""
+	case 1:
+		return servers[0]
+	}
+	i := s.r.Intn(len(servers))
+	j := s.r.Intn(len(servers) - 1)
+	if j >= i {
+		j++
+	}
+	fallback := s.medianLatency(servers)
+	if s.score(servers[j], fallback) < s.score(servers[i], fallback) {
+		return servers[j]
+	}
+	return servers[i]
+}
+
+// score 实例的负载，还没有延迟样本的实例使用 fallback，调用方需要持有锁
+func (s *loadStats) score(addr string, fallback float64) float64 {
+	b := s.backends[addr]
+	if b == nil || b.calls == 0 && b.active == 0 {
+		return 0
+	}
+	if b.calls == 0 {
+		return float64(b.active+1) * fallback
+	}
+	return float64(b.active+1) * b.latency
+}
+
+// medianLatency servers 中有样本的实例延迟的中位数，都没有样本时返回1，只按正在进行的调用数比较。调用方需要持有锁
+func (s *loadStats) medianLatency(servers []string) float64 {
+	var samples []float64
+	for _, addr := range servers {
+		if b := s.backends[addr]; b != nil && b.calls > 0 {
+			samples = append(samples, b.latency)
+		}
+	}
+	if len(samples) == 0 {
+		return 1
+	}
+	sort.Float64s(samples)
+	return samples[len(samples)/2]
+}
+
+// forget 删除不在服务列表中的实例的统计
+func (s *loadStats) forget(alive map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, b := range s.backends {
+		if !alive[addr] && b.active == 0 {
+			delete(s.backends, addr)
+		}
+	}
+}
+
+// Load 返回每个实例的负载统计，按地址排序
+func (xc *XClient) Load() []BackendLoad {
+	xc.load.mu.Lock()
+	defer xc.load.mu.Unlock()
+	loads := make([]BackendLoad, 0, len(xc.load.backends))
+	for addr, b := range xc.load.backends {
+		loads = append(loads, BackendLoad{
+			Addr:    addr,
+			Active:  b.active,
+			Latency: time.Duration(b.latency),
+			Calls:   b.calls,
+		})
+	}
+	sort.Slice(loads, func(i, j int) bool { return loads[i].Addr < loads[j].Addr })
+	return loads
+}
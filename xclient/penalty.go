@@ -0,0 +1,129 @@
+package xclient
+
+import (
+	"sync"
+	"time"
+)
+
+//
+// 灰名单
+// 熔断器在 XClient 内部，没有开启熔断时，随机和轮询仍然会从服务发现拿到反复出错的实例。
+// XClient 把每个实例的连接错误报告给服务发现，服务发现在惩罚期内把实例从 Get 和 GetAll 的结果中去掉：
+//
+//	d := xclient.NewMultiServerDiscovery(servers)
+//	d.SetFailurePenalty(time.Second, time.Minute)
+//
+// 第一次失败惩罚 base，之后每次连续失败翻倍，不超过 max；调用成功，或者惩罚期结束后又过了 max 时间没有再失败，
+// 失败次数清零，惩罚逐渐衰减。所有实例都在惩罚期内时不再排除，总比没有实例可用好。
+// 广播和多数派调用同样跳过惩罚期内的实例。健康检查、预热和订阅使用 Members 得到包括惩罚期内实例在内的服务列表，
+// 实例没有真正下线时连接不会被关闭。
+// 一致性哈希的 GetFor 不受影响，保证 key 到实例的映射稳定，反复出错的实例由熔断器处理
+//
+
+// FailureReporter 接收调用结果的服务发现，XClient 在每次调用后报告实例的状态
+type FailureReporter interface {
+	ReportFailure(rpcAddr string) // 实例出现连接错误
+	ReportSuccess(rpcAddr string) // 实例调用成功
+}
+
+var _ FailureReporter = (*MultiServersDiscovery)(nil)
+
+// MemberDiscovery GetAll 会排除部分实例的服务发现，Members 返回服务列表中的全部实例
+type MemberDiscovery interface {
+	Members() ([]string, error)
+}
+
+var _ MemberDiscovery = (*MultiServersDiscovery)(nil)
+
+// members 返回服务列表中的全部实例，服务发现不支持 Members 时使用 GetAll
+func members(d Discovery) ([]string, error) {
+	if md, ok := d.(MemberDiscovery); ok {
+		return md.Members()
+	}
+	return d.GetAll()
+}
+
+// penaltyBox 每个实例的惩罚状态，MyRegistryDiscovery 按服务名划分的服务列表共用同一个
+type penaltyBox struct {
+	mu      sync.Mutex
+	base    time.Duration // 为0时不惩罚
+	max     time.Duration
+	entries map[string]*penalty
+}
+
+// penalty 一个实例连续失败的次数和惩罚结束的时间
+type penalty struct {
+	failures int
+	until    time.Time
+}
+
+func newPenaltyBox() *penaltyBox {
+	return &penaltyBox{entries: make(map[string]*penalty)}
+}
+
+// SetFailurePenalty 开启灰名单，base 为0时关闭。max 小于 base 时等于 base
+func (d *MultiServersDiscovery) SetFailurePenalty(base, max time.Duration) {
+	if max < base {
+		max = base
+	}
+	b := d.penalties
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.base, b.max = base, max
+	if base <= 0 {
+		b.entries = make(map[string]*penalty)
+	}
+}
+
+// ReportFailure 记录一次失败，实例进入惩罚期
+func (d *MultiServersDiscovery) ReportFailure(rpcAddr string) {
+	b := d.penalties
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.base <= 0 {
+		return
+	}
+	now := time.Now()
+	p := b.entries[rpcAddr]
+	if p == nil || now.After(p.until.Add(b.max)) {
+		p = &penalty{}
+		b.entries[rpcAddr] = p
+	}
+	p.failures++
+	wait := b.base
+	for i := 1; i < p.failures && wait < b.max; i++ {
+		wait *= 2
+	}
+	if wait > b.max {
+		wait = b.max
+	}
+	p.until = now.Add(wait)
+}
+
+// ReportSuccess 实例调用成功，清除它的惩罚
+func (d *MultiServersDiscovery) ReportSuccess(rpcAddr string) {
+	b := d.penalties
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.entries, rpcAddr)
+}
+
+// filter 去掉惩罚期内的实例，都在惩罚期内时返回 servers 本身
+func (b *penaltyBox) filter(servers []string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.entries) == 0 {
+		return servers
+	}
+	now := time.Now()
+	kept := make([]string, 0, len(servers))
+	for _, s := range servers {
+		if p := b.entries[s]; p == nil || !now.Before(p.until) {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == 0 {
+		return servers
+	}
+	return kept
+}
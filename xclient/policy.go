@@ -0,0 +1,177 @@
+package xclient
+
+import (
+	"MyRPC/client"
+	"MyRPC/logger"
+	"context"
+	"reflect"
+	"time"
+)
+
+//
+// 调用失败时的处理方式
+// Failfast 失败立即返回错误，是默认的方式；Failover 换一个实例重试，WithRetry 会同时开启它；
+// Failsafe 记录日志后返回 nil，reply 保持零值，适合写审计日志这类可以丢弃的调用；
+// Failback 记录失败的调用，在后台按退避策略各自重试，调用本身立即返回 nil，适合通知这类必须送达但不需要结果的调用。
+// 可以为整个 XClient 配置，也可以用 WithFailModeContext 为单次调用指定
+//
+
+type FailMode int
+
+const (
+	Failfast FailMode = iota // 失败立即返回错误
+	Failover                 // 换一个实例重试
+	Failsafe                 // 忽略错误，返回零值
+	Failback                 // 后台重试，立即返回
+)
+
+func (m FailMode) String() string {
+	switch m {
+	case Failfast:
+		return "failfast"
+	case Failover:
+		return "failover"
+	case Failsafe:
+		return "failsafe"
+	case Failback:
+		return "failback"
+	}
+	return "unknown"
+}
+
+const (
+	defaultFailoverAttempts = 3               // Failover 没有配置重试策略时最多尝试的次数
+	defaultFailbackInterval = time.Second     // Failback 没有配置退避策略时的重试间隔
+	failbackQueueSize       = 1024            // Failback 最多同时等待重试的调用数，满了之后丢弃新的调用
+	failbackWorkers         = 16              // Failback 同时进行的重试数，一个慢实例不会挡住其他调用的重试
+	failbackCallTimeout     = 5 * time.Second // Failback 后台重试单次调用的超时时间
+)
+
+// WithFailMode 设置调用失败时的处理方式，和 WithRetry 的先后顺序无关
+func WithFailMode(mode FailMode) XOption {
+	return func(xc *XClient) {
+		xc.failMode = mode
+		xc.failModeSet = true
+	}
+}
+
+type failModeKey struct{}
+
+// WithFailModeContext 返回为单次调用指定失败处理方式的 ctx，优先于 XClient 的配置
+func WithFailModeContext(ctx context.Context, mode FailMode) context.Context {
+	return context.WithValue(ctx, failModeKey{}, mode)
+}
+
+// failModeOf 本次调用的失败处理方式
+func (xc *XClient) failModeOf(ctx context.Context) FailMode {
+	if mode, ok := ctx.Value(failModeKey{}).(FailMode); ok {
+		return mode
+	}
+	return xc.failMode
+}
+
+// retryPolicyOf Failover 使用的重试策略，没有配置 WithRetry 时换实例重试连接错误
+func (xc *XClient) retryPolicyOf() *retryPolicy {
+	if xc.retry != nil {
+		return xc.retry
+	}
+	return &retryPolicy{maxAttempts: defaultFailoverAttempts}
+}
+
+// callOnce 选择一个实例调用一次
+func (xc *XClient) callOnce(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	rpcAddr, err := xc.selectFor(ctx, serviceMethod, args)
+	if err != nil {
+		return err
+	}
+	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+}
+
+// resetReply 把 reply 恢复为零值，失败的调用可能已经解码了一部分
+func resetReply(reply interface{}) {
+	v := reflect.ValueOf(reply)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v.Elem().Set(reflect.Zero(v.Elem().Type()))
+	}
+}
+
+// failbackCall 等待后台重试的调用
+type failbackCall struct {
+	serviceMethod string
+	args          interface{}
+	replyType     reflect.Type // 重试时新建 reply，结果被丢弃
+	md            client.Metadata
+	attempt       int
+}
+
+type failbackQueue struct {
+	pending chan struct{} // 每个等待重试的调用占一个位置
+	workers chan struct{} // 每个正在进行的重试占一个位置
+}
+
+// failback 把失败的调用放入后台重试，每个调用按自己的退避时间独立重试
+func (xc *XClient) failback(ctx context.Context, serviceMethod string, args, reply interface{}, err error) {
+	call := &failbackCall{
+		serviceMethod: serviceMethod,
+		args:          args,
+		md:            client.MetadataFromContext(ctx),
+		attempt:       1,
+	}
+	if reply != nil {
+		call.replyType = reflect.TypeOf(reply).Elem()
+	}
+	// maxAttempts 包括失败的这一次，不大于1时不再重试
+	if xc.retryPolicyOf().maxAttempts <= 1 {
+		logger.Errorf("rpc xclient: %s failed, no retry left, dropped: %v", serviceMethod, err)
+		return
+	}
+	select {
+	case xc.failbacks.pending <- struct{}{}:
+		logger.Warnf("rpc xclient: %s failed, retry later: %v", serviceMethod, err)
+		go xc.retryFailback(call)
+	default:
+		logger.Errorf("rpc xclient: %s failed and failback queue is full, dropped: %v", serviceMethod, err)
+	}
+}
+
+// retryFailback 在后台重试一个失败的调用，每次重试前按退避策略等待，连同第一次调用达到 maxAttempts 次后丢弃
+func (xc *XClient) retryFailback(call *failbackCall) {
+	defer func() { <-xc.failbacks.pending }()
+	p := xc.retryPolicyOf()
+	for {
+		wait := defaultFailbackInterval
+		if p.backoff != nil {
+			wait = p.backoff(call.attempt)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-xc.done:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		select {
+		case <-xc.done:
+			return
+		case xc.failbacks.workers <- struct{}{}:
+		}
+
+		var reply interface{}
+		if call.replyType != nil {
+			reply = reflect.New(call.replyType).Interface()
+		}
+		ctx, cancel := context.WithTimeout(client.WithMetadata(context.Background(), call.md), failbackCallTimeout)
+		err := xc.callOnce(ctx, call.serviceMethod, call.args, reply)
+		cancel()
+		<-xc.failbacks.workers
+		switch {
+		case err == nil:
+			logger.Infof("rpc xclient: %s succeeded after %d retries", call.serviceMethod, call.attempt)
+			return
+		case call.attempt+1 >= p.maxAttempts:
+			logger.Errorf("rpc xclient: %s failed after %d retries, dropped: %v", call.serviceMethod, call.attempt, err)
+			return
+		}
+		call.attempt++
+	}
+}
@@ -0,0 +1,108 @@
+package xclient
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// 服务发现插件
+// 不同的服务发现后端通过 RegisterDiscoveryProvider 按 scheme 注册，使用方只需要一个地址：
+//
+//	xclient.NewDiscovery("http://localhost:9999/_geerpc_/registry")
+//	xclient.NewDiscovery("static:///tcp@10.0.0.1:9999,tcp@10.0.0.2:9999")
+//
+// 地址中的 timeout 参数是服务列表的过期时间，比如 ?timeout=30s。新的后端不需要修改本包，注册一个 DiscoveryFactory 即可。
+// etcd 和 Nacos 的后端是单独的模块 MyRPC/contrib/etcd 和 MyRPC/contrib/nacos，引入对应的包后支持 etcd:// 和 nacos:// 地址，
+// 不使用它们的程序不需要下载它们的依赖
+//
+
+// DiscoveryFactory 根据地址创建服务发现
+type DiscoveryFactory func(target *url.URL) (Discovery, error)
+
+var (
+	providerMu sync.RWMutex
+	providers  = map[string]DiscoveryFactory{
+		"static": newStaticDiscovery,
+		"http":   newHTTPRegistryDiscovery,
+		"https":  newHTTPRegistryDiscovery,
+	}
+)
+
+// RegisterDiscoveryProvider 注册服务发现的后端，scheme 已存在时覆盖
+func RegisterDiscoveryProvider(scheme string, f DiscoveryFactory) {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	providers[scheme] = f
+}
+
+// DiscoveryProviders 返回已注册的后端，按名称排序
+func DiscoveryProviders() []string {
+	providerMu.RLock()
+	defer providerMu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for scheme := range providers {
+		names = append(names, scheme)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewDiscovery 根据地址的 scheme 选择后端创建服务发现
+func NewDiscovery(target string) (Discovery, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	providerMu.RLock()
+	f := providers[u.Scheme]
+	providerMu.RUnlock()
+	if f == nil {
+		return nil, errors.New("rpc discovery: unknown provider " + u.Scheme)
+	}
+	return f(u)
+}
+
+// TargetTimeout 读取地址中的 timeout 参数，没有时返回0，即使用默认值
+func TargetTimeout(target *url.URL) (time.Duration, error) {
+	v := target.Query().Get("timeout")
+	if v == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// TargetHosts 地址中逗号分隔的多个主机
+func TargetHosts(target *url.URL) []string {
+	var hosts []string
+	for _, h := range strings.Split(target.Host, ",") {
+		if h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+func newStaticDiscovery(target *url.URL) (Discovery, error) {
+	var servers []string
+	for _, s := range strings.Split(strings.TrimPrefix(target.Path, "/"), ",") {
+		if s != "" {
+			servers = append(servers, s)
+		}
+	}
+	return NewMultiServerDiscovery(servers), nil
+}
+
+func newHTTPRegistryDiscovery(target *url.URL) (Discovery, error) {
+	timeout, err := TargetTimeout(target)
+	if err != nil {
+		return nil, err
+	}
+	u := *target
+	u.RawQuery = ""
+	return NewMyRegistryDiscovery(u.String(), timeout), nil
+}
@@ -0,0 +1,147 @@
+package xclient
+
+import (
+	"MyRPC/client"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+//
+// 重试与故障转移
+// 服务发现返回的实例可能已经挂掉，此时调用会因为连接错误失败。开启重试后，XClient 会换一个实例重新调用。
+//
+
+// XOption XClient 的可选配置
+type XOption func(xc *XClient)
+
+// Backoff 返回第 attempt 次重试前需要等待的时间，attempt 从 1 开始
+type Backoff func(attempt int) time.Duration
+
+// ConstantBackoff 每次重试前等待固定的时间
+func ConstantBackoff(d time.Duration) Backoff {
+	return func(int) time.Duration {
+		return d
+	}
+}
+
+// ExponentialBackoff 等待时间从 base 开始每次翻倍，最多不超过 max
+func ExponentialBackoff(base, max time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// retryPolicy 重试策略
+type retryPolicy struct {
+	maxAttempts int     // 最多尝试的次数，包括第一次调用
+	backoff     Backoff // 重试前的等待时间
+	retryable   []error // 可以重试的错误，为空时只重试连接错误
+}
+
+// WithRetry 开启重试（Failover），调用因为连接错误（或者 retryableErrors 中的错误）失败时，换一个实例重新调用，
+// 最多调用 maxAttempts 次。backoff 为 nil 时不等待。Failback 在后台重试时也使用这里的次数和退避策略，
+// 次数同样包括第一次调用，maxAttempts 为1时失败的调用直接丢弃，不在后台重试。
+// 用 WithFailMode 指定了其他处理方式时保留它
+func WithRetry(maxAttempts int, backoff Backoff, retryableErrors ...error) XOption {
+	return func(xc *XClient) {
+		if !xc.failModeSet {
+			xc.failMode = Failover
+		}
+		xc.retry = &retryPolicy{
+			maxAttempts: maxAttempts,
+			backoff:     backoff,
+			retryable:   retryableErrors,
+		}
+	}
+}
+
+// shouldRetry 判断错误是否可以重试
+func (p *retryPolicy) shouldRetry(err error) bool {
+	if isConnError(err) {
+		return true
+	}
+	for _, e := range p.retryable {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// isConnError 判断是否是连接错误，连接错误说明实例不可用，换一个实例重试是安全的
+func isConnError(err error) bool {
+	if errors.Is(err, client.ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// wait 等待第 attempt 次重试，ctx 结束时提前返回错误
+func (p *retryPolicy) wait(ctx context.Context, attempt int) error {
+	if p.backoff == nil {
+		return ctx.Err()
+	}
+	t := time.NewTimer(p.backoff(attempt))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// callWithRetry 按照重试策略调用，每次重试尽量选择一个还没有尝试过的实例
+func (xc *XClient) callWithRetry(ctx context.Context, p *retryPolicy, serviceMethod string, args, reply interface{}) error {
+	tried := make(map[string]bool)
+	var err error
+	for attempt := 0; attempt < p.maxAttempts; attempt++ {
+		if attempt > 0 {
+			if werr := p.wait(ctx, attempt); werr != nil {
+				return err
+			}
+		}
+		var rpcAddr string
+		rpcAddr, err = xc.selectFor(ctx, serviceMethod, args)
+		if err != nil {
+			return err
+		}
+		if tried[rpcAddr] {
+			rpcAddr = xc.untried(serviceMethod, tried, rpcAddr)
+		}
+		tried[rpcAddr] = true
+		err = xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+		if err == nil || !p.shouldRetry(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// untried 从所有实例中找一个还没有尝试过的，都尝试过了就返回 fallback
+func (xc *XClient) untried(serviceMethod string, tried map[string]bool, fallback string) string {
+	servers, err := xc.allServers(serviceMethod)
+	if err != nil {
+		return fallback
+	}
+	if xc.breakers != nil {
+		servers = xc.breakers.available(servers)
+	}
+	for _, s := range servers {
+		if !tried[s] {
+			return s
+		}
+	}
+	return fallback
+}
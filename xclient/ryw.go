@@ -0,0 +1,138 @@
+package xclient
+
+import (
+	"MyRPC/callopt"
+	"MyRPC/client"
+	"context"
+	"sync"
+	"time"
+)
+
+//
+// 读己之写
+// 实例之间异步复制数据的服务，写请求之后马上读，可能从另一个实例读到还没有复制过来的旧数据。
+// Session 记录最近一次写请求由哪个实例处理（服务端在 Trailer 中返回实例ID），Window 内的读请求在元数据中带上这个实例ID，
+// XClient 看到这个提示就把请求路由到同一个实例，超过 Window 后认为数据已经复制完成，恢复正常的负载均衡：
+//
+//	s := xclient.NewSession(time.Second)
+//	err := xc.Call(s.Write(ctx), "KV.Put", kv, &ok)
+//	err = xc.Call(s.Read(ctx), "KV.Get", key, &value)
+//
+// 提示放在元数据中，所以也可以随下游调用继续传递。提示的实例已经下线、熔断或者找不到时按正常方式选择实例
+//
+
+// Session 一个需要读己之写的会话，比如一个用户的请求，可以被多个协程共用
+type Session struct {
+	Window time.Duration // 写之后多长时间内的读请求路由到同一个实例
+
+	mu       sync.Mutex
+	instance string    // 最近一次写请求的实例ID
+	written  time.Time // 最近一次写请求完成的时间
+}
+
+// NewSession window 是写之后读请求需要路由到同一个实例的时间，一般是实例之间复制的延迟
+func NewSession(window time.Duration) *Session {
+	return &Session{Window: window}
+}
+
+type sessionKey struct{}
+
+// Write 返回写请求使用的 ctx，调用成功后记录处理它的实例
+func (s *Session) Write(ctx context.Context) context.Context {
+	ctx = client.WithMetadata(ctx, client.Metadata{client.ReadYourWritesMetadataKey: client.ReadYourWritesWrite})
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// Read 返回读请求使用的 ctx，在最近一次写请求之后的 Window 内带上路由到同一个实例的提示
+func (s *Session) Read(ctx context.Context) context.Context {
+	s.mu.Lock()
+	instance, fresh := s.instance, time.Since(s.written) < s.Window
+	s.mu.Unlock()
+	if instance == "" || !fresh {
+		return ctx
+	}
+	return client.WithMetadata(ctx, client.Metadata{client.ReadYourWritesMetadataKey: instance})
+}
+
+// record 记录写请求的实例
+func (s *Session) record(instance string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instance, s.written = instance, time.Now()
+}
+
+// writeSession ctx 是 Session.Write 返回的写请求时返回对应的 Session
+func writeSession(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	if s == nil || client.MetadataFromContext(ctx)[client.ReadYourWritesMetadataKey] != client.ReadYourWritesWrite {
+		return nil
+	}
+	return s
+}
+
+// recordWrite 写请求成功后记录实例，同时记下处理请求的连接 key 上的实例ID，之后的提示据此找到实例。
+// 和 recordInstance 使用同一个键，连接关闭时一起清理，调用方不能持有锁
+func (xc *XClient) recordWrite(s *Session, key string, trailer client.Metadata) {
+	instance := trailer[client.TrailerInstance]
+	if instance == "" {
+		return
+	}
+	s.record(instance)
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if _, ok := xc.clients[key]; ok {
+		xc.instances[key] = instance
+	}
+}
+
+// hintedServer 元数据中读己之写提示的实例，找不到或者不可用时返回空字符串
+func (xc *XClient) hintedServer(ctx context.Context, serviceMethod string) string {
+	instance := client.MetadataFromContext(ctx)[client.ReadYourWritesMetadataKey]
+	if instance == "" || instance == client.ReadYourWritesWrite {
+		return ""
+	}
+	servers, err := xc.allServers(serviceMethod)
+	if err != nil {
+		return ""
+	}
+	for _, rpcAddr := range servers {
+		if xc.instanceAt(rpcAddr) != instance {
+			continue
+		}
+		if xc.breakers != nil && xc.breakers.isOpen(rpcAddr) {
+			return ""
+		}
+		return rpcAddr
+	}
+	return ""
+}
+
+// instanceAt rpcAddr 上的实例ID，优先使用服务发现的信息，否则使用 rpcAddr 上任意一个连接记录的实例ID
+func (xc *XClient) instanceAt(rpcAddr string) string {
+	if id := xc.instanceOf(rpcAddr); id != "" {
+		return id
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if id := xc.instances[rpcAddr]; id != "" {
+		return id
+	}
+	for key, id := range xc.instances {
+		if id != "" && keyAddr(key) == rpcAddr {
+			return id
+		}
+	}
+	return ""
+}
+
+// selectFor 选择处理请求的实例，有读己之写的提示时使用提示的实例
+func (xc *XClient) selectFor(ctx context.Context, serviceMethod string, args interface{}) (string, error) {
+	// 服务列表过期时先按调用的 ctx 刷新，之后选择实例时不会再阻塞在注册中心上
+	if err := RefreshContext(ctx, xc.d); err != nil {
+		return "", err
+	}
+	if rpcAddr := xc.hintedServer(ctx, serviceMethod); rpcAddr != "" {
+		return rpcAddr, nil
+	}
+	return xc.selectServer(serviceMethod, args, callopt.FromContext(ctx).Key)
+}
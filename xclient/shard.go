@@ -0,0 +1,224 @@
+package xclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// 分片
+// 分片存储的后端事先把 key 空间划分成若干分片，每个分片由固定的一组实例负责，不能用整个服务列表上的哈希环来选择。
+// 开启分片后 XClient 先用 ShardResolver 把请求的 key 映射到分片，再从当前的服务列表中找出属于该分片的实例，
+// 最后在这些实例上做一致性哈希，同一个 key 总是落到分片内的同一个实例上：
+//
+//	r := xclient.NewDNSShardResolver(shardOf, "shard-%s.kv.svc.cluster.local")
+//	xc := xclient.NewXClient(d, xclient.RandomSelect, nil, xclient.WithSharding(r, nil))
+//
+// 开启分片后 SelectMode 不再生效，熔断的实例会被跳过，但不会把请求发到其他分片
+//
+
+// ShardResolver 把 key 映射到分片，并从服务列表中找出分片内的实例
+type ShardResolver interface {
+	Shard(key string) (string, error)                         // key 所在的分片
+	Members(shard string, servers []string) ([]string, error) // servers 中属于 shard 的实例
+}
+
+// ShardKeyer 请求参数实现该接口时，使用 ShardKey 作为分片的 key
+type ShardKeyer interface {
+	ShardKey() string
+}
+
+// ShardKeyFunc 从请求中取出分片的 key
+type ShardKeyFunc func(serviceMethod string, args interface{}) string
+
+// WithSharding 按分片选择实例，key 为 nil 时参数实现了 ShardKeyer 则使用 ShardKey，否则使用 服务名.方法名+参数
+func WithSharding(r ShardResolver, key ShardKeyFunc) XOption {
+	return func(xc *XClient) {
+		if key == nil {
+			key = shardKey
+		}
+		xc.shards = &sharding{resolver: r, key: key, rings: make(map[string]*shardRing)}
+	}
+}
+
+func shardKey(serviceMethod string, args interface{}) string {
+	if k, ok := args.(ShardKeyer); ok {
+		return k.ShardKey()
+	}
+	return requestKey(serviceMethod, args)
+}
+
+type sharding struct {
+	resolver ShardResolver
+	key      ShardKeyFunc
+	mu       sync.Mutex
+	rings    map[string]*shardRing // 每个分片的哈希环，分片内的实例变化时重建
+}
+
+type shardRing struct {
+	members string // 建环时的实例，逗号分隔
+	ring    *HashRing
+}
+
+// ring 返回分片内实例的哈希环
+func (s *sharding) ring(shard string, members []string) *HashRing {
+	joined := strings.Join(members, ",")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.rings[shard]
+	if r == nil || r.members != joined {
+		r = &shardRing{members: joined, ring: New(members, replicateCount)}
+		s.rings[shard] = r
+	}
+	return r.ring
+}
+
+// pickShard 在 key 所在分片的可用实例中做一致性哈希，调用方没有给出 key 时从请求中取
+func (xc *XClient) pickShard(serviceMethod string, args interface{}, key string) (string, error) {
+	if key == "" {
+		key = xc.shards.key(serviceMethod, args)
+	}
+	shard, err := xc.shards.resolver.Shard(key)
+	if err != nil {
+		return "", err
+	}
+	servers, err := xc.allServers(serviceMethod)
+	if err != nil {
+		return "", err
+	}
+	members, err := xc.shards.resolver.Members(shard, servers)
+	if err != nil {
+		return "", err
+	}
+	if len(members) == 0 {
+		return "", fmt.Errorf("rpc xclient: no available servers for shard %s", shard)
+	}
+	if xc.breakers != nil {
+		if members = xc.breakers.available(members); len(members) == 0 {
+			return "", ErrAllBreakersOpen
+		}
+	}
+	return xc.shards.ring(shard, members).GetNode(key), nil
+}
+
+// StaticShardResolver 静态配置每个分片的实例
+type StaticShardResolver struct {
+	shardOf func(key string) string
+	shards  map[string][]string // 分片 -> rpcAddr
+}
+
+// NewStaticShardResolver shardOf 把 key 映射到分片，shards 是每个分片的实例，只有仍在服务列表中的实例会被选择
+func NewStaticShardResolver(shardOf func(key string) string, shards map[string][]string) *StaticShardResolver {
+	return &StaticShardResolver{shardOf: shardOf, shards: shards}
+}
+
+func (r *StaticShardResolver) Shard(key string) (string, error) {
+	return r.shardOf(key), nil
+}
+
+func (r *StaticShardResolver) Members(shard string, servers []string) ([]string, error) {
+	configured, ok := r.shards[shard]
+	if !ok {
+		return nil, errors.New("rpc xclient: unknown shard " + shard)
+	}
+	set := make(map[string]bool, len(configured))
+	for _, s := range configured {
+		set[s] = true
+	}
+	var members []string
+	for _, s := range servers {
+		if set[s] {
+			members = append(members, s)
+		}
+	}
+	return members, nil
+}
+
+// defaultShardDNSTTL DNS 解析结果的缓存时间
+const defaultShardDNSTTL = 30 * time.Second
+
+// DNSShardResolver 通过 DNS 找出分片的实例：分片的域名解析出的 IP 就是分片内实例的 IP，
+// 服务列表中 IP 匹配的实例属于该分片
+type DNSShardResolver struct {
+	shardOf func(key string) string
+	host    string                                        // 分片域名的模板，%s 替换为分片
+	TTL     time.Duration                                 // 解析结果的缓存时间
+	Lookup  func(host string) (addrs []string, err error) // 解析域名，默认使用 net.LookupHost
+
+	mu    sync.Mutex
+	cache map[string]dnsShard
+}
+
+type dnsShard struct {
+	ips     map[string]bool
+	expires time.Time
+}
+
+// NewDNSShardResolver shardOf 把 key 映射到分片，host 是分片域名的模板，比如 shard-%s.kv.svc.cluster.local
+func NewDNSShardResolver(shardOf func(key string) string, host string) *DNSShardResolver {
+	return &DNSShardResolver{
+		shardOf: shardOf,
+		host:    host,
+		TTL:     defaultShardDNSTTL,
+		Lookup:  net.LookupHost,
+		cache:   make(map[string]dnsShard),
+	}
+}
+
+func (r *DNSShardResolver) Shard(key string) (string, error) {
+	return r.shardOf(key), nil
+}
+
+func (r *DNSShardResolver) Members(shard string, servers []string) ([]string, error) {
+	ips, err := r.resolve(shard)
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	for _, s := range servers {
+		if ips[serverHost(s)] {
+			members = append(members, s)
+		}
+	}
+	return members, nil
+}
+
+// resolve 解析分片的域名，解析失败时继续使用过期的结果
+func (r *DNSShardResolver) resolve(shard string) (map[string]bool, error) {
+	r.mu.Lock()
+	cached, ok := r.cache[shard]
+	r.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.ips, nil
+	}
+	addrs, err := r.Lookup(fmt.Sprintf(r.host, shard))
+	if err != nil {
+		if ok {
+			return cached.ips, nil
+		}
+		return nil, err
+	}
+	ips := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		ips[a] = true
+	}
+	r.mu.Lock()
+	r.cache[shard] = dnsShard{ips: ips, expires: time.Now().Add(r.TTL)}
+	r.mu.Unlock()
+	return ips, nil
+}
+
+// serverHost 取 protocol@host:port 中的 host
+func serverHost(rpcAddr string) string {
+	if at := strings.Index(rpcAddr, "@"); at >= 0 {
+		rpcAddr = rpcAddr[at+1:]
+	}
+	if host, _, err := net.SplitHostPort(rpcAddr); err == nil {
+		return host
+	}
+	return rpcAddr
+}
@@ -0,0 +1,179 @@
+package xclient
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// 按版本分流
+// 灰度发布时，新版本先部署少量实例，只让一小部分流量进来。服务端用 SetVersion 声明自己的版本并随心跳上报，
+// XClient 按服务配置每个版本的权重，先按权重选出版本，再在这个版本的实例中按 SelectMode 选择：
+//
+//	server.SetVersion("v2")
+//	xc.SetTrafficSplit("Foo", map[string]int{"v1": 90, "v2": 10})
+//
+// 没有声明版本的实例版本为空字符串，可以用 "" 作为权重的键。权重为正的版本当前都没有实例时，
+// 在还有实例的版本之间按权重选择，都没有实例时不分流。
+// 一致性哈希（包括 CallWithKey）用 key 选择版本，同一个 key 总是落到同一个版本上。
+// 需要服务发现提供实例信息，比如 MyRegistryDiscovery
+//
+
+// versionWeight 一个版本的权重
+type versionWeight struct {
+	version string
+	weight  int
+}
+
+// trafficSplit 每个服务的版本权重
+type trafficSplit struct {
+	mu     sync.Mutex
+	splits map[string][]versionWeight // 服务名 -> 按版本排序的权重
+	r      *rand.Rand
+	next   map[string]int        // 每个 服务名/版本 的轮询位置
+	rings  map[string]*shardRing // 每个 服务名/版本 的哈希环，实例变化时重建
+}
+
+// SetTrafficSplit 设置 service 的流量在各版本之间的比例，weights 为空时取消分流。
+// 权重不能为负数，至少有一个版本的权重为正
+func (xc *XClient) SetTrafficSplit(service string, weights map[string]int) error {
+	if _, ok := xc.d.(instanceDiscovery); !ok {
+		return errors.New("rpc xclient: traffic split requires a discovery that knows server versions")
+	}
+	var split []versionWeight
+	total := 0
+	for version, w := range weights {
+		if w < 0 {
+			return fmt.Errorf("rpc xclient: negative weight %d for version %q", w, version)
+		}
+		if w > 0 {
+			split = append(split, versionWeight{version: version, weight: w})
+			total += w
+		}
+	}
+	if len(weights) > 0 && total == 0 {
+		return errors.New("rpc xclient: traffic split needs a positive weight")
+	}
+	sort.Slice(split, func(i, j int) bool { return split[i].version < split[j].version })
+
+	xc.mu.Lock()
+	if xc.split == nil {
+		xc.split = &trafficSplit{
+			splits: make(map[string][]versionWeight),
+			r:      rand.New(rand.NewSource(time.Now().UnixNano())),
+			next:   make(map[string]int),
+			rings:  make(map[string]*shardRing),
+		}
+	}
+	s := xc.split
+	xc.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(split) == 0 {
+		delete(s.splits, service)
+	} else {
+		s.splits[service] = split
+	}
+	return nil
+}
+
+// splitOf 返回 service 的版本权重，没有分流时返回 nil
+func (xc *XClient) splitOf(service string) []versionWeight {
+	xc.mu.Lock()
+	s := xc.split
+	xc.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.splits[service]
+}
+
+// pickVersion 按权重选出版本，再在版本的实例中选择。hashed 时用 key 选择版本和实例，
+// 没有一个版本有实例时 ok 为 false，调用方按不分流处理
+func (xc *XClient) pickVersion(serviceMethod string, split []versionWeight, key string, hashed bool) (rpcAddr string, ok bool, err error) {
+	servers, err := xc.allServers(serviceMethod)
+	if err != nil {
+		return "", false, err
+	}
+	if xc.breakers != nil {
+		if alive := xc.breakers.available(servers); len(alive) > 0 {
+			servers = alive
+		}
+	}
+	d := xc.d.(instanceDiscovery)
+	byVersion := make(map[string][]string)
+	for _, s := range servers {
+		item, _ := d.ServerItem(s)
+		byVersion[item.Version] = append(byVersion[item.Version], s)
+	}
+	// 只在有实例的版本之间分配权重
+	var candidates []versionWeight
+	total := 0
+	for _, vw := range split {
+		if len(byVersion[vw.version]) > 0 {
+			candidates = append(candidates, vw)
+			total += vw.weight
+		}
+	}
+	if total == 0 {
+		return "", false, nil
+	}
+
+	s := xc.split
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	if hashed {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		n = int(h.Sum32() % uint32(total))
+	} else {
+		n = s.r.Intn(total)
+	}
+	version := candidates[len(candidates)-1].version
+	for _, vw := range candidates {
+		if n < vw.weight {
+			version = vw.version
+			break
+		}
+		n -= vw.weight
+	}
+	members := byVersion[version]
+	slot := serviceName(serviceMethod) + "/" + version
+	switch {
+	case hashed:
+		return s.ring(slot, members).GetNode(key), true, nil
+	case xc.mode == RoundRobinSelect:
+		i := s.next[slot] % len(members)
+		s.next[slot] = i + 1
+		return members[i], true, nil
+	case xc.mode == LeastActiveSelect:
+		return xc.load.leastLoaded(members), true, nil
+	case xc.mode == P2CSelect:
+		return xc.load.p2c(members), true, nil
+	default:
+		return members[s.r.Intn(len(members))], true, nil
+	}
+}
+
+// ring 返回版本实例的哈希环，调用方需要持有锁
+func (s *trafficSplit) ring(slot string, members []string) *HashRing {
+	sorted := append([]string(nil), members...)
+	sort.Strings(sorted)
+	joined := strings.Join(sorted, ",")
+	r := s.rings[slot]
+	if r == nil || r.members != joined {
+		r = &shardRing{members: joined, ring: New(sorted, replicateCount)}
+		s.rings[slot] = r
+	}
+	return r.ring
+}
@@ -0,0 +1,85 @@
+package xclient
+
+import (
+	"sort"
+	"sync"
+)
+
+//
+// 订阅服务列表的增减
+// Watch 给出的是完整的服务列表，应用关心的通常是哪些实例上线了、哪些下线了：提前为新实例建立连接，
+// 把下线实例上的连接排空。Subscribe 在 Watch 之上算出每次变化的差异，按顺序回调：
+//
+//	cancel := d.Subscribe(func(added, removed []string) {
+//		log.Printf("servers added %v, removed %v", added, removed)
+//	})
+//	defer cancel()
+//
+// 订阅时先用当前的服务列表回调一次，之后只在列表变化时回调。消费慢时中间的变化会被合并，
+// 但每次回调的差异总是相对上一次回调，把所有回调累加起来就是最新的服务列表
+//
+
+// SubscribableDiscovery 可以订阅服务列表增减的服务发现，MultiServersDiscovery 以及内嵌它的服务发现都实现了它
+type SubscribableDiscovery interface {
+	Discovery
+	Subscribe(fn func(added, removed []string)) (cancel func())
+}
+
+var _ SubscribableDiscovery = (*MultiServersDiscovery)(nil)
+
+// Subscribe 订阅服务列表的增减，见 Subscribe 函数
+func (d *MultiServersDiscovery) Subscribe(fn func(added, removed []string)) (cancel func()) {
+	return Subscribe(d, fn)
+}
+
+// Subscribe 订阅 wd 的服务列表的增减，fn 在单独的协程中依次调用，不会同时执行。
+// cancel 之后不再回调，正在执行的回调不受影响
+func Subscribe(wd WatchableDiscovery, fn func(added, removed []string)) (cancel func()) {
+	// 先订阅再取当前的列表，两者之间的变化会在之后的通知中得到，差异为空时不回调。
+	// Members 可能要请求注册中心，放在协程中，不阻塞调用方
+	updates, unwatch := wd.Watch()
+	stop := make(chan struct{})
+	go func() {
+		defer unwatch()
+		current, _ := members(wd)
+		known := make(map[string]bool, len(current))
+		notify := func(servers []string) {
+			var added, removed []string
+			alive := make(map[string]bool, len(servers))
+			for _, s := range servers {
+				alive[s] = true
+				if !known[s] {
+					added = append(added, s)
+				}
+			}
+			for s := range known {
+				if !alive[s] {
+					removed = append(removed, s)
+				}
+			}
+			sort.Strings(removed)
+			known = alive
+			if len(added) == 0 && len(removed) == 0 {
+				return
+			}
+			select {
+			case <-stop:
+			default:
+				fn(added, removed)
+			}
+		}
+		notify(current)
+		for {
+			select {
+			case servers := <-updates:
+				notify(servers)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stop) })
+	}
+}
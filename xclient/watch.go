@@ -0,0 +1,117 @@
+package xclient
+
+import (
+	"MyRPC/client"
+	"MyRPC/logger"
+	"context"
+	"time"
+)
+
+//
+// 连接缓存同步
+// 服务发现支持 Watch 时，XClient 订阅服务列表的增减（见 subscribe.go），让缓存的连接和服务列表保持一致：
+// 已经下线的实例立即从缓存中移除，不再接受新的调用，等正在进行的请求结束后关闭连接；
+// 开启预热时，新上线的实例提前建立连接，第一次调用不用等待连接和握手
+//
+
+const (
+	drainTimeout      = 10 * time.Second // 等待下线实例的请求结束的最长时间
+	drainPollInterval = 10 * time.Millisecond
+)
+
+// WithWarmup 开启预热：创建 XClient 时以及服务列表中出现新实例时，提前建立连接
+func WithWarmup() XOption {
+	return func(xc *XClient) {
+		xc.warmup = true
+	}
+}
+
+// watch 订阅服务列表的增减，服务发现不支持 Watch 时只在创建时预热
+func (xc *XClient) watch() {
+	wd, ok := xc.d.(WatchableDiscovery)
+	if !ok {
+		if xc.warmup {
+			go func() {
+				if servers, err := members(xc.d); err == nil {
+					xc.sync(servers)
+				}
+			}()
+		}
+		return
+	}
+	// 回调在同一个协程中依次执行，topology 不需要加锁
+	topology := make(map[string]bool)
+	cancel := Subscribe(wd, func(added, removed []string) {
+		for _, s := range added {
+			topology[s] = true
+		}
+		for _, s := range removed {
+			delete(topology, s)
+		}
+		servers := make([]string, 0, len(topology))
+		for s := range topology {
+			servers = append(servers, s)
+		}
+		xc.sync(servers)
+	})
+	go func() {
+		<-xc.done
+		cancel()
+	}()
+}
+
+// sync 关闭已经下线的实例的连接，开启预热或健康检查时为新实例建立连接
+func (xc *XClient) sync(servers []string) {
+	alive := make(map[string]bool, len(servers))
+	for _, s := range servers {
+		alive[s] = true
+	}
+	xc.mu.Lock()
+	var stale []*client.Client
+	for key, client := range xc.clients {
+		if !alive[keyAddr(key)] {
+			stale = append(stale, client)
+			delete(xc.clients, key)
+			delete(xc.lastUsed, key)
+			delete(xc.instances, key)
+			if xc.health != nil {
+				delete(xc.health.pings, key)
+			}
+		}
+	}
+	var added []string
+	if xc.warmup || xc.health != nil {
+		for _, s := range servers {
+			if _, ok := xc.clients[s]; !ok {
+				added = append(added, s)
+			}
+		}
+	}
+	xc.mu.Unlock()
+	xc.load.forget(alive)
+
+	for _, client := range stale {
+		go drain(client)
+	}
+	for _, addr := range added {
+		go func(addr string) {
+			select {
+			case <-xc.done:
+				return
+			default:
+			}
+			if _, err := xc.dial(context.Background(), addr, ""); err != nil {
+				logger.Warnf("rpc xclient: warm up %s error: %v", addr, err)
+			}
+		}(addr)
+	}
+}
+
+// drain 等待连接上正在进行的请求结束后关闭连接，最多等待 drainTimeout
+func drain(client *client.Client) {
+	deadline := time.Now().Add(drainTimeout)
+	for client.Pending() > 0 && client.IsAvailable() && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	_ = client.Close()
+}
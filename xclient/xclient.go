@@ -1,10 +1,17 @@
 package xclient
 
 import (
-	"MyRPC"
+	"MyRPC/callopt"
+	"MyRPC/client"
+	"MyRPC/codec"
+	"MyRPC/logger"
 	"context"
+	"errors"
+	"fmt"
 	"reflect"
+	"strings"
 	"sync"
+	"time"
 )
 
 //
@@ -12,105 +19,530 @@ import (
 //
 
 type XClient struct {
-	d       Discovery
-	mode    SelectMode
-	opt     *MyRPC.Option
-	mu      sync.Mutex
-	clients map[string]*MyRPC.Client	// 键是服务器的IP 值是与该IP服务器连接的客户端
+	d           Discovery
+	mode        SelectMode
+	opt         *client.Option
+	mu          sync.Mutex
+	clients     map[string]*client.Client // 键是服务器的IP 值是与该IP服务器连接的客户端
+	retry       *retryPolicy              // 重试策略，为nil时 Failover 使用默认的策略
+	failMode    FailMode                  // 调用失败时的处理方式
+	failModeSet bool                      // failMode 是否由 WithFailMode 指定
+	breakers    *circuitBreakers          // 每个实例的熔断器，为nil时不熔断
+
+	lastUsed    map[string]time.Time // 每个缓存连接最近一次使用的时间
+	instances   map[string]string    // 每个缓存连接建立时对端的实例ID
+	fdThreshold float64              // 文件描述符使用率的阈值，为0时不检查
+	evicted     uint64               // 因为文件描述符压力被关闭的连接数
+
+	load      *loadStats    // 每个实例的负载统计
+	shards    *sharding     // 分片，为nil时不分片
+	failbacks failbackQueue // Failback 等待重试的调用
+	warmup    bool          // 提前为新实例建立连接
+	health    *healthCheck  // 后台健康检查，为nil时不检查
+	cache     *replyCache   // 响应缓存，为nil时不缓存
+	split     *trafficSplit // 按版本分流，为nil时不分流
+	done      chan struct{} // Close 时关闭，停止订阅服务列表的变化
+	closeOnce sync.Once
 }
 
-func NewXClient(d Discovery, mode SelectMode, opt *MyRPC.Option) *XClient {
-	return &XClient{
-		d:       d,
-		mode:    mode,
-		opt:     opt,
-		mu:      sync.Mutex{},
-		clients: make(map[string]*MyRPC.Client),
+var _ client.Caller = (*XClient)(nil)
+
+func NewXClient(d Discovery, mode SelectMode, opt *client.Option, opts ...XOption) *XClient {
+	xc := &XClient{
+		d:         d,
+		mode:      mode,
+		opt:       opt,
+		mu:        sync.Mutex{},
+		clients:   make(map[string]*client.Client),
+		lastUsed:  make(map[string]time.Time),
+		instances: make(map[string]string),
+		done:      make(chan struct{}),
+		load:      newLoadStats(),
+		failbacks: failbackQueue{
+			pending: make(chan struct{}, failbackQueueSize),
+			workers: make(chan struct{}, failbackWorkers),
+		},
+	}
+	for _, o := range opts {
+		o(xc)
+	}
+	xc.watch()
+	if xc.health != nil {
+		go xc.healthLoop()
 	}
+	return xc
 }
 
 func (xc *XClient) Close() error {
+	xc.closeOnce.Do(func() { close(xc.done) })
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
 	for key, client := range xc.clients {
 		_ = client.Close()
 		delete(xc.clients, key)
+		delete(xc.lastUsed, key)
+		delete(xc.instances, key)
 	}
 	return nil
 }
 
-func (xc *XClient) dial(rpcAddr string) (*MyRPC.Client, error) {
+// dial 返回 rpcAddr 的缓存连接，ct 不是默认的编码方式时使用单独的连接，新建连接在 ctx 结束时放弃
+func (xc *XClient) dial(ctx context.Context, rpcAddr string, ct codec.Type) (*client.Client, error) {
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
-	client, ok := xc.clients[rpcAddr]
-	// 已经由存在的连接 不可用 关闭
-	if ok && !client.IsAvailable() {
+	opt := xc.opt
+	key := xc.connKey(rpcAddr, ct)
+	if key != rpcAddr {
+		o := *client.DefaultOption
+		if xc.opt != nil {
+			o = *xc.opt
+		}
+		o.CodecType = ct
+		opt = &o
+	}
+	client, ok := xc.clients[key]
+	// 已经由存在的连接 不可用或者对端已经重启 关闭
+	if ok && (!client.IsAvailable() || xc.restarted(key, rpcAddr)) {
 		_ = client.Close()
-		delete(xc.clients, rpcAddr)
+		delete(xc.clients, key)
+		delete(xc.lastUsed, key)
 		client = nil
 	}
 	// 没有缓存的客户端
 	if client == nil {
 		var err error
-		client, err = MyRPC.XDial(rpcAddr, xc.opt)
+		client, err = xc.dialWithEviction(ctx, rpcAddr, opt)
 		if err != nil {
 			return nil, err
 		}
-		xc.clients[rpcAddr] = client
+		xc.clients[key] = client
+		xc.recordInstance(key, rpcAddr, client)
 	}
+	xc.touch(key)
 	// 返回缓存客户端
 	return client, nil
 }
 
+// codecType XClient 默认的编码方式
+func (xc *XClient) codecType() codec.Type {
+	if xc.opt == nil || xc.opt.CodecType == "" {
+		return client.DefaultOption.CodecType
+	}
+	return xc.opt.CodecType
+}
+
+// clientKey 非默认编码方式的连接在缓存中的键，形如 tcp@127.0.0.1:9999#application/json
+func clientKey(rpcAddr string, ct codec.Type) string {
+	return rpcAddr + "#" + string(ct)
+}
+
+// connKey 使用编码方式 ct 调用 rpcAddr 时缓存连接的键，默认的编码方式直接用 rpcAddr
+func (xc *XClient) connKey(rpcAddr string, ct codec.Type) string {
+	if ct != "" && ct != xc.codecType() {
+		return clientKey(rpcAddr, ct)
+	}
+	return rpcAddr
+}
+
+// keyAddr 取缓存键中的 rpcAddr
+func keyAddr(key string) string {
+	if i := strings.LastIndex(key, "#"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
 func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	client, err := xc.dial(rpcAddr)
+	start := time.Now()
+	if xc.breakers != nil {
+		xc.breakers.reserveProbe(rpcAddr)
+	}
+	xc.load.begin(rpcAddr)
+	c, err := xc.dial(ctx, rpcAddr, callopt.FromContext(ctx).Codec)
+	if tl := client.TimelineFromContext(ctx); tl != nil {
+		tl.Dial = time.Since(start)
+	}
+	session := writeSession(ctx)
+	var trailer client.Metadata
+	if session != nil {
+		ctx, trailer = client.WithTrailer(ctx)
+	}
+	if err == nil {
+		err = c.Call(ctx, serviceMethod, args, reply)
+	}
+	if session != nil && err == nil {
+		xc.recordWrite(session, xc.connKey(rpcAddr, callopt.FromContext(ctx).Codec), trailer)
+	}
+	xc.load.end(rpcAddr, time.Since(start))
+	// 只有连接错误才说明实例不可用，服务端返回的业务错误不计入熔断和灰名单
+	if err == nil || c == nil || isConnError(err) {
+		if xc.breakers != nil {
+			xc.breakers.record(rpcAddr, err)
+		}
+		xc.report(rpcAddr, err)
+	} else if xc.breakers != nil {
+		// 业务错误说明实例可以正常处理请求，半开状态的试探调用也算成功
+		xc.breakers.record(rpcAddr, nil)
+	}
+	return err
+}
+
+// report 把实例的状态报告给支持灰名单的服务发现
+func (xc *XClient) report(rpcAddr string, err error) {
+	r, ok := xc.d.(FailureReporter)
+	if !ok {
+		return
+	}
 	if err != nil {
-		return err
+		r.ReportFailure(rpcAddr)
+	} else {
+		r.ReportSuccess(rpcAddr)
 	}
-	return client.Call(ctx, serviceMethod, args, reply, 1)
 }
 
-func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	rpcAddr, err := xc.d.Get(xc.mode)
+// Call 选择一个实例调用，失败时按照 FailMode 处理。opts（以及 ctx 中的 callopt）可以为单次调用
+// 设置超时时间、编码方式、元数据，指定实例，或者用 Failover 重试
+func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}, opts ...callopt.CallOption) error {
+	if len(opts) > 0 {
+		ctx = callopt.NewContext(ctx, opts...)
+	}
+	o := callopt.FromContext(ctx)
+	ctx, cancel := o.Context(ctx)
+	defer cancel()
+	ct := o.Codec
+	if ct == "" {
+		ct = xc.codecType()
+	}
+	cached := xc.cache.lookup(ctx, &o, serviceMethod, args, ct)
+	if cached.load(reply) {
+		return nil
+	}
+	if o.Target != "" {
+		return cached.store(xc.call(o.Target, ctx, serviceMethod, args, reply), reply)
+	}
+	if o.Retry > 0 {
+		p := *xc.retryPolicyOf()
+		p.maxAttempts = o.Retry
+		return cached.store(xc.callWithRetry(ctx, &p, serviceMethod, args, reply), reply)
+	}
+	switch mode := xc.failModeOf(ctx); mode {
+	case Failover:
+		return cached.store(xc.callWithRetry(ctx, xc.retryPolicyOf(), serviceMethod, args, reply), reply)
+	case Failsafe:
+		if err := xc.callOnce(ctx, serviceMethod, args, reply); err != nil {
+			logger.Warnf("rpc xclient: %s failed, ignored: %v", serviceMethod, err)
+			resetReply(reply)
+			return nil
+		}
+		return cached.store(nil, reply)
+	case Failback:
+		if err := xc.callOnce(ctx, serviceMethod, args, reply); err != nil {
+			xc.failback(ctx, serviceMethod, args, reply, err)
+			resetReply(reply)
+			return nil
+		}
+		return cached.store(nil, reply)
+	default:
+		return cached.store(xc.callOnce(ctx, serviceMethod, args, reply), reply)
+	}
+}
+
+// CallWithKey 按 key 做一致性哈希选择实例后调用，服务列表不变时相同 key 的调用总是落到同一个实例上，
+// 适合在实例内存中按用户缓存数据的有状态服务。不受 SelectMode 影响，失败处理和 opts 与 Call 相同。
+// 选中的实例熔断或者 Failover 重试时会换到其他实例
+func (xc *XClient) CallWithKey(ctx context.Context, key, serviceMethod string, args, reply interface{}, opts ...callopt.CallOption) error {
+	// 复制一份再追加，不能写进调用方切片的底层数组
+	return xc.Call(ctx, serviceMethod, args, reply, append(append([]callopt.CallOption(nil), opts...), callopt.WithKey(key))...)
+}
+
+// selectServer 选择服务实例，开启熔断时跳过处于熔断状态的实例，key 不为空时按 key 做一致性哈希
+func (xc *XClient) selectServer(serviceMethod string, args interface{}, key string) (string, error) {
+	rpcAddr, err := xc.pickServer(serviceMethod, args, key)
+	if err != nil || xc.breakers == nil || !xc.breakers.isOpen(rpcAddr) {
+		return rpcAddr, err
+	}
+	// 选中的实例已熔断，随机和轮询策略再选几次，仍然不行就按负载均衡策略在剩余可用的实例中选择
+	if xc.mode != HashRingSelect && key == "" {
+		servers, _ := xc.allServers(serviceMethod)
+		for i := 0; i < len(servers); i++ {
+			if rpcAddr, err = xc.pickServer(serviceMethod, args, key); err == nil && !xc.breakers.isOpen(rpcAddr) {
+				return rpcAddr, nil
+			}
+		}
+	}
+	servers, err := xc.allServers(serviceMethod)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+	if alive := xc.breakers.available(servers); len(alive) > 0 {
+		return xc.pickAlive(alive, serviceMethod, args, key), nil
+	}
+	return "", ErrAllBreakersOpen
 }
 
-// Broadcast 将请求广播到所有的服务实例
-func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	servers, err := xc.d.GetAll()
+// pickAlive 按负载均衡策略在没有熔断的实例中选择，一致性哈希时相同的 key 仍然落到同一个实例上
+func (xc *XClient) pickAlive(alive []string, serviceMethod string, args interface{}, key string) string {
+	if xc.mode == HashRingSelect || key != "" {
+		if key == "" {
+			key = requestKey(serviceMethod, args)
+		}
+		return New(alive, replicateCount).GetNode(key)
+	}
+	switch xc.mode {
+	case LeastActiveSelect:
+		return xc.load.leastLoaded(alive)
+	case P2CSelect:
+		return xc.load.p2c(alive)
+	default:
+		return xc.breakers.pick(alive, xc.mode)
+	}
+}
+
+// pickServer 根据负载均衡策略选择服务实例，一致性哈希使用 服务名.方法名+参数 作为key，
+// 相同的请求总是落到同一个服务实例上。调用方给出 key 时不论什么策略都按它做一致性哈希
+func (xc *XClient) pickServer(serviceMethod string, args interface{}, key string) (string, error) {
+	if xc.shards != nil {
+		return xc.pickShard(serviceMethod, args, key)
+	}
+	hashed := xc.mode == HashRingSelect || key != ""
+	if key == "" {
+		key = requestKey(serviceMethod, args)
+	}
+	if split := xc.splitOf(serviceName(serviceMethod)); split != nil {
+		if rpcAddr, ok, err := xc.pickVersion(serviceMethod, split, key, hashed); ok || err != nil {
+			return rpcAddr, err
+		}
+	}
+	if !hashed && (xc.mode == LeastActiveSelect || xc.mode == P2CSelect) {
+		return xc.loadAware(serviceMethod)
+	}
+	// 服务发现知道每个实例提供哪些服务时，只在提供该服务的实例中选择
+	if sd, ok := xc.d.(ServiceDiscovery); ok {
+		if !hashed {
+			return sd.GetService(serviceName(serviceMethod), xc.mode)
+		}
+		return sd.GetServiceFor(serviceName(serviceMethod), key)
+	}
+	if !hashed {
+		return xc.d.Get(xc.mode)
+	}
+	kd, ok := xc.d.(KeyedDiscovery)
+	if !ok {
+		return "", errors.New("rpc xclient: discovery doesn't support hash ring select mode")
+	}
+	return kd.GetFor(key)
+}
+
+// loadAware 根据负载统计在没有熔断的实例中选择
+func (xc *XClient) loadAware(serviceMethod string) (string, error) {
+	servers, err := xc.allServers(serviceMethod)
 	if err != nil {
+		return "", err
+	}
+	if xc.breakers != nil {
+		if alive := xc.breakers.available(servers); len(alive) > 0 {
+			servers = alive
+		}
+	}
+	if len(servers) == 0 {
+		return "", errors.New("rpc discovery: no available servers")
+	}
+	if xc.mode == P2CSelect {
+		return xc.load.p2c(servers), nil
+	}
+	return xc.load.leastLoaded(servers), nil
+}
+
+// allServers 返回可以处理 serviceMethod 的所有实例，不包括惩罚期内的实例
+func (xc *XClient) allServers(serviceMethod string) ([]string, error) {
+	if sd, ok := xc.d.(ServiceDiscovery); ok {
+		return sd.GetAllService(serviceName(serviceMethod))
+	}
+	return xc.d.GetAll()
+}
+
+// serviceName 取 服务名.方法名 中的服务名
+func serviceName(serviceMethod string) string {
+	if dot := strings.LastIndex(serviceMethod, "."); dot >= 0 {
+		return serviceMethod[:dot]
+	}
+	return serviceMethod
+}
+
+// requestKey 生成请求的哈希key，参数是指针时取其指向的值，避免使用地址
+func requestKey(serviceMethod string, args interface{}) string {
+	v := reflect.ValueOf(args)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return serviceMethod
+	}
+	return fmt.Sprintf("%s:%v", serviceMethod, v.Interface())
+}
+
+// Broadcast 将请求广播到所有的服务实例，reply 取第一个调用成功的实例的结果，返回第一个错误
+func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	results, err := xc.BroadcastAll(ctx, serviceMethod, args, reply)
+	if reply == nil {
 		return err
 	}
+	for _, r := range results {
+		if r.Err == nil {
+			reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r.Reply).Elem())
+			break
+		}
+	}
+	return err
+}
+
+// PerServerResult 广播时单个实例的结果
+type PerServerResult struct {
+	Server  string
+	Reply   interface{} // 与 reply 类型相同的新值，reply 为 nil 或者调用失败时为 nil
+	Err     error
+	Latency time.Duration
+}
+
+// BroadcastOption BroadcastAll 的可选配置
+type BroadcastOption func(*broadcastOptions)
+
+type broadcastOptions struct {
+	continueOnError bool
+}
+
+// ContinueOnError 某个实例出错时不取消其他实例的调用
+func ContinueOnError() BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.continueOnError = true
+	}
+}
+
+// BroadcastAll 将请求广播到所有的服务实例，按服务列表的顺序返回每个实例的结果和耗时。
+// reply 只用来确定响应的类型，不会被修改；默认某个实例出错时取消其他实例的调用，返回的 error 是第一个错误
+func (xc *XClient) BroadcastAll(ctx context.Context, serviceMethod string, args, reply interface{}, opts ...BroadcastOption) ([]*PerServerResult, error) {
+	if err := RefreshContext(ctx, xc.d); err != nil {
+		return nil, err
+	}
+	servers, err := xc.allServers(serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	var o broadcastOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	var e error
-	replyDone := reply == nil // 如果reply是nil的话，不需要设置值
 	ctx, cancel := context.WithCancel(ctx)
-	for _, rpcAddr := range servers {
+	defer cancel()
+	results := make([]*PerServerResult, len(servers))
+	for i, rpcAddr := range servers {
 		wg.Add(1)
-		go func(rpcAddr string) {
+		go func(i int, rpcAddr string) {
 			defer wg.Done()
 			var clonedReply interface{}
 			if reply != nil {
 				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
 			}
+			start := time.Now()
 			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			r := &PerServerResult{Server: rpcAddr, Err: err, Latency: time.Since(start)}
+			if err == nil {
+				r.Reply = clonedReply
+			}
+			results[i] = r
 			mu.Lock()
 			if err != nil && e == nil {
 				e = err
-				cancel() // 实例发生错误，则返回其错误
-			}
-			if err == nil && !replyDone {
-				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
-				// 某个实例调用成功，返回，其他的实例不需要返回
-				replyDone = true
+				if !o.continueOnError {
+					cancel() // 实例发生错误，取消其他实例的调用
+				}
 			}
 			mu.Unlock()
-		}(rpcAddr)
+		}(i, rpcAddr)
 	}
 	wg.Wait()
-	return e
+	return results, e
+}
+
+// ErrNoQuorum 没有足够多的实例返回一致的结果
+var ErrNoQuorum = errors.New("rpc xclient: quorum not reached")
+
+// CallQuorum 将请求发送到所有的服务实例，quorum 个实例返回相同（reflect.DeepEqual）的结果时成功，
+// reply 设为该结果并取消其余的调用；剩下的实例已经不可能凑够 quorum 个一致的结果时提前返回 ErrNoQuorum。
+// 和 Broadcast 一样 reply 可以为 nil，这时 quorum 个实例调用成功即可
+func (xc *XClient) CallQuorum(ctx context.Context, serviceMethod string, args, reply interface{}, quorum int) error {
+	if err := RefreshContext(ctx, xc.d); err != nil {
+		return err
+	}
+	servers, err := xc.allServers(serviceMethod)
+	if err != nil {
+		return err
+	}
+	if quorum <= 0 || quorum > len(servers) {
+		return fmt.Errorf("rpc xclient: invalid quorum %d for %d servers", quorum, len(servers))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		reply interface{}
+		err   error
+	}
+	ch := make(chan result, len(servers))
+	// reply 为 nil 时不关心结果，只要足够多的实例调用成功
+	var replyType reflect.Type
+	if reply != nil {
+		replyType = reflect.ValueOf(reply).Elem().Type()
+	}
+	for _, rpcAddr := range servers {
+		go func(rpcAddr string) {
+			var clonedReply interface{}
+			if replyType != nil {
+				clonedReply = reflect.New(replyType).Interface()
+			}
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			ch <- result{clonedReply, err}
+		}(rpcAddr)
+	}
+
+	var groups []interface{} // 不同的结果
+	var counts []int         // 每个结果的票数
+	var firstErr error
+	best := 0
+	for pending := len(servers); pending > 0; pending-- {
+		r := <-ch
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+		} else {
+			i := 0
+			for i < len(groups) && !reflect.DeepEqual(groups[i], r.reply) {
+				i++
+			}
+			if i == len(groups) {
+				groups = append(groups, r.reply)
+				counts = append(counts, 0)
+			}
+			counts[i]++
+			if counts[i] >= quorum {
+				if reply != nil {
+					reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r.reply).Elem())
+				}
+				return nil
+			}
+			if counts[i] > best {
+				best = counts[i]
+			}
+		}
+		if best+pending-1 < quorum {
+			break
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("%w: %v", ErrNoQuorum, firstErr)
+	}
+	return ErrNoQuorum
 }
@@ -0,0 +1,935 @@
+package xclient
+
+import (
+	"MyRPC"
+	"MyRPC/callopt"
+	"MyRPC/codec"
+	"MyRPC/registry"
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Foo int
+
+// Sum 返回参数之和再加上 f，不同的 f 模拟返回不一致结果的实例
+func (f Foo) Sum(args [2]int, reply *int) error {
+	*reply = args[0] + args[1] + int(f)
+	return nil
+}
+
+// startServer 启动一个注册了 Foo 的服务端，返回 tcp@addr
+func startServer(t *testing.T) string {
+	return startFoo(t, 0)
+}
+
+func startFoo(t *testing.T, foo Foo) string {
+	server := MyRPC.NewServer()
+	if err := server.Register(&foo); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go server.Accept(l)
+	return "tcp@" + l.Addr().String()
+}
+
+// cached 返回 XClient 当前缓存的连接
+func (xc *XClient) cached() map[string]*MyRPC.Client {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	clients := make(map[string]*MyRPC.Client, len(xc.clients))
+	for addr, c := range xc.clients {
+		clients[addr] = c
+	}
+	return clients
+}
+
+func waitFor(t *testing.T, cond func() bool, msg string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestXClient_SyncWithDiscovery(t *testing.T) {
+	a, b := startServer(t), startServer(t)
+	d := NewMultiServerDiscovery([]string{a})
+	xc := NewXClient(d, RoundRobinSelect, nil, WithWarmup())
+	defer func() { _ = xc.Close() }()
+	waitFor(t, func() bool { return xc.cached()[a] != nil }, "expect a is warmed up")
+	old := xc.cached()[a]
+
+	_ = d.Update([]string{b})
+	waitFor(t, func() bool {
+		clients := xc.cached()
+		return clients[a] == nil && clients[b] != nil
+	}, "expect a is removed and b is warmed up")
+	waitFor(t, func() bool { return !old.IsAvailable() }, "expect the client of a is closed")
+}
+
+func TestXClient_Timeline(t *testing.T) {
+	xc := NewXClient(NewMultiServerDiscovery([]string{startServer(t)}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	ctx, tl := MyRPC.WithTimeline(context.Background())
+	var reply int
+	if err := xc.Call(ctx, "Foo.Sum", [2]int{1, 2}, &reply); err != nil || reply != 3 {
+		t.Fatalf("failed to call Foo.Sum: %d, %v", reply, err)
+	}
+	if tl.Dial <= 0 || tl.Total <= 0 {
+		t.Fatalf("expect dial time recorded for the first call, got %s", tl)
+	}
+}
+
+func TestLoadStats_LeastLoaded(t *testing.T) {
+	s := newLoadStats()
+	s.begin("a")
+	s.end("a", 10*time.Millisecond)
+	s.begin("b")
+	s.end("b", 10*time.Millisecond)
+	if addr := s.leastLoaded([]string{"a", "b", "c"}); addr != "c" {
+		t.Fatalf("expect the unused instance c to be probed first, got %s", addr)
+	}
+	s.begin("a")
+	if addr := s.leastLoaded([]string{"a", "b"}); addr != "b" {
+		t.Fatalf("expect b with fewer active calls, got %s", addr)
+	}
+	s.end("a", 10*time.Millisecond)
+	s.begin("b")
+	s.end("b", 100*time.Millisecond)
+	if addr := s.leastLoaded([]string{"a", "b"}); addr != "a" {
+		t.Fatalf("expect a with lower latency, got %s", addr)
+	}
+	s.forget(map[string]bool{"a": true})
+	if _, ok := s.backends["b"]; ok {
+		t.Fatal("expect stats of removed instance b to be dropped")
+	}
+}
+
+func TestLoadStats_SlowNewBackend(t *testing.T) {
+	s := newLoadStats()
+	for _, addr := range []string{"a", "b"} {
+		s.begin(addr)
+		s.end(addr, 10*time.Millisecond)
+	}
+	// 新实例 c 的第一个调用还没有返回，之后的调用不会都落到它上面
+	if addr := s.leastLoaded([]string{"a", "b", "c"}); addr != "c" {
+		t.Fatalf("expect the idle new instance probed first, got %s", addr)
+	}
+	s.begin("c")
+	for i := 0; i < 20; i++ {
+		if addr := s.leastLoaded([]string{"a", "b", "c"}); addr == "c" {
+			t.Fatal("expect no more calls to c before its first response")
+		}
+		if addr := s.p2c([]string{"a", "c"}); addr == "c" {
+			t.Fatal("expect p2c to prefer a over the busy new instance c")
+		}
+	}
+}
+
+func TestLoadStats_P2C(t *testing.T) {
+	s := newLoadStats()
+	s.begin("a")
+	s.end("a", time.Second)
+	s.begin("a")
+	servers := []string{"a", "b", "c"}
+	picked := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		picked[s.p2c(servers)]++
+	}
+	if picked["a"] != 0 || picked["b"] == 0 || picked["c"] == 0 {
+		t.Fatalf("expect the loaded instance a never picked and the others both picked, got %v", picked)
+	}
+	if addr := s.p2c([]string{"a"}); addr != "a" {
+		t.Fatalf("expect the only instance picked, got %s", addr)
+	}
+}
+
+func TestXClient_LeastActive(t *testing.T) {
+	a, b := startServer(t), startServer(t)
+	d := NewMultiServerDiscovery([]string{a, b})
+	if _, err := d.Get(LeastActiveSelect); err == nil {
+		t.Fatal("expect error when discovery is asked for least active select")
+	}
+	xc := NewXClient(d, LeastActiveSelect, nil)
+	defer func() { _ = xc.Close() }()
+	for i := 0; i < 10; i++ {
+		var reply int
+		if err := xc.Call(context.Background(), "Foo.Sum", [2]int{i, i}, &reply); err != nil || reply != 2*i {
+			t.Fatalf("failed to call Foo.Sum: %d, %v", reply, err)
+		}
+	}
+	loads := xc.Load()
+	if len(loads) != 2 {
+		t.Fatalf("expect load stats of both instances, got %v", loads)
+	}
+	var calls uint64
+	for _, l := range loads {
+		if l.Active != 0 || l.Calls == 0 || l.Latency <= 0 {
+			t.Fatalf("unexpected load stats %+v", l)
+		}
+		calls += l.Calls
+	}
+	if calls != 10 {
+		t.Fatalf("expect 10 calls recorded, got %d", calls)
+	}
+}
+
+type userKey string
+
+func (k userKey) ShardKey() string { return string(k) }
+
+func TestXClient_Sharding(t *testing.T) {
+	shardOf := func(key string) string { return key[:1] }
+	servers := []string{"tcp@10.0.0.1:1", "tcp@10.0.0.2:1", "tcp@10.0.1.1:1", "tcp@10.0.1.2:1"}
+	r := NewStaticShardResolver(shardOf, map[string][]string{
+		"a": {"tcp@10.0.0.1:1", "tcp@10.0.0.2:1"},
+		"b": {"tcp@10.0.1.1:1", "tcp@10.0.1.2:1", "tcp@10.0.1.3:1"},
+	})
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil, WithSharding(r, nil))
+	defer func() { _ = xc.Close() }()
+	for _, key := range []userKey{"a1", "a2", "b1", "b2", "b3"} {
+		addr, err := xc.pickServer("KV.Get", key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if members, _ := r.Members(shardOf(string(key)), servers); !contains(members, addr) {
+			t.Fatalf("expect %s routed inside shard %v, got %s", key, members, addr)
+		}
+		if again, _ := xc.pickServer("KV.Get", key, ""); again != addr {
+			t.Fatalf("expect %s always routed to %s, got %s", key, addr, again)
+		}
+	}
+	if _, err := xc.pickServer("KV.Get", userKey("c1"), ""); err == nil {
+		t.Fatal("expect error for unknown shard")
+	}
+
+	dns := NewDNSShardResolver(shardOf, "shard-%s.kv")
+	dns.Lookup = func(host string) ([]string, error) {
+		if host == "shard-b.kv" {
+			return []string{"10.0.1.2"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	xc = NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil, WithSharding(dns, nil))
+	defer func() { _ = xc.Close() }()
+	if addr, err := xc.pickServer("KV.Get", userKey("b1"), ""); err != nil || addr != "tcp@10.0.1.2:1" {
+		t.Fatalf("expect b1 routed to the resolved instance, got %s, %v", addr, err)
+	}
+	if _, err := xc.pickServer("KV.Get", userKey("a1"), ""); err == nil {
+		t.Fatal("expect error when the shard can't be resolved")
+	}
+}
+
+func contains(servers []string, addr string) bool {
+	for _, s := range servers {
+		if s == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func TestXClient_BroadcastAll(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := "tcp@" + l.Addr().String()
+	_ = l.Close()
+	servers := []string{startServer(t), down, startServer(t)}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	var reply int
+	results, err := xc.BroadcastAll(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply, ContinueOnError())
+	if err == nil || len(results) != 3 {
+		t.Fatalf("expect 3 results and the error of %s, got %d, %v", down, len(results), err)
+	}
+	for i, r := range results {
+		if r.Server != servers[i] || r.Latency <= 0 {
+			t.Fatalf("unexpected result %+v", r)
+		}
+		if r.Server == down {
+			if r.Err == nil || r.Reply != nil {
+				t.Fatalf("expect error from %s, got %+v", down, r)
+			}
+		} else if r.Err != nil || *r.Reply.(*int) != 3 {
+			t.Fatalf("expect reply 3 from %s, got %+v", r.Server, r)
+		}
+	}
+	if reply != 0 {
+		t.Fatal("expect reply prototype untouched")
+	}
+	xc = NewXClient(NewMultiServerDiscovery(servers[:1]), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	if err := xc.Broadcast(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply); err != nil || reply != 3 {
+		t.Fatalf("expect Broadcast to set the reply, got %d, %v", reply, err)
+	}
+}
+
+func TestXClient_CallQuorum(t *testing.T) {
+	servers := []string{startFoo(t, 0), startFoo(t, 10), startFoo(t, 0)}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	var reply int
+	if err := xc.CallQuorum(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply, 2); err != nil || reply != 3 {
+		t.Fatalf("expect quorum of 2 agreeing on 3, got %d, %v", reply, err)
+	}
+	if err := xc.CallQuorum(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply, 3); !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("expect ErrNoQuorum when replies disagree, got %v", err)
+	}
+	if err := xc.CallQuorum(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply, 4); err == nil {
+		t.Fatal("expect error for quorum larger than the number of servers")
+	}
+	// reply 为 nil 时只统计成功的调用
+	if err := xc.CallQuorum(context.Background(), "Foo.Sum", [2]int{1, 2}, nil, 3); err != nil {
+		t.Fatalf("expect quorum of successful calls with a nil reply, got %v", err)
+	}
+}
+
+func TestXClient_FailMode(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := "tcp@" + l.Addr().String()
+	_ = l.Close()
+	up := startServer(t)
+	d := NewMultiServerDiscovery([]string{down, up})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	ctx := context.Background()
+
+	reply := 100
+	d.index = 0
+	if err := xc.Call(ctx, "Foo.Sum", [2]int{1, 2}, &reply); err == nil {
+		t.Fatal("expect failfast to return the error")
+	}
+	d.index = 0
+	if err := xc.Call(WithFailModeContext(ctx, Failover), "Foo.Sum", [2]int{1, 2}, &reply); err != nil || reply != 3 {
+		t.Fatalf("expect failover to another server, got %d, %v", reply, err)
+	}
+	d.index = 0
+	if err := xc.Call(WithFailModeContext(ctx, Failsafe), "Foo.Sum", [2]int{1, 2}, &reply); err != nil || reply != 0 {
+		t.Fatalf("expect failsafe to return zero value without error, got %d, %v", reply, err)
+	}
+
+	d = NewMultiServerDiscovery([]string{down})
+	xc = NewXClient(d, RoundRobinSelect, nil, WithRetry(3, ConstantBackoff(10*time.Millisecond)), WithFailMode(Failback))
+	defer func() { _ = xc.Close() }()
+	reply = 100
+	if err := xc.Call(ctx, "Foo.Sum", [2]int{1, 2}, &reply); err != nil || reply != 0 {
+		t.Fatalf("expect failback to return zero value without error, got %d, %v", reply, err)
+	}
+	_ = d.Update([]string{up})
+	waitFor(t, func() bool {
+		for _, l := range xc.Load() {
+			if l.Addr == up && l.Calls == 1 {
+				return true
+			}
+		}
+		return false
+	}, "expect the failed call retried in background")
+}
+
+func TestXClient_FailbackMaxAttempts(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := "tcp@" + l.Addr().String()
+	_ = l.Close()
+	up := startServer(t)
+	calls := func(xc *XClient) uint64 {
+		for _, l := range xc.Load() {
+			if l.Addr == up {
+				return l.Calls
+			}
+		}
+		return 0
+	}
+	for _, attempts := range []int{1, 2} {
+		d := NewMultiServerDiscovery([]string{down})
+		xc := NewXClient(d, RoundRobinSelect, nil, WithRetry(attempts, ConstantBackoff(10*time.Millisecond)), WithFailMode(Failback))
+		var reply int
+		if err := xc.Call(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply); err != nil {
+			t.Fatalf("expect failback to return nil, got %v", err)
+		}
+		_ = d.Update([]string{up})
+		if attempts == 1 {
+			// 第一次调用已经用完了次数，不在后台重试
+			time.Sleep(100 * time.Millisecond)
+			if n := calls(xc); n != 0 || len(xc.failbacks.pending) != 0 {
+				t.Fatalf("expect no retry with maxAttempts 1, got %d calls", n)
+			}
+		} else {
+			waitFor(t, func() bool { return calls(xc) == 1 }, "expect one retry with maxAttempts 2")
+		}
+		_ = xc.Close()
+	}
+}
+
+// Gate 的 Wait 在 args 为 1 时阻塞到 release 关闭，模拟一个很慢的调用
+type Gate struct {
+	release chan struct{}
+	done    int32
+}
+
+func (g *Gate) Wait(args int, reply *int) error {
+	if args == 1 {
+		<-g.release
+	}
+	atomic.AddInt32(&g.done, 1)
+	return nil
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond)
+	for attempt, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if got := backoff(attempt + 1); got != want*time.Millisecond {
+			t.Fatalf("attempt %d: expect %v, got %v", attempt+1, want*time.Millisecond, got)
+		}
+	}
+	// 次数很大时不会溢出，base 大于 max 时等于 max
+	if got := backoff(1000); got != 50*time.Millisecond {
+		t.Fatalf("expect the backoff capped at max, got %v", got)
+	}
+	if got := ExponentialBackoff(time.Second, time.Millisecond)(1); got != time.Millisecond {
+		t.Fatalf("expect max when base exceeds it, got %v", got)
+	}
+
+	// 等待期间 ctx 结束时提前返回
+	p := &retryPolicy{backoff: ExponentialBackoff(time.Minute, time.Minute)}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := p.wait(ctx, 1); !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Fatalf("expect the wait to end with ctx, got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestXClient_FailbackConcurrent(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := "tcp@" + l.Addr().String()
+	_ = l.Close()
+	g := &Gate{release: make(chan struct{})}
+	defer close(g.release)
+	server := MyRPC.NewServer()
+	_ = server.Register(g)
+	l, _ = net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	up := "tcp@" + l.Addr().String()
+
+	// WithFailMode 在 WithRetry 之前也不会被覆盖
+	d := NewMultiServerDiscovery([]string{down})
+	xc := NewXClient(d, RoundRobinSelect, nil, WithFailMode(Failback), WithRetry(3, ConstantBackoff(100*time.Millisecond)))
+	defer func() { _ = xc.Close() }()
+	if xc.failMode != Failback {
+		t.Fatalf("expect Failback kept after WithRetry, got %v", xc.failMode)
+	}
+	for _, args := range []int{1, 2} {
+		if err := xc.Call(context.Background(), "Gate.Wait", args, nil); err != nil {
+			t.Fatalf("expect failback to return without error, got %v", err)
+		}
+	}
+	_ = d.Update([]string{up})
+	// 第一个调用的重试阻塞时，第二个调用的重试照常进行
+	waitFor(t, func() bool { return atomic.LoadInt32(&g.done) == 1 }, "expect a slow retry not to block the other")
+}
+
+func TestXClient_CallOptions(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := "tcp@" + l.Addr().String()
+	_ = l.Close()
+	a, b := startFoo(t, 0), startFoo(t, 10)
+	d := NewMultiServerDiscovery([]string{down, a})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	ctx := context.Background()
+
+	var reply int
+	if err := xc.Call(ctx, "Foo.Sum", [2]int{1, 2}, &reply, callopt.WithTarget(b)); err != nil || reply != 13 {
+		t.Fatalf("expect call sent to the target, got %d, %v", reply, err)
+	}
+	d.index = 0
+	if err := xc.Call(ctx, "Foo.Sum", [2]int{1, 2}, &reply, callopt.WithRetry(2)); err != nil || reply != 3 {
+		t.Fatalf("expect retry on another server, got %d, %v", reply, err)
+	}
+	if err := xc.Call(ctx, "Foo.Sum", [2]int{1, 2}, &reply, callopt.WithTarget(a), callopt.WithCodec(codec.JsonType)); err != nil || reply != 3 {
+		t.Fatalf("failed to call with json codec: %d, %v", reply, err)
+	}
+	clients := xc.cached()
+	if clients[a] == nil || clients[clientKey(a, codec.JsonType)] == nil {
+		t.Fatalf("expect separate connections per codec, got %v", clients)
+	}
+	_ = d.Update([]string{down})
+	waitFor(t, func() bool { return len(xc.cached()) == 0 }, "expect connections of removed servers closed for all codecs")
+}
+
+func TestXClient_Restart(t *testing.T) {
+	r := registry.New(time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	start := func(addr string, foo Foo) (*MyRPC.Server, net.Listener) {
+		server := MyRPC.NewServer()
+		if err := server.Register(&foo); err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Accept(l)
+		server.Heartbeat(ts.URL, "tcp@"+l.Addr().String(), time.Minute)
+		return server, l
+	}
+	old, l := start("127.0.0.1:0", 10)
+	addr := l.Addr().String()
+
+	d := NewMyRegistryDiscovery(ts.URL, time.Nanosecond)
+	xc := NewXClient(d, RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	var reply int
+	if err := xc.Call(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply); err != nil || reply != 13 {
+		t.Fatalf("expect 13 from the first instance, got %d, %v", reply, err)
+	}
+
+	// 旧进程不再接受新连接，但已经建立的连接还能用，重启后的实例用同一个地址注册
+	_ = l.Close()
+	restarted, l2 := start(addr, 20)
+	defer func() { _ = l2.Close() }()
+	if old.InstanceID() == restarted.InstanceID() {
+		t.Fatal("expect a new instance id")
+	}
+	if err := xc.Call(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply); err != nil || reply != 23 {
+		t.Fatalf("expect the restarted instance after reconnecting, got %d, %v", reply, err)
+	}
+}
+
+func TestXClient_ReadYourWrites(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{startFoo(t, 10), startFoo(t, 20)})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	s := NewSession(time.Hour)
+	ctx := context.Background()
+
+	var written int
+	if err := xc.Call(s.Write(ctx), "Foo.Sum", [2]int{1, 2}, &written); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		var reply int
+		if err := xc.Call(s.Read(ctx), "Foo.Sum", [2]int{1, 2}, &reply); err != nil || reply != written {
+			t.Fatalf("expect reads routed to the instance that served the write (%d), got %d, %v", written, reply, err)
+		}
+	}
+
+	// 超过 Window 后恢复轮询
+	s.Window = 0
+	seen := make(map[int]bool)
+	for i := 0; i < 4; i++ {
+		var reply int
+		if err := xc.Call(s.Read(ctx), "Foo.Sum", [2]int{1, 2}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		seen[reply] = true
+	}
+	if len(seen) != 2 {
+		t.Fatalf("expect round robin after the window, got %v", seen)
+	}
+
+	// 其他编码方式的连接上的写请求记在这个连接的键上
+	xc2 := NewXClient(NewMultiServerDiscovery([]string{startFoo(t, 10), startFoo(t, 20)}), RoundRobinSelect, nil)
+	defer func() { _ = xc2.Close() }()
+	s = NewSession(time.Hour)
+	json := callopt.WithCodec(codec.JsonType)
+	if err := xc2.Call(s.Write(ctx), "Foo.Sum", [2]int{1, 2}, &written, json); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		var reply int
+		if err := xc2.Call(s.Read(ctx), "Foo.Sum", [2]int{1, 2}, &reply, json); err != nil || reply != written {
+			t.Fatalf("expect json reads routed to the instance that served the write (%d), got %d, %v", written, reply, err)
+		}
+	}
+	xc2.mu.Lock()
+	for key := range xc2.instances {
+		if _, ok := xc2.clients[key]; !ok {
+			t.Errorf("expect instances keyed by cached connections, got %q", key)
+		}
+	}
+	xc2.mu.Unlock()
+}
+
+func TestXClient_HealthCheck(t *testing.T) {
+	a, b := startServer(t), startServer(t)
+	d := NewMultiServerDiscovery([]string{a})
+	xc := NewXClient(d, RandomSelect, nil, WithHealthCheck(20*time.Millisecond, time.Second))
+	defer func() { _ = xc.Close() }()
+	waitFor(t, func() bool { return xc.cached()[a] != nil }, "expect a is warmed up by the health check")
+	waitFor(t, func() bool {
+		s := xc.Stats()
+		return len(s.Conns) == 1 && !s.Conns[0].LastPing.IsZero()
+	}, "expect a is pinged")
+
+	// 断开的连接被关闭并移出缓存，下一轮检查重新建立连接
+	old := xc.cached()[a]
+	_ = old.Close()
+	waitFor(t, func() bool {
+		c := xc.cached()[a]
+		return c != nil && c != old
+	}, "expect the dead client of a is replaced")
+	if s := xc.Stats(); s.HealthEvicted == 0 || s.HealthChecks == 0 {
+		t.Fatalf("expect health check counters, got %+v", s)
+	}
+
+	_ = d.Update([]string{a, b})
+	waitFor(t, func() bool { return xc.cached()[b] != nil }, "expect b is warmed up")
+	s := xc.Stats()
+	if len(s.Conns) != 2 || s.Conns[0].Key > s.Conns[1].Key || !s.Conns[0].Available || s.Conns[0].Addr != keyAddr(s.Conns[0].Key) {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestXClient_ResponseCache(t *testing.T) {
+	a := startServer(t)
+	xc := NewXClient(NewMultiServerDiscovery([]string{a}), RandomSelect, nil, WithResponseCache(nil, 0))
+	defer func() { _ = xc.Close() }()
+	ctx := context.Background()
+	var reply int
+	for i := 0; i < 3; i++ {
+		if err := xc.Call(ctx, "Foo.Sum", [2]int{1, 2}, &reply, callopt.WithCache(time.Minute)); err != nil || reply != 3 {
+			t.Fatalf("expect 3, got %d, %v", reply, err)
+		}
+	}
+	if s := xc.Stats(); s.CacheHits != 2 || s.CacheMisses != 1 {
+		t.Fatalf("expect 2 hits and 1 miss, got %+v", s)
+	}
+	// 不带 WithCache 的调用和参数不同的调用不使用缓存
+	_ = xc.Call(ctx, "Foo.Sum", [2]int{1, 2}, &reply)
+	_ = xc.Call(ctx, "Foo.Sum", [2]int{2, 2}, &reply, callopt.WithCache(time.Minute))
+	if s := xc.Stats(); s.CacheHits != 2 || s.CacheMisses != 2 || reply != 4 {
+		t.Fatalf("expect 2 hits and 2 misses, got %+v, reply %d", s, reply)
+	}
+	// 元数据不同的调用方不共用缓存，请求ID不计入键
+	tenant := MyRPC.WithMetadata(ctx, MyRPC.Metadata{MyRPC.MetadataTenant: "a", MyRPC.MetadataRequestID: "1"})
+	_ = xc.Call(tenant, "Foo.Sum", [2]int{1, 2}, &reply, callopt.WithCache(time.Minute))
+	tenant = MyRPC.WithMetadata(ctx, MyRPC.Metadata{MyRPC.MetadataTenant: "a", MyRPC.MetadataRequestID: "2"})
+	_ = xc.Call(tenant, "Foo.Sum", [2]int{1, 2}, &reply, callopt.WithCache(time.Minute))
+	_ = xc.Call(ctx, "Foo.Sum", [2]int{1, 2}, &reply, callopt.WithCache(time.Minute), callopt.WithMetadata(map[string]string{MyRPC.MetadataTenant: "b"}))
+	_ = xc.Call(ctx, "Foo.Sum", [2]int{1, 2}, &reply, callopt.WithCache(time.Minute), callopt.WithTarget(a))
+	if s := xc.Stats(); s.CacheHits != 3 || s.CacheMisses != 5 {
+		t.Fatalf("expect separate entries per tenant and target, got %+v", s)
+	}
+
+	// 服务端不可用时命中缓存的调用仍然成功
+	down := NewXClient(NewMultiServerDiscovery([]string{"tcp@127.0.0.1:1"}), RandomSelect, nil, WithResponseCache(xc.cache.backend, time.Minute))
+	defer func() { _ = down.Close() }()
+	if err := down.Call(ctx, "Foo.Sum", [2]int{1, 2}, &reply); err != nil || reply != 3 {
+		t.Fatalf("expect the cached reply from the shared backend, got %d, %v", reply, err)
+	}
+	if err := down.Call(ctx, "Foo.Sum", [2]int{1, 2}, &reply, callopt.WithCache(-1)); err == nil {
+		t.Fatal("expect WithCache(-1) to bypass the cache")
+	}
+}
+
+// hiddenArgs 只有未导出字段不同的参数，编码结果相同
+type hiddenArgs struct {
+	A int
+	b int
+}
+
+func TestReplyCache_Key(t *testing.T) {
+	rc := &replyCache{backend: NewLRUCache(0), ttl: time.Minute}
+	ctx := context.Background()
+	var o callopt.Options
+	key := func(args interface{}, ct codec.Type) string {
+		if c := rc.lookup(ctx, &o, "Foo.Sum", args, ct); c != nil {
+			return c.key
+		}
+		return ""
+	}
+	// 有未导出字段的参数不缓存，否则 b 不同的两个调用会共用结果
+	if key(hiddenArgs{A: 1, b: 1}, codec.GobType) != "" || key(hiddenArgs{A: 1, b: 2}, codec.JsonType) != "" {
+		t.Fatal("expect args with unexported fields not cached")
+	}
+	// 编码相同但类型不同的参数不共用键
+	if a, b := key([2]int{1, 2}, codec.JsonType), key([]int{1, 2}, codec.JsonType); a == "" || a == b {
+		t.Fatalf("expect distinct keys for [2]int and []int, got %q and %q", a, b)
+	}
+	// 自己实现编码的类型按编码结果区分
+	t1, t2 := time.Unix(1, 0).UTC(), time.Unix(2, 0).UTC()
+	if a, b := key(t1, codec.GobType), key(t2, codec.GobType); a == "" || a == b {
+		t.Fatalf("expect distinct keys for different times, got %q and %q", a, b)
+	}
+	if key([2]int{1, 2}, codec.JsonType) == key([2]int{1, 2}, codec.GobType) {
+		t.Fatal("expect the codec in the key")
+	}
+	// 元数据的值原样计入键，无效的 UTF-8 不会和替换字符冲突
+	o.Metadata = map[string]string{"tenant": "\xff"}
+	a := key([2]int{1, 2}, codec.GobType)
+	o.Metadata = map[string]string{"tenant": "\ufffd"}
+	if b := key([2]int{1, 2}, codec.GobType); a == b {
+		t.Fatal("expect distinct keys for different metadata")
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := NewLRUCache(2)
+	c.Set("a", []byte("1"), time.Minute)
+	c.Set("b", []byte("2"), time.Minute)
+	c.Get("a")
+	c.Set("c", []byte("3"), time.Minute)
+	if _, ok := c.Get("b"); ok || c.Len() != 2 {
+		t.Fatal("expect b is evicted as the least recently used")
+	}
+	c.Set("d", []byte("4"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, ok := c.Get("d"); ok {
+		t.Fatal("expect d is expired")
+	}
+	if v, ok := c.Get("c"); !ok || string(v) != "3" {
+		t.Fatalf("expect c, got %q", v)
+	}
+}
+
+func TestXClient_FailurePenalty(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := "tcp@" + l.Addr().String()
+	_ = l.Close()
+	d := NewMultiServerDiscovery([]string{down, startServer(t)})
+	d.SetFailurePenalty(time.Minute, time.Minute)
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// 挂掉的实例失败一次后进入灰名单，之后的调用都落到正常的实例上
+	failures := 0
+	for i := 0; i < 6; i++ {
+		var reply int
+		if err := xc.Call(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply); err != nil {
+			failures++
+		}
+	}
+	if failures != 1 {
+		t.Fatalf("expect the down server selected once, got %d failures", failures)
+	}
+}
+
+func TestXClient_CallWithKey(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{startFoo(t, 10), startFoo(t, 20), startFoo(t, 30)})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	ctx := context.Background()
+
+	// 轮询策略下，相同 key 的调用仍然落到同一个实例上
+	instances := make(map[int]bool)
+	for _, key := range []string{"user-1", "user-2", "user-3", "user-4", "user-5", "user-6", "user-7", "user-8"} {
+		var first int
+		for i := 0; i < 3; i++ {
+			var reply int
+			if err := xc.CallWithKey(ctx, key, "Foo.Sum", [2]int{1, 2}, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				first = reply
+			} else if reply != first {
+				t.Fatalf("expect %s to stick to one instance, got %d and %d", key, first, reply)
+			}
+		}
+		instances[first] = true
+	}
+	if len(instances) < 2 {
+		t.Fatalf("expect keys spread over the instances, got %v", instances)
+	}
+
+	// 不修改调用方传入的 opts
+	opts := make([]callopt.CallOption, 1, 2)
+	opts[0] = callopt.WithTimeout(time.Second)
+	var reply int
+	if err := xc.CallWithKey(ctx, "user-1", "Foo.Sum", [2]int{1, 2}, &reply, opts...); err != nil {
+		t.Fatal(err)
+	}
+	if opts[:2][1] != nil {
+		t.Fatal("expect CallWithKey not to write into the caller's opts")
+	}
+}
+
+func TestXClient_TrafficSplit(t *testing.T) {
+	r := registry.New(time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	start := func(version string, foo Foo) {
+		server := MyRPC.NewServer()
+		if err := server.Register(&foo); err != nil {
+			t.Fatal(err)
+		}
+		server.SetVersion(version)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = l.Close() })
+		go server.Accept(l)
+		server.Heartbeat(ts.URL, "tcp@"+l.Addr().String(), time.Minute)
+	}
+	start("v1", 10)
+	start("v1", 10)
+	start("v2", 20)
+
+	d := NewMyRegistryDiscovery(ts.URL, time.Minute)
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	if err := xc.SetTrafficSplit("Foo", map[string]int{"v1": -1}); err == nil {
+		t.Fatal("expect error for a negative weight")
+	}
+	if err := xc.SetTrafficSplit("Foo", map[string]int{"v1": 0, "v2": 0}); err == nil {
+		t.Fatal("expect error without a positive weight")
+	}
+	if err := NewXClient(NewMultiServerDiscovery(nil), RandomSelect, nil).SetTrafficSplit("Foo", map[string]int{"v1": 1}); err == nil {
+		t.Fatal("expect error for a discovery without versions")
+	}
+
+	call := func() int {
+		var reply int
+		if err := xc.Call(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	if err := xc.SetTrafficSplit("Foo", map[string]int{"v1": 0, "v2": 1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if reply := call(); reply != 23 {
+			t.Fatalf("expect all calls on v2, got %d", reply)
+		}
+	}
+	if err := xc.SetTrafficSplit("Foo", map[string]int{"v1": 90, "v2": 10}); err != nil {
+		t.Fatal(err)
+	}
+	canary := 0
+	for i := 0; i < 200; i++ {
+		if call() == 23 {
+			canary++
+		}
+	}
+	if canary == 0 || canary > 60 {
+		t.Fatalf("expect about 10%% of calls on v2, got %d/200", canary)
+	}
+	// 配置的版本都没有实例时不分流
+	if err := xc.SetTrafficSplit("Foo", map[string]int{"v3": 1}); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		seen[call()] = true
+	}
+	if len(seen) != 2 {
+		t.Fatalf("expect all versions without a split, got %v", seen)
+	}
+}
+
+func TestCircuitBreakers_Probe(t *testing.T) {
+	xc := NewXClient(NewMultiServerDiscovery(nil), RandomSelect, nil, WithCircuitBreaker(1, 20*time.Millisecond))
+	defer func() { _ = xc.Close() }()
+	cb := xc.breakers
+	cb.record("a", errors.New("down"))
+	if alive := cb.available([]string{"a", "b"}); len(alive) != 1 || alive[0] != "b" {
+		t.Fatalf("expect the tripped server skipped, got %v", alive)
+	}
+
+	// 冷却结束后，过滤不会让实例重新进入熔断，直到真正向它发起试探调用
+	time.Sleep(30 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if alive := cb.available([]string{"a", "b"}); len(alive) != 2 {
+			t.Fatalf("expect the server half-open after cooldown, got %v", alive)
+		}
+	}
+	cb.reserveProbe("a")
+	if !cb.isOpen("a") {
+		t.Fatal("expect only one probe while it is in flight")
+	}
+	cb.record("a", nil)
+	if cb.isOpen("a") {
+		t.Fatal("expect the breaker closed after a successful probe")
+	}
+}
+
+// 试探调用收到业务错误说明实例可以正常处理请求，熔断器恢复
+func TestCircuitBreakers_ProbeAppError(t *testing.T) {
+	addr := startServer(t)
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr}), RandomSelect, nil, WithCircuitBreaker(1, 20*time.Millisecond))
+	defer func() { _ = xc.Close() }()
+	xc.breakers.record(addr, errors.New("down"))
+	time.Sleep(30 * time.Millisecond)
+
+	var reply int
+	if err := xc.Call(context.Background(), "Foo.Missing", [2]int{1, 2}, &reply); err == nil || isConnError(err) {
+		t.Fatalf("expect an application error, got %v", err)
+	}
+	xc.breakers.reserveProbe(addr)
+	if xc.breakers.isOpen(addr) {
+		t.Fatal("expect the breaker closed after a probe answered with an application error")
+	}
+}
+
+// 熔断后在剩余实例中重新选择时仍然按照负载均衡策略
+func TestXClient_PickAlive(t *testing.T) {
+	alive := []string{"b", "c", "d"}
+	rr := NewXClient(NewMultiServerDiscovery(nil), RoundRobinSelect, nil, WithCircuitBreaker(1, time.Minute))
+	defer func() { _ = rr.Close() }()
+	for i := 0; i < 6; i++ {
+		if got := rr.pickAlive(alive, "Foo.Sum", nil, ""); got != alive[i%3] {
+			t.Fatalf("expect round robin to pick %s, got %s", alive[i%3], got)
+		}
+	}
+
+	random := NewXClient(NewMultiServerDiscovery(nil), RandomSelect, nil, WithCircuitBreaker(1, time.Minute))
+	defer func() { _ = random.Close() }()
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		seen[random.pickAlive(alive, "Foo.Sum", nil, "")] = true
+	}
+	if len(seen) != len(alive) {
+		t.Fatalf("expect random select to spread over %v, got %v", alive, seen)
+	}
+
+	first := random.pickAlive(alive, "Foo.Sum", nil, "user-1")
+	for i := 0; i < 10; i++ {
+		if got := random.pickAlive(alive, "Foo.Sum", nil, "user-1"); got != first {
+			t.Fatalf("expect the key to stick to %s, got %s", first, got)
+		}
+	}
+}
+
+func TestXClient_PenaltyKeepsConnections(t *testing.T) {
+	a, b := startFoo(t, 0), startFoo(t, 10)
+	d := NewMultiServerDiscovery([]string{a, b})
+	d.SetFailurePenalty(time.Minute, time.Minute)
+	xc := NewXClient(d, RandomSelect, nil, WithHealthCheck(20*time.Millisecond, time.Second))
+	defer func() { _ = xc.Close() }()
+	waitFor(t, func() bool { return xc.cached()[a] != nil && xc.cached()[b] != nil }, "expect both servers warmed up")
+	old := xc.cached()[b]
+
+	// 惩罚期内的实例不会被选中，广播也跳过它，但健康检查不会关闭它的连接
+	d.ReportFailure(b)
+	for i := 0; i < 5; i++ {
+		var reply int
+		if err := xc.Call(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply); err != nil || reply != 3 {
+			t.Fatalf("expect calls routed to %s, got %d, %v", a, reply, err)
+		}
+	}
+	var reply int
+	results, err := xc.BroadcastAll(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply)
+	if err != nil || len(results) != 1 || results[0].Server != a {
+		t.Fatalf("expect broadcast to skip the penalized server, got %+v, %v", results, err)
+	}
+	rounds := xc.Stats().HealthChecks
+	waitFor(t, func() bool { return xc.Stats().HealthChecks >= rounds+2 }, "expect more health check rounds")
+	if xc.cached()[b] != old {
+		t.Fatal("expect the connection of the penalized server kept")
+	}
+}